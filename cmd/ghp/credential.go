@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// credentialReuseMargin is how long a cached token must remain valid for it
+// to be handed out again instead of minting a new one.
+const credentialReuseMargin = 5 * time.Minute
+
+func newCredentialCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "credential",
+		Short: "Act as a git credential helper, handing out scoped ghp_ tokens",
+		Long: `Act as a git credential helper. Configure it with, for example:
+
+  git config --global credential.https://ghp.example.com.helper '!ghp credential --scope contents:write'
+  git config --global credential.https://ghp.example.com.useHttpPath true
+
+For each repository, "get" mints a token with the given scopes, or returns a
+cached one that is still valid; "erase", which git runs when a credential is
+rejected, drops it from the cache. useHttpPath is required so git passes the
+repository path.`,
+	}
+	cmd.PersistentFlags().String("scope", "contents:read", "scopes for minted tokens (e.g., contents:read,pulls:write)")
+	cmd.PersistentFlags().String("duration", "1h", "lifetime of minted tokens")
+
+	getCmd := &cobra.Command{
+		Use:   "get",
+		Short: "Print credentials for the repository described on stdin",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadCLIConfig()
+			if err != nil {
+				return err
+			}
+			if cfg.ServerURL == "" || cfg.UserToken == "" {
+				return fmt.Errorf("not configured/authenticated. Set GHP_SERVER_URL and GHP_USER_TOKEN, or run 'ghp auth login'")
+			}
+			scope, _ := cmd.Flags().GetString("scope")
+			duration, _ := cmd.Flags().GetString("duration")
+			if err := validateDuration(duration); err != nil {
+				return err
+			}
+			return credentialGet(cfg, scope, duration, os.Stdin, os.Stdout)
+		},
+	}
+
+	eraseCmd := &cobra.Command{
+		Use:    "erase",
+		Short:  "Forget the cached credentials for the repository described on stdin",
+		Hidden: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadCLIConfig()
+			if err != nil {
+				return err
+			}
+			scope, _ := cmd.Flags().GetString("scope")
+			return credentialErase(cfg, scope, os.Stdin)
+		},
+	}
+
+	// git also offers helpers the credentials it used successfully; minted
+	// tokens are cached by "get" already, so storing is a no-op.
+	storeCmd := &cobra.Command{
+		Use:    "store",
+		Hidden: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, err := io.Copy(io.Discard, os.Stdin)
+			return err
+		},
+	}
+
+	cmd.AddCommand(getCmd, storeCmd, eraseCmd)
+	return cmd
+}
+
+// credentialGet answers a git credential "get" request read from in. Requests
+// for hosts other than the ghp server are ignored, so git falls through to
+// its other helpers.
+func credentialGet(cfg *cliConfig, scope, duration string, in io.Reader, out io.Writer) error {
+	repo, err := credentialRepo(cfg, in)
+	if err != nil || repo == "" {
+		return err
+	}
+
+	cache := loadCredentialCache()
+	key := credentialKey(cfg.ServerURL, repo, scope)
+	c, ok := cache[key]
+	if !ok || time.Until(c.ExpiresAt) < credentialReuseMargin {
+		var result struct {
+			Token     string    `json:"token"`
+			ExpiresAt time.Time `json:"expires_at"`
+		}
+		body := map[string]interface{}{
+			"repository": repo,
+			"scopes":     scope,
+			"duration":   duration,
+			"session_id": credentialSessionID(repo),
+		}
+		if err := callAPI(cfg, "POST", "/api/tokens", body, &result); err != nil {
+			return err
+		}
+		c = cachedCredential{Token: result.Token, ExpiresAt: result.ExpiresAt}
+		cache[key] = c
+		saveCredentialCache(cache)
+	}
+
+	fmt.Fprintf(out, "username=x-access-token\n")
+	fmt.Fprintf(out, "password=%s\n", c.Token)
+	fmt.Fprintf(out, "password_expiry_utc=%d\n", c.ExpiresAt.Unix())
+	return nil
+}
+
+// credentialErase answers a git credential "erase" request read from in by
+// dropping the cached token for the repository, so the next "get" mints a
+// new one.
+func credentialErase(cfg *cliConfig, scope string, in io.Reader) error {
+	if cfg.ServerURL == "" {
+		_, err := io.Copy(io.Discard, in)
+		return err
+	}
+	repo, err := credentialRepo(cfg, in)
+	if err != nil || repo == "" {
+		return err
+	}
+	cache := loadCredentialCache()
+	key := credentialKey(cfg.ServerURL, repo, scope)
+	if _, ok := cache[key]; ok {
+		delete(cache, key)
+		saveCredentialCache(cache)
+	}
+	return nil
+}
+
+// credentialRepo reads a git credential request from in and returns the
+// repository it names, or "" if it is for a host other than the ghp server.
+func credentialRepo(cfg *cliConfig, in io.Reader) (string, error) {
+	req, err := parseCredentialRequest(in)
+	if err != nil {
+		return "", err
+	}
+	server, err := url.Parse(cfg.ServerURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid server URL: %w", err)
+	}
+	if !strings.EqualFold(req["host"], server.Host) {
+		return "", nil
+	}
+
+	repo := strings.TrimSuffix(strings.Trim(req["path"], "/"), ".git")
+	if strings.Count(repo, "/") != 1 {
+		return "", fmt.Errorf("cannot tell the repository from path %q; set credential.useHttpPath", req["path"])
+	}
+	return repo, nil
+}
+
+// credentialKey is the cache key for a token minted for repo with scope. It
+// includes the full server URL, so servers sharing a host never share tokens.
+func credentialKey(serverURL, repo, scope string) string {
+	return strings.TrimSuffix(serverURL, "/") + " " + repo + " " + scope
+}
+
+// credentialSessionID is the session_id of tokens minted for repo. Each
+// repository has its own, so a server's tokens.session_id_policy never lets
+// a token for one repository revoke or block another's.
+func credentialSessionID(repo string) string {
+	return "git-credential:" + repo
+}
+
+// parseCredentialRequest reads git credential protocol key=value lines up to
+// a blank line or EOF.
+func parseCredentialRequest(in io.Reader) (map[string]string, error) {
+	req := make(map[string]string)
+	sc := bufio.NewScanner(in)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			break
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed credential line %q", line)
+		}
+		req[k] = v
+	}
+	return req, sc.Err()
+}
+
+// cachedCredential is a token minted by "ghp credential get".
+type cachedCredential struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func credentialCachePath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".config", "ghp", "credentials.json"), nil
+}
+
+// loadCredentialCache returns the cached credentials keyed by credentialKey,
+// dropping expired ones. A missing or unreadable cache is empty.
+func loadCredentialCache() map[string]cachedCredential {
+	cache := make(map[string]cachedCredential)
+	path, err := credentialCachePath()
+	if err != nil {
+		return cache
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cache
+	}
+	json.Unmarshal(data, &cache)
+	for k, c := range cache {
+		if time.Now().After(c.ExpiresAt) {
+			delete(cache, k)
+		}
+	}
+	return cache
+}
+
+// saveCredentialCache writes the cache best-effort; a failure only means the
+// next request mints a new token.
+func saveCredentialCache(cache map[string]cachedCredential) {
+	path, err := credentialCachePath()
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return
+	}
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return
+	}
+	os.WriteFile(path, data, 0600)
+}
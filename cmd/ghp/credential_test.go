@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goodtune/ghp/internal/database"
+	"github.com/goodtune/ghp/internal/token"
+)
+
+func TestCredentialGet(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	var minted []map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method+" "+r.URL.Path != "POST /api/tokens" || r.Header.Get("Authorization") != "Bearer user-token" {
+			http.NotFound(w, r)
+			return
+		}
+		var req map[string]string
+		json.NewDecoder(r.Body).Decode(&req)
+		minted = append(minted, req)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"token":"ghp_minted%d","expires_at":%q}`, len(minted), time.Now().Add(time.Hour).Format(time.RFC3339))
+	}))
+	defer srv.Close()
+	cfg := &cliConfig{ServerURL: srv.URL, UserToken: "user-token"}
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	get := func(input string) string {
+		t.Helper()
+		var out bytes.Buffer
+		if err := credentialGet(cfg, "contents:write", "1h", strings.NewReader(input), &out); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+
+	out := get("protocol=https\nhost=" + host + "\npath=org/repo.git\n\n")
+	if !strings.HasPrefix(out, "username=x-access-token\npassword=ghp_minted1\npassword_expiry_utc=") {
+		t.Errorf("output = %q", out)
+	}
+	if len(minted) != 1 || minted[0]["repository"] != "org/repo" || minted[0]["scopes"] != "contents:write" {
+		t.Fatalf("minted = %v", minted)
+	}
+
+	// The cached token is returned for the same repository.
+	if out := get("protocol=https\nhost=" + host + "\npath=org/repo.git\n"); !strings.Contains(out, "password=ghp_minted1\n") {
+		t.Errorf("second output = %q, want the cached token", out)
+	}
+	if len(minted) != 1 {
+		t.Errorf("minted %d tokens, want 1", len(minted))
+	}
+
+	// Other hosts are left to git's other helpers.
+	if out := get("protocol=https\nhost=github.com\npath=org/repo.git\n\n"); out != "" {
+		t.Errorf("output for another host = %q, want none", out)
+	}
+
+	// Erasing drops the cached token, so the next request mints another.
+	if err := credentialErase(cfg, "contents:write", strings.NewReader("protocol=https\nhost="+host+"\npath=org/repo.git\npassword=ghp_minted1\n\n")); err != nil {
+		t.Fatal(err)
+	}
+	if out := get("protocol=https\nhost=" + host + "\npath=org/repo.git\n"); !strings.Contains(out, "password=ghp_minted2\n") {
+		t.Errorf("output after erase = %q, want a new token", out)
+	}
+
+	// Servers at different URLs on one host don't share cached tokens.
+	if credentialKey(srv.URL+"/", "org/repo", "s") != credentialKey(srv.URL, "org/repo", "s") {
+		t.Error("trailing slash changed the cache key")
+	}
+	if credentialKey("https://ghp.example.com/a", "org/repo", "s") == credentialKey("https://ghp.example.com/b", "org/repo", "s") {
+		t.Error("servers on one host share a cache key")
+	}
+
+	var out2 bytes.Buffer
+	err := credentialGet(cfg, "contents:write", "1h", strings.NewReader("protocol=https\nhost="+host+"\n\n"), &out2)
+	if err == nil || !strings.Contains(err.Error(), "useHttpPath") {
+		t.Errorf("missing path: err = %v, want useHttpPath hint", err)
+	}
+}
+
+func TestCredentialGetSessionPolicies(t *testing.T) {
+	for _, policy := range []string{"reject", "revoke"} {
+		t.Run(policy, func(t *testing.T) {
+			t.Setenv("HOME", t.TempDir())
+			ctx := context.Background()
+			store, err := database.NewSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { store.Close() })
+			if err := store.EnsureMigrationsTable(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if err := database.NewMigrator(store, "sqlite").Migrate(ctx); err != nil {
+				t.Fatal(err)
+			}
+			user := &database.User{GitHubID: 1, GitHubUsername: "alice", Role: "user"}
+			if err := store.UpsertUser(ctx, user); err != nil {
+				t.Fatal(err)
+			}
+			gt := &database.GitHubToken{UserID: user.ID, AccessToken: "x", RefreshToken: "x",
+				AccessTokenExpiresAt: time.Now().Add(time.Hour), RefreshTokenExpiresAt: time.Now().Add(time.Hour)}
+			if err := store.UpsertGitHubToken(ctx, gt); err != nil {
+				t.Fatal(err)
+			}
+			ts := token.NewService(store, time.Hour)
+			ts.SetSessionIDPolicy(policy)
+
+			// A stand-in for POST /api/tokens backed by the real token service.
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var req map[string]string
+				json.NewDecoder(r.Body).Decode(&req)
+				result, err := ts.Create(r.Context(), token.CreateRequest{
+					UserID: user.ID, GitHubTokenID: gt.ID, Repository: req["repository"],
+					Scopes: map[string]string{"contents": "read"}, Duration: time.Hour, SessionID: req["session_id"],
+				})
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprintf(w, `{"message":%q}`, err.Error())
+					return
+				}
+				w.WriteHeader(http.StatusCreated)
+				json.NewEncoder(w).Encode(map[string]any{"token": result.Token, "expires_at": result.ExpiresAt})
+			}))
+			defer srv.Close()
+			cfg := &cliConfig{ServerURL: srv.URL, UserToken: "user-token"}
+			host := strings.TrimPrefix(srv.URL, "http://")
+
+			for _, repo := range []string{"org/a", "org/b"} {
+				var out bytes.Buffer
+				in := strings.NewReader("protocol=https\nhost=" + host + "\npath=" + repo + ".git\n\n")
+				if err := credentialGet(cfg, "contents:read", "1h", in, &out); err != nil {
+					t.Fatalf("%s: %v", repo, err)
+				}
+			}
+
+			// Both repositories keep a working token.
+			tokens, err := store.ListProxyTokens(ctx, user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tokens) != 2 {
+				t.Fatalf("got %d tokens, want 2", len(tokens))
+			}
+			for _, pt := range tokens {
+				if pt.RevokedAt != nil {
+					t.Errorf("token for %s was revoked", pt.Repository)
+				}
+			}
+		})
+	}
+}
+
+func TestParseCredentialRequest(t *testing.T) {
+	req, err := parseCredentialRequest(strings.NewReader("protocol=https\nhost=ghp.example.com\npath=a/b.git\n\nignored=1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(req) != 3 || req["host"] != "ghp.example.com" || req["path"] != "a/b.git" {
+		t.Errorf("request = %v", req)
+	}
+	if _, err := parseCredentialRequest(strings.NewReader("garbage\n")); err == nil {
+		t.Error("malformed line accepted")
+	}
+}
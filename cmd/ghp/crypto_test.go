@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goodtune/ghp/internal/crypto"
+	"github.com/goodtune/ghp/internal/database"
+)
+
+func TestVerifyGitHubTokens(t *testing.T) {
+	ctx := context.Background()
+	store, err := database.NewSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if err := store.EnsureMigrationsTable(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.NewMigrator(store, "sqlite").Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	newEncryptor := func() *crypto.Encryptor {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc, err := crypto.NewEncryptor(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return enc
+	}
+	current, old := newEncryptor(), newEncryptor()
+
+	seed := func(i int, enc *crypto.Encryptor, refresh string) {
+		user := &database.User{GitHubID: int64(i), GitHubUsername: fmt.Sprintf("user%d", i), Role: "user"}
+		if err := store.UpsertUser(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+		access, _ := enc.Encrypt("gho_secret")
+		if refresh == "" {
+			refresh, _ = enc.Encrypt("ghr_secret")
+		}
+		gt := &database.GitHubToken{UserID: user.ID, AccessToken: access, RefreshToken: refresh,
+			AccessTokenExpiresAt: time.Now().Add(time.Hour), RefreshTokenExpiresAt: time.Now().Add(time.Hour)}
+		if err := store.UpsertGitHubToken(ctx, gt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seed(1, current, "")
+	seed(2, current, "")
+	seed(3, old, "")               // encrypted with another key
+	seed(4, current, "not-base64") // corrupt refresh token
+
+	var out bytes.Buffer
+	ok, failed, err := verifyGitHubTokens(ctx, store, current, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok != 2 || failed != 2 {
+		t.Errorf("ok, failed = %d, %d; want 2, 2", ok, failed)
+	}
+	if n := strings.Count(out.String(), "FAIL"); n != 2 {
+		t.Errorf("output reports %d failures, want 2:\n%s", n, out.String())
+	}
+	if strings.Contains(out.String(), "secret") {
+		t.Errorf("output leaks plaintext:\n%s", out.String())
+	}
+}
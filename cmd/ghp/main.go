@@ -25,6 +25,8 @@ func main() {
 		newMigrateCmd(),
 		newAuthCmd(),
 		newTokenCmd(),
+		newCredentialCmd(),
+		newCryptoCmd(),
 		newVersionCmd(),
 	)
 
@@ -25,7 +25,7 @@ func newMigrateCmd() *cobra.Command {
 				return err
 			}
 
-			store, err := database.Open(cfg.Database.Driver, cfg.Database.DSN)
+			store, err := database.Open(cfg.Database)
 			if err != nil {
 				return fmt.Errorf("opening database: %w", err)
 			}
@@ -67,7 +67,7 @@ func newMigrateCmd() *cobra.Command {
 				return err
 			}
 
-			store, err := database.Open(cfg.Database.Driver, cfg.Database.DSN)
+			store, err := database.Open(cfg.Database)
 			if err != nil {
 				return fmt.Errorf("opening database: %w", err)
 			}
@@ -97,5 +97,52 @@ func newMigrateCmd() *cobra.Command {
 		},
 	})
 
+	redoCmd := &cobra.Command{
+		Use:   "redo",
+		Short: "Roll back and re-apply the most recent migrations (development only)",
+		Long: "Runs the down migration for the last N applied migrations, then applies them again.\n" +
+			"Rolling back can destroy data, so this requires --confirm and is intended for\n" +
+			"schema development only.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			confirm, _ := cmd.Flags().GetBool("confirm")
+			if !confirm {
+				return fmt.Errorf("redo rolls back migrations and may destroy data; re-run with --confirm in a development environment")
+			}
+			steps, _ := cmd.Flags().GetInt("steps")
+
+			cfgPath, _ := cmd.Flags().GetString("config")
+			if cfgPath == "" {
+				cfgPath = os.Getenv("GHP_CONFIG")
+			}
+
+			cfg, err := config.Load(cfgPath)
+			if err != nil {
+				return err
+			}
+
+			store, err := database.Open(cfg.Database)
+			if err != nil {
+				return fmt.Errorf("opening database: %w", err)
+			}
+			defer store.Close()
+
+			migrator := database.NewMigrator(store, cfg.Database.Driver)
+
+			ctx := context.Background()
+			redone, err := migrator.Redo(ctx, steps)
+			for _, name := range redone {
+				fmt.Printf("%-40s redone\n", name)
+			}
+			if err != nil {
+				return fmt.Errorf("redoing migrations: %w", err)
+			}
+
+			return nil
+		},
+	}
+	redoCmd.Flags().Int("steps", 1, "number of migrations to redo")
+	redoCmd.Flags().Bool("confirm", false, "confirm rolling back migrations")
+	cmd.AddCommand(redoCmd)
+
 	return cmd
 }
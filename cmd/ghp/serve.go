@@ -11,7 +11,7 @@ import (
 )
 
 func newServeCmd() *cobra.Command {
-	return &cobra.Command{
+	cmd := &cobra.Command{
 		Use:   "serve",
 		Short: "Run the server (proxy + web UI + API)",
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -24,6 +24,9 @@ func newServeCmd() *cobra.Command {
 			if err != nil {
 				return err
 			}
+			if dryRun, _ := cmd.Flags().GetBool("dry-run-requests"); dryRun {
+				cfg.Proxy.RecordOnly = true
+			}
 
 			logger := newLogger(cfg)
 			logger.Info("server_start", "msg", "starting ghp server")
@@ -32,22 +35,12 @@ func newServeCmd() *cobra.Command {
 			return srv.Run(context.Background())
 		},
 	}
+	cmd.Flags().Bool("dry-run-requests", false, "record proxied requests instead of forwarding them to GitHub (dev mode only)")
+	return cmd
 }
 
 func newLogger(cfg *config.Config) *slog.Logger {
-	var level slog.Level
-	switch cfg.Logging.Level {
-	case "debug":
-		level = slog.LevelDebug
-	case "warn":
-		level = slog.LevelWarn
-	case "error":
-		level = slog.LevelError
-	default:
-		level = slog.LevelInfo
-	}
-
-	opts := &slog.HandlerOptions{Level: level}
+	opts := &slog.HandlerOptions{Level: config.ParseLevel(cfg.Logging.Level)}
 
 	switch cfg.Logging.Output {
 	case "file":
@@ -6,7 +6,10 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"strings"
 	"text/tabwriter"
 	"time"
 
@@ -33,15 +36,40 @@ func newTokenCmd() *cobra.Command {
 			}
 
 			repo, _ := cmd.Flags().GetString("repo")
+			if fromGit, _ := cmd.Flags().GetBool("repo-from-git"); fromGit {
+				if repo, err = repoFromGit(); err != nil {
+					return err
+				}
+			}
 			scope, _ := cmd.Flags().GetString("scope")
 			duration, _ := cmd.Flags().GetString("duration")
 			sessionID, _ := cmd.Flags().GetString("session")
+			maxRequests, _ := cmd.Flags().GetInt64("max-requests")
+			singleUse, _ := cmd.Flags().GetBool("single-use")
+			note, _ := cmd.Flags().GetString("note")
+			outputFile, _ := cmd.Flags().GetString("output-file")
+			force, _ := cmd.Flags().GetBool("force")
+
+			// Catch typos before calling the server; the server still
+			// enforces its own maximum.
+			if err := validateDuration(duration); err != nil {
+				return err
+			}
+			// Refuse before minting a token that couldn't be saved.
+			if outputFile != "" && !force {
+				if _, err := os.Lstat(outputFile); err == nil {
+					return fmt.Errorf("%s already exists (use --force to overwrite)", outputFile)
+				}
+			}
 
-			body := map[string]string{
-				"repository": repo,
-				"scopes":     scope,
-				"duration":   duration,
-				"session_id": sessionID,
+			body := map[string]interface{}{
+				"repository":   repo,
+				"scopes":       scope,
+				"duration":     duration,
+				"session_id":   sessionID,
+				"max_requests": maxRequests,
+				"single_use":   singleUse,
+				"description":  note,
 			}
 			jsonBody, _ := json.Marshal(body)
 
@@ -66,7 +94,18 @@ func newTokenCmd() *cobra.Command {
 				return fmt.Errorf("failed: %s", result["message"])
 			}
 
-			fmt.Printf("Token:      %s\n", result["token"])
+			tokenValue, _ := result["token"].(string)
+			exportValue := tokenValue
+			if outputFile != "" {
+				tokenID, _ := result["id"].(string)
+				if err := saveTokenFile(cfg, tokenID, outputFile, tokenValue, force); err != nil {
+					return err
+				}
+				fmt.Printf("Token:      written to %s\n", outputFile)
+				exportValue = "$(cat " + shellQuote(outputFile) + ")"
+			} else {
+				fmt.Printf("Token:      %s\n", tokenValue)
+			}
 			fmt.Printf("Repository: %s\n", result["repository"])
 
 			if scopes, ok := result["scopes"].(map[string]interface{}); ok {
@@ -81,9 +120,15 @@ func newTokenCmd() *cobra.Command {
 			if sid, ok := result["session_id"].(string); ok && sid != "" {
 				fmt.Printf("Session:    %s\n", sid)
 			}
+			if n, ok := result["max_requests"].(float64); ok {
+				fmt.Printf("Requests:   %.0f (then revoked)\n", n)
+			}
+			if note, ok := result["description"].(string); ok && note != "" {
+				fmt.Printf("Note:       %s\n", note)
+			}
 
 			fmt.Printf("\nConfigure your agent:\n")
-			fmt.Printf("  export GH_TOKEN=%s\n", result["token"])
+			fmt.Printf("  export GH_TOKEN=%s\n", exportValue)
 
 			serverHost := cfg.ServerURL
 			// Strip protocol.
@@ -99,10 +144,17 @@ func newTokenCmd() *cobra.Command {
 		},
 	}
 	createCmd.Flags().String("repo", "", "repository (owner/repo)")
+	createCmd.Flags().Bool("repo-from-git", false, "take the repository from the current checkout's origin remote")
 	createCmd.Flags().String("scope", "", "scopes (e.g., contents:read,pulls:write)")
 	createCmd.Flags().String("duration", "24h", "token duration")
 	createCmd.Flags().String("session", "", "session identifier")
-	createCmd.MarkFlagRequired("repo")
+	createCmd.Flags().Int64("max-requests", 0, "revoke the token after this many requests (0 for unlimited)")
+	createCmd.Flags().Bool("single-use", false, "revoke the token after its first successful request")
+	createCmd.Flags().String("note", "", "note on why the token exists (informational only)")
+	createCmd.Flags().String("output-file", "", "write only the token to this file (mode 0600) instead of printing it")
+	createCmd.Flags().Bool("force", false, "overwrite an existing --output-file")
+	createCmd.MarkFlagsOneRequired("repo", "repo-from-git")
+	createCmd.MarkFlagsMutuallyExclusive("repo", "repo-from-git")
 	createCmd.MarkFlagRequired("scope")
 
 	// token list
@@ -139,7 +191,7 @@ func newTokenCmd() *cobra.Command {
 			}
 
 			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-			fmt.Fprintln(w, "ID\tREPO\tSCOPES\tSESSION\tEXPIRES\tREQUESTS")
+			fmt.Fprintln(w, "ID\tREPO\tSCOPES\tSESSION\tEXPIRES\tREQUESTS\tNOTE")
 			for _, t := range tokens {
 				prefix := fmt.Sprint(t["token_prefix"])
 				repo := fmt.Sprint(t["repository"])
@@ -173,8 +225,13 @@ func newTokenCmd() *cobra.Command {
 					requests = fmt.Sprintf("%.0f", n)
 				}
 
-				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
-					prefix, repo, scopeStr, session, expiresStr, requests)
+				note, _ := t["description"].(string)
+				if note == "" {
+					note = "-"
+				}
+
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+					prefix, repo, scopeStr, session, expiresStr, requests, note)
 			}
 			w.Flush()
 			return nil
@@ -221,10 +278,196 @@ func newTokenCmd() *cobra.Command {
 		},
 	}
 
-	cmd.AddCommand(createCmd, listCmd, revokeCmd)
+	// token check
+	checkCmd := &cobra.Command{
+		Use:   "check",
+		Short: "Check whether scopes would allow a request, without creating a token",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadCLIConfig()
+			if err != nil {
+				return err
+			}
+			if cfg.ServerURL == "" || cfg.UserToken == "" {
+				return fmt.Errorf("not configured/authenticated")
+			}
+
+			scope, _ := cmd.Flags().GetString("scope")
+			method, _ := cmd.Flags().GetString("method")
+			path, _ := cmd.Flags().GetString("path")
+			return checkScope(cfg, scope, method, path, os.Stdout)
+		},
+	}
+	checkCmd.Flags().String("scope", "", "scopes (e.g., contents:read,pulls:write)")
+	checkCmd.Flags().String("method", "GET", "HTTP method of the request")
+	checkCmd.Flags().String("path", "", "API path of the request (e.g., /repos/owner/repo/pulls)")
+	checkCmd.MarkFlagRequired("scope")
+	checkCmd.MarkFlagRequired("path")
+
+	cmd.AddCommand(createCmd, listCmd, revokeCmd, checkCmd)
 	return cmd
 }
 
+// repoFromGit returns the owner/repo of the current checkout's origin remote.
+func repoFromGit() (string, error) {
+	out, err := exec.Command("git", "config", "--get", "remote.origin.url").Output()
+	if err != nil || strings.TrimSpace(string(out)) == "" {
+		return "", fmt.Errorf("no git remote named origin found here; pass --repo owner/repo instead")
+	}
+	return parseRemoteURL(strings.TrimSpace(string(out)))
+}
+
+// parseRemoteURL extracts owner/repo from a git remote URL in scp-like SSH
+// form (git@github.com:owner/repo.git) or URL form (https://github.com/owner/repo,
+// ssh://git@github.com/owner/repo.git).
+func parseRemoteURL(remote string) (string, error) {
+	var p string
+	if u, err := url.Parse(remote); err == nil && u.Scheme != "" && u.Host != "" {
+		p = u.Path
+	} else if _, after, ok := strings.Cut(remote, ":"); ok && !strings.Contains(remote, "://") {
+		p = after
+	}
+	p = strings.TrimSuffix(strings.Trim(p, "/"), ".git")
+	owner, repo, ok := strings.Cut(p, "/")
+	if !ok || owner == "" || repo == "" || strings.Contains(repo, "/") {
+		return "", fmt.Errorf("cannot determine owner/repo from git remote %q; pass --repo instead", remote)
+	}
+	return owner + "/" + repo, nil
+}
+
+// checkScope asks the server whether a token with the given scopes could make
+// the request, first flagging permissions the server doesn't know. A denied
+// request is reported as an error.
+func checkScope(cfg *cliConfig, scope, method, path string, out io.Writer) error {
+	var known struct {
+		Permissions []string `json:"permissions"`
+	}
+	if err := callAPI(cfg, "GET", "/api/scopes", nil, &known); err != nil {
+		return err
+	}
+	isKnown := make(map[string]bool, len(known.Permissions))
+	for _, p := range known.Permissions {
+		isKnown[p] = true
+	}
+	for _, part := range strings.Split(scope, ",") {
+		perm, _, _ := strings.Cut(strings.TrimSpace(part), ":")
+		if perm != "" && !isKnown[perm] {
+			fmt.Fprintf(out, "Warning: permission %q is not enforced by any ghp rule\n", perm)
+		}
+	}
+
+	var result struct {
+		Allowed    bool   `json:"allowed"`
+		Permission string `json:"permission"`
+		Level      string `json:"level"`
+	}
+	body := map[string]string{"scopes": scope, "method": method, "path": path}
+	if err := callAPI(cfg, "POST", "/api/scopes/check", body, &result); err != nil {
+		return err
+	}
+
+	required := "no specific scope"
+	if result.Permission != "" {
+		required = result.Permission + ":" + result.Level
+	}
+	if !result.Allowed {
+		return fmt.Errorf("denied: %s %s requires %s", method, path, required)
+	}
+	fmt.Fprintf(out, "Allowed: %s %s requires %s\n", method, path, required)
+	return nil
+}
+
+// callAPI makes an authenticated JSON request to the ghp server and decodes
+// a successful response into v.
+func callAPI(cfg *cliConfig, method, path string, body, v interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, cfg.ServerURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cfg.UserToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("connecting to server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		var result map[string]string
+		json.NewDecoder(resp.Body).Decode(&result)
+		return fmt.Errorf("failed: %s", result["message"])
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// validateDuration checks that a --duration value is a positive Go duration.
+func validateDuration(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid --duration %q: use a Go duration such as 30m, 8h or 168h", s)
+	}
+	if d <= 0 {
+		return fmt.Errorf("invalid --duration %q: must be positive", s)
+	}
+	return nil
+}
+
+// writeTokenFile writes token, and nothing else, to path with mode 0600. An
+// existing file is only replaced when force is set, and then takes mode 0600
+// too.
+func writeTokenFile(path, token string, force bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("%s already exists (use --force to overwrite)", path)
+		}
+		return fmt.Errorf("writing token: %w", err)
+	}
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return fmt.Errorf("writing token: %w", err)
+	}
+	if _, err := f.WriteString(token); err != nil {
+		f.Close()
+		return fmt.Errorf("writing token: %w", err)
+	}
+	return f.Close()
+}
+
+// saveTokenFile writes a just-created token to path. If that fails the token
+// is revoked, since nobody could use it and it would otherwise linger until
+// it expires.
+func saveTokenFile(cfg *cliConfig, id, path, token string, force bool) error {
+	err := writeTokenFile(path, token, force)
+	if err == nil {
+		return nil
+	}
+	var result map[string]interface{}
+	if rerr := callAPI(cfg, "DELETE", "/api/tokens/"+id, nil, &result); rerr != nil {
+		return fmt.Errorf("%w; revoking token %s: %v", err, id, rerr)
+	}
+	return fmt.Errorf("%w (token %s revoked)", err, id)
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
 func joinStrings(parts []string, sep string) string {
 	result := ""
 	for i, p := range parts {
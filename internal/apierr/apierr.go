@@ -0,0 +1,65 @@
+// Package apierr defines the machine-readable error codes returned in the
+// "code" field of ghp's JSON error responses. Codes are part of the API
+// contract: add new ones freely, but never change or reuse an existing one.
+package apierr
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Request validation.
+const (
+	InvalidRequest    = "invalid_request"
+	InvalidRepository = "invalid_repository"
+	InvalidScope      = "invalid_scope"
+	InvalidDuration   = "invalid_duration"
+	PayloadTooLarge   = "payload_too_large"
+	NotAcceptable     = "not_acceptable"
+	InsufficientScope = "insufficient_github_scope"
+)
+
+// Authentication and authorization.
+const (
+	Unauthenticated  = "unauthenticated"
+	InvalidToken     = "invalid_token"
+	TokenExpired     = "token_expired"
+	TokenRevoked     = "token_revoked"
+	UserDisabled     = "user_disabled"
+	Forbidden        = "forbidden"
+	AdminRequired    = "admin_required"
+	ScopeDenied      = "scope_denied"
+	InvalidSignature = "invalid_signature"
+	SessionLimit     = "session_limit_reached"
+	RateLimited      = "rate_limited"
+	MethodNotAllowed = "method_not_allowed"
+	// ProxyTokenNotAllowed rejects a ghp_ proxy token presented to the
+	// management API, which only accepts sessions.
+	ProxyTokenNotAllowed = "proxy_token_not_allowed"
+	// Failed GitHub logins: the OAuth state was unknown or expired, GitHub
+	// refused the code exchange, or the user's profile couldn't be read.
+	InvalidState    = "invalid_state"
+	ExchangeFailed  = "exchange_failed"
+	UserFetchFailed = "user_fetch_failed"
+)
+
+// Resources and upstream.
+const (
+	NotFound           = "not_found"
+	GitHubTokenMissing = "github_token_missing"
+	UpstreamError      = "upstream_error"
+	Internal           = "internal_error"
+)
+
+// Response is the JSON body of an error response.
+type Response struct {
+	Message string `json:"message"`
+	Code    string `json:"code"`
+}
+
+// Write writes a JSON error response with the given status, code and message.
+func Write(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Response{Message: message, Code: code})
+}
@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// adminCacheTTL is how long an AdminResolver remembers a user's role.
+const adminCacheTTL = 5 * time.Minute
+
+// AdminSource decides whether a GitHub user is an admin. accessToken is the
+// user's own GitHub token, for sources that must ask GitHub.
+type AdminSource interface {
+	IsAdmin(ctx context.Context, login, accessToken string) (bool, error)
+}
+
+// StaticAdmins grants admin to a fixed list of GitHub usernames (the admins
+// setting).
+type StaticAdmins []string
+
+// IsAdmin implements AdminSource.
+func (s StaticAdmins) IsAdmin(_ context.Context, login, _ string) (bool, error) {
+	for _, admin := range s {
+		if strings.EqualFold(admin, login) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// TeamAdmins grants admin to active members of GitHub teams, named
+// "org/team-slug" (the auth.admin_teams setting). Checking membership needs
+// the user's token to be able to read the organization's teams.
+type TeamAdmins struct {
+	Teams   []string
+	APIBase string
+	Client  *http.Client
+}
+
+// IsAdmin implements AdminSource.
+func (t *TeamAdmins) IsAdmin(ctx context.Context, login, accessToken string) (bool, error) {
+	for _, team := range t.Teams {
+		org, slug, ok := strings.Cut(team, "/")
+		if !ok {
+			return false, fmt.Errorf("admin team %q must be org/team", team)
+		}
+		u := fmt.Sprintf("%s/orgs/%s/teams/%s/memberships/%s",
+			t.APIBase, url.PathEscape(org), url.PathEscape(slug), url.PathEscape(login))
+		req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+		if err != nil {
+			return false, err
+		}
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		req.Header.Set("Accept", "application/vnd.github+json")
+		resp, err := t.Client.Do(req)
+		if err != nil {
+			return false, err
+		}
+		var membership struct {
+			State string `json:"state"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&membership)
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusNotFound:
+			continue
+		case resp.StatusCode != http.StatusOK:
+			return false, fmt.Errorf("checking %s membership: GitHub returned %d", team, resp.StatusCode)
+		case err != nil:
+			return false, fmt.Errorf("checking %s membership: %w", team, err)
+		case membership.State == "active":
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// AdminResolver merges every configured AdminSource. Sources are consulted
+// in order and the first to grant admin wins; a source that fails is logged
+// and counts as not granting it. Results are cached per user for
+// adminCacheTTL, unless a source failed.
+type AdminResolver struct {
+	sources []AdminSource
+	logger  *slog.Logger
+
+	mu    sync.Mutex
+	cache map[string]cachedRole
+}
+
+type cachedRole struct {
+	admin   bool
+	expires time.Time
+}
+
+// NewAdminResolver returns a resolver over sources.
+func NewAdminResolver(logger *slog.Logger, sources ...AdminSource) *AdminResolver {
+	return &AdminResolver{sources: sources, logger: logger, cache: make(map[string]cachedRole)}
+}
+
+// IsAdmin reports whether login is an admin under any source.
+func (r *AdminResolver) IsAdmin(ctx context.Context, login, accessToken string) bool {
+	admin, _ := r.Resolve(ctx, login, accessToken)
+	return admin
+}
+
+// Resolve is IsAdmin, but also returns the error of a failed source when no
+// source granted admin, so callers can tell "not an admin" from "unknown".
+func (r *AdminResolver) Resolve(ctx context.Context, login, accessToken string) (bool, error) {
+	key := strings.ToLower(login)
+	now := time.Now()
+	r.mu.Lock()
+	c, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok && now.Before(c.expires) {
+		return c.admin, nil
+	}
+
+	var failed error
+	for _, s := range r.sources {
+		ok, err := s.IsAdmin(ctx, login, accessToken)
+		if err != nil {
+			r.logger.Warn("admin_source_failed", "user", login, "error", err)
+			failed = err
+			continue
+		}
+		if ok {
+			r.remember(key, true, now)
+			return true, nil
+		}
+	}
+	if failed != nil {
+		return false, failed
+	}
+	r.remember(key, false, now)
+	return false, nil
+}
+
+func (r *AdminResolver) remember(key string, admin bool, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cache[key] = cachedRole{admin: admin, expires: now.Add(adminCacheTTL)}
+}
@@ -4,19 +4,26 @@ package auth
 import (
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/goodtune/ghp/internal/apierr"
 	"github.com/goodtune/ghp/internal/config"
 	"github.com/goodtune/ghp/internal/crypto"
 	"github.com/goodtune/ghp/internal/database"
+	"github.com/goodtune/ghp/internal/oauth"
 )
 
 const (
@@ -24,14 +31,41 @@ const (
 	SessionCookieName = "ghp_session"
 	// SessionDuration is how long a browser session lasts.
 	SessionDuration = 30 * 24 * time.Hour
+	// sessionTouchInterval coalesces last-used updates: a session's
+	// LastUsedAt is only rewritten once this much time has passed.
+	sessionTouchInterval = time.Minute
+	// sessionRecheckInterval is how long a cached session is trusted before
+	// it is re-read from the store, so sessions ended by another replica
+	// stop working there too.
+	sessionRecheckInterval = 30 * time.Second
+	// stateTTL is how long a user has to complete an OAuth login.
+	stateTTL = 10 * time.Minute
+	// TestGitHubToken stands in for the GitHub token of dev-mode test
+	// logins, which have no real one.
+	TestGitHubToken = "gho_test_dummy_token"
 )
 
+// ErrSessionLimit is returned when a user already has the maximum number of
+// sessions and auth.session_limit_action is "deny".
+var ErrSessionLimit = errors.New("session limit reached")
+
 // Session represents an authenticated user session.
 type Session struct {
 	UserID    string
 	Username  string
 	Role      string
+	CreatedAt time.Time
 	ExpiresAt time.Time
+	// LastUsedAt is when the session last authenticated a request, to
+	// within sessionTouchInterval.
+	LastUsedAt time.Time
+	// RoleCheckedAt is when Role was last decided.
+	RoleCheckedAt time.Time
+
+	// hash identifies the session in the store and the cache; loadedAt is
+	// when the cached copy was last read from or written to the store.
+	hash     string
+	loadedAt time.Time
 }
 
 // Handler manages OAuth flows and sessions.
@@ -40,24 +74,89 @@ type Handler struct {
 	store     database.Store
 	encryptor *crypto.Encryptor
 	logger    *slog.Logger
-
+	// oauth talks to GitHub's OAuth and user endpoints; see SetOAuthClient.
+	oauth  oauth.Client
+	admins *AdminResolver
+	// errorPage renders failed logins for browsers; see SetLoginErrorPage.
+	errorPage LoginErrorPage
+
+	// sessions caches sessions by token hash. With a store, the store is
+	// authoritative and sessions survive restarts; without one (in tests)
+	// the cache is all there is.
 	mu       sync.RWMutex
-	sessions map[string]*Session // session token -> Session
+	sessions map[string]*Session
 
 	// OAuth state tokens (short-lived, in-memory).
 	stateMu sync.Mutex
-	states  map[string]time.Time
+	states  map[string]oauthState
+}
+
+// LoginError describes a failed GitHub login. Reason is one of the apierr
+// codes apierr.InvalidRequest, InvalidState, ExchangeFailed, UserFetchFailed,
+// UserDisabled or Internal.
+type LoginError struct {
+	Status  int
+	Reason  string
+	Message string
+}
+
+// LoginErrorPage renders a failed login for a browser.
+type LoginErrorPage func(w http.ResponseWriter, r *http.Request, e LoginError)
+
+// SetOAuthClient replaces the client used to sign users in with GitHub,
+// which by default calls GitHub.
+func (h *Handler) SetOAuthClient(c oauth.Client) {
+	h.oauth = c
+}
+
+// SetLoginErrorPage sets the page browsers see when a login fails. Without
+// one (the default, and for API clients) failures are JSON errors.
+func (h *Handler) SetLoginErrorPage(page LoginErrorPage) {
+	h.errorPage = page
+}
+
+// loginFailed reports a failed OAuth callback: browsers get the login error
+// page, other clients a JSON error.
+func (h *Handler) loginFailed(w http.ResponseWriter, r *http.Request, status int, reason, message string) {
+	if h.errorPage != nil && r.URL.Query().Get("format") != "json" &&
+		strings.Contains(r.Header.Get("Accept"), "text/html") {
+		h.errorPage(w, r, LoginError{Status: status, Reason: reason, Message: message})
+		return
+	}
+	apierr.Write(w, status, reason, message)
+}
+
+// oauthState tracks a pending OAuth login.
+type oauthState struct {
+	expiresAt time.Time
+	// callback is the validated loopback URL a CLI login asked to be
+	// redirected to with its session token, if any.
+	callback string
 }
 
 // NewHandler creates a new auth handler.
 func NewHandler(cfg *config.Config, store database.Store, enc *crypto.Encryptor, logger *slog.Logger) *Handler {
+	client := http.DefaultClient
+	// A bad upstream proxy setting is reported by the proxy handler.
+	if up, err := cfg.Proxy.Upstream(); err == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = up.Proxy
+		client = &http.Client{Transport: transport}
+	}
+	// The static list is checked first, as it needs no call to GitHub.
+	sources := []AdminSource{StaticAdmins(cfg.Admins)}
+	if len(cfg.Auth.AdminTeams) > 0 {
+		sources = append(sources, &TeamAdmins{Teams: cfg.Auth.AdminTeams, APIBase: strings.TrimSuffix(cfg.GitHub.APIBaseURL, "/"), Client: client})
+	}
 	return &Handler{
 		cfg:       cfg,
 		store:     store,
 		encryptor: enc,
 		logger:    logger,
+		oauth:     oauth.NewClient(cfg.GitHub, client),
+		admins:    NewAdminResolver(logger, sources...),
 		sessions:  make(map[string]*Session),
-		states:    make(map[string]time.Time),
+		states:    make(map[string]oauthState),
 	}
 }
 
@@ -75,28 +174,160 @@ func (h *Handler) RegisterRoutes(mux *http.ServeMux) {
 	}
 }
 
-// GetSession returns the session for the given request, or nil.
+// GetSession returns the session for the given request, or nil. The result
+// is a copy, so callers can read it freely while role refreshes update the
+// cached session.
 func (h *Handler) GetSession(r *http.Request) *Session {
+	var s *Session
 	// Check cookie first.
 	if cookie, err := r.Cookie(SessionCookieName); err == nil {
-		return h.lookupSession(cookie.Value)
+		s = h.lookupSession(r.Context(), cookie.Value)
+	} else if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ghpr_") {
+		// Check Authorization header for service tokens (CLI usage).
+		s = h.lookupSession(r.Context(), strings.TrimPrefix(auth, "Bearer "))
 	}
+	if s == nil {
+		return nil
+	}
+	h.refreshRole(r.Context(), s)
+	h.mu.RLock()
+	c := *s
+	h.mu.RUnlock()
+	return &c
+}
 
-	// Check Authorization header for service tokens (CLI usage).
-	auth := r.Header.Get("Authorization")
-	if strings.HasPrefix(auth, "Bearer ghpr_") {
-		return h.lookupSession(strings.TrimPrefix(auth, "Bearer "))
+// refreshRole re-decides the session's role once auth.role_refresh_interval
+// has passed since it was last decided, so a user removed from the admins
+// list or teams loses admin promptly rather than when the session expires.
+// The user's other sessions and stored role follow. If the role can't be
+// confirmed, for example because the team lookup fails, the user is treated
+// as a non-admin until a later check succeeds. Dev mode is skipped, as test
+// logins choose their own role.
+func (h *Handler) refreshRole(ctx context.Context, s *Session) {
+	interval := h.cfg.Auth.RoleRefreshInterval
+	if interval <= 0 || h.cfg.DevMode || h.store == nil {
+		return
+	}
+	now := time.Now()
+	h.mu.Lock()
+	due := now.Sub(s.RoleCheckedAt) >= interval
+	if due {
+		// Claim the check so concurrent requests don't repeat it.
+		s.RoleCheckedAt = now
+	}
+	h.mu.Unlock()
+	if !due {
+		return
 	}
 
-	return nil
+	// Without a token the static admins list still applies; team sources
+	// fail, which drops admin below.
+	accessToken, err := h.githubAccessToken(ctx, s.UserID)
+	if err != nil {
+		h.logger.Warn("role_refresh_token_failed", "user", s.Username, "error", err)
+	}
+	admin, err := h.admins.Resolve(ctx, s.Username, accessToken)
+	if err != nil {
+		h.logger.Warn("role_refresh_failed", "user", s.Username, "error", err)
+		admin = false
+	}
+	role := "user"
+	if admin {
+		role = "admin"
+	}
+
+	h.mu.Lock()
+	old := s.Role
+	for _, other := range h.sessions {
+		if other.UserID == s.UserID {
+			other.Role, other.RoleCheckedAt = role, now
+		}
+	}
+	s.Role = role
+	h.mu.Unlock()
+	if err := h.store.SetUserSessionsRole(ctx, s.UserID, role, now); err != nil {
+		h.logger.Error("failed to update session roles", "user", s.Username, "error", err)
+	}
+	if old == role {
+		return
+	}
+	if err := h.store.SetUserRole(ctx, s.UserID, role); err != nil {
+		h.logger.Error("failed to update user role", "user", s.Username, "error", err)
+	}
+	h.logger.Info("role_changed", "user", s.Username, "from", old, "to", role)
 }
 
-// RequireAuth is middleware that enforces authentication.
+// githubAccessToken returns the user's plaintext GitHub access token,
+// refreshing it first if it expires soon. App user tokens only last 8 hours,
+// so a stored token is usually stale by the time a role check needs it.
+func (h *Handler) githubAccessToken(ctx context.Context, userID string) (string, error) {
+	if h.encryptor == nil {
+		return "", errors.New("no encryptor configured")
+	}
+	gt, err := h.store.GetGitHubToken(ctx, userID)
+	if err != nil {
+		return "", fmt.Errorf("loading github token: %w", err)
+	}
+	if gt == nil {
+		return "", errors.New("github token not found")
+	}
+	if time.Until(gt.AccessTokenExpiresAt) >= oauth.RefreshSkew {
+		plaintext, err := h.encryptor.Decrypt(gt.AccessToken)
+		if err != nil {
+			return "", fmt.Errorf("decrypting github token: %w", err)
+		}
+		return plaintext, nil
+	}
+
+	refreshPlaintext, err := h.encryptor.Decrypt(gt.RefreshToken)
+	if err != nil {
+		return "", fmt.Errorf("decrypting refresh token: %w", err)
+	}
+	tok, err := h.oauth.RefreshToken(ctx, refreshPlaintext)
+	if err != nil {
+		return "", fmt.Errorf("refreshing github token: %w", err)
+	}
+	encAccess, err := h.encryptor.Encrypt(tok.AccessToken)
+	if err != nil {
+		return "", fmt.Errorf("encrypting new access token: %w", err)
+	}
+	encRefresh, err := h.encryptor.Encrypt(tok.RefreshToken)
+	if err != nil {
+		return "", fmt.Errorf("encrypting new refresh token: %w", err)
+	}
+	now := time.Now()
+	gt.AccessToken = encAccess
+	gt.RefreshToken = encRefresh
+	gt.AccessTokenExpiresAt = now.Add(time.Duration(tok.ExpiresIn) * time.Second)
+	gt.RefreshTokenExpiresAt = now.Add(6 * 30 * 24 * time.Hour)
+	if tok.Scope != "" {
+		gt.Scopes = tok.Scope
+	}
+	if err := h.store.UpsertGitHubToken(ctx, gt); err != nil {
+		return "", fmt.Errorf("persisting refreshed token: %w", err)
+	}
+	return tok.AccessToken, nil
+}
+
+// isProxyToken reports whether an Authorization header carries a ghp_ proxy
+// token, which is only valid against the proxy.
+func isProxyToken(authorization string) bool {
+	scheme, credential, _ := strings.Cut(authorization, " ")
+	return (strings.EqualFold(scheme, "bearer") || strings.EqualFold(scheme, "token")) &&
+		strings.HasPrefix(strings.TrimSpace(credential), "ghp_")
+}
+
+// RequireAuth is middleware that enforces authentication. Proxy tokens are
+// refused outright, so a leaked agent token can never mint or manage tokens.
 func (h *Handler) RequireAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isProxyToken(r.Header.Get("Authorization")) {
+			apierr.Write(w, http.StatusUnauthorized, apierr.ProxyTokenNotAllowed, "Proxy tokens cannot access the management API")
+			return
+		}
 		session := h.GetSession(r)
 		if session == nil {
-			http.Error(w, `{"message":"Authentication required"}`, http.StatusUnauthorized)
+			apierr.Write(w, http.StatusUnauthorized, apierr.Unauthenticated, "Authentication required")
 			return
 		}
 		ctx := context.WithValue(r.Context(), sessionKey{}, session)
@@ -109,7 +340,7 @@ func (h *Handler) RequireAdmin(next http.Handler) http.Handler {
 	return h.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		session := SessionFromContext(r.Context())
 		if session == nil || session.Role != "admin" {
-			http.Error(w, `{"message":"Admin access required"}`, http.StatusForbidden)
+			apierr.Write(w, http.StatusForbidden, apierr.AdminRequired, "Admin access required")
 			return
 		}
 		next.ServeHTTP(w, r)
@@ -124,52 +355,296 @@ func SessionFromContext(ctx context.Context) *Session {
 	return s
 }
 
-func (h *Handler) lookupSession(token string) *Session {
+// hashSessionToken returns the SHA-256 hex digest a session is stored under.
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// lookupSession returns the live session for token, or nil. Sessions idle
+// for longer than auth.session_idle_timeout are ended.
+func (h *Handler) lookupSession(ctx context.Context, token string) *Session {
+	now := time.Now()
+	hash := hashSessionToken(token)
 	h.mu.RLock()
-	defer h.mu.RUnlock()
-	s, ok := h.sessions[token]
-	if !ok {
+	s, ok := h.sessions[hash]
+	var lastUsed, loaded time.Time
+	if ok {
+		lastUsed, loaded = s.LastUsedAt, s.loadedAt
+	}
+	h.mu.RUnlock()
+	if h.store != nil && (!ok || now.Sub(loaded) >= sessionRecheckInterval) {
+		if s = h.loadSession(ctx, hash, now); s == nil {
+			return nil
+		}
+		h.mu.RLock()
+		lastUsed = s.LastUsedAt
+		h.mu.RUnlock()
+	} else if !ok {
 		return nil
 	}
-	if time.Now().After(s.ExpiresAt) {
+	if now.After(s.ExpiresAt) {
+		h.endSession(ctx, hash)
 		return nil
 	}
+	if idle := h.cfg.Auth.SessionIdleTimeout; idle > 0 && now.Sub(lastUsed) > idle {
+		h.endSession(ctx, hash)
+		return nil
+	}
+	if now.Sub(lastUsed) >= sessionTouchInterval {
+		h.mu.Lock()
+		s.LastUsedAt = now
+		h.mu.Unlock()
+		if h.store != nil {
+			if err := h.store.TouchSession(ctx, hash, now); err != nil {
+				h.logger.Warn("failed to record session use", "user", s.Username, "error", err)
+			}
+		}
+	}
 	return s
 }
 
-func (h *Handler) createSession(userID, username, role string) string {
-	token := generateSessionToken()
+// loadSession reads a session from the store into the cache, dropping it
+// from the cache if the store no longer has it. A store error keeps any
+// cached copy rather than logging everyone out.
+func (h *Handler) loadSession(ctx context.Context, hash string, now time.Time) *Session {
+	stored, err := h.store.GetSession(ctx, hash)
 	h.mu.Lock()
 	defer h.mu.Unlock()
-	h.sessions[token] = &Session{
-		UserID:    userID,
-		Username:  username,
-		Role:      role,
-		ExpiresAt: time.Now().Add(SessionDuration),
+	cached := h.sessions[hash]
+	if err != nil {
+		h.logger.Error("failed to load session", "error", err)
+		return cached
 	}
-	return token
+	if stored == nil {
+		delete(h.sessions, hash)
+		return nil
+	}
+	s := &Session{
+		UserID:        stored.UserID,
+		Username:      stored.Username,
+		Role:          stored.Role,
+		CreatedAt:     stored.CreatedAt,
+		ExpiresAt:     stored.ExpiresAt,
+		LastUsedAt:    stored.LastUsedAt,
+		RoleCheckedAt: stored.RoleCheckedAt,
+		hash:          hash,
+		loadedAt:      now,
+	}
+	// Uses and role checks are recorded in the store only now and then;
+	// keep the cache's if it is ahead.
+	if cached != nil {
+		if cached.LastUsedAt.After(s.LastUsedAt) {
+			s.LastUsedAt = cached.LastUsedAt
+		}
+		if cached.RoleCheckedAt.After(s.RoleCheckedAt) {
+			s.Role, s.RoleCheckedAt = cached.Role, cached.RoleCheckedAt
+		}
+	}
+	h.sessions[hash] = s
+	return s
+}
+
+// userSessions returns the user's unexpired sessions.
+func (h *Handler) userSessions(ctx context.Context, userID string, now time.Time) ([]*Session, error) {
+	var active []*Session
+	if h.store != nil {
+		stored, err := h.store.ListUserSessions(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		for _, st := range stored {
+			if now.Before(st.ExpiresAt) {
+				active = append(active, &Session{UserID: st.UserID, CreatedAt: st.CreatedAt, ExpiresAt: st.ExpiresAt, hash: st.TokenHash})
+			}
+		}
+		return active, nil
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, s := range h.sessions {
+		if s.UserID == userID && now.Before(s.ExpiresAt) {
+			active = append(active, s)
+		}
+	}
+	return active, nil
+}
+
+// createSession starts a session for the user, enforcing
+// auth.max_sessions_per_user. It returns the number of the user's older
+// sessions evicted to make room, or ErrSessionLimit if the limit denies
+// new sessions instead.
+func (h *Handler) createSession(ctx context.Context, userID, username, role string) (string, int, error) {
+	now := time.Now()
+	if h.store != nil {
+		if _, err := h.store.DeleteExpiredSessions(ctx, now); err != nil {
+			h.logger.Warn("failed to delete expired sessions", "error", err)
+		}
+	}
+
+	evicted := 0
+	if max := h.cfg.Auth.MaxSessionsPerUser; max > 0 {
+		active, err := h.userSessions(ctx, userID, now)
+		if err != nil {
+			return "", 0, fmt.Errorf("listing sessions: %w", err)
+		}
+		if len(active) >= max {
+			if h.cfg.Auth.SessionLimitAction == "deny" {
+				h.logger.Warn("session_limit_denied", "user", username, "active", len(active), "max", max)
+				return "", 0, ErrSessionLimit
+			}
+			// Evict the oldest sessions, leaving room for the new one.
+			sort.Slice(active, func(i, j int) bool {
+				return active[i].CreatedAt.Before(active[j].CreatedAt)
+			})
+			for _, s := range active[:len(active)-max+1] {
+				h.endSession(ctx, s.hash)
+				evicted++
+			}
+			h.logger.Warn("session_evicted", "user", username, "evicted", evicted, "max", max)
+		}
+	}
+
+	token := generateSessionToken()
+	s := &Session{
+		UserID:        userID,
+		Username:      username,
+		Role:          role,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(SessionDuration),
+		LastUsedAt:    now,
+		RoleCheckedAt: now,
+		hash:          hashSessionToken(token),
+		loadedAt:      now,
+	}
+	if h.store != nil {
+		err := h.store.CreateSession(ctx, &database.Session{
+			TokenHash:     s.hash,
+			UserID:        userID,
+			Username:      username,
+			Role:          role,
+			CreatedAt:     now,
+			ExpiresAt:     s.ExpiresAt,
+			LastUsedAt:    now,
+			RoleCheckedAt: now,
+		})
+		if err != nil {
+			return "", 0, fmt.Errorf("storing session: %w", err)
+		}
+	}
+	h.mu.Lock()
+	// Expired sessions are only dropped from the cache when looked up, so
+	// prune the ones nobody asks for again.
+	for hash, cached := range h.sessions {
+		if now.After(cached.ExpiresAt) {
+			delete(h.sessions, hash)
+		}
+	}
+	h.sessions[s.hash] = s
+	h.mu.Unlock()
+	return token, evicted, nil
+}
+
+// startSession creates a session for an interactive login, writing an error
+// response if the session limit denies it. Evictions are reported to the
+// client in the X-GHP-Sessions-Evicted header.
+func (h *Handler) startSession(w http.ResponseWriter, r *http.Request, user *database.User) (string, bool) {
+	token, evicted, err := h.createSession(r.Context(), user.ID, user.GitHubUsername, user.Role)
+	if errors.Is(err, ErrSessionLimit) {
+		apierr.Write(w, http.StatusForbidden, apierr.SessionLimit,
+			"Session limit reached; sign out of another session first")
+		return "", false
+	}
+	if err != nil {
+		h.logger.Error("failed to create session", "user", user.GitHubUsername, "error", err)
+		apierr.Write(w, http.StatusInternalServerError, apierr.Internal, "Internal error")
+		return "", false
+	}
+	if evicted > 0 {
+		w.Header().Set("X-GHP-Sessions-Evicted", strconv.Itoa(evicted))
+	}
+	return token, true
 }
 
 // CreateTestSession creates a session for E2E testing without OAuth.
-// Returns the session token that should be set as the ghp_session cookie.
+// Returns the session token that should be set as the ghp_session cookie,
+// or "" if the session limit denies it.
 func (h *Handler) CreateTestSession(userID, username, role string) string {
-	return h.createSession(userID, username, role)
+	token, _, _ := h.createSession(context.Background(), userID, username, role)
+	return token
 }
 
-func (h *Handler) deleteSession(token string) {
+// EndUserSessions ends every session of the user, returning how many there
+// were. An error means the stored sessions may still be valid on other
+// replicas.
+func (h *Handler) EndUserSessions(ctx context.Context, userID string) (int, error) {
 	h.mu.Lock()
-	defer h.mu.Unlock()
-	delete(h.sessions, token)
+	n := 0
+	for hash, s := range h.sessions {
+		if s.UserID == userID {
+			delete(h.sessions, hash)
+			n++
+		}
+	}
+	h.mu.Unlock()
+	if h.store != nil {
+		stored, err := h.store.DeleteUserSessions(ctx, userID)
+		if err != nil {
+			return n, fmt.Errorf("ending sessions: %w", err)
+		}
+		n = int(stored)
+	}
+	return n, nil
+}
+
+// endSession ends the session with the given token hash.
+func (h *Handler) endSession(ctx context.Context, hash string) {
+	h.mu.Lock()
+	delete(h.sessions, hash)
+	h.mu.Unlock()
+	if h.store != nil {
+		if err := h.store.DeleteSession(ctx, hash); err != nil {
+			h.logger.Error("failed to end session", "error", err)
+		}
+	}
+}
+
+// addState records a pending login. Expired states are pruned first, and at
+// auth.max_pending_logins the oldest pending login is dropped, so a flood of
+// login requests can't grow the map without bound.
+func (h *Handler) addState(state, callback string) {
+	now := time.Now()
+	h.stateMu.Lock()
+	defer h.stateMu.Unlock()
+	var oldest string
+	for s, p := range h.states {
+		if now.After(p.expiresAt) {
+			delete(h.states, s)
+		} else if oldest == "" || p.expiresAt.Before(h.states[oldest].expiresAt) {
+			oldest = s
+		}
+	}
+	if max := h.cfg.Auth.MaxPendingLogins; max > 0 && len(h.states) >= max {
+		delete(h.states, oldest)
+	}
+	h.states[state] = oauthState{expiresAt: now.Add(stateTTL), callback: callback}
 }
 
 func (h *Handler) handleGitHubLogin(w http.ResponseWriter, r *http.Request) {
+	callback := r.URL.Query().Get("redirect_uri")
+	if callback != "" {
+		if err := h.validateCallback(callback); err != nil {
+			h.logger.Warn("rejected login callback", "redirect_uri", callback, "error", err)
+			http.Error(w, "Invalid redirect_uri: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	state := generateState()
-	h.stateMu.Lock()
-	h.states[state] = time.Now().Add(10 * time.Minute)
-	h.stateMu.Unlock()
+	h.addState(state, callback)
 
-	url := fmt.Sprintf("https://github.com/login/oauth/authorize?client_id=%s&state=%s",
-		h.cfg.GitHub.ClientID, state)
+	url := fmt.Sprintf("%s?client_id=%s&state=%s",
+		h.cfg.GitHub.OAuthURL("/login/oauth/authorize"), h.cfg.GitHub.ClientID, state)
 
 	// If the request accepts JSON (CLI), return the URL; otherwise redirect.
 	if strings.Contains(r.Header.Get("Accept"), "application/json") {
@@ -180,6 +655,49 @@ func (h *Handler) handleGitHubLogin(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 }
 
+// validateCallback checks that a CLI callback URL is a plain-HTTP loopback
+// address on one of the configured auth.allowed_callback_ports, so a login
+// can never be used to hand a session token to another host.
+func (h *Handler) validateCallback(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("malformed URL")
+	}
+	if u.Scheme != "http" || u.User != nil {
+		return fmt.Errorf("must be an http:// loopback URL")
+	}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("host %q is not a loopback address", host)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		return fmt.Errorf("an explicit port is required")
+	}
+	if !portAllowed(h.cfg.Auth.AllowedCallbackPorts, port) {
+		return fmt.Errorf("port %d is not allowed", port)
+	}
+	return nil
+}
+
+// portAllowed reports whether port matches one of the specs, each either a
+// single port ("8085") or an inclusive range ("49152-65535"). Malformed
+// specs match nothing.
+func portAllowed(specs []string, port int) bool {
+	for _, spec := range specs {
+		lo, hi, isRange := strings.Cut(strings.TrimSpace(spec), "-")
+		if !isRange {
+			hi = lo
+		}
+		first, err1 := strconv.Atoi(lo)
+		last, err2 := strconv.Atoi(hi)
+		if err1 == nil && err2 == nil && port >= first && port <= last {
+			return true
+		}
+	}
+	return false
+}
+
 func (h *Handler) handleGitHubCallback(w http.ResponseWriter, r *http.Request) {
 	// Handle GitHub App installation callback.
 	// When a user installs the app, GitHub redirects here with installation_id
@@ -194,56 +712,57 @@ func (h *Handler) handleGitHubCallback(w http.ResponseWriter, r *http.Request) {
 	state := r.URL.Query().Get("state")
 
 	if code == "" || state == "" {
-		http.Error(w, "Missing code or state", http.StatusBadRequest)
+		h.loginFailed(w, r, http.StatusBadRequest, apierr.InvalidRequest, "Missing code or state")
 		return
 	}
 
 	// Validate state.
 	h.stateMu.Lock()
-	expiry, ok := h.states[state]
+	pending, ok := h.states[state]
 	if ok {
 		delete(h.states, state)
 	}
 	h.stateMu.Unlock()
 
-	if !ok || time.Now().After(expiry) {
-		http.Error(w, "Invalid or expired state", http.StatusBadRequest)
+	if !ok || time.Now().After(pending.expiresAt) {
+		h.loginFailed(w, r, http.StatusBadRequest, apierr.InvalidState, "Invalid or expired state")
 		return
 	}
 
 	// Exchange code for access token.
-	accessToken, refreshToken, expiresIn, err := h.exchangeCode(code)
+	tok, err := h.oauth.ExchangeCode(r.Context(), code)
 	if err != nil {
 		h.logger.Error("OAuth code exchange failed", "error", err)
-		http.Error(w, "Authentication failed", http.StatusInternalServerError)
+		h.loginFailed(w, r, http.StatusBadGateway, apierr.ExchangeFailed, "GitHub did not complete the sign-in")
 		return
 	}
 
 	// Get user info from GitHub.
-	ghUser, err := h.getGitHubUser(accessToken)
+	ghUser, err := h.oauth.GetUser(r.Context(), tok.AccessToken)
 	if err != nil {
 		h.logger.Error("Failed to get GitHub user", "error", err)
-		http.Error(w, "Failed to get user info", http.StatusInternalServerError)
+		h.loginFailed(w, r, http.StatusBadGateway, apierr.UserFetchFailed, "Failed to get user info from GitHub")
 		return
 	}
 
 	// Encrypt tokens before storage.
-	encAccess, err := h.encryptor.Encrypt(accessToken)
+	encAccess, err := h.encryptor.Encrypt(tok.AccessToken)
 	if err != nil {
 		h.logger.Error("Failed to encrypt access token", "error", err)
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		h.loginFailed(w, r, http.StatusInternalServerError, apierr.Internal, "Internal error")
 		return
 	}
-	encRefresh, err := h.encryptor.Encrypt(refreshToken)
+	encRefresh, err := h.encryptor.Encrypt(tok.RefreshToken)
 	if err != nil {
 		h.logger.Error("Failed to encrypt refresh token", "error", err)
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		h.loginFailed(w, r, http.StatusInternalServerError, apierr.Internal, "Internal error")
 		return
 	}
 
-	// Determine role.
+	// Determine role. If it can't be decided, an existing user keeps theirs.
 	role := "user"
-	if h.cfg.IsAdmin(ghUser.Login) {
+	admin, roleErr := h.admins.Resolve(r.Context(), ghUser.Login, tok.AccessToken)
+	if admin {
 		role = "admin"
 	}
 
@@ -256,29 +775,57 @@ func (h *Handler) handleGitHubCallback(w http.ResponseWriter, r *http.Request) {
 	}
 	if err := h.store.UpsertUser(r.Context(), user); err != nil {
 		h.logger.Error("Failed to upsert user", "error", err)
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		h.loginFailed(w, r, http.StatusInternalServerError, apierr.Internal, "Internal error")
 		return
 	}
+	if user.DisabledAt != nil {
+		h.logger.Warn("auth_login_denied", "user", ghUser.Login, "reason", "user_disabled")
+		h.loginFailed(w, r, http.StatusForbidden, apierr.UserDisabled, "Your ghp account has been disabled")
+		return
+	}
+	if roleErr == nil && user.Role != role {
+		if err := h.store.SetUserRole(r.Context(), user.ID, role); err != nil {
+			h.logger.Error("Failed to update user role", "error", err)
+			h.loginFailed(w, r, http.StatusInternalServerError, apierr.Internal, "Internal error")
+			return
+		}
+		h.logger.Info("role_changed", "user", ghUser.Login, "from", user.Role, "to", role)
+		user.Role = role
+	}
 
 	// Store GitHub token.
 	gt := &database.GitHubToken{
 		UserID:                user.ID,
 		AccessToken:           encAccess,
 		RefreshToken:          encRefresh,
-		AccessTokenExpiresAt:  time.Now().Add(time.Duration(expiresIn) * time.Second),
+		AccessTokenExpiresAt:  time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second),
 		RefreshTokenExpiresAt: time.Now().Add(6 * 30 * 24 * time.Hour), // ~6 months
-		Scopes:                "",
+		Scopes:                tok.Scope,
 	}
 	if err := h.store.UpsertGitHubToken(r.Context(), gt); err != nil {
 		h.logger.Error("Failed to store GitHub token", "error", err)
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		h.loginFailed(w, r, http.StatusInternalServerError, apierr.Internal, "Internal error")
 		return
 	}
 
 	h.logger.Info("auth_login", "user", ghUser.Login, "github_id", ghUser.ID)
 
 	// Create session.
-	sessionToken := h.createSession(user.ID, user.GitHubUsername, user.Role)
+	sessionToken, ok := h.startSession(w, r, user)
+	if !ok {
+		return
+	}
+
+	// A CLI login with a local callback gets the token handed to its listener.
+	if pending.callback != "" {
+		target, _ := url.Parse(pending.callback)
+		q := target.Query()
+		q.Set("session_token", sessionToken)
+		q.Set("username", ghUser.Login)
+		target.RawQuery = q.Encode()
+		http.Redirect(w, r, target.String(), http.StatusSeeOther)
+		return
+	}
 
 	// If the request wants JSON (CLI client), return the token.
 	if r.URL.Query().Get("format") == "json" {
@@ -296,6 +843,7 @@ func (h *Handler) handleGitHubCallback(w http.ResponseWriter, r *http.Request) {
 		Value:    sessionToken,
 		Path:     "/",
 		HttpOnly: true,
+		Secure:   h.cfg.Server.Security.SecureCookies,
 		SameSite: http.SameSiteLaxMode,
 		MaxAge:   int(SessionDuration.Seconds()),
 	})
@@ -305,17 +853,31 @@ func (h *Handler) handleGitHubCallback(w http.ResponseWriter, r *http.Request) {
 
 func (h *Handler) handleLogout(w http.ResponseWriter, r *http.Request) {
 	if cookie, err := r.Cookie(SessionCookieName); err == nil {
-		h.deleteSession(cookie.Value)
+		h.endSession(r.Context(), hashSessionToken(cookie.Value))
 	}
 	http.SetCookie(w, &http.Cookie{
 		Name:     SessionCookieName,
 		Value:    "",
 		Path:     "/",
 		HttpOnly: true,
+		Secure:   h.cfg.Server.Security.SecureCookies,
 		MaxAge:   -1,
 	})
+
+	redirect := h.cfg.Web.PostLogoutRedirect
+	if redirect == "" {
+		redirect = "/login"
+	}
+
+	// Browsers navigating directly get redirected; API/CLI clients get JSON
+	// that includes the landing page for scripted UIs to follow.
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"message": "Logged out"})
+	json.NewEncoder(w).Encode(map[string]string{"message": "Logged out", "redirect": redirect})
 }
 
 func (h *Handler) handleStatus(w http.ResponseWriter, r *http.Request) {
@@ -377,9 +939,13 @@ func (h *Handler) handleTestLogin(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to create test user", http.StatusInternalServerError)
 		return
 	}
+	if user.DisabledAt != nil {
+		apierr.Write(w, http.StatusForbidden, apierr.UserDisabled, "User has been disabled")
+		return
+	}
 
 	// Create a dummy GitHub token so token creation works.
-	encDummy, _ := h.encryptor.Encrypt("gho_test_dummy_token")
+	encDummy, _ := h.encryptor.Encrypt(TestGitHubToken)
 	gt := &database.GitHubToken{
 		UserID:                user.ID,
 		AccessToken:           encDummy,
@@ -395,7 +961,10 @@ func (h *Handler) handleTestLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create session.
-	sessionToken := h.createSession(user.ID, user.GitHubUsername, user.Role)
+	sessionToken, ok := h.startSession(w, r, user)
+	if !ok {
+		return
+	}
 
 	// Set cookie.
 	http.SetCookie(w, &http.Cookie{
@@ -403,6 +972,7 @@ func (h *Handler) handleTestLogin(w http.ResponseWriter, r *http.Request) {
 		Value:    sessionToken,
 		Path:     "/",
 		HttpOnly: true,
+		Secure:   h.cfg.Server.Security.SecureCookies,
 		SameSite: http.SameSiteLaxMode,
 		MaxAge:   int(SessionDuration.Seconds()),
 	})
@@ -416,76 +986,6 @@ func (h *Handler) handleTestLogin(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-type githubUser struct {
-	ID    int64  `json:"id"`
-	Login string `json:"login"`
-	Email string `json:"email"`
-}
-
-func (h *Handler) exchangeCode(code string) (accessToken, refreshToken string, expiresIn int, err error) {
-	body := fmt.Sprintf("client_id=%s&client_secret=%s&code=%s",
-		h.cfg.GitHub.ClientID, h.cfg.GitHub.ClientSecret, code)
-
-	req, err := http.NewRequest("POST", "https://github.com/login/oauth/access_token",
-		strings.NewReader(body))
-	if err != nil {
-		return "", "", 0, err
-	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("Accept", "application/json")
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "", "", 0, err
-	}
-	defer resp.Body.Close()
-
-	var result struct {
-		AccessToken  string `json:"access_token"`
-		RefreshToken string `json:"refresh_token"`
-		ExpiresIn    int    `json:"expires_in"`
-		Error        string `json:"error"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", "", 0, err
-	}
-	if result.Error != "" {
-		return "", "", 0, fmt.Errorf("OAuth error: %s", result.Error)
-	}
-
-	if result.ExpiresIn == 0 {
-		result.ExpiresIn = 28800 // 8 hours default
-	}
-
-	return result.AccessToken, result.RefreshToken, result.ExpiresIn, nil
-}
-
-func (h *Handler) getGitHubUser(accessToken string) (*githubUser, error) {
-	req, err := http.NewRequest("GET", "https://api.github.com/user", nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("Authorization", "Bearer "+accessToken)
-	req.Header.Set("Accept", "application/json")
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("GitHub API returned %d: %s", resp.StatusCode, body)
-	}
-
-	var user githubUser
-	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
-		return nil, err
-	}
-	return &user, nil
-}
-
 func generateSessionToken() string {
 	b := make([]byte, 32)
 	rand.Read(b)
@@ -0,0 +1,680 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goodtune/ghp/internal/config"
+	"github.com/goodtune/ghp/internal/crypto"
+	"github.com/goodtune/ghp/internal/database"
+	"github.com/goodtune/ghp/internal/oauth"
+)
+
+func newTestHandler(t *testing.T, cfg *config.Config) *Handler {
+	t.Helper()
+	return NewHandler(cfg, nil, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+// newTestStore returns a migrated SQLite store in a temporary directory.
+func newTestStore(t *testing.T) *database.SQLiteStore {
+	t.Helper()
+	ctx := context.Background()
+	store, err := database.NewSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if err := store.EnsureMigrationsTable(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.NewMigrator(store, "sqlite").Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestAuthorizeURLUsesOAuthHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"", "https://github.com/login/oauth/authorize?"},
+		{"github.com", "https://github.com/login/oauth/authorize?"},
+		{"ghes.example.com", "https://ghes.example.com/login/oauth/authorize?"},
+		{"http://localhost:9000/", "http://localhost:9000/login/oauth/authorize?"},
+	}
+
+	for _, tt := range tests {
+		cfg := config.Defaults()
+		cfg.GitHub.OAuthHost = tt.host
+		cfg.GitHub.ClientID = "Iv1.test"
+		h := newTestHandler(t, cfg)
+
+		req := httptest.NewRequest(http.MethodGet, "/auth/github", nil)
+		req.Header.Set("Accept", "application/json")
+		rec := httptest.NewRecorder()
+		h.handleGitHubLogin(rec, req)
+
+		var resp map[string]string
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(resp["url"], tt.want) {
+			t.Errorf("oauth_host %q: authorize URL = %q, want prefix %q", tt.host, resp["url"], tt.want)
+		}
+		if !strings.Contains(resp["url"], "client_id=Iv1.test") {
+			t.Errorf("authorize URL %q missing client_id", resp["url"])
+		}
+	}
+}
+
+func TestLogoutContentNegotiation(t *testing.T) {
+	cfg := config.Defaults()
+	cfg.Web.PostLogoutRedirect = "https://intranet.example.com/signed-out"
+	h := newTestHandler(t, cfg)
+
+	// Browser navigation is redirected.
+	req := httptest.NewRequest(http.MethodPost, "/auth/logout", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	rec := httptest.NewRecorder()
+	h.handleLogout(rec, req)
+	if rec.Code != http.StatusSeeOther {
+		t.Errorf("browser logout status = %d, want %d", rec.Code, http.StatusSeeOther)
+	}
+	if loc := rec.Header().Get("Location"); loc != cfg.Web.PostLogoutRedirect {
+		t.Errorf("Location = %q, want %q", loc, cfg.Web.PostLogoutRedirect)
+	}
+
+	// API and CLI clients get JSON.
+	for _, accept := range []string{"application/json", "*/*", ""} {
+		req := httptest.NewRequest(http.MethodPost, "/auth/logout", nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		h.handleLogout(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("Accept %q: status = %d, want 200", accept, rec.Code)
+		}
+		var resp map[string]string
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("Accept %q: %v", accept, err)
+		}
+		if resp["redirect"] != cfg.Web.PostLogoutRedirect {
+			t.Errorf("Accept %q: redirect = %q", accept, resp["redirect"])
+		}
+	}
+}
+
+func TestGitHubLoginCallbackValidation(t *testing.T) {
+	tests := []struct {
+		name       string
+		callback   string
+		wantStatus int
+	}{
+		{"no callback", "", http.StatusOK},
+		{"loopback IPv4 in range", "http://127.0.0.1:53682/callback", http.StatusOK},
+		{"loopback IPv6 in range", "http://[::1]:53682/callback", http.StatusOK},
+		{"localhost single port", "http://localhost:8085/callback", http.StatusOK},
+		{"non-loopback host", "http://evil.example.com:53682/callback", http.StatusBadRequest},
+		{"private address", "http://192.168.1.10:53682/callback", http.StatusBadRequest},
+		{"port outside allowlist", "http://127.0.0.1:8080/callback", http.StatusBadRequest},
+		{"missing port", "http://127.0.0.1/callback", http.StatusBadRequest},
+		{"https scheme", "https://127.0.0.1:53682/callback", http.StatusBadRequest},
+		{"userinfo", "http://evil.example.com@127.0.0.1:53682/", http.StatusBadRequest},
+	}
+
+	cfg := config.Defaults()
+	cfg.Auth.AllowedCallbackPorts = []string{"8085", "49152-65535"}
+	h := newTestHandler(t, cfg)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "/auth/github"
+			if tt.callback != "" {
+				target += "?redirect_uri=" + url.QueryEscape(tt.callback)
+			}
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			req.Header.Set("Accept", "application/json")
+			rec := httptest.NewRecorder()
+			h.handleGitHubLogin(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, strings.TrimSpace(rec.Body.String()))
+			}
+		})
+	}
+}
+
+func TestGitHubCallback(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	enc, err := crypto.NewEncryptor(strings.Repeat("ab", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(config.Defaults(), store, enc, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	h.SetOAuthClient(&oauth.Mock{
+		ExchangeCodeFunc: func(_ context.Context, code string) (*oauth.Token, error) {
+			if code != "abc" {
+				t.Errorf("exchanged code %q, want abc", code)
+			}
+			return &oauth.Token{AccessToken: "ghu_a", RefreshToken: "ghr_r", ExpiresIn: 3600, Scope: "repo"}, nil
+		},
+		GetUserFunc: func(_ context.Context, accessToken string) (*oauth.User, error) {
+			if accessToken != "ghu_a" {
+				t.Errorf("fetched user with %q, want ghu_a", accessToken)
+			}
+			return &oauth.User{ID: 42, Login: "alice", Email: "alice@example.com"}, nil
+		},
+	})
+	h.addState("known", "")
+
+	req := httptest.NewRequest(http.MethodGet, "/auth/github/callback?code=abc&state=known", nil)
+	rec := httptest.NewRecorder()
+	h.handleGitHubCallback(rec, req)
+
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/" {
+		t.Fatalf("status = %d, Location = %q, want 303 to /", rec.Code, rec.Header().Get("Location"))
+	}
+	var cookie *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == SessionCookieName {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatal("no session cookie set")
+	}
+	sreq := httptest.NewRequest(http.MethodGet, "/auth/status", nil)
+	sreq.AddCookie(cookie)
+	if s := h.GetSession(sreq); s == nil || s.Username != "alice" {
+		t.Errorf("session = %+v, want alice's", s)
+	}
+
+	user, err := store.GetUserByGitHubID(ctx, 42)
+	if err != nil || user == nil {
+		t.Fatalf("user not stored: %v", err)
+	}
+	if user.GitHubUsername != "alice" || user.GitHubEmail != "alice@example.com" || user.Role != "user" {
+		t.Errorf("stored user = %+v", user)
+	}
+	gt, err := store.GetGitHubToken(ctx, user.ID)
+	if err != nil || gt == nil {
+		t.Fatalf("github token not stored: %v", err)
+	}
+	if access, err := enc.Decrypt(gt.AccessToken); err != nil || access != "ghu_a" {
+		t.Errorf("stored access token = %q, %v", access, err)
+	}
+	if refresh, err := enc.Decrypt(gt.RefreshToken); err != nil || refresh != "ghr_r" {
+		t.Errorf("stored refresh token = %q, %v", refresh, err)
+	}
+	if gt.Scopes != "repo" {
+		t.Errorf("scopes = %q, want repo", gt.Scopes)
+	}
+	if d := time.Until(gt.AccessTokenExpiresAt); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("access token expires in %v, want an hour", d)
+	}
+
+	// A disabled user can't sign in again.
+	if err := store.SetUserDisabled(ctx, user.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	h.addState("again", "")
+	rec = httptest.NewRecorder()
+	h.handleGitHubCallback(rec, httptest.NewRequest(http.MethodGet, "/auth/github/callback?code=abc&state=again", nil))
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "user_disabled") {
+		t.Errorf("disabled user: status = %d, body = %s; want 403 user_disabled", rec.Code, rec.Body)
+	}
+}
+
+func TestGitHubCallbackErrors(t *testing.T) {
+	exchanged := func(context.Context, string) (*oauth.Token, error) {
+		return &oauth.Token{AccessToken: "ghu_a", RefreshToken: "ghr_r"}, nil
+	}
+	tests := []struct {
+		name       string
+		query      string
+		github     *oauth.Mock
+		wantStatus int
+		wantReason string
+	}{
+		{"missing code", "state=known", &oauth.Mock{}, http.StatusBadRequest, "invalid_request"},
+		{"unknown state", "code=abc&state=unknown", &oauth.Mock{}, http.StatusBadRequest, "invalid_state"},
+		{"exchange refused", "code=abc&state=known", &oauth.Mock{
+			ExchangeCodeFunc: func(context.Context, string) (*oauth.Token, error) {
+				return nil, errors.New("OAuth error: bad_verification_code")
+			},
+		}, http.StatusBadGateway, "exchange_failed"},
+		{"user fetch failed", "code=abc&state=known", &oauth.Mock{
+			ExchangeCodeFunc: exchanged,
+			GetUserFunc: func(context.Context, string) (*oauth.User, error) {
+				return nil, errors.New("GitHub API returned 500")
+			},
+		}, http.StatusBadGateway, "user_fetch_failed"},
+	}
+	for _, tt := range tests {
+		for _, browser := range []bool{false, true} {
+			h := newTestHandler(t, config.Defaults())
+			h.SetOAuthClient(tt.github)
+			var shown *LoginError
+			h.SetLoginErrorPage(func(w http.ResponseWriter, r *http.Request, e LoginError) {
+				shown = &e
+				w.WriteHeader(e.Status)
+			})
+			h.addState("known", "")
+
+			req := httptest.NewRequest(http.MethodGet, "/auth/github/callback?"+tt.query, nil)
+			if browser {
+				req.Header.Set("Accept", "text/html,application/xhtml+xml")
+			}
+			rec := httptest.NewRecorder()
+			h.handleGitHubCallback(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("%s (browser=%v): status = %d, want %d", tt.name, browser, rec.Code, tt.wantStatus)
+			}
+			if browser {
+				if shown == nil || shown.Reason != tt.wantReason {
+					t.Errorf("%s: error page shown with %+v, want reason %s", tt.name, shown, tt.wantReason)
+				}
+				continue
+			}
+			var body struct{ Code string }
+			if shown != nil || json.NewDecoder(rec.Body).Decode(&body) != nil || body.Code != tt.wantReason {
+				t.Errorf("%s: JSON code = %q (page shown: %v), want %s", tt.name, body.Code, shown != nil, tt.wantReason)
+			}
+		}
+	}
+}
+
+func TestCreateSessionLimit(t *testing.T) {
+	cfg := config.Defaults()
+	cfg.Auth.MaxSessionsPerUser = 2
+	h := newTestHandler(t, cfg)
+	ctx := context.Background()
+
+	first, _, _ := h.createSession(ctx, "u1", "alice", "user")
+	second, _, _ := h.createSession(ctx, "u1", "alice", "user")
+	other, _, _ := h.createSession(ctx, "u2", "bob", "user")
+
+	// A third session for alice evicts her oldest, and only hers.
+	third, evicted, err := h.createSession(ctx, "u1", "alice", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evicted != 1 {
+		t.Errorf("evicted = %d, want 1", evicted)
+	}
+	if h.lookupSession(ctx, first) != nil {
+		t.Error("oldest session still valid after eviction")
+	}
+	for _, tok := range []string{second, third, other} {
+		if h.lookupSession(ctx, tok) == nil {
+			t.Errorf("session %s was evicted", tok)
+		}
+	}
+
+	// With deny, the new login fails and existing sessions survive.
+	cfg.Auth.SessionLimitAction = "deny"
+	if _, _, err := h.createSession(ctx, "u1", "alice", "user"); !errors.Is(err, ErrSessionLimit) {
+		t.Errorf("err = %v, want ErrSessionLimit", err)
+	}
+	if h.lookupSession(ctx, second) == nil || h.lookupSession(ctx, third) == nil {
+		t.Error("deny evicted an existing session")
+	}
+
+	// Logging out frees a slot.
+	h.endSession(ctx, hashSessionToken(second))
+	if _, _, err := h.createSession(ctx, "u1", "alice", "user"); err != nil {
+		t.Errorf("after logout: %v", err)
+	}
+}
+
+func TestCreateSessionPrunesExpired(t *testing.T) {
+	h := newTestHandler(t, config.Defaults())
+	ctx := context.Background()
+
+	stale, _, _ := h.createSession(ctx, "u1", "alice", "user")
+	h.sessions[hashSessionToken(stale)].ExpiresAt = time.Now().Add(-time.Minute)
+	fresh, _, _ := h.createSession(ctx, "u2", "bob", "user")
+
+	if _, ok := h.sessions[hashSessionToken(stale)]; ok {
+		t.Error("expired session still cached")
+	}
+	if _, ok := h.sessions[hashSessionToken(fresh)]; !ok {
+		t.Error("new session not cached")
+	}
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	cfg := config.Defaults()
+	cfg.Auth.SessionIdleTimeout = 30 * time.Minute
+	h := newTestHandler(t, cfg)
+	ctx := context.Background()
+
+	token, _, _ := h.createSession(ctx, "u1", "alice", "user")
+	s := h.sessions[hashSessionToken(token)]
+
+	// A recent use isn't rewritten on every request.
+	recent := time.Now().Add(-10 * time.Second)
+	s.LastUsedAt = recent
+	h.lookupSession(ctx, token)
+	if !s.LastUsedAt.Equal(recent) {
+		t.Error("LastUsedAt rewritten within the touch interval")
+	}
+
+	// Use advances LastUsedAt once the interval has passed.
+	old := time.Now().Add(-2 * time.Minute)
+	s.LastUsedAt = old
+	if h.lookupSession(ctx, token) == nil {
+		t.Fatal("session rejected before idle timeout")
+	}
+	if !s.LastUsedAt.After(old) {
+		t.Error("LastUsedAt did not advance on use")
+	}
+
+	// A session idle past the timeout is ended.
+	s.LastUsedAt = time.Now().Add(-31 * time.Minute)
+	if h.lookupSession(ctx, token) != nil {
+		t.Error("idle session still valid")
+	}
+	if _, ok := h.sessions[hashSessionToken(token)]; ok {
+		t.Error("idle session not removed")
+	}
+}
+
+func TestSessionsPersist(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	cfg := config.Defaults()
+	cfg.Auth.MaxSessionsPerUser = 2
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	first := NewHandler(cfg, store, nil, logger)
+
+	token, _, err := first.createSession(ctx, "u1", "alice", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := store.GetSession(ctx, hashSessionToken(token)); err != nil || stored == nil {
+		t.Fatalf("session not stored: %v", err)
+	}
+
+	// A restarted server, or another replica, accepts the session.
+	second := NewHandler(cfg, store, nil, logger)
+	s := second.lookupSession(ctx, token)
+	if s == nil || s.Username != "alice" || s.Role != "admin" {
+		t.Fatalf("session after restart = %+v, want alice's admin session", s)
+	}
+
+	// The session limit counts sessions started on any replica.
+	if _, _, err := second.createSession(ctx, "u1", "alice", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, evicted, err := second.createSession(ctx, "u1", "alice", "admin"); err != nil || evicted != 1 {
+		t.Errorf("third session evicted %d (%v), want 1", evicted, err)
+	}
+
+	// The evicted session stops working on the first replica once its
+	// cached copy is rechecked.
+	if first.lookupSession(ctx, token) == nil {
+		t.Error("cached session rejected before the recheck interval")
+	}
+	first.sessions[hashSessionToken(token)].loadedAt = time.Now().Add(-sessionRecheckInterval)
+	if first.lookupSession(ctx, token) != nil {
+		t.Error("evicted session still valid on the first replica")
+	}
+
+	if n, err := second.EndUserSessions(ctx, "u1"); err != nil || n != 2 {
+		t.Errorf("EndUserSessions = %d, %v; want 2", n, err)
+	}
+	if sessions, _ := store.ListUserSessions(ctx, "u1"); len(sessions) != 0 {
+		t.Errorf("%d sessions left in the store", len(sessions))
+	}
+}
+
+func TestAddStateBounded(t *testing.T) {
+	cfg := config.Defaults()
+	cfg.Auth.MaxPendingLogins = 10
+	h := newTestHandler(t, cfg)
+
+	h.states["stale"] = oauthState{expiresAt: time.Now().Add(-time.Second)}
+	for i := 0; i < 100; i++ {
+		h.addState(generateState(), "")
+	}
+	if n := len(h.states); n != 10 {
+		t.Errorf("len(states) = %d, want 10", n)
+	}
+	if _, ok := h.states["stale"]; ok {
+		t.Error("expired state not pruned")
+	}
+
+	// The newest login survives the flood.
+	h.addState("newest", "")
+	if _, ok := h.states["newest"]; !ok {
+		t.Error("newest state evicted")
+	}
+}
+
+func TestAdminResolver(t *testing.T) {
+	var calls int
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch r.URL.Path {
+		case "/orgs/acme/teams/ops/memberships/carol":
+			w.Write([]byte(`{"state":"active"}`))
+		case "/orgs/acme/teams/ops/memberships/dave":
+			w.Write([]byte(`{"state":"pending"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer github.Close()
+
+	r := NewAdminResolver(slog.New(slog.NewTextHandler(io.Discard, nil)),
+		StaticAdmins{"Alice"},
+		&TeamAdmins{Teams: []string{"acme/ops"}, APIBase: github.URL, Client: github.Client()})
+
+	for login, want := range map[string]bool{
+		"alice": true, // static list, case-insensitive
+		"carol": true, // active team member
+		"dave":  false,
+		"bob":   false,
+	} {
+		if got := r.IsAdmin(context.Background(), login, "gho_x"); got != want {
+			t.Errorf("IsAdmin(%s) = %v, want %v", login, got, want)
+		}
+	}
+	if calls != 3 {
+		t.Errorf("GitHub called %d times, want 3 (not for the static admin)", calls)
+	}
+
+	// Results are cached.
+	r.IsAdmin(context.Background(), "carol", "gho_x")
+	if calls != 3 {
+		t.Errorf("GitHub called again for a cached user")
+	}
+}
+
+// fakeAdmins is an AdminSource backed by a map of logins.
+type fakeAdmins map[string]bool
+
+func (f fakeAdmins) IsAdmin(_ context.Context, login, _ string) (bool, error) {
+	return f[login], nil
+}
+
+func TestRefreshRole(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	cfg := config.Defaults()
+	cfg.Auth.RoleRefreshInterval = time.Minute
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	h := NewHandler(cfg, store, nil, logger)
+	admins := fakeAdmins{"alice": true}
+	h.admins = NewAdminResolver(logger, admins)
+
+	user := &database.User{GitHubID: 1, GitHubUsername: "alice", Role: "admin"}
+	if err := store.UpsertUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	token := h.CreateTestSession(user.ID, user.GitHubUsername, "admin")
+	session := func() *Session {
+		req := httptest.NewRequest("GET", "/auth/status", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return h.GetSession(req)
+	}
+
+	// Alice is removed from the admins, but keeps admin until the interval passes.
+	delete(admins, "alice")
+	if s := session(); s.Role != "admin" {
+		t.Fatalf("role = %q before the refresh interval, want admin", s.Role)
+	}
+
+	h.sessions[hashSessionToken(token)].RoleCheckedAt = time.Now().Add(-2 * time.Minute)
+	if s := session(); s.Role != "user" {
+		t.Errorf("role = %q after re-evaluation, want user", s.Role)
+	}
+	stored, err := store.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Role != "user" {
+		t.Errorf("stored role = %q, want user", stored.Role)
+	}
+}
+
+// teamAdmins is an AdminSource standing in for a team lookup: it grants admin
+// when called with the current GitHub token and fails otherwise.
+type teamAdmins struct{ token string }
+
+func (f *teamAdmins) IsAdmin(_ context.Context, _, accessToken string) (bool, error) {
+	if accessToken != f.token {
+		return false, fmt.Errorf("team lookup with %q: 401 Bad credentials", accessToken)
+	}
+	return true, nil
+}
+
+func TestRefreshRoleRefreshesGitHubToken(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	enc, err := crypto.NewEncryptor(strings.Repeat("ab", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Defaults()
+	cfg.Auth.RoleRefreshInterval = time.Minute
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	h := NewHandler(cfg, store, enc, logger)
+	h.admins = NewAdminResolver(logger, &teamAdmins{token: "ghu_new"})
+	refreshed := 0
+	h.SetOAuthClient(&oauth.Mock{
+		RefreshTokenFunc: func(_ context.Context, refreshToken string) (*oauth.Token, error) {
+			if refreshToken != "ghr_old" {
+				return nil, fmt.Errorf("bad refresh token %q", refreshToken)
+			}
+			refreshed++
+			return &oauth.Token{AccessToken: "ghu_new", RefreshToken: "ghr_new", ExpiresIn: 28800}, nil
+		},
+	})
+
+	user := &database.User{GitHubID: 1, GitHubUsername: "alice", Role: "admin"}
+	if err := store.UpsertUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	encAccess, _ := enc.Encrypt("ghu_old")
+	encRefresh, _ := enc.Encrypt("ghr_old")
+	if err := store.UpsertGitHubToken(ctx, &database.GitHubToken{
+		UserID:                user.ID,
+		AccessToken:           encAccess,
+		RefreshToken:          encRefresh,
+		AccessTokenExpiresAt:  time.Now().Add(-time.Hour),
+		RefreshTokenExpiresAt: time.Now().Add(time.Hour),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	token := h.CreateTestSession(user.ID, user.GitHubUsername, "admin")
+	session := func() *Session {
+		h.sessions[hashSessionToken(token)].RoleCheckedAt = time.Now().Add(-2 * time.Minute)
+		req := httptest.NewRequest("GET", "/auth/status", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return h.GetSession(req)
+	}
+
+	// The expired token is refreshed and the team lookup confirms admin.
+	if s := session(); s.Role != "admin" {
+		t.Errorf("role = %q with an expired token, want admin", s.Role)
+	}
+	if refreshed != 1 {
+		t.Errorf("refreshed %d times, want 1", refreshed)
+	}
+	gt, err := store.GetGitHubToken(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, _ := enc.Decrypt(gt.AccessToken); plaintext != "ghu_new" {
+		t.Errorf("stored access token = %q, want ghu_new", plaintext)
+	}
+
+	// Once the role can't be confirmed, admin is dropped rather than kept.
+	h.admins = NewAdminResolver(logger, &teamAdmins{token: "ghu_other"})
+	if s := session(); s.Role != "user" {
+		t.Errorf("role = %q when the team lookup fails, want user", s.Role)
+	}
+	stored, err := store.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Role != "user" {
+		t.Errorf("stored role = %q, want user", stored.Role)
+	}
+}
+
+func TestRefreshRoleConcurrentReaders(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	// Every request re-decides the role, so readers race the refresh unless
+	// GetSession hands out copies (run with -race).
+	cfg := config.Defaults()
+	cfg.Auth.RoleRefreshInterval = time.Nanosecond
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	h := NewHandler(cfg, store, nil, logger)
+	h.admins = NewAdminResolver(logger, fakeAdmins{"alice": true})
+
+	user := &database.User{GitHubID: 1, GitHubUsername: "alice", Role: "admin"}
+	if err := store.UpsertUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	token := h.CreateTestSession(user.ID, user.GitHubUsername, "admin")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("GET", "/auth/status", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			for j := 0; j < 20; j++ {
+				if s := h.GetSession(req); s == nil || s.Role != "admin" {
+					t.Errorf("session = %+v, want admin", s)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
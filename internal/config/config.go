@@ -2,7 +2,13 @@
 package config
 
 import (
+	"crypto/tls"
 	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
 	"strings"
 	"time"
 
@@ -21,6 +27,12 @@ type Config struct {
 	Logging  LoggingConfig  `koanf:"logging"`
 	Metrics  MetricsConfig  `koanf:"metrics"`
 	OTEL     OTELConfig     `koanf:"otel"`
+	Audit    AuditConfig    `koanf:"audit"`
+	Proxy    ProxyConfig    `koanf:"proxy"`
+	Webhooks WebhooksConfig `koanf:"webhooks"`
+	Web      WebConfig      `koanf:"web"`
+	Auth     AuthConfig     `koanf:"auth"`
+	Debug    DebugConfig    `koanf:"debug"`
 	Admins   []string       `koanf:"admins"`
 
 	EncryptionKey string `koanf:"encryption_key"`
@@ -28,6 +40,10 @@ type Config struct {
 	// DevMode enables test-only endpoints (e.g. /auth/test-login).
 	// Must never be enabled in production.
 	DevMode bool `koanf:"dev_mode"`
+	// DevModeAllowRealData lets dev mode start against a database holding
+	// real users' GitHub tokens. By default that is refused, so dev mode
+	// can't be switched on against production data.
+	DevModeAllowRealData bool `koanf:"dev_mode_allow_real_data"`
 }
 
 type GitHubConfig struct {
@@ -35,37 +51,312 @@ type GitHubConfig struct {
 	ClientID       string `koanf:"client_id"`
 	ClientSecret   string `koanf:"client_secret"`
 	PrivateKeyFile string `koanf:"private_key_file"`
+
+	// OAuthHost serves the OAuth authorize and token endpoints: github.com,
+	// or the hostname of a GitHub Enterprise Server. A scheme may be given;
+	// https is assumed otherwise.
+	OAuthHost string `koanf:"oauth_host"`
+
+	// APIBaseURL is the REST API root ghp proxies to: https://api.github.com,
+	// or https://<host>/api/v3 on a GitHub Enterprise Server. GraphQL is
+	// served beside it.
+	APIBaseURL string `koanf:"api_base_url"`
+	// UploadBaseURL is the root of the release asset upload API:
+	// https://uploads.github.com, or https://<host>/api/uploads on GHES.
+	UploadBaseURL string `koanf:"upload_base_url"`
+}
+
+// OAuthURL returns the URL of an OAuth endpoint (e.g. "/login/oauth/authorize")
+// on the configured OAuth host.
+func (g GitHubConfig) OAuthURL(path string) string {
+	host := g.OAuthHost
+	if host == "" {
+		host = "github.com"
+	}
+	if !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+	return strings.TrimSuffix(host, "/") + path
 }
 
 type DatabaseConfig struct {
 	Driver string `koanf:"driver"`
 	DSN    string `koanf:"dsn"`
+	// AutoMigrate applies pending migrations at startup instead of refusing
+	// to start until 'ghp migrate' has been run.
+	AutoMigrate bool `koanf:"auto_migrate"`
+	// The connection pool settings apply to postgres. Zero leaves the
+	// database/sql default.
+	MaxOpenConns    int           `koanf:"max_open_conns"`
+	MaxIdleConns    int           `koanf:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `koanf:"conn_max_lifetime"`
+	ConnMaxIdleTime time.Duration `koanf:"conn_max_idle_time"`
 }
 
 type ServerConfig struct {
 	Listen                  string `koanf:"listen"`
 	SystemdSocketActivation bool   `koanf:"systemd_socket_activation"`
 	BaseURL                 string `koanf:"base_url"`
+	// MaxConnections caps simultaneously open client connections; further
+	// connections wait in the listen backlog. Zero means unlimited.
+	MaxConnections int `koanf:"max_connections"`
+	// H2C accepts cleartext HTTP/2 for ingress that terminates TLS and
+	// speaks h2c to the backend. HTTP/1.1 is still served.
+	H2C bool `koanf:"h2c"`
+	// StrictAccept answers 406 to API requests whose Accept header excludes
+	// every format the endpoint can produce, instead of sending JSON anyway.
+	StrictAccept bool `koanf:"strict_accept"`
+	// Security hardens browser-facing responses for HTTPS deployments.
+	Security SecurityConfig `koanf:"security"`
+	// TLS serves the listener over HTTPS when a certificate is configured.
+	TLS ServerTLSConfig `koanf:"tls"`
+	// TrustedProxies are the networks of reverse proxies whose
+	// X-Forwarded-For header is believed when finding a client's address.
+	// Connections over a Unix socket are always from a trusted proxy.
+	TrustedProxies []string `koanf:"trusted_proxies"`
+	// AdminAllowedCIDRs restricts the admin API to clients in these
+	// networks. Empty allows any source.
+	AdminAllowedCIDRs []string `koanf:"admin_allowed_cidrs"`
+	// CanonicalHost, if set, is the only hostname ghp answers on: requests
+	// for any other host (except the api.github.com virtualhost and health
+	// checks) are redirected to it with a 308. A port may be included.
+	CanonicalHost string `koanf:"canonical_host"`
+}
+
+type ServerTLSConfig struct {
+	CertFile  string `koanf:"cert_file"`
+	KeyFile   string `koanf:"key_file"`
+	TLSConfig `koanf:",squash"`
+}
+
+// TLSConfig restricts the TLS versions and cipher suites a connection may
+// negotiate.
+type TLSConfig struct {
+	// MinVersion is the lowest TLS version allowed: "1.2" or "1.3".
+	MinVersion string `koanf:"min_version"`
+	// CipherSuites names the TLS 1.2 cipher suites allowed (e.g.
+	// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256). Empty allows Go's defaults;
+	// TLS 1.3 suites are not configurable.
+	CipherSuites []string `koanf:"cipher_suites"`
+}
+
+// Config returns a tls.Config applying t.
+func (t TLSConfig) Config() (*tls.Config, error) {
+	c := &tls.Config{}
+	switch t.MinVersion {
+	case "1.2":
+		c.MinVersion = tls.VersionTLS12
+	case "1.3":
+		c.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("min_version must be 1.2 or 1.3, got %q", t.MinVersion)
+	}
+	for _, name := range t.CipherSuites {
+		id, ok := cipherSuite(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		c.CipherSuites = append(c.CipherSuites, id)
+	}
+	return c, nil
+}
+
+// cipherSuite looks up a secure cipher suite by its standard name.
+func cipherSuite(name string) (uint16, bool) {
+	for _, cs := range tls.CipherSuites() {
+		if cs.Name == name {
+			return cs.ID, true
+		}
+	}
+	return 0, false
+}
+
+type SecurityConfig struct {
+	// HSTS sends Strict-Transport-Security on responses to HTTPS requests,
+	// including those that reached a TLS-terminating ingress, as reported
+	// by X-Forwarded-Proto.
+	HSTS       bool          `koanf:"hsts"`
+	HSTSMaxAge time.Duration `koanf:"hsts_max_age"`
+	// SecureCookies marks session cookies Secure so browsers only send
+	// them over HTTPS.
+	SecureCookies bool `koanf:"secure_cookies"`
 }
 
 type TokensConfig struct {
 	DefaultDuration time.Duration `koanf:"default_duration"`
 	MaxDuration     time.Duration `koanf:"max_duration"`
+	// RevocationGrace lets a revoked token keep working for in-flight
+	// requests for this long. Zero revokes immediately.
+	RevocationGrace time.Duration `koanf:"revocation_grace"`
+	// ScopePolicy decides what happens when a requested proxy scope needs an
+	// OAuth scope the user's GitHub token wasn't granted: "warn" creates the
+	// token with a warning, "block" refuses it.
+	ScopePolicy string `koanf:"scope_policy"`
+	// GitHubExpiryPolicy governs proxy tokens that would outlive the user's
+	// GitHub refresh token, beyond which the credential can't be renewed:
+	// "off" allows them, "cap" shortens them to the refresh token's expiry,
+	// and "reject" refuses them.
+	GitHubExpiryPolicy string `koanf:"github_expiry_policy"`
+	// SessionIDPolicy keeps a session_id to one active token per user:
+	// "off" allows any number, "reject" refuses a new token for a session
+	// that already has one, and "revoke" revokes the earlier token.
+	SessionIDPolicy string `koanf:"session_id_policy"`
+	// VerifyRepository checks the repository on GitHub, with the user's
+	// credentials, before creating a token: "off" skips the check, "exists"
+	// requires the user can see the repository, and "unarchived" also
+	// refuses archived repositories.
+	VerifyRepository string `koanf:"verify_repository"`
+	// ExpiryJitter moves each token's expiry by a random offset of up to
+	// ±ExpiryJitter (never beyond MaxDuration), so tokens minted together
+	// don't expire together. Zero disables it.
+	ExpiryJitter time.Duration `koanf:"expiry_jitter"`
+	// MaxScopes limits how many distinct permissions one token may carry.
+	// Zero is unlimited.
+	MaxScopes int `koanf:"max_scopes"`
+	// AllowMetadataOnly lets a token request name no scopes, granting it
+	// metadata:read. By default at least one scope is required.
+	AllowMetadataOnly bool `koanf:"allow_metadata_only"`
+	// RateLimit caps requests per proxy token.
+	RateLimit RateLimitConfig `koanf:"rate_limit"`
+	// ReconcileInterval is how often tokens belonging to disabled or
+	// deleted users are found and revoked. Zero checks only at startup.
+	ReconcileInterval time.Duration `koanf:"reconcile_interval"`
+	// ArchiveAfter moves tokens this long past their expiry or revocation
+	// into the token archive, at every reconcile. Zero keeps them in place.
+	ArchiveAfter time.Duration `koanf:"archive_after"`
+	// RepoPolicies cap the access level of tokens for matching repositories.
+	// The first matching policy applies.
+	RepoPolicies []RepoPolicy `koanf:"repo_policies"`
+}
+
+// RepoPolicy caps the level of every scope on tokens for repositories
+// matching Repository (path.Match syntax over owner/repo, e.g. "org/*",
+// case-insensitive). Action decides what happens to a request for more:
+// "reject" (the default) refuses it, "downgrade" lowers it to MaxLevel.
+type RepoPolicy struct {
+	Repository string `koanf:"repository"`
+	MaxLevel   string `koanf:"max_level"`
+	Action     string `koanf:"action"`
+}
+
+type RateLimitConfig struct {
+	// Requests allowed per token in each Window. Zero disables the limit.
+	Requests int           `koanf:"requests"`
+	Window   time.Duration `koanf:"window"`
+	// Backend counts requests in "memory" (per replica) or in the "db",
+	// which enforces one limit across every replica sharing the database.
+	Backend string `koanf:"backend"`
 }
 
 type LoggingConfig struct {
 	Output string         `koanf:"output"`
 	Level  string         `koanf:"level"`
 	File   LogFileConfig  `koanf:"file"`
+
+	// Per-class request logging: proxied GitHub calls, ghp's own API, the
+	// login flow and the web UI.
+	Proxy LogClassConfig `koanf:"proxy"`
+	API   LogClassConfig `koanf:"api"`
+	Auth  LogClassConfig `koanf:"auth"`
+	Web   LogClassConfig `koanf:"web"`
+
+	// AuditRetention is how long audit entries are kept. Older entries are
+	// pruned every AuditPruneInterval. Zero keeps them forever.
+	AuditRetention time.Duration `koanf:"audit_retention"`
+	// AuditRetentionAction is what pruning does with an old entry: "delete"
+	// it, or "archive" it to the audit_log_archive table.
+	AuditRetentionAction string `koanf:"audit_retention_action"`
+	// AuditPruneInterval is how often old audit entries are pruned. Zero
+	// prunes only at startup.
+	AuditPruneInterval time.Duration `koanf:"audit_prune_interval"`
 }
 
 type LogFileConfig struct {
 	Path string `koanf:"path"`
 }
 
+// LogClassConfig controls how one class of request is logged.
+type LogClassConfig struct {
+	// Level logs requests that succeed (status below 400).
+	Level string `koanf:"level"`
+	// DeniedLevel logs requests answered with 4xx or 5xx. Empty uses Level.
+	DeniedLevel string `koanf:"denied_level"`
+	// IncludePath adds the request path to each line.
+	IncludePath bool `koanf:"include_path"`
+	// IncludeHeaders adds the request headers, with credentials redacted.
+	IncludeHeaders bool `koanf:"include_headers"`
+}
+
+// LevelFor returns the level to log a request that got status.
+func (c LogClassConfig) LevelFor(status int) slog.Level {
+	if status >= 400 && c.DeniedLevel != "" {
+		return ParseLevel(c.DeniedLevel)
+	}
+	return ParseLevel(c.Level)
+}
+
+// Attrs returns the optional log attributes for a request to path: the path
+// itself and the request headers, as configured.
+func (c LogClassConfig) Attrs(r *http.Request, path string) []any {
+	var attrs []any
+	if c.IncludePath {
+		attrs = append(attrs, "path", path)
+	}
+	if c.IncludeHeaders {
+		attrs = append(attrs, "headers", RedactHeaders(r.Header))
+	}
+	return attrs
+}
+
+// ParseLevel maps a configured level name to its slog level, defaulting to
+// info.
+func ParseLevel(s string) slog.Level {
+	switch s {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
+
+func validLevel(s string) bool {
+	switch s {
+	case "", "debug", "info", "warn", "error":
+		return true
+	}
+	return false
+}
+
 type MetricsConfig struct {
 	Enabled bool   `koanf:"enabled"`
 	Listen  string `koanf:"listen"`
+	// Auth protects /metrics with a bearer token or basic auth. With neither
+	// configured the endpoint is unauthenticated.
+	Auth MetricsAuthConfig `koanf:"auth"`
+	// AllowedCIDRs restricts /metrics to scrapers in these networks. Empty
+	// allows any source.
+	AllowedCIDRs []string `koanf:"allowed_cidrs"`
+	// LabelMode controls the user and repo labels, whose cardinality grows
+	// with the number of users and repositories: "full" keeps them, "hash"
+	// folds them into LabelBuckets buckets, and "collapse" replaces them
+	// with a constant.
+	LabelMode    string `koanf:"label_mode"`
+	LabelBuckets int    `koanf:"label_buckets"`
+	// ReconcileInterval is how often gauges derived from the database (such
+	// as active tokens per user) are recomputed.
+	ReconcileInterval time.Duration `koanf:"reconcile_interval"`
+	// ResponseSummaryInterval, if set, logs how many proxied responses fell
+	// in each status class over every interval.
+	ResponseSummaryInterval time.Duration `koanf:"response_summary_interval"`
+}
+
+type MetricsAuthConfig struct {
+	BearerToken string `koanf:"bearer_token"`
+	Username    string `koanf:"username"`
+	Password    string `koanf:"password"`
 }
 
 type OTELConfig struct {
@@ -74,31 +365,237 @@ type OTELConfig struct {
 	Protocol string `koanf:"protocol"`
 }
 
+type AuditConfig struct {
+	// MaxResults caps the number of entries a single audit query may return.
+	MaxResults int `koanf:"max_results"`
+	// ExportFormat is the default /api/audit/export format: json or logfmt.
+	ExportFormat string `koanf:"export_format"`
+	// CoalesceWindow merges a proxy request's audit entry into the previous
+	// one when the same token repeats the same method, path and status within
+	// this window, counting repeats in the entry's metadata. Zero disables it.
+	CoalesceWindow time.Duration `koanf:"coalesce_window"`
+	// ExcludePaths lists API path patterns (path.Match syntax, e.g. "/user"
+	// or "/repos/*/*/branches") whose successful GET and HEAD proxy requests
+	// are not written to the audit log. Writes and failures are always kept.
+	ExcludePaths []string `koanf:"exclude_paths"`
+	// MaxMetadataBytes caps the size of an entry's metadata. Larger metadata
+	// is replaced by a marker holding its size and a truncated preview.
+	// Zero is unlimited.
+	MaxMetadataBytes int `koanf:"max_metadata_bytes"`
+}
+
+type ProxyConfig struct {
+	// IdentifyAgent appends the token's session ID and prefix to the
+	// User-Agent sent upstream, so requests can be traced in GitHub's logs.
+	IdentifyAgent bool `koanf:"identify_agent"`
+	// StripHeaders names agent request headers that are never forwarded
+	// upstream, even if they would otherwise be relayed.
+	StripHeaders []string `koanf:"strip_headers"`
+	// FollowRedirects makes ghp follow upstream redirects itself. By default
+	// 3xx responses are relayed to the agent so ghp's credentials are never
+	// sent to the redirect target.
+	FollowRedirects bool `koanf:"follow_redirects"`
+	// AllowedMethods lists the only HTTP methods the proxy accepts, whatever
+	// a token's scopes. Empty allows every method.
+	AllowedMethods []string `koanf:"allowed_methods"`
+	// RewriteURLs rewrites upstream API URLs in relayed Location headers to
+	// point back at ghp, so agents keep talking to the proxy.
+	RewriteURLs bool `koanf:"rewrite_urls"`
+	// CorrelationID sends a ghp-generated X-GHP-Request-Id upstream and
+	// records it with GitHub's X-GitHub-Request-Id in the audit log.
+	CorrelationID bool `koanf:"correlation_id"`
+	// MaxBufferedBody is the largest response body, in bytes, ghp will buffer
+	// to rewrite. Larger responses are streamed through unmodified.
+	MaxBufferedBody int64 `koanf:"max_buffered_body"`
+	// ScopeOverrides are checked before the built-in endpoint rules, so
+	// operators can change which permission an endpoint requires.
+	ScopeOverrides []ScopeOverride `koanf:"scope_overrides"`
+	// ScopeRulesFile names a YAML file of endpoint rules (see ScopeRules),
+	// read and validated by Load into ScopeRules.
+	ScopeRulesFile string     `koanf:"scope_rules_file"`
+	ScopeRules     ScopeRules `koanf:"-"`
+	// GitHubScopeCheck decides what happens when a write ghp allows needs an
+	// OAuth scope the user's GitHub token wasn't granted: "block" refuses it
+	// with a 403 before contacting GitHub, "off" forwards it anyway.
+	GitHubScopeCheck string `koanf:"github_scope_check"`
+	// UnmatchedPolicy decides what happens to requests no scope rule
+	// covers: "forward" relays them for GitHub to authorize, and
+	// "require_scope" first refuses tokens that carry no scope beyond
+	// metadata.
+	UnmatchedPolicy string `koanf:"unmatched_policy"`
+	// TLS restricts the connections ghp makes to GitHub.
+	TLS TLSConfig `koanf:"tls"`
+	// HTTPProxy and HTTPSProxy route ghp's requests to GitHub through a
+	// forward proxy, except for hosts matching NoProxy. Each falls back to
+	// the matching environment variable when unset.
+	HTTPProxy  string   `koanf:"http_proxy"`
+	HTTPSProxy string   `koanf:"https_proxy"`
+	NoProxy    []string `koanf:"no_proxy"`
+	// UserRateWarning is a soft limit, in proxied requests per minute per
+	// user: past it ghp logs and audits "user_rate_high" once a minute, but
+	// keeps serving. Zero disables the warning.
+	UserRateWarning int `koanf:"user_rate_warning"`
+	// PathStyles lists the URL styles the proxy accepts: "ghes" serves
+	// /api/v3/... and /api/graphql as GitHub Enterprise Server does, and
+	// "bare" serves /... and /graphql as api.github.com does (reached through
+	// the api.github.com virtualhost).
+	PathStyles []string `koanf:"path_styles"`
+	// APIVersion is sent upstream as X-GitHub-Api-Version on requests that
+	// don't choose a version themselves. Empty leaves GitHub's default.
+	APIVersion string `koanf:"api_version"`
+	// RecordOnly answers allowed requests with a canned 200 and records what
+	// would have been sent to GitHub in the audit log, for testing agents
+	// without GitHub. Requires dev mode.
+	RecordOnly bool `koanf:"record_only"`
+}
+
+// ScopeOverride maps requests matching Pattern (a regular expression over the
+// API path, e.g. "^/repos/[^/]+/[^/]+/compare/.*$") and Method ("" for any)
+// to the permission and level ("read" or "write") they require.
+type ScopeOverride struct {
+	Pattern    string `koanf:"pattern"`
+	Method     string `koanf:"method"`
+	Permission string `koanf:"permission"`
+	Level      string `koanf:"level"`
+}
+
+type WebhooksConfig struct {
+	// Secret is the webhook secret configured on GitHub. The /webhooks
+	// endpoint is only enabled when both Secret and ForwardURL are set.
+	Secret     string `koanf:"secret"`
+	ForwardURL string `koanf:"forward_url"`
+}
+
+// Enabled reports whether inbound webhook handling is configured.
+func (w WebhooksConfig) Enabled() bool {
+	return w.Secret != "" && w.ForwardURL != ""
+}
+
+type WebConfig struct {
+	// Enabled serves the web UI (dashboard, admin, login and static assets).
+	// The API and OAuth endpoints are served regardless.
+	Enabled bool `koanf:"enabled"`
+	// TemplateDir, when set, is searched for *.html templates that override
+	// the embedded ones of the same name.
+	TemplateDir string `koanf:"template_dir"`
+	// PostLogoutRedirect is where browsers are sent after signing out.
+	PostLogoutRedirect string `koanf:"post_logout_redirect"`
+	// RootBehavior decides what GET / does for unauthenticated requests:
+	// "login_redirect" sends them to /login, "json_status" returns a JSON
+	// status document, and "custom_redirect" sends them to RootRedirect.
+	RootBehavior string `koanf:"root_behavior"`
+	RootRedirect string `koanf:"root_redirect"`
+}
+
+type DebugConfig struct {
+	// PprofListen is a private address on which to serve net/http/pprof.
+	// Profiling is never served on the main listener; empty disables it.
+	PprofListen string `koanf:"pprof_listen"`
+}
+
+type AuthConfig struct {
+	// AllowedCallbackPorts lists the loopback ports, singly ("8085") or as
+	// ranges ("49152-65535"), that a CLI login may ask to be redirected to.
+	AllowedCallbackPorts []string `koanf:"allowed_callback_ports"`
+	// MaxSessionsPerUser caps concurrent sessions per user; zero is unlimited.
+	MaxSessionsPerUser int `koanf:"max_sessions_per_user"`
+	// SessionLimitAction is what happens when a login would exceed the cap:
+	// "evict" (the oldest session ends) or "deny" (the login fails).
+	SessionLimitAction string `koanf:"session_limit_action"`
+	// SessionIdleTimeout ends sessions unused for this long, to within a
+	// minute. Zero only ends them when they expire.
+	SessionIdleTimeout time.Duration `koanf:"session_idle_timeout"`
+	// MaxPendingLogins caps OAuth logins awaiting GitHub's callback; the
+	// oldest is dropped to make room. Zero is unlimited.
+	MaxPendingLogins int `koanf:"max_pending_logins"`
+	// AdminTeams grants the admin role to members of these GitHub teams,
+	// named "org/team-slug", in addition to the admins list.
+	AdminTeams []string `koanf:"admin_teams"`
+	// RoleRefreshInterval is how often a signed-in user's role is decided
+	// again from the admins list and teams. Zero decides it only at login.
+	RoleRefreshInterval time.Duration `koanf:"role_refresh_interval"`
+}
+
 // Defaults returns a Config with sensible defaults.
 func Defaults() *Config {
 	return &Config{
+		GitHub: GitHubConfig{
+			OAuthHost:     "github.com",
+			APIBaseURL:    "https://api.github.com",
+			UploadBaseURL: "https://uploads.github.com",
+		},
 		Database: DatabaseConfig{
-			Driver: "sqlite",
-			DSN:    "ghp.db",
+			Driver:          "sqlite",
+			DSN:             "ghp.db",
+			MaxOpenConns:    20,
+			MaxIdleConns:    5,
+			ConnMaxLifetime: 30 * time.Minute,
+			ConnMaxIdleTime: 5 * time.Minute,
 		},
 		Server: ServerConfig{
 			Listen: ":8080",
+			Security: SecurityConfig{
+				HSTSMaxAge: 365 * 24 * time.Hour,
+			},
+			TLS: ServerTLSConfig{TLSConfig: TLSConfig{MinVersion: "1.2"}},
 		},
 		Tokens: TokensConfig{
-			DefaultDuration: 24 * time.Hour,
-			MaxDuration:     7 * 24 * time.Hour,
+			DefaultDuration:    24 * time.Hour,
+			MaxDuration:        7 * 24 * time.Hour,
+			ScopePolicy:        "warn",
+			GitHubExpiryPolicy: "off",
+			SessionIDPolicy:    "off",
+			VerifyRepository:   "off",
+			ReconcileInterval:  5 * time.Minute,
+			RateLimit: RateLimitConfig{
+				Window:  time.Hour,
+				Backend: "memory",
+			},
 		},
 		Logging: LoggingConfig{
 			Output: "stdout",
 			Level:  "info",
+			Proxy:  LogClassConfig{Level: "info", IncludePath: true},
+			API:    LogClassConfig{Level: "debug", IncludePath: true},
+			Auth:   LogClassConfig{Level: "debug", IncludePath: true},
+			Web:    LogClassConfig{Level: "debug", IncludePath: true},
+
+			AuditRetentionAction: "delete",
+			AuditPruneInterval:   time.Hour,
 		},
 		Metrics: MetricsConfig{
-			Enabled: false,
-			Listen:  ":9090",
+			Enabled:           false,
+			Listen:            ":9090",
+			LabelMode:         "full",
+			LabelBuckets:      32,
+			ReconcileInterval: 5 * time.Minute,
 		},
 		OTEL: OTELConfig{
 			Protocol: "grpc",
 		},
+		Proxy: ProxyConfig{
+			MaxBufferedBody:  1 << 20,
+			GitHubScopeCheck: "block",
+			UnmatchedPolicy:  "forward",
+			PathStyles:       []string{"ghes", "bare"},
+			TLS:              TLSConfig{MinVersion: "1.2"},
+		},
+		Web: WebConfig{
+			Enabled:            true,
+			PostLogoutRedirect: "/login",
+			RootBehavior:       "login_redirect",
+		},
+		Audit: AuditConfig{
+			MaxResults:       1000,
+			ExportFormat:     "json",
+			MaxMetadataBytes: 64 << 10,
+		},
+		Auth: AuthConfig{
+			AllowedCallbackPorts: []string{"49152-65535"},
+			SessionLimitAction:   "evict",
+			MaxPendingLogins:     10000,
+			RoleRefreshInterval:  15 * time.Minute,
+		},
 	}
 }
 
@@ -118,21 +615,14 @@ func Load(path string) (*Config, error) {
 	// Only the first underscore separates the section from the field name;
 	// subsequent underscores are preserved as literal characters in field names
 	// (e.g. GHP_GITHUB_CLIENT_ID -> github.client_id, GHP_DEV_MODE -> dev_mode).
-	if err := k.Load(env.Provider("GHP_", ".", func(s string) string {
-		s = strings.TrimPrefix(s, "GHP_")
-		s = strings.ToLower(s)
-		if i := strings.Index(s, "_"); i > 0 {
-			section, field := s[:i], s[i+1:]
-			switch section {
-			case "github", "database", "server", "tokens", "logging", "metrics", "otel":
-				// Handle 3-level nesting for logging.file.*
-				if section == "logging" && strings.HasPrefix(field, "file_") {
-					return "logging.file." + field[len("file_"):]
-				}
-				return section + "." + field
-			}
+	// List settings (see listKeys) are comma-separated and replace, rather than
+	// extend, any list from the config file.
+	if err := k.Load(env.ProviderWithValue("GHP_", ".", func(key, value string) (string, interface{}) {
+		key = envKey(key)
+		if listKeys[key] {
+			return key, splitList(value)
 		}
-		return s
+		return key, value
 	}), nil); err != nil {
 		return nil, fmt.Errorf("loading env vars: %w", err)
 	}
@@ -141,9 +631,207 @@ func Load(path string) (*Config, error) {
 		return nil, fmt.Errorf("unmarshaling config: %w", err)
 	}
 
+	for key, v := range map[string]string{"api_base_url": cfg.GitHub.APIBaseURL, "upload_base_url": cfg.GitHub.UploadBaseURL} {
+		if u, err := url.Parse(v); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("github.%s must be an http or https URL, got %q", key, v)
+		}
+	}
+	if a := cfg.Tokens.ArchiveAfter; a < 0 || (a > 0 && a <= cfg.Tokens.RevocationGrace) {
+		return nil, fmt.Errorf("tokens.archive_after must be zero or longer than tokens.revocation_grace, got %s", a)
+	}
+	if b := cfg.Tokens.RateLimit.Backend; b != "memory" && b != "db" {
+		return nil, fmt.Errorf("tokens.rate_limit.backend must be memory or db, got %q", b)
+	}
+	if _, err := cfg.Server.TLS.Config(); err != nil {
+		return nil, fmt.Errorf("server.tls: %w", err)
+	}
+	if _, err := cfg.Proxy.TLS.Config(); err != nil {
+		return nil, fmt.Errorf("proxy.tls: %w", err)
+	}
+	if _, err := cfg.Proxy.Upstream(); err != nil {
+		return nil, fmt.Errorf("proxy.%w", err)
+	}
+	if _, err := ParseCIDRs(cfg.Server.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("server.trusted_proxies: %w", err)
+	}
+	if _, err := ParseCIDRs(cfg.Server.AdminAllowedCIDRs); err != nil {
+		return nil, fmt.Errorf("server.admin_allowed_cidrs: %w", err)
+	}
+	for i, p := range cfg.Tokens.RepoPolicies {
+		if err := checkPathPatterns([]string{p.Repository}); err != nil {
+			return nil, fmt.Errorf("tokens.repo_policies[%d]: %w", i, err)
+		}
+		if p.MaxLevel != "read" && p.MaxLevel != "write" {
+			return nil, fmt.Errorf("tokens.repo_policies[%d]: max_level must be read or write, got %q", i, p.MaxLevel)
+		}
+		if p.Action != "" && p.Action != "reject" && p.Action != "downgrade" {
+			return nil, fmt.Errorf("tokens.repo_policies[%d]: action must be reject or downgrade, got %q", i, p.Action)
+		}
+	}
+	if m := cfg.Metrics.LabelMode; m != "full" && m != "hash" && m != "collapse" {
+		return nil, fmt.Errorf("metrics.label_mode must be full, hash or collapse, got %q", m)
+	}
+	if cfg.Metrics.LabelBuckets <= 0 {
+		return nil, fmt.Errorf("metrics.label_buckets must be positive, got %d", cfg.Metrics.LabelBuckets)
+	}
+	if err := checkPathPatterns(cfg.Audit.ExcludePaths); err != nil {
+		return nil, fmt.Errorf("audit.exclude_paths: %w", err)
+	}
+	if f := cfg.Audit.ExportFormat; f != "json" && f != "logfmt" {
+		return nil, fmt.Errorf("audit.export_format must be json or logfmt, got %q", f)
+	}
+	if a := cfg.Logging.AuditRetentionAction; a != "delete" && a != "archive" {
+		return nil, fmt.Errorf("logging.audit_retention_action must be delete or archive, got %q", a)
+	}
+	if cfg.Logging.AuditRetention < 0 {
+		return nil, fmt.Errorf("logging.audit_retention must not be negative, got %s", cfg.Logging.AuditRetention)
+	}
+	for name, c := range map[string]LogClassConfig{"proxy": cfg.Logging.Proxy, "api": cfg.Logging.API, "auth": cfg.Logging.Auth, "web": cfg.Logging.Web} {
+		if !validLevel(c.Level) || !validLevel(c.DeniedLevel) {
+			return nil, fmt.Errorf("logging.%s levels must be debug, info, warn or error", name)
+		}
+	}
+	for _, team := range cfg.Auth.AdminTeams {
+		if org, slug, ok := strings.Cut(team, "/"); !ok || org == "" || slug == "" {
+			return nil, fmt.Errorf("auth.admin_teams: %q must be org/team-slug", team)
+		}
+	}
+	switch b := cfg.Web.RootBehavior; b {
+	case "login_redirect", "json_status":
+	case "custom_redirect":
+		if cfg.Web.RootRedirect == "" {
+			return nil, fmt.Errorf("web.root_redirect is required when web.root_behavior is custom_redirect")
+		}
+	default:
+		return nil, fmt.Errorf("web.root_behavior must be login_redirect, json_status or custom_redirect, got %q", b)
+	}
+	if a := cfg.Auth.SessionLimitAction; a != "evict" && a != "deny" {
+		return nil, fmt.Errorf("auth.session_limit_action must be evict or deny, got %q", a)
+	}
+	if v := cfg.Tokens.VerifyRepository; v != "off" && v != "exists" && v != "unarchived" {
+		return nil, fmt.Errorf("tokens.verify_repository must be off, exists or unarchived, got %q", v)
+	}
+	if p := cfg.Tokens.ScopePolicy; p != "warn" && p != "block" {
+		return nil, fmt.Errorf("tokens.scope_policy must be warn or block, got %q", p)
+	}
+	if p := cfg.Tokens.GitHubExpiryPolicy; p != "off" && p != "cap" && p != "reject" {
+		return nil, fmt.Errorf("tokens.github_expiry_policy must be off, cap or reject, got %q", p)
+	}
+	if p := cfg.Tokens.SessionIDPolicy; p != "off" && p != "reject" && p != "revoke" {
+		return nil, fmt.Errorf("tokens.session_id_policy must be off, reject or revoke, got %q", p)
+	}
+	if c := cfg.Proxy.GitHubScopeCheck; c != "block" && c != "off" {
+		return nil, fmt.Errorf("proxy.github_scope_check must be block or off, got %q", c)
+	}
+	if p := cfg.Proxy.UnmatchedPolicy; p != "forward" && p != "require_scope" {
+		return nil, fmt.Errorf("proxy.unmatched_policy must be forward or require_scope, got %q", p)
+	}
+	if len(cfg.Proxy.PathStyles) == 0 {
+		return nil, fmt.Errorf("proxy.path_styles must list at least one of ghes or bare")
+	}
+	for _, style := range cfg.Proxy.PathStyles {
+		if style != "ghes" && style != "bare" {
+			return nil, fmt.Errorf("proxy.path_styles must be ghes or bare, got %q", style)
+		}
+	}
+	for i, o := range cfg.Proxy.ScopeOverrides {
+		if err := o.validate(); err != nil {
+			return nil, fmt.Errorf("proxy.scope_overrides[%d]: %w", i, err)
+		}
+	}
+	if cfg.Proxy.ScopeRulesFile != "" {
+		sr, err := LoadScopeRules(cfg.Proxy.ScopeRulesFile)
+		if err != nil {
+			return nil, fmt.Errorf("proxy.scope_rules_file: %w", err)
+		}
+		cfg.Proxy.ScopeRules = sr
+	}
+
 	return cfg, nil
 }
 
+// ParseCIDRs parses a list of networks in CIDR notation.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// checkPathPatterns reports the first malformed path.Match pattern.
+func checkPathPatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// listKeys are the config keys whose environment variables hold
+// comma-separated lists.
+var listKeys = map[string]bool{
+	"admins":                      true,
+	"proxy.strip_headers":         true,
+	"proxy.allowed_methods":       true,
+	"auth.allowed_callback_ports": true,
+	"metrics.allowed_cidrs":       true,
+	"audit.exclude_paths":         true,
+	"server.tls.cipher_suites":    true,
+	"proxy.tls.cipher_suites":     true,
+	"server.trusted_proxies":      true,
+	"server.admin_allowed_cidrs":  true,
+	"proxy.no_proxy":              true,
+	"auth.admin_teams":            true,
+	"proxy.path_styles":           true,
+}
+
+// nestedKeys lists, per section, the sub-sections whose fields are nested a
+// level deeper (e.g. GHP_LOGGING_FILE_PATH -> logging.file.path).
+var nestedKeys = map[string][]string{
+	"logging": {"file", "proxy", "api", "auth", "web"},
+	"metrics": {"auth"},
+	"proxy":   {"tls"},
+	"server":  {"security", "tls"},
+	"tokens":  {"rate_limit"},
+}
+
+// envKey maps a GHP_ environment variable name to its config key.
+func envKey(s string) string {
+	s = strings.TrimPrefix(s, "GHP_")
+	s = strings.ToLower(s)
+	if i := strings.Index(s, "_"); i > 0 {
+		section, field := s[:i], s[i+1:]
+		switch section {
+		case "github", "database", "server", "tokens", "logging", "metrics", "otel", "audit", "proxy", "webhooks", "web", "auth", "debug":
+			for _, sub := range nestedKeys[section] {
+				if strings.HasPrefix(field, sub+"_") {
+					return section + "." + sub + "." + field[len(sub)+1:]
+				}
+			}
+			return section + "." + field
+		}
+	}
+	return s
+}
+
+// splitList splits a comma-separated value, trimming spaces and dropping
+// empty elements.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
 // IsAdmin returns true if the given GitHub username is in the admin list.
 func (c *Config) IsAdmin(username string) bool {
 	for _, admin := range c.Admins {
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// redacted replaces secret values in Redacted output.
+const redacted = "***"
+
+// dsnPassword matches the password in a key=value (libpq-style) DSN.
+var dsnPassword = regexp.MustCompile(`(password=)('[^']*'|\S+)`)
+
+// Redacted returns the configuration as a map keyed by configuration names
+// (as in the config file), with secrets replaced by "***". Unset secrets are
+// left empty so it's clear they aren't configured.
+func (c *Config) Redacted() map[string]any {
+	r := *c
+	redact(&r.EncryptionKey)
+	redact(&r.GitHub.ClientSecret)
+	redact(&r.Webhooks.Secret)
+	redact(&r.Metrics.Auth.BearerToken)
+	redact(&r.Metrics.Auth.Password)
+	r.Database.DSN = redactDSN(r.Database.DSN)
+	r.Proxy.HTTPProxy = redactURL(r.Proxy.HTTPProxy)
+	r.Proxy.HTTPSProxy = redactURL(r.Proxy.HTTPSProxy)
+	return toMap(reflect.ValueOf(r)).(map[string]any)
+}
+
+// secretHeaders are request headers that carry credentials.
+var secretHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "X-Hub-Signature-256"}
+
+// RedactHeaders returns a copy of h, flattened for logging, with credential
+// headers replaced by "***".
+func RedactHeaders(h http.Header) map[string]string {
+	out := make(map[string]string, len(h))
+	for k, v := range h {
+		out[k] = strings.Join(v, ", ")
+	}
+	for _, k := range secretHeaders {
+		if _, ok := out[k]; ok {
+			out[k] = redacted
+		}
+	}
+	return out
+}
+
+func redact(s *string) {
+	if *s != "" {
+		*s = redacted
+	}
+}
+
+// redactDSN hides the password in a URL or key=value database DSN.
+func redactDSN(dsn string) string {
+	if r := redactURL(dsn); r != dsn {
+		return r
+	}
+	return dsnPassword.ReplaceAllString(dsn, "${1}"+redacted)
+}
+
+// redactURL hides the password in a URL's userinfo, such as a proxy URL's
+// credentials. Anything else is returned unchanged.
+func redactURL(s string) string {
+	if u, err := url.Parse(s); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			// url.URL.Redacted masks the password as "xxxxx".
+			return strings.Replace(u.Redacted(), ":xxxxx@", ":"+redacted+"@", 1)
+		}
+	}
+	return s
+}
+
+// toMap converts a configuration value to maps keyed by koanf tags.
+func toMap(v reflect.Value) any {
+	if d, ok := v.Interface().(time.Duration); ok {
+		return d.String()
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		m := make(map[string]any)
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			key := t.Field(i).Tag.Get("koanf")
+			switch {
+			case key == ",squash":
+				for k, fv := range toMap(v.Field(i)).(map[string]any) {
+					m[k] = fv
+				}
+			case key != "":
+				m[key] = toMap(v.Field(i))
+			}
+		}
+		return m
+	case reflect.Slice:
+		out := make([]any, v.Len())
+		for i := range out {
+			out[i] = toMap(v.Index(i))
+		}
+		return out
+	default:
+		return v.Interface()
+	}
+}
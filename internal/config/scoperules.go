@@ -0,0 +1,68 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/knadh/koanf/parsers/yaml"
+	"github.com/knadh/koanf/providers/file"
+	"github.com/knadh/koanf/v2"
+)
+
+// ScopeRules is the content of a proxy.scope_rules_file:
+//
+//	replace_builtin: false
+//	rules:
+//	  - pattern: '^/repos/[^/]+/[^/]+/deployments(/.*)?$'
+//	    method: POST
+//	    permission: deployments
+//	    level: write
+//
+// Its rules are checked after proxy.scope_overrides and before the built-in
+// rules, which ReplaceBuiltin drops altogether.
+type ScopeRules struct {
+	ReplaceBuiltin bool            `koanf:"replace_builtin"`
+	Rules          []ScopeOverride `koanf:"rules"`
+}
+
+// LoadScopeRules reads and validates a scope rules file.
+func LoadScopeRules(path string) (ScopeRules, error) {
+	var sr ScopeRules
+	k := koanf.New(".")
+	if err := k.Load(file.Provider(path), yaml.Parser()); err != nil {
+		return sr, fmt.Errorf("loading %s: %w", path, err)
+	}
+	if err := k.Unmarshal("", &sr); err != nil {
+		return sr, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if sr.ReplaceBuiltin && len(sr.Rules) == 0 {
+		return sr, fmt.Errorf("%s: replace_builtin needs at least one rule", path)
+	}
+	for i, o := range sr.Rules {
+		if err := o.validate(); err != nil {
+			return sr, fmt.Errorf("%s: rules[%d]: %w", path, i, err)
+		}
+	}
+	return sr, nil
+}
+
+// validate checks that a rule's pattern compiles, its method (if any) is an
+// HTTP method the API uses, and its permission and level are set.
+func (o ScopeOverride) validate() error {
+	if _, err := regexp.Compile(o.Pattern); err != nil {
+		return fmt.Errorf("invalid pattern: %w", err)
+	}
+	switch strings.ToUpper(o.Method) {
+	case "", "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE":
+	default:
+		return fmt.Errorf("method must be GET, HEAD, POST, PUT, PATCH, DELETE or empty for any, got %q", o.Method)
+	}
+	if o.Permission == "" {
+		return fmt.Errorf("permission is required")
+	}
+	if o.Level != "read" && o.Level != "write" {
+		return fmt.Errorf("level must be read or write, got %q", o.Level)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// UpstreamProxy is the forward proxy ghp uses to reach GitHub.
+type UpstreamProxy struct {
+	HTTP    *url.URL
+	HTTPS   *url.URL
+	NoProxy []string
+}
+
+// Upstream returns the effective upstream proxy: proxy.http_proxy,
+// proxy.https_proxy and proxy.no_proxy, each falling back to the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables when unset.
+func (c ProxyConfig) Upstream() (*UpstreamProxy, error) {
+	u := &UpstreamProxy{NoProxy: c.NoProxy}
+	if len(u.NoProxy) == 0 {
+		u.NoProxy = splitList(getenv("NO_PROXY"))
+	}
+	var err error
+	if u.HTTP, err = parseProxyURL(c.HTTPProxy, getenv("HTTP_PROXY")); err != nil {
+		return nil, fmt.Errorf("http_proxy: %w", err)
+	}
+	if u.HTTPS, err = parseProxyURL(c.HTTPSProxy, getenv("HTTPS_PROXY")); err != nil {
+		return nil, fmt.Errorf("https_proxy: %w", err)
+	}
+	return u, nil
+}
+
+// getenv reads an environment variable, accepting the lowercase spelling
+// as curl and Go do.
+func getenv(name string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return os.Getenv(strings.ToLower(name))
+}
+
+func parseProxyURL(configured, env string) (*url.URL, error) {
+	s := configured
+	if s == "" {
+		s = env
+	}
+	if s == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		// Like Go, accept a bare host:port.
+		u, err = url.Parse("http://" + s)
+	}
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q", redactURL(s))
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	return u, nil
+}
+
+// Proxy is an http.Transport Proxy function. Loopback addresses and hosts
+// matching NoProxy are reached directly.
+func (u *UpstreamProxy) Proxy(req *http.Request) (*url.URL, error) {
+	proxy := u.HTTP
+	if req.URL.Scheme == "https" {
+		proxy = u.HTTPS
+	}
+	if proxy == nil || u.bypass(req.URL.Hostname()) {
+		return nil, nil
+	}
+	return proxy, nil
+}
+
+// bypass reports whether host should be reached directly. NoProxy entries
+// may be "*", an IP address, a CIDR, or a domain, which also matches its
+// subdomains (with or without a leading dot).
+func (u *UpstreamProxy) bypass(host string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	if host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return true
+	}
+	for _, entry := range u.NoProxy {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		switch {
+		case entry == "*":
+			return true
+		case ip != nil:
+			if _, n, err := net.ParseCIDR(entry); err == nil && n.Contains(ip) {
+				return true
+			}
+			if ip.Equal(net.ParseIP(entry)) {
+				return true
+			}
+		default:
+			domain := strings.TrimPrefix(entry, ".")
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// String describes the proxy for logs, hiding any credentials.
+func (u *UpstreamProxy) String() string {
+	describe := func(p *url.URL) string {
+		if p == nil {
+			return "direct"
+		}
+		return p.Redacted()
+	}
+	return fmt.Sprintf("http=%s https=%s no_proxy=%s", describe(u.HTTP), describe(u.HTTPS), strings.Join(u.NoProxy, ","))
+}
@@ -83,35 +83,93 @@ func (m *Migrator) PendingMigrations(ctx context.Context) ([]string, error) {
 
 // Migrate runs all pending up migrations.
 func (m *Migrator) Migrate(ctx context.Context) error {
+	_, err := m.Apply(ctx)
+	return err
+}
+
+// Apply runs all pending migrations like Migrate, returning the names of
+// those applied (including any applied before a failure).
+func (m *Migrator) Apply(ctx context.Context) ([]string, error) {
 	executor, ok := m.db.(MigrationExecutor)
 	if !ok {
-		return fmt.Errorf("store does not support migrations")
+		return nil, fmt.Errorf("store does not support migrations")
 	}
 
 	if err := executor.EnsureMigrationsTable(ctx); err != nil {
-		return fmt.Errorf("ensuring migrations table: %w", err)
+		return nil, fmt.Errorf("ensuring migrations table: %w", err)
 	}
 
 	pending, err := m.PendingMigrations(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	migFS, dir := m.migrations()
 
+	var applied []string
 	for _, name := range pending {
 		filename := name + ".up.sql"
 		data, err := fs.ReadFile(migFS, dir+"/"+filename)
 		if err != nil {
-			return fmt.Errorf("reading migration %s: %w", filename, err)
+			return applied, fmt.Errorf("reading migration %s: %w", filename, err)
 		}
 
 		if err := executor.RunMigration(ctx, name, string(data)); err != nil {
-			return fmt.Errorf("running migration %s: %w", name, err)
+			return applied, fmt.Errorf("running migration %s: %w", name, err)
+		}
+		applied = append(applied, name)
+	}
+
+	return applied, nil
+}
+
+// Rollback runs the down migrations for the last steps applied migrations,
+// newest first, and returns the names rolled back.
+func (m *Migrator) Rollback(ctx context.Context, steps int) ([]string, error) {
+	executor, ok := m.db.(MigrationExecutor)
+	if !ok {
+		return nil, fmt.Errorf("store does not support migrations")
+	}
+	if steps <= 0 {
+		return nil, fmt.Errorf("steps must be positive")
+	}
+
+	applied, err := executor.AppliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(applied)
+	if steps > len(applied) {
+		return nil, fmt.Errorf("cannot roll back %d migration(s): only %d applied", steps, len(applied))
+	}
+
+	migFS, dir := m.migrations()
+
+	var rolledBack []string
+	for i := len(applied) - 1; i >= len(applied)-steps; i-- {
+		name := applied[i]
+		filename := name + ".down.sql"
+		data, err := fs.ReadFile(migFS, dir+"/"+filename)
+		if err != nil {
+			return rolledBack, fmt.Errorf("reading migration %s: %w", filename, err)
+		}
+
+		if err := executor.RollbackMigration(ctx, name, string(data)); err != nil {
+			return rolledBack, fmt.Errorf("rolling back migration %s: %w", name, err)
 		}
+		rolledBack = append(rolledBack, name)
 	}
 
-	return nil
+	return rolledBack, nil
+}
+
+// Redo rolls back the last steps migrations and re-applies them.
+func (m *Migrator) Redo(ctx context.Context, steps int) ([]string, error) {
+	rolledBack, err := m.Rollback(ctx, steps)
+	if err != nil {
+		return rolledBack, err
+	}
+	return rolledBack, m.Migrate(ctx)
 }
 
 // Status returns the status of all known migrations.
@@ -165,4 +223,5 @@ type MigrationExecutor interface {
 	EnsureMigrationsTable(ctx context.Context) error
 	AppliedMigrations(ctx context.Context) ([]string, error)
 	RunMigration(ctx context.Context, name, sql string) error
+	RollbackMigration(ctx context.Context, name, sql string) error
 }
@@ -0,0 +1,2 @@
+DELETE FROM audit_log WHERE user_id IS NULL;
+ALTER TABLE audit_log ALTER COLUMN user_id SET NOT NULL;
@@ -0,0 +1,3 @@
+-- Events that are not attributable to a ghp user (e.g. inbound webhooks)
+-- are recorded with a NULL user_id.
+ALTER TABLE audit_log ALTER COLUMN user_id DROP NOT NULL;
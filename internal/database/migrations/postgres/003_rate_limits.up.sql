@@ -0,0 +1,7 @@
+-- Per-key fixed-window request counters, shared by every ghp replica using
+-- this database. window_start is the Unix time the current window began.
+CREATE TABLE rate_limits (
+    key TEXT PRIMARY KEY,
+    window_start BIGINT NOT NULL,
+    count BIGINT NOT NULL DEFAULT 0
+);
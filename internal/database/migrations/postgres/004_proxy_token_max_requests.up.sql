@@ -0,0 +1,3 @@
+-- Optional per-token request budget: once a token has served max_requests
+-- requests it is revoked. Zero means unlimited.
+ALTER TABLE proxy_tokens ADD COLUMN max_requests BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,7 @@
+-- Indexes for the remaining hot filters: audit log queries by token and
+-- repository, and sweeps of proxy tokens by expiry. audit_log(user_id),
+-- audit_log(timestamp), proxy_tokens(user_id) and proxy_tokens(token_hash)
+-- are indexed by 001_initial.
+CREATE INDEX idx_audit_log_proxy_token_id ON audit_log(proxy_token_id);
+CREATE INDEX idx_audit_log_repository ON audit_log(repository);
+CREATE INDEX idx_proxy_tokens_expires_at ON proxy_tokens(expires_at);
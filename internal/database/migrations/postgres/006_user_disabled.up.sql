@@ -0,0 +1,2 @@
+-- Disabled users keep their history, but the server revokes their tokens.
+ALTER TABLE users ADD COLUMN disabled_at TIMESTAMPTZ;
@@ -0,0 +1 @@
+ALTER TABLE proxy_tokens DROP COLUMN description;
@@ -0,0 +1,2 @@
+-- Optional free-text note on why a token exists. Informational only.
+ALTER TABLE proxy_tokens ADD COLUMN description TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,16 @@
+-- Browser and CLI sessions, so they survive restarts and are shared by every
+-- replica. Only a SHA-256 hash of the session token is stored. There is no
+-- foreign key to users: purging a user deletes their sessions explicitly.
+CREATE TABLE sessions (
+    token_hash TEXT PRIMARY KEY,
+    user_id UUID NOT NULL,
+    username TEXT NOT NULL,
+    role TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    last_used_at TIMESTAMPTZ NOT NULL,
+    role_checked_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idx_sessions_user_id ON sessions(user_id);
+CREATE INDEX idx_sessions_expires_at ON sessions(expires_at);
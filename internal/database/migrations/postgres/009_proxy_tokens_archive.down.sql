@@ -0,0 +1,9 @@
+-- Entries for archived tokens lose their token ID, as they would have had the
+-- tokens been deleted under the foreign key.
+UPDATE audit_log SET proxy_token_id = NULL
+WHERE proxy_token_id IS NOT NULL AND proxy_token_id NOT IN (SELECT id FROM proxy_tokens);
+
+ALTER TABLE audit_log ADD CONSTRAINT audit_log_proxy_token_id_fkey
+    FOREIGN KEY (proxy_token_id) REFERENCES proxy_tokens(id) ON DELETE SET NULL;
+
+DROP TABLE IF EXISTS proxy_tokens_archive;
@@ -0,0 +1,26 @@
+-- Expired and revoked proxy tokens are moved here once tokens.archive_after
+-- has passed, keeping a record of them without slowing token lookups. The
+-- token hash is dropped: an archived token can never be used again. There is
+-- no foreign key to users: purging a user deletes their archive explicitly.
+CREATE TABLE proxy_tokens_archive (
+    id UUID PRIMARY KEY,
+    token_prefix TEXT NOT NULL,
+    user_id UUID NOT NULL,
+    repository TEXT NOT NULL,
+    scopes JSONB NOT NULL,
+    session_id TEXT NOT NULL DEFAULT '',
+    expires_at TIMESTAMPTZ NOT NULL,
+    revoked_at TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ,
+    request_count BIGINT NOT NULL DEFAULT 0,
+    max_requests BIGINT NOT NULL DEFAULT 0,
+    description TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL,
+    archived_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idx_proxy_tokens_archive_user_id ON proxy_tokens_archive(user_id);
+CREATE INDEX idx_proxy_tokens_archive_repository ON proxy_tokens_archive(repository);
+
+-- Audit entries keep the ID of an archived token.
+ALTER TABLE audit_log DROP CONSTRAINT IF EXISTS audit_log_proxy_token_id_fkey;
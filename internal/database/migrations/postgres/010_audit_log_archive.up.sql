@@ -0,0 +1,22 @@
+-- Audit entries older than logging.audit_retention are moved here when
+-- logging.audit_retention_action is archive, keeping the live table small.
+-- There are no foreign keys: purging a user handles their entries explicitly.
+CREATE TABLE audit_log_archive (
+    id UUID PRIMARY KEY,
+    timestamp TIMESTAMPTZ NOT NULL,
+    user_id UUID,
+    proxy_token_id UUID,
+    action TEXT NOT NULL,
+    method TEXT NOT NULL DEFAULT '',
+    path TEXT NOT NULL DEFAULT '',
+    repository TEXT NOT NULL DEFAULT '',
+    status_code INT NOT NULL DEFAULT 0,
+    duration_ms INT NOT NULL DEFAULT 0,
+    session_id TEXT NOT NULL DEFAULT '',
+    metadata JSONB,
+    created_at TIMESTAMPTZ NOT NULL,
+    archived_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idx_audit_log_archive_user_id ON audit_log_archive(user_id);
+CREATE INDEX idx_audit_log_archive_timestamp ON audit_log_archive(timestamp);
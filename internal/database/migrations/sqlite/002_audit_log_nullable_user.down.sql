@@ -0,0 +1,23 @@
+CREATE TABLE audit_log_old (
+    id TEXT PRIMARY KEY,
+    timestamp TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    proxy_token_id TEXT REFERENCES proxy_tokens(id) ON DELETE SET NULL,
+    action TEXT NOT NULL,
+    method TEXT NOT NULL DEFAULT '',
+    path TEXT NOT NULL DEFAULT '',
+    repository TEXT NOT NULL DEFAULT '',
+    status_code INTEGER NOT NULL DEFAULT 0,
+    duration_ms INTEGER NOT NULL DEFAULT 0,
+    session_id TEXT NOT NULL DEFAULT '',
+    metadata TEXT,
+    created_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now'))
+);
+
+INSERT INTO audit_log_old SELECT * FROM audit_log WHERE user_id IS NOT NULL;
+DROP TABLE audit_log;
+ALTER TABLE audit_log_old RENAME TO audit_log;
+
+CREATE INDEX idx_audit_log_user_id ON audit_log(user_id);
+CREATE INDEX idx_audit_log_timestamp ON audit_log(timestamp);
+CREATE INDEX idx_audit_log_action ON audit_log(action);
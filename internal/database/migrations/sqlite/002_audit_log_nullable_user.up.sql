@@ -0,0 +1,26 @@
+-- Events that are not attributable to a ghp user (e.g. inbound webhooks)
+-- are recorded with a NULL user_id. SQLite cannot alter a column's
+-- constraints in place, so the table is rebuilt.
+CREATE TABLE audit_log_new (
+    id TEXT PRIMARY KEY,
+    timestamp TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+    user_id TEXT REFERENCES users(id) ON DELETE CASCADE,
+    proxy_token_id TEXT REFERENCES proxy_tokens(id) ON DELETE SET NULL,
+    action TEXT NOT NULL,
+    method TEXT NOT NULL DEFAULT '',
+    path TEXT NOT NULL DEFAULT '',
+    repository TEXT NOT NULL DEFAULT '',
+    status_code INTEGER NOT NULL DEFAULT 0,
+    duration_ms INTEGER NOT NULL DEFAULT 0,
+    session_id TEXT NOT NULL DEFAULT '',
+    metadata TEXT,
+    created_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now'))
+);
+
+INSERT INTO audit_log_new SELECT * FROM audit_log;
+DROP TABLE audit_log;
+ALTER TABLE audit_log_new RENAME TO audit_log;
+
+CREATE INDEX idx_audit_log_user_id ON audit_log(user_id);
+CREATE INDEX idx_audit_log_timestamp ON audit_log(timestamp);
+CREATE INDEX idx_audit_log_action ON audit_log(action);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_proxy_tokens_expires_at;
+DROP INDEX IF EXISTS idx_audit_log_repository;
+DROP INDEX IF EXISTS idx_audit_log_proxy_token_id;
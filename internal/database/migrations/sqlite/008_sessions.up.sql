@@ -0,0 +1,15 @@
+-- Browser and CLI sessions, so they survive restarts and are shared by every
+-- replica. Only a SHA-256 hash of the session token is stored. There is no
+-- foreign key to users: purging a user deletes their sessions explicitly.
+CREATE TABLE sessions (
+    token_hash TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    username TEXT NOT NULL,
+    role TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    expires_at TEXT NOT NULL,
+    last_used_at TEXT NOT NULL,
+    role_checked_at TEXT NOT NULL
+);
+
+CREATE INDEX idx_sessions_user_id ON sessions(user_id);
@@ -0,0 +1,32 @@
+-- Entries for archived tokens lose their token ID, as they would have had the
+-- tokens been deleted under the foreign key.
+UPDATE audit_log SET proxy_token_id = NULL
+WHERE proxy_token_id IS NOT NULL AND proxy_token_id NOT IN (SELECT id FROM proxy_tokens);
+
+CREATE TABLE audit_log_old (
+    id TEXT PRIMARY KEY,
+    timestamp TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+    user_id TEXT REFERENCES users(id) ON DELETE CASCADE,
+    proxy_token_id TEXT REFERENCES proxy_tokens(id) ON DELETE SET NULL,
+    action TEXT NOT NULL,
+    method TEXT NOT NULL DEFAULT '',
+    path TEXT NOT NULL DEFAULT '',
+    repository TEXT NOT NULL DEFAULT '',
+    status_code INTEGER NOT NULL DEFAULT 0,
+    duration_ms INTEGER NOT NULL DEFAULT 0,
+    session_id TEXT NOT NULL DEFAULT '',
+    metadata TEXT,
+    created_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now'))
+);
+
+INSERT INTO audit_log_old SELECT * FROM audit_log;
+DROP TABLE audit_log;
+ALTER TABLE audit_log_old RENAME TO audit_log;
+
+CREATE INDEX idx_audit_log_user_id ON audit_log(user_id);
+CREATE INDEX idx_audit_log_timestamp ON audit_log(timestamp);
+CREATE INDEX idx_audit_log_action ON audit_log(action);
+CREATE INDEX idx_audit_log_proxy_token_id ON audit_log(proxy_token_id);
+CREATE INDEX idx_audit_log_repository ON audit_log(repository);
+
+DROP TABLE IF EXISTS proxy_tokens_archive;
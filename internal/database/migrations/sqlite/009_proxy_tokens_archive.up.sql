@@ -0,0 +1,52 @@
+-- Expired and revoked proxy tokens are moved here once tokens.archive_after
+-- has passed, keeping a record of them without slowing token lookups. The
+-- token hash is dropped: an archived token can never be used again. There is
+-- no foreign key to users: purging a user deletes their archive explicitly.
+CREATE TABLE proxy_tokens_archive (
+    id TEXT PRIMARY KEY,
+    token_prefix TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    repository TEXT NOT NULL,
+    scopes TEXT NOT NULL,
+    session_id TEXT NOT NULL DEFAULT '',
+    expires_at TEXT NOT NULL,
+    revoked_at TEXT,
+    last_used_at TEXT,
+    request_count INTEGER NOT NULL DEFAULT 0,
+    max_requests INTEGER NOT NULL DEFAULT 0,
+    description TEXT NOT NULL DEFAULT '',
+    created_at TEXT NOT NULL,
+    archived_at TEXT NOT NULL
+);
+
+CREATE INDEX idx_proxy_tokens_archive_user_id ON proxy_tokens_archive(user_id);
+CREATE INDEX idx_proxy_tokens_archive_repository ON proxy_tokens_archive(repository);
+
+-- Audit entries keep the ID of an archived token, so the foreign key to
+-- proxy_tokens is dropped. SQLite cannot drop a constraint in place, so the
+-- table is rebuilt.
+CREATE TABLE audit_log_new (
+    id TEXT PRIMARY KEY,
+    timestamp TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+    user_id TEXT REFERENCES users(id) ON DELETE CASCADE,
+    proxy_token_id TEXT,
+    action TEXT NOT NULL,
+    method TEXT NOT NULL DEFAULT '',
+    path TEXT NOT NULL DEFAULT '',
+    repository TEXT NOT NULL DEFAULT '',
+    status_code INTEGER NOT NULL DEFAULT 0,
+    duration_ms INTEGER NOT NULL DEFAULT 0,
+    session_id TEXT NOT NULL DEFAULT '',
+    metadata TEXT,
+    created_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now'))
+);
+
+INSERT INTO audit_log_new SELECT * FROM audit_log;
+DROP TABLE audit_log;
+ALTER TABLE audit_log_new RENAME TO audit_log;
+
+CREATE INDEX idx_audit_log_user_id ON audit_log(user_id);
+CREATE INDEX idx_audit_log_timestamp ON audit_log(timestamp);
+CREATE INDEX idx_audit_log_action ON audit_log(action);
+CREATE INDEX idx_audit_log_proxy_token_id ON audit_log(proxy_token_id);
+CREATE INDEX idx_audit_log_repository ON audit_log(repository);
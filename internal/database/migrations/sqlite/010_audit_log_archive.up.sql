@@ -0,0 +1,22 @@
+-- Audit entries older than logging.audit_retention are moved here when
+-- logging.audit_retention_action is archive, keeping the live table small.
+-- There are no foreign keys: purging a user handles their entries explicitly.
+CREATE TABLE audit_log_archive (
+    id TEXT PRIMARY KEY,
+    timestamp TEXT NOT NULL,
+    user_id TEXT,
+    proxy_token_id TEXT,
+    action TEXT NOT NULL,
+    method TEXT NOT NULL DEFAULT '',
+    path TEXT NOT NULL DEFAULT '',
+    repository TEXT NOT NULL DEFAULT '',
+    status_code INTEGER NOT NULL DEFAULT 0,
+    duration_ms INTEGER NOT NULL DEFAULT 0,
+    session_id TEXT NOT NULL DEFAULT '',
+    metadata TEXT,
+    created_at TEXT NOT NULL,
+    archived_at TEXT NOT NULL
+);
+
+CREATE INDEX idx_audit_log_archive_user_id ON audit_log_archive(user_id);
+CREATE INDEX idx_audit_log_archive_timestamp ON audit_log_archive(timestamp);
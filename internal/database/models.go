@@ -3,19 +3,29 @@ package database
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 )
 
+// ErrSessionActive is returned by CreateSessionProxyToken when the session
+// already has an active token.
+var ErrSessionActive = errors.New("session already has an active token")
+
 // User represents a ghp user authenticated via GitHub OAuth.
 type User struct {
-	ID             string    `json:"id"`
-	GitHubID       int64     `json:"github_id"`
-	GitHubUsername  string    `json:"github_username"`
-	GitHubEmail    string    `json:"github_email"`
-	Role           string    `json:"role"`
-	CreatedAt      time.Time `json:"created_at"`
-	UpdatedAt      time.Time `json:"updated_at"`
+	ID             string `json:"id"`
+	GitHubID       int64  `json:"github_id"`
+	GitHubUsername string `json:"github_username"`
+	GitHubEmail    string `json:"github_email"`
+	Role           string `json:"role"`
+	// DisabledAt is set while the user is disabled; their tokens are revoked.
+	DisabledAt *time.Time `json:"disabled_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
 }
 
 // GitHubToken stores an encrypted GitHub OAuth token pair.
@@ -26,9 +36,11 @@ type GitHubToken struct {
 	RefreshToken          string    `json:"refresh_token"`
 	AccessTokenExpiresAt  time.Time `json:"access_token_expires_at"`
 	RefreshTokenExpiresAt time.Time `json:"refresh_token_expires_at"`
-	Scopes                string    `json:"scopes"`
-	CreatedAt             time.Time `json:"created_at"`
-	UpdatedAt             time.Time `json:"updated_at"`
+	// Scopes are the OAuth scopes GitHub reported granting, comma-separated.
+	// Empty when unknown (GitHub App user tokens carry no scopes).
+	Scopes    string    `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
 }
 
 // ProxyToken represents a ghp_ token issued to agents.
@@ -45,14 +57,39 @@ type ProxyToken struct {
 	RevokedAt     *time.Time      `json:"revoked_at,omitempty"`
 	LastUsedAt    *time.Time      `json:"last_used_at,omitempty"`
 	RequestCount  int64           `json:"request_count"`
+	MaxRequests   int64           `json:"max_requests,omitempty"` // Zero is unlimited.
+	Description   string          `json:"description,omitempty"`  // Free-text note; not enforced.
 	CreatedAt     time.Time       `json:"created_at"`
+
+	// Revoking is set by token resolution (not stored) when the token has
+	// been revoked but is still inside the configured revocation grace.
+	Revoking bool `json:"-"`
+}
+
+// ArchivedProxyToken is an expired or revoked proxy token moved out of the
+// live table by ArchiveProxyTokens. Its hash isn't kept.
+type ArchivedProxyToken struct {
+	ID           string          `json:"id"`
+	TokenPrefix  string          `json:"token_prefix"`
+	UserID       string          `json:"user_id"`
+	Repository   string          `json:"repository"`
+	Scopes       json.RawMessage `json:"scopes"`
+	SessionID    string          `json:"session_id"`
+	ExpiresAt    time.Time       `json:"expires_at"`
+	RevokedAt    *time.Time      `json:"revoked_at,omitempty"`
+	LastUsedAt   *time.Time      `json:"last_used_at,omitempty"`
+	RequestCount int64           `json:"request_count"`
+	MaxRequests  int64           `json:"max_requests,omitempty"`
+	Description  string          `json:"description,omitempty"`
+	CreatedAt    time.Time       `json:"created_at"`
+	ArchivedAt   time.Time       `json:"archived_at"`
 }
 
 // AuditEntry represents an entry in the audit log.
 type AuditEntry struct {
 	ID           string          `json:"id"`
 	Timestamp    time.Time       `json:"timestamp"`
-	UserID       string          `json:"user_id"`
+	UserID       string          `json:"user_id"` // Empty for events not tied to a user (e.g. webhooks).
 	ProxyTokenID *string         `json:"proxy_token_id,omitempty"`
 	Action       string          `json:"action"`
 	Method       string          `json:"method,omitempty"`
@@ -64,6 +101,23 @@ type AuditEntry struct {
 	Metadata     json.RawMessage `json:"metadata,omitempty"`
 }
 
+// auditPruneBatch is how many audit entries PruneAuditEntries removes per
+// statement, so pruning a large backlog never holds a long lock.
+const auditPruneBatch = 1000
+
+// Session is a browser or CLI login session. Only a hash of its token is
+// stored.
+type Session struct {
+	TokenHash     string
+	UserID        string
+	Username      string
+	Role          string
+	CreatedAt     time.Time
+	ExpiresAt     time.Time
+	LastUsedAt    time.Time
+	RoleCheckedAt time.Time
+}
+
 // Scopes represents a map of permission to access level.
 type Scopes map[string]string
 
@@ -89,6 +143,22 @@ func (s Scopes) HasPermission(permission, level string) bool {
 	return granted == level
 }
 
+// RepoTokenStats summarizes the proxy tokens issued for one repository.
+type RepoTokenStats struct {
+	Repository   string `json:"repository"`
+	ActiveTokens int64  `json:"active_tokens"`
+	// Requests is the total proxied through any of the repository's
+	// tokens, including expired and revoked ones.
+	Requests int64 `json:"requests"`
+}
+
+// PurgeResult counts the rows PurgeUser removed or anonymized.
+type PurgeResult struct {
+	ProxyTokens  int64 `json:"proxy_tokens"`
+	GitHubTokens int64 `json:"github_tokens"`
+	AuditEntries int64 `json:"audit_entries"`
+}
+
 // Store defines the database operations for ghp.
 type Store interface {
 	// Users
@@ -96,29 +166,78 @@ type Store interface {
 	GetUserByGitHubID(ctx context.Context, githubID int64) (*User, error)
 	GetUserByID(ctx context.Context, id string) (*User, error)
 	ListUsers(ctx context.Context) ([]*User, error)
+	ListUsersFiltered(ctx context.Context, filter UserFilter) ([]*User, error)
+	SetUserDisabled(ctx context.Context, id string, disabled bool) error
+	SetUserRole(ctx context.Context, id, role string) error
+	PurgeUser(ctx context.Context, id string, anonymizeAudit bool) (*PurgeResult, error)
 
 	// GitHub tokens
 	UpsertGitHubToken(ctx context.Context, token *GitHubToken) error
 	GetGitHubToken(ctx context.Context, userID string) (*GitHubToken, error)
 	GetGitHubTokenByID(ctx context.Context, id string) (*GitHubToken, error)
+	ListGitHubTokens(ctx context.Context) ([]*GitHubToken, error)
+	UpdateGitHubTokenScopes(ctx context.Context, id, scopes string) error
 
 	// Proxy tokens
 	CreateProxyToken(ctx context.Context, token *ProxyToken) error
+	CreateSessionProxyToken(ctx context.Context, token *ProxyToken, replace bool) ([]string, error)
 	GetProxyTokenByHash(ctx context.Context, hash string) (*ProxyToken, error)
 	GetProxyTokenByID(ctx context.Context, id string) (*ProxyToken, error)
 	ListProxyTokens(ctx context.Context, userID string) ([]*ProxyToken, error)
 	ListAllProxyTokens(ctx context.Context) ([]*ProxyToken, error)
 	RevokeProxyToken(ctx context.Context, id string) error
+	RevokeAllProxyTokens(ctx context.Context, userID string) (int64, error)
 	UpdateProxyTokenUsage(ctx context.Context, id string) error
+	IncrementAndCheckUsage(ctx context.Context, id string, maxRequests int64) (int64, bool, error)
+	RefundUsage(ctx context.Context, id string) error
+	CountActiveProxyTokensByUser(ctx context.Context) (map[string]int64, error)
+	TokenStatsByRepo(ctx context.Context) ([]*RepoTokenStats, error)
+	ListOrphanedProxyTokens(ctx context.Context) ([]*ProxyToken, error)
+	ArchiveProxyTokens(ctx context.Context, before time.Time) (int64, error)
+	ListArchivedProxyTokens(ctx context.Context, filter ArchiveFilter) ([]*ArchivedProxyToken, error)
 
 	// Audit log
+	SetMaxMetadataBytes(n int)
 	CreateAuditEntry(ctx context.Context, entry *AuditEntry) error
+	UpdateAuditEntryMetadata(ctx context.Context, id string, metadata json.RawMessage) error
 	ListAuditEntries(ctx context.Context, filter AuditFilter) ([]*AuditEntry, error)
+	GetAuditEntryByID(ctx context.Context, id string) (*AuditEntry, error)
+	PruneAuditEntries(ctx context.Context, before time.Time, archive bool) (int64, error)
+
+	// Sessions
+	CreateSession(ctx context.Context, session *Session) error
+	GetSession(ctx context.Context, tokenHash string) (*Session, error)
+	ListUserSessions(ctx context.Context, userID string) ([]*Session, error)
+	TouchSession(ctx context.Context, tokenHash string, lastUsedAt time.Time) error
+	SetUserSessionsRole(ctx context.Context, userID, role string, checkedAt time.Time) error
+	DeleteSession(ctx context.Context, tokenHash string) error
+	DeleteUserSessions(ctx context.Context, userID string) (int64, error)
+	DeleteExpiredSessions(ctx context.Context, now time.Time) (int64, error)
+
+	// Rate limits
+	IncrementRateLimit(ctx context.Context, key string, windowStart time.Time) (int64, error)
+	DeleteExpiredRateLimits(ctx context.Context, before time.Time) (int64, error)
 
 	// Lifecycle
 	Close() error
 }
 
+// UserFilter defines criteria for listing users.
+type UserFilter struct {
+	// Query matches a case-insensitive substring of the username or email.
+	Query  string
+	Limit  int
+	Offset int
+}
+
+// ArchiveFilter defines criteria for listing archived proxy tokens.
+type ArchiveFilter struct {
+	UserID     string
+	Repository string
+	Limit      int
+	Offset     int
+}
+
 // AuditFilter defines criteria for querying the audit log.
 type AuditFilter struct {
 	UserID     string
@@ -126,6 +245,64 @@ type AuditFilter struct {
 	TokenID    string
 	Action     string
 	StatusCode int
-	Limit      int
-	Offset     int
+	// StatusCodeMin and StatusCodeMax bound the status code inclusively;
+	// zero leaves that end of the range open.
+	StatusCodeMin int
+	StatusCodeMax int
+	Limit         int
+	Offset        int
+
+	// Cursor, when set, selects entries strictly older than the entry it
+	// was derived from (see AuditCursor). It takes precedence over Offset
+	// and avoids the O(N) scan OFFSET incurs on large tables.
+	Cursor string
+}
+
+// AuditCursor returns an opaque keyset cursor pointing just past the given
+// entry, for use as AuditFilter.Cursor when fetching the next page.
+func AuditCursor(e *AuditEntry) string {
+	raw := e.Timestamp.UTC().Format(time.RFC3339Nano) + "|" + e.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// ParseAuditCursor decodes a cursor produced by AuditCursor.
+func ParseAuditCursor(cursor string) (timestamp, id string, err error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid cursor: %w", err)
+	}
+	timestamp, id, ok := strings.Cut(string(raw), "|")
+	if !ok || id == "" {
+		return "", "", fmt.Errorf("invalid cursor")
+	}
+	if _, err := time.Parse(time.RFC3339Nano, timestamp); err != nil {
+		return "", "", fmt.Errorf("invalid cursor timestamp: %w", err)
+	}
+	return timestamp, id, nil
+}
+
+// capMetadata returns metadata unchanged if it fits in max bytes (or max is
+// zero). Otherwise it returns a marker, still valid JSON, recording the
+// original size and as much of the original text as fits.
+func capMetadata(metadata json.RawMessage, max int) json.RawMessage {
+	if max <= 0 || len(metadata) <= max {
+		return metadata
+	}
+	marker := func(preview string) json.RawMessage {
+		b, _ := json.Marshal(map[string]interface{}{
+			"truncated":      true,
+			"original_bytes": len(metadata),
+			"preview":        preview,
+		})
+		return b
+	}
+	// Escaping can grow the preview, so shrink it until the marker fits.
+	for n := max - len(marker("")); n > 0; {
+		m := marker(strings.ToValidUTF8(string(metadata[:n]), ""))
+		if len(m) <= max {
+			return m
+		}
+		n -= len(m) - max
+	}
+	return marker("")
 }
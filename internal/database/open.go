@@ -1,15 +1,24 @@
 package database
 
-import "fmt"
+import (
+	"fmt"
 
-// Open creates a Store for the given driver and DSN.
-func Open(driver, dsn string) (Store, error) {
-	switch driver {
+	"github.com/goodtune/ghp/internal/config"
+)
+
+// Open creates a Store for the configured driver and DSN.
+func Open(cfg config.DatabaseConfig) (Store, error) {
+	switch cfg.Driver {
 	case "sqlite":
-		return NewSQLiteStore(dsn)
+		return NewSQLiteStore(cfg.DSN)
 	case "postgres":
-		return nil, fmt.Errorf("postgres driver not yet implemented — use sqlite for development")
+		return NewPostgresStore(cfg.DSN, PoolConfig{
+			MaxOpenConns:    cfg.MaxOpenConns,
+			MaxIdleConns:    cfg.MaxIdleConns,
+			ConnMaxLifetime: cfg.ConnMaxLifetime,
+			ConnMaxIdleTime: cfg.ConnMaxIdleTime,
+		})
 	default:
-		return nil, fmt.Errorf("unsupported database driver: %s", driver)
+		return nil, fmt.Errorf("unsupported database driver: %s", cfg.Driver)
 	}
 }
@@ -0,0 +1,1136 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// PoolConfig sizes a PostgresStore's connection pool. Zero values keep the
+// database/sql defaults: unlimited open connections, two idle connections,
+// and connections reused indefinitely.
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+}
+
+// PostgresStore implements Store using PostgreSQL.
+type PostgresStore struct {
+	db *sql.DB
+
+	// maxMetadataBytes caps audit entry metadata; see capMetadata.
+	maxMetadataBytes int
+}
+
+// NewPostgresStore connects to the PostgreSQL database at dsn, a URL or
+// key=value connection string.
+func NewPostgresStore(dsn string, pool PoolConfig) (*PostgresStore, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("opening postgres: %w", err)
+	}
+	db.SetMaxOpenConns(pool.MaxOpenConns)
+	if pool.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(pool.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(pool.ConnMaxIdleTime)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("opening postgres: %w", err)
+	}
+
+	return &PostgresStore{db: db}, nil
+}
+
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
+
+// isUUID reports whether id can name a row. IDs are UUID columns in
+// PostgreSQL, which rejects any other string outright; callers treat such
+// IDs as not found, as SQLite does.
+func isUUID(id string) bool {
+	return uuid.Validate(id) == nil
+}
+
+// --- Migration support ---
+
+func (s *PostgresStore) EnsureMigrationsTable(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			name TEXT PRIMARY KEY,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)
+	`)
+	return err
+}
+
+func (s *PostgresStore) AppliedMigrations(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT name FROM schema_migrations ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// RunMigration applies a migration in a transaction. The SQL is sent without
+// parameters, so the driver uses the simple protocol and a migration may hold
+// several statements.
+func (s *PostgresStore) RunMigration(ctx context.Context, name, sqlStr string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, sqlStr); err != nil {
+		return fmt.Errorf("executing migration SQL: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (name) VALUES ($1)`, name); err != nil {
+		return fmt.Errorf("recording migration: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStore) RollbackMigration(ctx context.Context, name, sqlStr string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, sqlStr); err != nil {
+		return fmt.Errorf("executing rollback SQL: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE name = $1`, name); err != nil {
+		return fmt.Errorf("removing migration record: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// --- Users ---
+
+const pgUserColumns = `id, github_id, github_username, github_email, role, disabled_at, created_at, updated_at`
+
+func (s *PostgresStore) UpsertUser(ctx context.Context, user *User) error {
+	if user.ID == "" {
+		user.ID = uuid.New().String()
+	}
+	now := time.Now().UTC()
+	// RETURNING yields the existing row's ID, role and disabled state on
+	// conflict.
+	var disabledAt sql.NullTime
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO users (id, github_id, github_username, github_email, role, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $6)
+		ON CONFLICT (github_id) DO UPDATE SET
+			github_username = excluded.github_username,
+			github_email = excluded.github_email,
+			updated_at = excluded.updated_at
+		RETURNING id, role, disabled_at, created_at, updated_at
+	`, user.ID, user.GitHubID, user.GitHubUsername, user.GitHubEmail, user.Role, now,
+	).Scan(&user.ID, &user.Role, &disabledAt, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	user.DisabledAt = nil
+	if disabledAt.Valid {
+		user.DisabledAt = &disabledAt.Time
+	}
+	return nil
+}
+
+func scanPgUser(scan func(dest ...any) error) (*User, error) {
+	u := &User{}
+	var disabledAt sql.NullTime
+	if err := scan(&u.ID, &u.GitHubID, &u.GitHubUsername, &u.GitHubEmail, &u.Role, &disabledAt, &u.CreatedAt, &u.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if disabledAt.Valid {
+		u.DisabledAt = &disabledAt.Time
+	}
+	return u, nil
+}
+
+func scanPgUserRows(rows *sql.Rows) ([]*User, error) {
+	var users []*User
+	for rows.Next() {
+		u, err := scanPgUser(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (s *PostgresStore) GetUserByGitHubID(ctx context.Context, githubID int64) (*User, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+pgUserColumns+` FROM users WHERE github_id = $1`, githubID)
+	u, err := scanPgUser(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return u, err
+}
+
+func (s *PostgresStore) GetUserByID(ctx context.Context, id string) (*User, error) {
+	if !isUUID(id) {
+		return nil, nil
+	}
+	row := s.db.QueryRowContext(ctx, `SELECT `+pgUserColumns+` FROM users WHERE id = $1`, id)
+	u, err := scanPgUser(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return u, err
+}
+
+func (s *PostgresStore) ListUsers(ctx context.Context) ([]*User, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+pgUserColumns+` FROM users ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanPgUserRows(rows)
+}
+
+// ListUsersFiltered returns users matching filter, oldest first.
+func (s *PostgresStore) ListUsersFiltered(ctx context.Context, filter UserFilter) ([]*User, error) {
+	query := `SELECT ` + pgUserColumns + ` FROM users`
+	var args []any
+	if filter.Query != "" {
+		args = append(args, "%"+escapeLike(strings.ToLower(filter.Query))+"%")
+		query += ` WHERE LOWER(github_username) LIKE $1 ESCAPE '\' OR LOWER(github_email) LIKE $1 ESCAPE '\'`
+	}
+	query += " ORDER BY created_at, id"
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+		if filter.Offset > 0 {
+			args = append(args, filter.Offset)
+			query += fmt.Sprintf(" OFFSET $%d", len(args))
+		}
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("listing users: %w", err)
+	}
+	defer rows.Close()
+	return scanPgUserRows(rows)
+}
+
+// SetUserRole changes a user's role ("user" or "admin").
+func (s *PostgresStore) SetUserRole(ctx context.Context, id, role string) error {
+	if !isUUID(id) {
+		return fmt.Errorf("user not found")
+	}
+	result, err := s.db.ExecContext(ctx,
+		`UPDATE users SET role = $1, updated_at = NOW() WHERE id = $2`, role, id)
+	if err != nil {
+		return fmt.Errorf("updating user: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("user not found")
+	}
+	return nil
+}
+
+// SetUserDisabled disables or re-enables a user. The tokens of a disabled
+// user are revoked by the server's token reconciler.
+func (s *PostgresStore) SetUserDisabled(ctx context.Context, id string, disabled bool) error {
+	if !isUUID(id) {
+		return fmt.Errorf("user not found")
+	}
+	result, err := s.db.ExecContext(ctx,
+		`UPDATE users SET disabled_at = CASE WHEN $1 THEN NOW() END, updated_at = NOW() WHERE id = $2`, disabled, id)
+	if err != nil {
+		return fmt.Errorf("updating user: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("user not found")
+	}
+	return nil
+}
+
+// PurgeUser erases a user in one transaction: their proxy tokens (archived
+// too), GitHub token and user row are deleted. Their audit entries are kept
+// with no user or session when anonymizeAudit is set, and deleted otherwise.
+func (s *PostgresStore) PurgeUser(ctx context.Context, id string, anonymizeAudit bool) (*PurgeResult, error) {
+	if !isUUID(id) {
+		return nil, fmt.Errorf("user not found")
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	exec := func(query string) (int64, error) {
+		result, err := tx.ExecContext(ctx, query, id)
+		if err != nil {
+			return 0, err
+		}
+		return result.RowsAffected()
+	}
+
+	res := &PurgeResult{}
+	// Audit entries go first: deleting the user would cascade to them.
+	auditSQL := `DELETE FROM %s WHERE user_id = $1`
+	if anonymizeAudit {
+		auditSQL = `UPDATE %s SET user_id = NULL, session_id = '' WHERE user_id = $1`
+	}
+	// The archived audit log is treated the same way.
+	for _, table := range []string{"audit_log", "audit_log_archive"} {
+		n, err := exec(fmt.Sprintf(auditSQL, table))
+		if err != nil {
+			return nil, fmt.Errorf("purging %s entries: %w", table, err)
+		}
+		res.AuditEntries += n
+		// Remaining entries (those kept anonymized, and ones not attributed
+		// to a user) lose the IDs of the tokens about to go.
+		if _, err = exec(`UPDATE ` + table + ` SET proxy_token_id = NULL WHERE proxy_token_id IN
+			(SELECT id FROM proxy_tokens WHERE user_id = $1 UNION ALL SELECT id FROM proxy_tokens_archive WHERE user_id = $1)`); err != nil {
+			return nil, fmt.Errorf("unlinking %s entries: %w", table, err)
+		}
+	}
+	if res.ProxyTokens, err = exec(`DELETE FROM proxy_tokens WHERE user_id = $1`); err != nil {
+		return nil, fmt.Errorf("deleting proxy tokens: %w", err)
+	}
+	archived, err := exec(`DELETE FROM proxy_tokens_archive WHERE user_id = $1`)
+	if err != nil {
+		return nil, fmt.Errorf("deleting archived proxy tokens: %w", err)
+	}
+	res.ProxyTokens += archived
+	if res.GitHubTokens, err = exec(`DELETE FROM github_tokens WHERE user_id = $1`); err != nil {
+		return nil, fmt.Errorf("deleting GitHub token: %w", err)
+	}
+	if _, err = exec(`DELETE FROM sessions WHERE user_id = $1`); err != nil {
+		return nil, fmt.Errorf("deleting sessions: %w", err)
+	}
+	n, err := exec(`DELETE FROM users WHERE id = $1`)
+	if err != nil {
+		return nil, fmt.Errorf("deleting user: %w", err)
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("user not found")
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// --- GitHub Tokens ---
+
+const pgGitHubTokenColumns = `id, user_id, access_token, refresh_token, access_token_expires_at, refresh_token_expires_at, scopes, created_at, updated_at`
+
+func scanPgGitHubToken(scan func(dest ...any) error) (*GitHubToken, error) {
+	t := &GitHubToken{}
+	if err := scan(&t.ID, &t.UserID, &t.AccessToken, &t.RefreshToken, &t.AccessTokenExpiresAt,
+		&t.RefreshTokenExpiresAt, &t.Scopes, &t.CreatedAt, &t.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (s *PostgresStore) UpsertGitHubToken(ctx context.Context, token *GitHubToken) error {
+	if token.ID == "" {
+		token.ID = uuid.New().String()
+	}
+	// On conflict the existing row keeps its ID; report it back, as callers
+	// reference the token by ID.
+	return s.db.QueryRowContext(ctx, `
+		INSERT INTO github_tokens (id, user_id, access_token, refresh_token, access_token_expires_at, refresh_token_expires_at, scopes, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NOW(), NOW())
+		ON CONFLICT (user_id) DO UPDATE SET
+			access_token = excluded.access_token,
+			refresh_token = excluded.refresh_token,
+			access_token_expires_at = excluded.access_token_expires_at,
+			refresh_token_expires_at = excluded.refresh_token_expires_at,
+			scopes = excluded.scopes,
+			updated_at = excluded.updated_at
+		RETURNING id
+	`, token.ID, token.UserID, token.AccessToken, token.RefreshToken,
+		token.AccessTokenExpiresAt, token.RefreshTokenExpiresAt, token.Scopes,
+	).Scan(&token.ID)
+}
+
+func (s *PostgresStore) GetGitHubToken(ctx context.Context, userID string) (*GitHubToken, error) {
+	if !isUUID(userID) {
+		return nil, nil
+	}
+	row := s.db.QueryRowContext(ctx,
+		`SELECT `+pgGitHubTokenColumns+` FROM github_tokens WHERE user_id = $1 ORDER BY updated_at DESC LIMIT 1`, userID)
+	t, err := scanPgGitHubToken(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return t, err
+}
+
+func (s *PostgresStore) GetGitHubTokenByID(ctx context.Context, id string) (*GitHubToken, error) {
+	if !isUUID(id) {
+		return nil, nil
+	}
+	row := s.db.QueryRowContext(ctx, `SELECT `+pgGitHubTokenColumns+` FROM github_tokens WHERE id = $1`, id)
+	t, err := scanPgGitHubToken(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return t, err
+}
+
+// ListGitHubTokens returns every stored GitHub token, still encrypted, for
+// maintenance commands.
+func (s *PostgresStore) ListGitHubTokens(ctx context.Context) ([]*GitHubToken, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+pgGitHubTokenColumns+` FROM github_tokens ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []*GitHubToken
+	for rows.Next() {
+		t, err := scanPgGitHubToken(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// UpdateGitHubTokenScopes records the OAuth scopes GitHub reports for a token.
+func (s *PostgresStore) UpdateGitHubTokenScopes(ctx context.Context, id, scopes string) error {
+	if !isUUID(id) {
+		return fmt.Errorf("github token not found")
+	}
+	result, err := s.db.ExecContext(ctx, `UPDATE github_tokens SET scopes = $1, updated_at = NOW() WHERE id = $2`, scopes, id)
+	if err != nil {
+		return fmt.Errorf("updating github token scopes: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("github token not found")
+	}
+	return nil
+}
+
+// --- Proxy Tokens ---
+
+const pgProxyTokenColumns = `id, token_hash, token_prefix, user_id, github_token_id, repository, scopes, session_id, expires_at, revoked_at, last_used_at, request_count, max_requests, description, created_at`
+
+func (s *PostgresStore) CreateProxyToken(ctx context.Context, token *ProxyToken) error {
+	if token.ID == "" {
+		token.ID = uuid.New().String()
+	}
+	scopesJSON, err := json.Marshal(token.Scopes)
+	if err != nil {
+		return fmt.Errorf("marshaling scopes: %w", err)
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO proxy_tokens (id, token_hash, token_prefix, user_id, github_token_id, repository, scopes, session_id, expires_at, request_count, max_requests, description, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, 0, $10, $11, NOW())
+	`, token.ID, token.TokenHash, token.TokenPrefix, token.UserID, token.GitHubTokenID,
+		token.Repository, string(scopesJSON), token.SessionID, token.ExpiresAt, token.MaxRequests, token.Description)
+	return err
+}
+
+// CreateSessionProxyToken stores token unless its user already has an
+// active token with the same session ID, in which case it returns
+// ErrSessionActive; with replace, those tokens are revoked instead and their
+// IDs returned. The check and the insert share a transaction, so concurrent
+// calls for one session can't both succeed.
+func (s *PostgresStore) CreateSessionProxyToken(ctx context.Context, token *ProxyToken, replace bool) ([]string, error) {
+	if token.ID == "" {
+		token.ID = uuid.New().String()
+	}
+	scopesJSON, err := json.Marshal(token.Scopes)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling scopes: %w", err)
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Locking the user's row serializes concurrent calls for their sessions.
+	var locked string
+	if err := tx.QueryRowContext(ctx, `SELECT id FROM users WHERE id = $1 FOR UPDATE`, token.UserID).Scan(&locked); err != nil {
+		return nil, fmt.Errorf("locking user: %w", err)
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT id FROM proxy_tokens WHERE user_id = $1 AND session_id = $2 AND revoked_at IS NULL AND expires_at > NOW()`,
+		token.UserID, token.SessionID)
+	if err != nil {
+		return nil, fmt.Errorf("listing session tokens: %w", err)
+	}
+	var active []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		active = append(active, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(active) > 0 && !replace {
+		return nil, ErrSessionActive
+	}
+
+	for _, id := range active {
+		if _, err := tx.ExecContext(ctx, `UPDATE proxy_tokens SET revoked_at = NOW() WHERE id = $1`, id); err != nil {
+			return nil, fmt.Errorf("revoking token %s: %w", id, err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO proxy_tokens (id, token_hash, token_prefix, user_id, github_token_id, repository, scopes, session_id, expires_at, request_count, max_requests, description, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, 0, $10, $11, NOW())
+	`, token.ID, token.TokenHash, token.TokenPrefix, token.UserID, token.GitHubTokenID,
+		token.Repository, string(scopesJSON), token.SessionID, token.ExpiresAt, token.MaxRequests, token.Description); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return active, nil
+}
+
+func scanPgProxyToken(scan func(dest ...any) error) (*ProxyToken, error) {
+	t := &ProxyToken{}
+	var scopes []byte
+	var revokedAt, lastUsedAt sql.NullTime
+	err := scan(&t.ID, &t.TokenHash, &t.TokenPrefix, &t.UserID, &t.GitHubTokenID, &t.Repository, &scopes,
+		&t.SessionID, &t.ExpiresAt, &revokedAt, &lastUsedAt, &t.RequestCount, &t.MaxRequests, &t.Description, &t.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	t.Scopes = json.RawMessage(scopes)
+	if revokedAt.Valid {
+		t.RevokedAt = &revokedAt.Time
+	}
+	if lastUsedAt.Valid {
+		t.LastUsedAt = &lastUsedAt.Time
+	}
+	return t, nil
+}
+
+func scanPgProxyTokenRows(rows *sql.Rows) ([]*ProxyToken, error) {
+	var tokens []*ProxyToken
+	for rows.Next() {
+		t, err := scanPgProxyToken(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *PostgresStore) GetProxyTokenByHash(ctx context.Context, hash string) (*ProxyToken, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+pgProxyTokenColumns+` FROM proxy_tokens WHERE token_hash = $1`, hash)
+	t, err := scanPgProxyToken(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return t, err
+}
+
+func (s *PostgresStore) GetProxyTokenByID(ctx context.Context, id string) (*ProxyToken, error) {
+	if !isUUID(id) {
+		return nil, nil
+	}
+	row := s.db.QueryRowContext(ctx, `SELECT `+pgProxyTokenColumns+` FROM proxy_tokens WHERE id = $1`, id)
+	t, err := scanPgProxyToken(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return t, err
+}
+
+func (s *PostgresStore) ListProxyTokens(ctx context.Context, userID string) ([]*ProxyToken, error) {
+	if !isUUID(userID) {
+		return nil, nil
+	}
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+pgProxyTokenColumns+` FROM proxy_tokens WHERE user_id = $1 ORDER BY created_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanPgProxyTokenRows(rows)
+}
+
+func (s *PostgresStore) ListAllProxyTokens(ctx context.Context) ([]*ProxyToken, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+pgProxyTokenColumns+` FROM proxy_tokens ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanPgProxyTokenRows(rows)
+}
+
+func (s *PostgresStore) RevokeProxyToken(ctx context.Context, id string) error {
+	if !isUUID(id) {
+		return fmt.Errorf("token not found or already revoked")
+	}
+	result, err := s.db.ExecContext(ctx, `UPDATE proxy_tokens SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL`, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("token not found or already revoked")
+	}
+	return nil
+}
+
+// RevokeAllProxyTokens revokes every active token belonging to the user and
+// returns the number revoked.
+func (s *PostgresStore) RevokeAllProxyTokens(ctx context.Context, userID string) (int64, error) {
+	if !isUUID(userID) {
+		return 0, nil
+	}
+	result, err := s.db.ExecContext(ctx,
+		`UPDATE proxy_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL`, userID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// ListOrphanedProxyTokens returns unrevoked proxy tokens whose owning user
+// is disabled or no longer exists.
+func (s *PostgresStore) ListOrphanedProxyTokens(ctx context.Context) ([]*ProxyToken, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT t.id, t.token_hash, t.token_prefix, t.user_id, t.github_token_id, t.repository, t.scopes, t.session_id, t.expires_at, t.revoked_at, t.last_used_at, t.request_count, t.max_requests, t.description, t.created_at
+		FROM proxy_tokens t LEFT JOIN users u ON u.id = t.user_id
+		WHERE t.revoked_at IS NULL AND (u.id IS NULL OR u.disabled_at IS NOT NULL)`)
+	if err != nil {
+		return nil, fmt.Errorf("listing orphaned tokens: %w", err)
+	}
+	defer rows.Close()
+	return scanPgProxyTokenRows(rows)
+}
+
+// ArchiveProxyTokens moves proxy tokens that expired or were revoked at or
+// before the cutoff into proxy_tokens_archive, and returns how many moved.
+func (s *PostgresStore) ArchiveProxyTokens(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `
+		WITH moved AS (
+			DELETE FROM proxy_tokens WHERE expires_at <= $1 OR revoked_at <= $1
+			RETURNING id, token_prefix, user_id, repository, scopes, session_id, expires_at, revoked_at, last_used_at, request_count, max_requests, description, created_at
+		)
+		INSERT INTO proxy_tokens_archive (id, token_prefix, user_id, repository, scopes, session_id, expires_at, revoked_at, last_used_at, request_count, max_requests, description, created_at, archived_at)
+		SELECT id, token_prefix, user_id, repository, scopes, session_id, expires_at, revoked_at, last_used_at, request_count, max_requests, description, created_at, NOW()
+		FROM moved`, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// ListArchivedProxyTokens returns archived proxy tokens matching filter,
+// most recently archived first.
+func (s *PostgresStore) ListArchivedProxyTokens(ctx context.Context, filter ArchiveFilter) ([]*ArchivedProxyToken, error) {
+	query := `SELECT id, token_prefix, user_id, repository, scopes, session_id, expires_at, revoked_at, last_used_at, request_count, max_requests, description, created_at, archived_at FROM proxy_tokens_archive WHERE TRUE`
+	var args []any
+	where := func(cond string, arg any) {
+		args = append(args, arg)
+		query += fmt.Sprintf(" AND "+cond, len(args))
+	}
+	if filter.UserID != "" {
+		if !isUUID(filter.UserID) {
+			return nil, nil
+		}
+		where(`user_id = $%d`, filter.UserID)
+	}
+	if filter.Repository != "" {
+		where(`repository = $%d`, filter.Repository)
+	}
+	query += ` ORDER BY archived_at DESC, id`
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	query += fmt.Sprintf(` LIMIT %d`, limit)
+	if filter.Offset > 0 {
+		query += fmt.Sprintf(` OFFSET %d`, filter.Offset)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("listing archived tokens: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []*ArchivedProxyToken
+	for rows.Next() {
+		t := &ArchivedProxyToken{}
+		var scopes []byte
+		var revokedAt, lastUsedAt sql.NullTime
+		if err := rows.Scan(&t.ID, &t.TokenPrefix, &t.UserID, &t.Repository, &scopes, &t.SessionID, &t.ExpiresAt,
+			&revokedAt, &lastUsedAt, &t.RequestCount, &t.MaxRequests, &t.Description, &t.CreatedAt, &t.ArchivedAt); err != nil {
+			return nil, err
+		}
+		t.Scopes = json.RawMessage(scopes)
+		if revokedAt.Valid {
+			t.RevokedAt = &revokedAt.Time
+		}
+		if lastUsedAt.Valid {
+			t.LastUsedAt = &lastUsedAt.Time
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// IncrementAndCheckUsage counts a request against a token's budget of
+// maxRequests (zero is unlimited), revoking the token when the budget is used
+// up, and returns the new request count. It reports exceeded, without
+// counting, if the token is revoked or its budget is already spent. The check
+// and increment are one statement, so concurrent requests can never overspend
+// the budget.
+func (s *PostgresStore) IncrementAndCheckUsage(ctx context.Context, id string, maxRequests int64) (int64, bool, error) {
+	if !isUUID(id) {
+		return 0, true, nil
+	}
+	var count int64
+	err := s.db.QueryRowContext(ctx, `
+		UPDATE proxy_tokens SET
+			request_count = request_count + 1,
+			last_used_at = NOW(),
+			revoked_at = CASE WHEN $1::bigint > 0 AND request_count + 1 >= $1::bigint THEN NOW() ELSE revoked_at END
+		WHERE id = $2 AND revoked_at IS NULL AND ($1::bigint = 0 OR request_count < $1::bigint)
+		RETURNING request_count
+	`, maxRequests, id).Scan(&count)
+	if err == sql.ErrNoRows {
+		// Nothing was counted; report the count as it stands.
+		err = s.db.QueryRowContext(ctx, `SELECT request_count FROM proxy_tokens WHERE id = $1`, id).Scan(&count)
+		if err == sql.ErrNoRows {
+			err = nil
+		}
+		return count, true, err
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return count, false, nil
+}
+
+// RefundUsage takes back one request counted by IncrementAndCheckUsage, for a
+// request that was never served. If that request's count revoked the token,
+// the revocation carries the same timestamp as last_used_at and is lifted;
+// a revocation made since then is kept.
+func (s *PostgresStore) RefundUsage(ctx context.Context, id string) error {
+	if !isUUID(id) {
+		return nil
+	}
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE proxy_tokens SET
+			request_count = request_count - 1,
+			revoked_at = CASE WHEN revoked_at = last_used_at THEN NULL ELSE revoked_at END
+		WHERE id = $1 AND request_count > 0
+	`, id)
+	return err
+}
+
+// CountActiveProxyTokensByUser returns the number of unrevoked, unexpired
+// proxy tokens held by each user. Users without active tokens are omitted.
+func (s *PostgresStore) CountActiveProxyTokensByUser(ctx context.Context) (map[string]int64, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT user_id, COUNT(*) FROM proxy_tokens
+		WHERE revoked_at IS NULL AND expires_at > NOW()
+		GROUP BY user_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var userID string
+		var n int64
+		if err := rows.Scan(&userID, &n); err != nil {
+			return nil, err
+		}
+		counts[userID] = n
+	}
+	return counts, rows.Err()
+}
+
+// TokenStatsByRepo returns, per repository, the number of active proxy tokens
+// and the requests made with all of its tokens, archived ones included,
+// busiest first.
+func (s *PostgresStore) TokenStatsByRepo(ctx context.Context) ([]*RepoTokenStats, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT repository,
+			COUNT(*) FILTER (WHERE revoked_at IS NULL AND expires_at > NOW()) AS active,
+			COALESCE(SUM(request_count), 0)::bigint AS requests
+		FROM (SELECT repository, expires_at, revoked_at, request_count FROM proxy_tokens
+			UNION ALL SELECT repository, expires_at, revoked_at, request_count FROM proxy_tokens_archive) t
+		GROUP BY repository
+		ORDER BY active DESC, requests DESC, repository`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []*RepoTokenStats
+	for rows.Next() {
+		st := &RepoTokenStats{}
+		if err := rows.Scan(&st.Repository, &st.ActiveTokens, &st.Requests); err != nil {
+			return nil, err
+		}
+		out = append(out, st)
+	}
+	return out, rows.Err()
+}
+
+func (s *PostgresStore) UpdateProxyTokenUsage(ctx context.Context, id string) error {
+	if !isUUID(id) {
+		return nil
+	}
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE proxy_tokens SET last_used_at = NOW(), request_count = request_count + 1 WHERE id = $1`, id)
+	return err
+}
+
+// --- Audit Log ---
+
+const pgAuditColumns = `id, timestamp, user_id, proxy_token_id, action, method, path, repository, status_code, duration_ms, session_id, metadata`
+
+// SetMaxMetadataBytes caps the size of the metadata stored with an audit
+// entry. Zero (the default) is unlimited.
+func (s *PostgresStore) SetMaxMetadataBytes(n int) {
+	s.maxMetadataBytes = n
+}
+
+func (s *PostgresStore) CreateAuditEntry(ctx context.Context, entry *AuditEntry) error {
+	if entry.ID == "" {
+		entry.ID = uuid.New().String()
+	}
+	metadataStr := "{}"
+	if entry.Metadata != nil {
+		metadataStr = string(capMetadata(entry.Metadata, s.maxMetadataBytes))
+	}
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO audit_log (id, timestamp, user_id, proxy_token_id, action, method, path, repository, status_code, duration_ms, session_id, metadata)
+		VALUES ($1, NOW(), $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	`, entry.ID, nullString(entry.UserID), entry.ProxyTokenID, entry.Action, entry.Method, entry.Path,
+		entry.Repository, entry.StatusCode, entry.DurationMS, entry.SessionID, metadataStr)
+	return err
+}
+
+// UpdateAuditEntryMetadata replaces the metadata of an existing audit entry.
+func (s *PostgresStore) UpdateAuditEntryMetadata(ctx context.Context, id string, metadata json.RawMessage) error {
+	if !isUUID(id) {
+		return nil
+	}
+	metadata = capMetadata(metadata, s.maxMetadataBytes)
+	_, err := s.db.ExecContext(ctx, `UPDATE audit_log SET metadata = $1 WHERE id = $2`, string(metadata), id)
+	return err
+}
+
+func (s *PostgresStore) ListAuditEntries(ctx context.Context, filter AuditFilter) ([]*AuditEntry, error) {
+	query := `SELECT ` + pgAuditColumns + ` FROM audit_log WHERE TRUE`
+	var args []any
+	where := func(cond string, arg any) {
+		args = append(args, arg)
+		query += fmt.Sprintf(" AND "+cond, len(args))
+	}
+
+	if filter.UserID != "" {
+		if !isUUID(filter.UserID) {
+			return nil, nil
+		}
+		where(`user_id = $%d`, filter.UserID)
+	}
+	if filter.Repository != "" {
+		where(`repository = $%d`, filter.Repository)
+	}
+	if filter.TokenID != "" {
+		if !isUUID(filter.TokenID) {
+			return nil, nil
+		}
+		where(`proxy_token_id = $%d`, filter.TokenID)
+	}
+	if filter.Action != "" {
+		where(`action = $%d`, filter.Action)
+	}
+	if filter.StatusCode != 0 {
+		where(`status_code = $%d`, filter.StatusCode)
+	}
+	if filter.StatusCodeMin != 0 {
+		where(`status_code >= $%d`, filter.StatusCodeMin)
+	}
+	if filter.StatusCodeMax != 0 {
+		where(`status_code <= $%d`, filter.StatusCodeMax)
+	}
+	if filter.Cursor != "" {
+		ts, id, err := ParseAuditCursor(filter.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		if !isUUID(id) {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+		at, _ := time.Parse(time.RFC3339Nano, ts)
+		args = append(args, at, id)
+		query += fmt.Sprintf(` AND (timestamp, id) < ($%d, $%d)`, len(args)-1, len(args))
+	}
+
+	query += ` ORDER BY timestamp DESC, id DESC`
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	query += fmt.Sprintf(` LIMIT %d`, limit)
+	if filter.Offset > 0 && filter.Cursor == "" {
+		query += fmt.Sprintf(` OFFSET %d`, filter.Offset)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*AuditEntry
+	for rows.Next() {
+		e, err := scanPgAuditEntry(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (s *PostgresStore) GetAuditEntryByID(ctx context.Context, id string) (*AuditEntry, error) {
+	if !isUUID(id) {
+		return nil, nil
+	}
+	row := s.db.QueryRowContext(ctx, `SELECT `+pgAuditColumns+` FROM audit_log WHERE id = $1`, id)
+	e, err := scanPgAuditEntry(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return e, err
+}
+
+func scanPgAuditEntry(scan func(dest ...any) error) (*AuditEntry, error) {
+	e := &AuditEntry{}
+	var userID, proxyTokenID sql.NullString
+	var metadata []byte
+	if err := scan(&e.ID, &e.Timestamp, &userID, &proxyTokenID, &e.Action, &e.Method,
+		&e.Path, &e.Repository, &e.StatusCode, &e.DurationMS, &e.SessionID, &metadata); err != nil {
+		return nil, err
+	}
+	e.UserID = userID.String
+	if proxyTokenID.Valid {
+		e.ProxyTokenID = &proxyTokenID.String
+	}
+	if metadata != nil {
+		e.Metadata = json.RawMessage(metadata)
+	}
+	return e, nil
+}
+
+// PruneAuditEntries removes audit entries logged before the cutoff, moving
+// them to audit_log_archive if archive is set, and returns how many went.
+func (s *PostgresStore) PruneAuditEntries(ctx context.Context, before time.Time, archive bool) (int64, error) {
+	query := `DELETE FROM audit_log WHERE id IN (SELECT id FROM audit_log WHERE timestamp < $1 ORDER BY timestamp LIMIT $2)`
+	if archive {
+		query = `
+			WITH moved AS (` + query + ` RETURNING ` + pgAuditColumns + `, created_at)
+			INSERT INTO audit_log_archive (` + pgAuditColumns + `, created_at, archived_at)
+			SELECT ` + pgAuditColumns + `, created_at, NOW() FROM moved`
+	}
+	var total int64
+	for {
+		result, err := s.db.ExecContext(ctx, query, before, auditPruneBatch)
+		if err != nil {
+			return total, err
+		}
+		n, err := result.RowsAffected()
+		total += n
+		if err != nil || n < auditPruneBatch {
+			return total, err
+		}
+	}
+}
+
+// --- Sessions ---
+
+const pgSessionColumns = `token_hash, user_id, username, role, created_at, expires_at, last_used_at, role_checked_at`
+
+func (s *PostgresStore) CreateSession(ctx context.Context, session *Session) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO sessions (`+pgSessionColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, session.TokenHash, session.UserID, session.Username, session.Role,
+		session.CreatedAt, session.ExpiresAt, session.LastUsedAt, session.RoleCheckedAt)
+	return err
+}
+
+func scanPgSession(scan func(dest ...any) error) (*Session, error) {
+	session := &Session{}
+	if err := scan(&session.TokenHash, &session.UserID, &session.Username, &session.Role,
+		&session.CreatedAt, &session.ExpiresAt, &session.LastUsedAt, &session.RoleCheckedAt); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (s *PostgresStore) GetSession(ctx context.Context, tokenHash string) (*Session, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+pgSessionColumns+` FROM sessions WHERE token_hash = $1`, tokenHash)
+	session, err := scanPgSession(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return session, err
+}
+
+// ListUserSessions returns the user's sessions, expired or not, oldest first.
+func (s *PostgresStore) ListUserSessions(ctx context.Context, userID string) ([]*Session, error) {
+	if !isUUID(userID) {
+		return nil, nil
+	}
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+pgSessionColumns+` FROM sessions WHERE user_id = $1 ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*Session
+	for rows.Next() {
+		session, err := scanPgSession(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// TouchSession records that a session authenticated a request.
+func (s *PostgresStore) TouchSession(ctx context.Context, tokenHash string, lastUsedAt time.Time) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE sessions SET last_used_at = $1 WHERE token_hash = $2`, lastUsedAt, tokenHash)
+	return err
+}
+
+// SetUserSessionsRole sets the role of every session of the user.
+func (s *PostgresStore) SetUserSessionsRole(ctx context.Context, userID, role string, checkedAt time.Time) error {
+	if !isUUID(userID) {
+		return nil
+	}
+	_, err := s.db.ExecContext(ctx, `UPDATE sessions SET role = $1, role_checked_at = $2 WHERE user_id = $3`,
+		role, checkedAt, userID)
+	return err
+}
+
+func (s *PostgresStore) DeleteSession(ctx context.Context, tokenHash string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM sessions WHERE token_hash = $1`, tokenHash)
+	return err
+}
+
+// DeleteUserSessions ends every session of the user and returns how many
+// there were.
+func (s *PostgresStore) DeleteUserSessions(ctx context.Context, userID string) (int64, error) {
+	if !isUUID(userID) {
+		return 0, nil
+	}
+	result, err := s.db.ExecContext(ctx, `DELETE FROM sessions WHERE user_id = $1`, userID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// DeleteExpiredSessions deletes sessions that expired before now and returns
+// how many there were.
+func (s *PostgresStore) DeleteExpiredSessions(ctx context.Context, now time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM sessions WHERE expires_at <= $1`, now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// IncrementRateLimit counts a request against key in the fixed window that
+// began at windowStart and returns the window's count so far. A request in a
+// newer window resets the count. The update is a single statement, so
+// concurrent callers, including other replicas, never lose increments.
+func (s *PostgresStore) IncrementRateLimit(ctx context.Context, key string, windowStart time.Time) (int64, error) {
+	var count int64
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO rate_limits (key, window_start, count) VALUES ($1, $2, 1)
+		ON CONFLICT (key) DO UPDATE SET
+			count = CASE WHEN excluded.window_start > rate_limits.window_start THEN 1 ELSE rate_limits.count + 1 END,
+			window_start = GREATEST(rate_limits.window_start, excluded.window_start)
+		RETURNING count
+	`, key, windowStart.Unix()).Scan(&count)
+	return count, err
+}
+
+// DeleteExpiredRateLimits removes rate limit rows whose window began before
+// before. Such windows are over, so the rows only take up space until their
+// key is seen again.
+func (s *PostgresStore) DeleteExpiredRateLimits(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM rate_limits WHERE window_start < $1`, before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Ensure PostgresStore implements all required interfaces.
+var (
+	_ Store             = (*PostgresStore)(nil)
+	_ MigrationExecutor = (*PostgresStore)(nil)
+)
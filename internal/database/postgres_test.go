@@ -0,0 +1,209 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newPostgresTestStore migrates the empty database named by
+// GHP_TEST_POSTGRES_DSN, skipping the test when it is unset, and rolls every
+// migration back afterwards.
+func newPostgresTestStore(t *testing.T) *PostgresStore {
+	t.Helper()
+	dsn := os.Getenv("GHP_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("GHP_TEST_POSTGRES_DSN not set")
+	}
+	store, err := NewPostgresStore(dsn, PoolConfig{MaxOpenConns: 4})
+	if err != nil {
+		t.Fatalf("NewPostgresStore: %v", err)
+	}
+	ctx := context.Background()
+	migrator := NewMigrator(store, "postgres")
+	if err := migrator.Migrate(ctx); err != nil {
+		store.Close()
+		t.Fatalf("Migrate: %v", err)
+	}
+	t.Cleanup(func() {
+		defer store.Close()
+		applied, err := store.AppliedMigrations(ctx)
+		if err != nil {
+			t.Errorf("AppliedMigrations: %v", err)
+			return
+		}
+		if _, err := migrator.Rollback(ctx, len(applied)); err != nil {
+			t.Errorf("Rollback: %v", err)
+		}
+	})
+	return store
+}
+
+func TestPostgresStore(t *testing.T) {
+	store := newPostgresTestStore(t)
+	ctx := context.Background()
+
+	user := &User{GitHubID: 1, GitHubUsername: "bob", GitHubEmail: "bob@example.com", Role: "user"}
+	if err := store.UpsertUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	again := &User{GitHubID: 1, GitHubUsername: "bobby", Role: "admin"}
+	if err := store.UpsertUser(ctx, again); err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != user.ID || again.Role != "user" {
+		t.Errorf("re-upsert gave ID %s role %s, want %s user", again.ID, again.Role, user.ID)
+	}
+	if u, err := store.GetUserByID(ctx, "not-a-uuid"); err != nil || u != nil {
+		t.Errorf("GetUserByID(not-a-uuid) = %v, %v; want not found", u, err)
+	}
+	if err := store.SetUserDisabled(ctx, user.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := store.GetUserByID(ctx, user.ID); u == nil || u.DisabledAt == nil || u.GitHubUsername != "bobby" {
+		t.Errorf("GetUserByID = %+v, want disabled bobby", u)
+	}
+	if users, err := store.ListUsersFiltered(ctx, UserFilter{Query: "BOB", Limit: 10}); err != nil || len(users) != 1 {
+		t.Errorf("ListUsersFiltered = %d users, %v", len(users), err)
+	}
+
+	gt := &GitHubToken{
+		UserID:                user.ID,
+		AccessToken:           "enc_access",
+		RefreshToken:          "enc_refresh",
+		AccessTokenExpiresAt:  time.Now().Add(8 * time.Hour),
+		RefreshTokenExpiresAt: time.Now().Add(180 * 24 * time.Hour),
+	}
+	if err := store.UpsertGitHubToken(ctx, gt); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.GetGitHubToken(ctx, user.ID); err != nil || got == nil || got.ID != gt.ID {
+		t.Fatalf("GetGitHubToken = %+v, %v", got, err)
+	}
+
+	pt := &ProxyToken{
+		TokenHash:     "sha256hash123",
+		TokenPrefix:   "ghp_a1b2",
+		UserID:        user.ID,
+		GitHubTokenID: gt.ID,
+		Repository:    "org/repo",
+		Scopes:        json.RawMessage(`{"contents":"read"}`),
+		ExpiresAt:     time.Now().Add(24 * time.Hour),
+	}
+	if err := store.CreateProxyToken(ctx, pt); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.GetProxyTokenByHash(ctx, "sha256hash123")
+	if err != nil || got == nil {
+		t.Fatalf("GetProxyTokenByHash = %v, %v", got, err)
+	}
+	var scopes map[string]string
+	if err := json.Unmarshal(got.Scopes, &scopes); err != nil || scopes["contents"] != "read" {
+		t.Errorf("scopes = %s, %v", got.Scopes, err)
+	}
+	for i, want := range []bool{false, false, true} {
+		count, exceeded, err := store.IncrementAndCheckUsage(ctx, pt.ID, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exceeded != want || count != min(int64(i+1), 2) {
+			t.Errorf("request %d: count %d exceeded %v", i+1, count, exceeded)
+		}
+	}
+	if got, _ := store.GetProxyTokenByID(ctx, pt.ID); got.RevokedAt == nil {
+		t.Error("token not revoked once its budget was spent")
+	}
+	if stats, err := store.TokenStatsByRepo(ctx); err != nil || len(stats) != 1 || stats[0].Requests != 2 {
+		t.Errorf("TokenStatsByRepo = %+v, %v", stats, err)
+	}
+	if orphans, err := store.ListOrphanedProxyTokens(ctx); err != nil || len(orphans) != 0 {
+		t.Errorf("ListOrphanedProxyTokens = %d, %v; the only token is revoked", len(orphans), err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := store.CreateAuditEntry(ctx, &AuditEntry{UserID: user.ID, ProxyTokenID: &pt.ID, Action: "proxy_request", StatusCode: 200}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.CreateAuditEntry(ctx, &AuditEntry{Action: "webhook"}); err != nil {
+		t.Fatal(err)
+	}
+	page, err := store.ListAuditEntries(ctx, AuditFilter{UserID: user.ID, Limit: 2})
+	if err != nil || len(page) != 2 {
+		t.Fatalf("first page = %d entries, %v", len(page), err)
+	}
+	rest, err := store.ListAuditEntries(ctx, AuditFilter{UserID: user.ID, Cursor: AuditCursor(page[1])})
+	if err != nil || len(rest) != 1 {
+		t.Errorf("second page = %d entries, %v; want 1", len(rest), err)
+	}
+
+	start := time.Unix(1000, 0)
+	for i, want := range []int64{1, 2} {
+		if n, err := store.IncrementRateLimit(ctx, "k", start); err != nil || n != want {
+			t.Errorf("IncrementRateLimit %d = %d, %v; want %d", i, n, err, want)
+		}
+	}
+	if n, _ := store.IncrementRateLimit(ctx, "k", start.Add(time.Minute)); n != 1 {
+		t.Errorf("count in a new window = %d, want 1", n)
+	}
+	if n, err := store.DeleteExpiredRateLimits(ctx, start.Add(2*time.Minute)); err != nil || n != 1 {
+		t.Errorf("DeleteExpiredRateLimits = %d, %v; want 1", n, err)
+	}
+
+	now := time.Now()
+	session := &Session{TokenHash: "h", UserID: user.ID, Username: "bobby", Role: "user",
+		CreatedAt: now, ExpiresAt: now.Add(time.Hour), LastUsedAt: now, RoleCheckedAt: now}
+	if err := store.CreateSession(ctx, session); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.GetSession(ctx, "h"); err != nil || got == nil || got.UserID != user.ID {
+		t.Errorf("GetSession = %+v, %v", got, err)
+	}
+	if n, err := store.DeleteExpiredSessions(ctx, now.Add(2*time.Hour)); err != nil || n != 1 {
+		t.Errorf("DeleteExpiredSessions = %d, %v; want 1", n, err)
+	}
+
+	// The spent token is archived, still counted, and purged with its user.
+	if n, err := store.ArchiveProxyTokens(ctx, time.Now()); err != nil || n != 1 {
+		t.Errorf("ArchiveProxyTokens = %d, %v; want 1", n, err)
+	}
+	if archived, err := store.ListArchivedProxyTokens(ctx, ArchiveFilter{UserID: user.ID}); err != nil || len(archived) != 1 || archived[0].RevokedAt == nil {
+		t.Errorf("ListArchivedProxyTokens = %+v, %v", archived, err)
+	}
+	if stats, err := store.TokenStatsByRepo(ctx); err != nil || len(stats) != 1 || stats[0].Requests != 2 {
+		t.Errorf("TokenStatsByRepo after archiving = %+v, %v", stats, err)
+	}
+
+	// Every audit entry is past a cutoff in the future; the user's are
+	// still purged from the archive.
+	if n, err := store.PruneAuditEntries(ctx, time.Now().Add(time.Minute), true); err != nil || n != 4 {
+		t.Errorf("PruneAuditEntries = %d, %v; want 4", n, err)
+	}
+
+	sessionToken := func(hash string) *ProxyToken {
+		return &ProxyToken{TokenHash: hash, TokenPrefix: "ghp_sess", UserID: user.ID, GitHubTokenID: gt.ID,
+			Repository: "org/repo", Scopes: json.RawMessage(`{}`), SessionID: "agent", ExpiresAt: time.Now().Add(time.Hour)}
+	}
+	first := sessionToken("session-1")
+	if replaced, err := store.CreateSessionProxyToken(ctx, first, false); err != nil || len(replaced) != 0 {
+		t.Fatalf("CreateSessionProxyToken = %v, %v", replaced, err)
+	}
+	if _, err := store.CreateSessionProxyToken(ctx, sessionToken("session-2"), false); !errors.Is(err, ErrSessionActive) {
+		t.Errorf("second token without replace: err = %v, want ErrSessionActive", err)
+	}
+	if replaced, err := store.CreateSessionProxyToken(ctx, sessionToken("session-2"), true); err != nil || !reflect.DeepEqual(replaced, []string{first.ID}) {
+		t.Errorf("CreateSessionProxyToken with replace = %v, %v; want [%s]", replaced, err, first.ID)
+	}
+
+	res, err := store.PurgeUser(ctx, user.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.AuditEntries != 3 || res.ProxyTokens != 3 || res.GitHubTokens != 1 {
+		t.Errorf("PurgeUser = %+v", res)
+	}
+}
@@ -5,6 +5,9 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"net/url"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -14,30 +17,42 @@ import (
 // SQLiteStore implements Store using SQLite.
 type SQLiteStore struct {
 	db *sql.DB
+
+	// maxMetadataBytes caps audit entry metadata; see capMetadata.
+	maxMetadataBytes int
 }
 
 // NewSQLiteStore opens a SQLite database at the given path.
 func NewSQLiteStore(dsn string) (*SQLiteStore, error) {
-	db, err := sql.Open("sqlite", dsn)
+	// Enable WAL mode and foreign keys, and wait for locks rather than
+	// failing with SQLITE_BUSY. The pragmas go in the DSN so that every
+	// pooled connection gets them, not only the first.
+	db, err := sql.Open("sqlite", withPragmas(dsn, "busy_timeout=5000", "foreign_keys=ON", "journal_mode=WAL"))
 	if err != nil {
 		return nil, fmt.Errorf("opening sqlite: %w", err)
 	}
-
-	// Enable WAL mode and foreign keys.
-	for _, pragma := range []string{
-		"PRAGMA journal_mode=WAL",
-		"PRAGMA foreign_keys=ON",
-		"PRAGMA busy_timeout=5000",
-	} {
-		if _, err := db.Exec(pragma); err != nil {
-			db.Close()
-			return nil, fmt.Errorf("setting pragma %s: %w", pragma, err)
-		}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("opening sqlite: %w", err)
 	}
 
 	return &SQLiteStore{db: db}, nil
 }
 
+// withPragmas adds _pragma parameters, which the driver runs on each new
+// connection, to a SQLite DSN.
+func withPragmas(dsn string, pragmas ...string) string {
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	for _, p := range pragmas {
+		dsn += sep + "_pragma=" + url.QueryEscape(p)
+		sep = "&"
+	}
+	return dsn
+}
+
 func (s *SQLiteStore) Close() error {
 	return s.db.Close()
 }
@@ -58,6 +73,14 @@ func parseTime(s string) time.Time {
 	return time.Time{}
 }
 
+// nullString maps an empty string to SQL NULL, for optional foreign keys.
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
 // --- Migration support ---
 
 func (s *SQLiteStore) EnsureMigrationsTable(ctx context.Context) error {
@@ -106,6 +129,24 @@ func (s *SQLiteStore) RunMigration(ctx context.Context, name, sqlStr string) err
 	return tx.Commit()
 }
 
+func (s *SQLiteStore) RollbackMigration(ctx context.Context, name, sqlStr string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, sqlStr); err != nil {
+		return fmt.Errorf("executing rollback SQL: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE name = ?`, name); err != nil {
+		return fmt.Errorf("removing migration record: %w", err)
+	}
+
+	return tx.Commit()
+}
+
 // --- Users ---
 
 func (s *SQLiteStore) UpsertUser(ctx context.Context, user *User) error {
@@ -125,76 +166,230 @@ func (s *SQLiteStore) UpsertUser(ctx context.Context, user *User) error {
 		return err
 	}
 	// Re-read to get the actual ID (in case of conflict, the existing row's ID is used).
+	var disabledAt sql.NullString
 	var createdStr, updatedStr string
 	err = s.db.QueryRowContext(ctx,
-		`SELECT id, role, created_at, updated_at FROM users WHERE github_id = ?`, user.GitHubID,
-	).Scan(&user.ID, &user.Role, &createdStr, &updatedStr)
+		`SELECT id, role, disabled_at, created_at, updated_at FROM users WHERE github_id = ?`, user.GitHubID,
+	).Scan(&user.ID, &user.Role, &disabledAt, &createdStr, &updatedStr)
 	if err != nil {
 		return err
 	}
 	user.CreatedAt = parseTime(createdStr)
 	user.UpdatedAt = parseTime(updatedStr)
+	user.DisabledAt = nil
+	if disabledAt.Valid {
+		ts := parseTime(disabledAt.String)
+		user.DisabledAt = &ts
+	}
 	return nil
 }
 
-func (s *SQLiteStore) GetUserByGitHubID(ctx context.Context, githubID int64) (*User, error) {
+func scanUser(scan func(dest ...interface{}) error) (*User, error) {
 	u := &User{}
+	var disabledAt sql.NullString
 	var createdStr, updatedStr string
-	err := s.db.QueryRowContext(ctx,
-		`SELECT id, github_id, github_username, github_email, role, created_at, updated_at FROM users WHERE github_id = ?`,
-		githubID,
-	).Scan(&u.ID, &u.GitHubID, &u.GitHubUsername, &u.GitHubEmail, &u.Role, &createdStr, &updatedStr)
-	if err == sql.ErrNoRows {
-		return nil, nil
-	}
-	if err != nil {
+	if err := scan(&u.ID, &u.GitHubID, &u.GitHubUsername, &u.GitHubEmail, &u.Role, &disabledAt, &createdStr, &updatedStr); err != nil {
 		return nil, err
 	}
 	u.CreatedAt = parseTime(createdStr)
 	u.UpdatedAt = parseTime(updatedStr)
+	if disabledAt.Valid {
+		ts := parseTime(disabledAt.String)
+		u.DisabledAt = &ts
+	}
 	return u, nil
 }
 
+func (s *SQLiteStore) GetUserByGitHubID(ctx context.Context, githubID int64) (*User, error) {
+	row := s.db.QueryRowContext(ctx,
+		`SELECT id, github_id, github_username, github_email, role, disabled_at, created_at, updated_at FROM users WHERE github_id = ?`,
+		githubID,
+	)
+	u, err := scanUser(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return u, err
+}
+
 func (s *SQLiteStore) GetUserByID(ctx context.Context, id string) (*User, error) {
-	u := &User{}
-	var createdStr, updatedStr string
-	err := s.db.QueryRowContext(ctx,
-		`SELECT id, github_id, github_username, github_email, role, created_at, updated_at FROM users WHERE id = ?`,
+	row := s.db.QueryRowContext(ctx,
+		`SELECT id, github_id, github_username, github_email, role, disabled_at, created_at, updated_at FROM users WHERE id = ?`,
 		id,
-	).Scan(&u.ID, &u.GitHubID, &u.GitHubUsername, &u.GitHubEmail, &u.Role, &createdStr, &updatedStr)
+	)
+	u, err := scanUser(row.Scan)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
+	return u, err
+}
+
+func (s *SQLiteStore) ListUsers(ctx context.Context) ([]*User, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, github_id, github_username, github_email, role, disabled_at, created_at, updated_at FROM users ORDER BY created_at`)
 	if err != nil {
 		return nil, err
 	}
-	u.CreatedAt = parseTime(createdStr)
-	u.UpdatedAt = parseTime(updatedStr)
-	return u, nil
+	defer rows.Close()
+
+	var users []*User
+	for rows.Next() {
+		u, err := scanUser(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
 }
 
-func (s *SQLiteStore) ListUsers(ctx context.Context) ([]*User, error) {
-	rows, err := s.db.QueryContext(ctx,
-		`SELECT id, github_id, github_username, github_email, role, created_at, updated_at FROM users ORDER BY created_at`)
+// PurgeUser erases a user in one transaction: their proxy tokens (archived
+// too), GitHub token and user row are deleted. Their audit entries are kept
+// with no user or session when anonymizeAudit is set, and deleted otherwise.
+func (s *SQLiteStore) PurgeUser(ctx context.Context, id string, anonymizeAudit bool) (*PurgeResult, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	exec := func(query string) (int64, error) {
+		result, err := tx.ExecContext(ctx, query, id)
+		if err != nil {
+			return 0, err
+		}
+		return result.RowsAffected()
+	}
+
+	res := &PurgeResult{}
+	// Audit entries go first: deleting the user would cascade to them.
+	auditSQL := `DELETE FROM %s WHERE user_id = ?`
+	if anonymizeAudit {
+		auditSQL = `UPDATE %s SET user_id = NULL, session_id = '' WHERE user_id = ?`
+	}
+	// The archived audit log is treated the same way.
+	for _, table := range []string{"audit_log", "audit_log_archive"} {
+		n, err := exec(fmt.Sprintf(auditSQL, table))
+		if err != nil {
+			return nil, fmt.Errorf("purging %s entries: %w", table, err)
+		}
+		res.AuditEntries += n
+		// Remaining entries (those kept anonymized, and ones not attributed
+		// to a user) lose the IDs of the tokens about to go.
+		if _, err = exec(`UPDATE ` + table + ` SET proxy_token_id = NULL WHERE proxy_token_id IN
+			(SELECT id FROM proxy_tokens WHERE user_id = ?1 UNION ALL SELECT id FROM proxy_tokens_archive WHERE user_id = ?1)`); err != nil {
+			return nil, fmt.Errorf("unlinking %s entries: %w", table, err)
+		}
+	}
+	if res.ProxyTokens, err = exec(`DELETE FROM proxy_tokens WHERE user_id = ?`); err != nil {
+		return nil, fmt.Errorf("deleting proxy tokens: %w", err)
+	}
+	archived, err := exec(`DELETE FROM proxy_tokens_archive WHERE user_id = ?`)
 	if err != nil {
+		return nil, fmt.Errorf("deleting archived proxy tokens: %w", err)
+	}
+	res.ProxyTokens += archived
+	if res.GitHubTokens, err = exec(`DELETE FROM github_tokens WHERE user_id = ?`); err != nil {
+		return nil, fmt.Errorf("deleting GitHub token: %w", err)
+	}
+	if _, err = exec(`DELETE FROM sessions WHERE user_id = ?`); err != nil {
+		return nil, fmt.Errorf("deleting sessions: %w", err)
+	}
+	n, err := exec(`DELETE FROM users WHERE id = ?`)
+	if err != nil {
+		return nil, fmt.Errorf("deleting user: %w", err)
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("user not found")
+	}
+	if err := tx.Commit(); err != nil {
 		return nil, err
 	}
+	return res, nil
+}
+
+// SetUserRole changes a user's role ("user" or "admin").
+func (s *SQLiteStore) SetUserRole(ctx context.Context, id, role string) error {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	result, err := s.db.ExecContext(ctx,
+		`UPDATE users SET role = ?, updated_at = ? WHERE id = ?`, role, now, id)
+	if err != nil {
+		return fmt.Errorf("updating user: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("user not found")
+	}
+	return nil
+}
+
+// SetUserDisabled disables or re-enables a user. The tokens of a disabled
+// user are revoked by the server's token reconciler.
+func (s *SQLiteStore) SetUserDisabled(ctx context.Context, id string, disabled bool) error {
+	var disabledAt interface{}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	if disabled {
+		disabledAt = now
+	}
+	result, err := s.db.ExecContext(ctx,
+		`UPDATE users SET disabled_at = ?, updated_at = ? WHERE id = ?`, disabledAt, now, id)
+	if err != nil {
+		return fmt.Errorf("updating user: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("user not found")
+	}
+	return nil
+}
+
+// ListUsersFiltered returns users matching filter, oldest first.
+func (s *SQLiteStore) ListUsersFiltered(ctx context.Context, filter UserFilter) ([]*User, error) {
+	query := `SELECT id, github_id, github_username, github_email, role, disabled_at, created_at, updated_at FROM users`
+	var args []interface{}
+	if filter.Query != "" {
+		pattern := "%" + escapeLike(strings.ToLower(filter.Query)) + "%"
+		query += ` WHERE LOWER(github_username) LIKE ? ESCAPE '\' OR LOWER(github_email) LIKE ? ESCAPE '\'`
+		args = append(args, pattern, pattern)
+	}
+	query += " ORDER BY created_at, id"
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+		if filter.Offset > 0 {
+			query += " OFFSET ?"
+			args = append(args, filter.Offset)
+		}
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("listing users: %w", err)
+	}
 	defer rows.Close()
 
 	var users []*User
 	for rows.Next() {
-		u := &User{}
-		var createdStr, updatedStr string
-		if err := rows.Scan(&u.ID, &u.GitHubID, &u.GitHubUsername, &u.GitHubEmail, &u.Role, &createdStr, &updatedStr); err != nil {
+		u, err := scanUser(rows.Scan)
+		if err != nil {
 			return nil, err
 		}
-		u.CreatedAt = parseTime(createdStr)
-		u.UpdatedAt = parseTime(updatedStr)
 		users = append(users, u)
 	}
 	return users, rows.Err()
 }
 
+// escapeLike escapes LIKE wildcards so s matches literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
 // --- GitHub Tokens ---
 
 func (s *SQLiteStore) UpsertGitHubToken(ctx context.Context, token *GitHubToken) error {
@@ -259,6 +454,50 @@ func (s *SQLiteStore) GetGitHubTokenByID(ctx context.Context, id string) (*GitHu
 	return t, nil
 }
 
+// ListGitHubTokens returns every stored GitHub token, still encrypted, for
+// maintenance commands.
+func (s *SQLiteStore) ListGitHubTokens(ctx context.Context) ([]*GitHubToken, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, user_id, access_token, refresh_token, access_token_expires_at, refresh_token_expires_at, scopes, created_at, updated_at
+		 FROM github_tokens ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []*GitHubToken
+	for rows.Next() {
+		t := &GitHubToken{}
+		var atExp, rtExp, createdStr, updatedStr string
+		if err := rows.Scan(&t.ID, &t.UserID, &t.AccessToken, &t.RefreshToken, &atExp, &rtExp, &t.Scopes, &createdStr, &updatedStr); err != nil {
+			return nil, err
+		}
+		t.AccessTokenExpiresAt = parseTime(atExp)
+		t.RefreshTokenExpiresAt = parseTime(rtExp)
+		t.CreatedAt = parseTime(createdStr)
+		t.UpdatedAt = parseTime(updatedStr)
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// UpdateGitHubTokenScopes records the OAuth scopes GitHub reports for a token.
+func (s *SQLiteStore) UpdateGitHubTokenScopes(ctx context.Context, id, scopes string) error {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	result, err := s.db.ExecContext(ctx, `UPDATE github_tokens SET scopes = ?, updated_at = ? WHERE id = ?`, scopes, now, id)
+	if err != nil {
+		return fmt.Errorf("updating github token scopes: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("github token not found")
+	}
+	return nil
+}
+
 // --- Proxy Tokens ---
 
 func (s *SQLiteStore) CreateProxyToken(ctx context.Context, token *ProxyToken) error {
@@ -271,21 +510,89 @@ func (s *SQLiteStore) CreateProxyToken(ctx context.Context, token *ProxyToken) e
 		return fmt.Errorf("marshaling scopes: %w", err)
 	}
 	_, err = s.db.ExecContext(ctx, `
-		INSERT INTO proxy_tokens (id, token_hash, token_prefix, user_id, github_token_id, repository, scopes, session_id, expires_at, request_count, created_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 0, ?)
+		INSERT INTO proxy_tokens (id, token_hash, token_prefix, user_id, github_token_id, repository, scopes, session_id, expires_at, request_count, max_requests, description, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 0, ?, ?, ?)
 	`, token.ID, token.TokenHash, token.TokenPrefix, token.UserID, token.GitHubTokenID,
 		token.Repository, string(scopesJSON), token.SessionID,
-		token.ExpiresAt.Format(time.RFC3339Nano), now)
+		token.ExpiresAt.Format(time.RFC3339Nano), token.MaxRequests, token.Description, now)
 	return err
 }
 
+// CreateSessionProxyToken stores token unless its user already has an
+// active token with the same session ID, in which case it returns
+// ErrSessionActive; with replace, those tokens are revoked instead and their
+// IDs returned. The check and the insert share a transaction, so concurrent
+// calls for one session can't both succeed.
+func (s *SQLiteStore) CreateSessionProxyToken(ctx context.Context, token *ProxyToken, replace bool) ([]string, error) {
+	if token.ID == "" {
+		token.ID = uuid.New().String()
+	}
+	scopesJSON, err := json.Marshal(token.Scopes)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling scopes: %w", err)
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Writing first takes the database's write lock, so a concurrent call
+	// waits here rather than reading the session's tokens alongside this one.
+	if _, err := tx.ExecContext(ctx, `UPDATE users SET id = id WHERE id = ?`, token.UserID); err != nil {
+		return nil, fmt.Errorf("locking user: %w", err)
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT id, expires_at FROM proxy_tokens WHERE user_id = ? AND session_id = ? AND revoked_at IS NULL`,
+		token.UserID, token.SessionID)
+	if err != nil {
+		return nil, fmt.Errorf("listing session tokens: %w", err)
+	}
+	var active []string
+	for rows.Next() {
+		var id, expiresStr string
+		if err := rows.Scan(&id, &expiresStr); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if parseTime(expiresStr).After(time.Now()) {
+			active = append(active, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(active) > 0 && !replace {
+		return nil, ErrSessionActive
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	for _, id := range active {
+		if _, err := tx.ExecContext(ctx, `UPDATE proxy_tokens SET revoked_at = ? WHERE id = ?`, now, id); err != nil {
+			return nil, fmt.Errorf("revoking token %s: %w", id, err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO proxy_tokens (id, token_hash, token_prefix, user_id, github_token_id, repository, scopes, session_id, expires_at, request_count, max_requests, description, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 0, ?, ?, ?)
+	`, token.ID, token.TokenHash, token.TokenPrefix, token.UserID, token.GitHubTokenID,
+		token.Repository, string(scopesJSON), token.SessionID,
+		token.ExpiresAt.Format(time.RFC3339Nano), token.MaxRequests, token.Description, now); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return active, nil
+}
+
 func scanProxyToken(scan func(dest ...interface{}) error) (*ProxyToken, error) {
 	t := &ProxyToken{}
 	var scopesStr string
 	var revokedAt, lastUsedAt sql.NullString
 	var expiresStr, createdStr string
 	err := scan(&t.ID, &t.TokenHash, &t.TokenPrefix, &t.UserID, &t.GitHubTokenID, &t.Repository, &scopesStr,
-		&t.SessionID, &expiresStr, &revokedAt, &lastUsedAt, &t.RequestCount, &createdStr)
+		&t.SessionID, &expiresStr, &revokedAt, &lastUsedAt, &t.RequestCount, &t.MaxRequests, &t.Description, &createdStr)
 	if err != nil {
 		return nil, err
 	}
@@ -305,7 +612,7 @@ func scanProxyToken(scan func(dest ...interface{}) error) (*ProxyToken, error) {
 
 func (s *SQLiteStore) GetProxyTokenByHash(ctx context.Context, hash string) (*ProxyToken, error) {
 	row := s.db.QueryRowContext(ctx, `
-		SELECT id, token_hash, token_prefix, user_id, github_token_id, repository, scopes, session_id, expires_at, revoked_at, last_used_at, request_count, created_at
+		SELECT id, token_hash, token_prefix, user_id, github_token_id, repository, scopes, session_id, expires_at, revoked_at, last_used_at, request_count, max_requests, description, created_at
 		FROM proxy_tokens WHERE token_hash = ?`, hash)
 	t, err := scanProxyToken(row.Scan)
 	if err == sql.ErrNoRows {
@@ -316,7 +623,7 @@ func (s *SQLiteStore) GetProxyTokenByHash(ctx context.Context, hash string) (*Pr
 
 func (s *SQLiteStore) GetProxyTokenByID(ctx context.Context, id string) (*ProxyToken, error) {
 	row := s.db.QueryRowContext(ctx, `
-		SELECT id, token_hash, token_prefix, user_id, github_token_id, repository, scopes, session_id, expires_at, revoked_at, last_used_at, request_count, created_at
+		SELECT id, token_hash, token_prefix, user_id, github_token_id, repository, scopes, session_id, expires_at, revoked_at, last_used_at, request_count, max_requests, description, created_at
 		FROM proxy_tokens WHERE id = ?`, id)
 	t, err := scanProxyToken(row.Scan)
 	if err == sql.ErrNoRows {
@@ -327,7 +634,7 @@ func (s *SQLiteStore) GetProxyTokenByID(ctx context.Context, id string) (*ProxyT
 
 func (s *SQLiteStore) ListProxyTokens(ctx context.Context, userID string) ([]*ProxyToken, error) {
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, token_hash, token_prefix, user_id, github_token_id, repository, scopes, session_id, expires_at, revoked_at, last_used_at, request_count, created_at
+		SELECT id, token_hash, token_prefix, user_id, github_token_id, repository, scopes, session_id, expires_at, revoked_at, last_used_at, request_count, max_requests, description, created_at
 		FROM proxy_tokens WHERE user_id = ? ORDER BY created_at DESC`, userID)
 	if err != nil {
 		return nil, err
@@ -338,7 +645,7 @@ func (s *SQLiteStore) ListProxyTokens(ctx context.Context, userID string) ([]*Pr
 
 func (s *SQLiteStore) ListAllProxyTokens(ctx context.Context) ([]*ProxyToken, error) {
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, token_hash, token_prefix, user_id, github_token_id, repository, scopes, session_id, expires_at, revoked_at, last_used_at, request_count, created_at
+		SELECT id, token_hash, token_prefix, user_id, github_token_id, repository, scopes, session_id, expires_at, revoked_at, last_used_at, request_count, max_requests, description, created_at
 		FROM proxy_tokens ORDER BY created_at DESC`)
 	if err != nil {
 		return nil, err
@@ -375,6 +682,261 @@ func (s *SQLiteStore) RevokeProxyToken(ctx context.Context, id string) error {
 	return nil
 }
 
+// ListOrphanedProxyTokens returns unrevoked proxy tokens whose owning user
+// is disabled or no longer exists.
+func (s *SQLiteStore) ListOrphanedProxyTokens(ctx context.Context) ([]*ProxyToken, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT t.id, t.token_hash, t.token_prefix, t.user_id, t.github_token_id, t.repository, t.scopes, t.session_id, t.expires_at, t.revoked_at, t.last_used_at, t.request_count, t.max_requests, t.description, t.created_at
+		FROM proxy_tokens t LEFT JOIN users u ON u.id = t.user_id
+		WHERE t.revoked_at IS NULL AND (u.id IS NULL OR u.disabled_at IS NOT NULL)`)
+	if err != nil {
+		return nil, fmt.Errorf("listing orphaned tokens: %w", err)
+	}
+	defer rows.Close()
+	return scanProxyTokenRows(rows)
+}
+
+// ArchiveProxyTokens moves proxy tokens that expired or were revoked at or
+// before the cutoff into proxy_tokens_archive, and returns how many moved.
+func (s *SQLiteStore) ArchiveProxyTokens(ctx context.Context, before time.Time) (int64, error) {
+	// Expiry is compared in Go (see CountActiveProxyTokensByUser).
+	rows, err := s.db.QueryContext(ctx, `SELECT id, expires_at, revoked_at FROM proxy_tokens`)
+	if err != nil {
+		return 0, err
+	}
+	var dead []string
+	for rows.Next() {
+		var id, expiresStr string
+		var revokedAt sql.NullString
+		if err := rows.Scan(&id, &expiresStr, &revokedAt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if !parseTime(expiresStr).After(before) || (revokedAt.Valid && !parseTime(revokedAt.String).After(before)) {
+			dead = append(dead, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(dead) == 0 {
+		return 0, nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	for _, id := range dead {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO proxy_tokens_archive (id, token_prefix, user_id, repository, scopes, session_id, expires_at, revoked_at, last_used_at, request_count, max_requests, description, created_at, archived_at)
+			SELECT id, token_prefix, user_id, repository, scopes, session_id, expires_at, revoked_at, last_used_at, request_count, max_requests, description, created_at, ?
+			FROM proxy_tokens WHERE id = ?`, now, id); err != nil {
+			return 0, fmt.Errorf("archiving token %s: %w", id, err)
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM proxy_tokens WHERE id = ?`, id); err != nil {
+			return 0, fmt.Errorf("deleting token %s: %w", id, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return int64(len(dead)), nil
+}
+
+// ListArchivedProxyTokens returns archived proxy tokens matching filter,
+// most recently archived first.
+func (s *SQLiteStore) ListArchivedProxyTokens(ctx context.Context, filter ArchiveFilter) ([]*ArchivedProxyToken, error) {
+	query := `SELECT id, token_prefix, user_id, repository, scopes, session_id, expires_at, revoked_at, last_used_at, request_count, max_requests, description, created_at, archived_at FROM proxy_tokens_archive WHERE 1=1`
+	var args []interface{}
+	if filter.UserID != "" {
+		query += ` AND user_id = ?`
+		args = append(args, filter.UserID)
+	}
+	if filter.Repository != "" {
+		query += ` AND repository = ?`
+		args = append(args, filter.Repository)
+	}
+	query += ` ORDER BY archived_at DESC, id`
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	query += fmt.Sprintf(` LIMIT %d`, limit)
+	if filter.Offset > 0 {
+		query += fmt.Sprintf(` OFFSET %d`, filter.Offset)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("listing archived tokens: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []*ArchivedProxyToken
+	for rows.Next() {
+		t := &ArchivedProxyToken{}
+		var scopesStr, expiresStr, createdStr, archivedStr string
+		var revokedAt, lastUsedAt sql.NullString
+		if err := rows.Scan(&t.ID, &t.TokenPrefix, &t.UserID, &t.Repository, &scopesStr, &t.SessionID, &expiresStr,
+			&revokedAt, &lastUsedAt, &t.RequestCount, &t.MaxRequests, &t.Description, &createdStr, &archivedStr); err != nil {
+			return nil, err
+		}
+		t.Scopes = json.RawMessage(scopesStr)
+		t.ExpiresAt = parseTime(expiresStr)
+		t.CreatedAt = parseTime(createdStr)
+		t.ArchivedAt = parseTime(archivedStr)
+		if revokedAt.Valid {
+			ts := parseTime(revokedAt.String)
+			t.RevokedAt = &ts
+		}
+		if lastUsedAt.Valid {
+			ts := parseTime(lastUsedAt.String)
+			t.LastUsedAt = &ts
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeAllProxyTokens revokes every active token belonging to the user and
+// returns the number revoked.
+func (s *SQLiteStore) RevokeAllProxyTokens(ctx context.Context, userID string) (int64, error) {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	result, err := s.db.ExecContext(ctx,
+		`UPDATE proxy_tokens SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL`, now, userID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// IncrementAndCheckUsage counts a request against a token's budget of
+// maxRequests (zero is unlimited), revoking the token when the budget is used
+// up, and returns the new request count. It reports exceeded, without
+// counting, if the token is revoked or its budget is already spent. The check
+// and increment are one statement, so concurrent requests can never overspend
+// the budget.
+func (s *SQLiteStore) IncrementAndCheckUsage(ctx context.Context, id string, maxRequests int64) (int64, bool, error) {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	var count int64
+	err := s.db.QueryRowContext(ctx, `
+		UPDATE proxy_tokens SET
+			request_count = request_count + 1,
+			last_used_at = ?1,
+			revoked_at = CASE WHEN ?2 > 0 AND request_count + 1 >= ?2 THEN ?1 ELSE revoked_at END
+		WHERE id = ?3 AND revoked_at IS NULL AND (?2 = 0 OR request_count < ?2)
+		RETURNING request_count
+	`, now, maxRequests, id).Scan(&count)
+	if err == sql.ErrNoRows {
+		// Nothing was counted; report the count as it stands.
+		err = s.db.QueryRowContext(ctx, `SELECT request_count FROM proxy_tokens WHERE id = ?`, id).Scan(&count)
+		if err == sql.ErrNoRows {
+			err = nil
+		}
+		return count, true, err
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return count, false, nil
+}
+
+// RefundUsage takes back one request counted by IncrementAndCheckUsage, for a
+// request that was never served. If that request's count revoked the token,
+// the revocation carries the same timestamp as last_used_at and is lifted;
+// a revocation made since then is kept.
+func (s *SQLiteStore) RefundUsage(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE proxy_tokens SET
+			request_count = request_count - 1,
+			revoked_at = CASE WHEN revoked_at = last_used_at THEN NULL ELSE revoked_at END
+		WHERE id = ? AND request_count > 0
+	`, id)
+	return err
+}
+
+// CountActiveProxyTokensByUser returns the number of unrevoked, unexpired
+// proxy tokens held by each user. Users without active tokens are omitted.
+func (s *SQLiteStore) CountActiveProxyTokensByUser(ctx context.Context) (map[string]int64, error) {
+	// Expiry is compared in Go: RFC3339Nano strings with trimmed fractional
+	// seconds don't sort chronologically.
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT user_id, expires_at FROM proxy_tokens WHERE revoked_at IS NULL`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var userID, expiresStr string
+		if err := rows.Scan(&userID, &expiresStr); err != nil {
+			return nil, err
+		}
+		if parseTime(expiresStr).After(now) {
+			counts[userID]++
+		}
+	}
+	return counts, rows.Err()
+}
+
+// TokenStatsByRepo returns, per repository, the number of active proxy tokens
+// and the requests made with all of its tokens, archived ones included,
+// busiest first.
+func (s *SQLiteStore) TokenStatsByRepo(ctx context.Context) ([]*RepoTokenStats, error) {
+	// Rows are grouped by expiry too, so that activity can be decided in Go
+	// (see CountActiveProxyTokensByUser).
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT repository, expires_at, revoked_at IS NULL, COUNT(*), SUM(request_count)
+		 FROM (SELECT repository, expires_at, revoked_at, request_count FROM proxy_tokens
+		       UNION ALL SELECT repository, expires_at, revoked_at, request_count FROM proxy_tokens_archive)
+		 GROUP BY repository, expires_at, revoked_at IS NULL`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	byRepo := make(map[string]*RepoTokenStats)
+	var out []*RepoTokenStats
+	for rows.Next() {
+		var repo, expiresStr string
+		var unrevoked bool
+		var tokens, requests int64
+		if err := rows.Scan(&repo, &expiresStr, &unrevoked, &tokens, &requests); err != nil {
+			return nil, err
+		}
+		st, ok := byRepo[repo]
+		if !ok {
+			st = &RepoTokenStats{Repository: repo}
+			byRepo[repo] = st
+			out = append(out, st)
+		}
+		if unrevoked && parseTime(expiresStr).After(now) {
+			st.ActiveTokens += tokens
+		}
+		st.Requests += requests
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].ActiveTokens != out[j].ActiveTokens {
+			return out[i].ActiveTokens > out[j].ActiveTokens
+		}
+		if out[i].Requests != out[j].Requests {
+			return out[i].Requests > out[j].Requests
+		}
+		return out[i].Repository < out[j].Repository
+	})
+	return out, nil
+}
+
 func (s *SQLiteStore) UpdateProxyTokenUsage(ctx context.Context, id string) error {
 	now := time.Now().UTC().Format(time.RFC3339Nano)
 	_, err := s.db.ExecContext(ctx,
@@ -384,6 +946,12 @@ func (s *SQLiteStore) UpdateProxyTokenUsage(ctx context.Context, id string) erro
 
 // --- Audit Log ---
 
+// SetMaxMetadataBytes caps the size of the metadata stored with an audit
+// entry. Zero (the default) is unlimited.
+func (s *SQLiteStore) SetMaxMetadataBytes(n int) {
+	s.maxMetadataBytes = n
+}
+
 func (s *SQLiteStore) CreateAuditEntry(ctx context.Context, entry *AuditEntry) error {
 	if entry.ID == "" {
 		entry.ID = uuid.New().String()
@@ -391,16 +959,23 @@ func (s *SQLiteStore) CreateAuditEntry(ctx context.Context, entry *AuditEntry) e
 	now := time.Now().UTC().Format(time.RFC3339Nano)
 	metadataStr := "{}"
 	if entry.Metadata != nil {
-		metadataStr = string(entry.Metadata)
+		metadataStr = string(capMetadata(entry.Metadata, s.maxMetadataBytes))
 	}
 	_, err := s.db.ExecContext(ctx, `
 		INSERT INTO audit_log (id, timestamp, user_id, proxy_token_id, action, method, path, repository, status_code, duration_ms, session_id, metadata)
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, entry.ID, now, entry.UserID, entry.ProxyTokenID, entry.Action, entry.Method, entry.Path,
+	`, entry.ID, now, nullString(entry.UserID), entry.ProxyTokenID, entry.Action, entry.Method, entry.Path,
 		entry.Repository, entry.StatusCode, entry.DurationMS, entry.SessionID, metadataStr)
 	return err
 }
 
+// UpdateAuditEntryMetadata replaces the metadata of an existing audit entry.
+func (s *SQLiteStore) UpdateAuditEntryMetadata(ctx context.Context, id string, metadata json.RawMessage) error {
+	metadata = capMetadata(metadata, s.maxMetadataBytes)
+	_, err := s.db.ExecContext(ctx, `UPDATE audit_log SET metadata = ? WHERE id = ?`, string(metadata), id)
+	return err
+}
+
 func (s *SQLiteStore) ListAuditEntries(ctx context.Context, filter AuditFilter) ([]*AuditEntry, error) {
 	query := `SELECT id, timestamp, user_id, proxy_token_id, action, method, path, repository, status_code, duration_ms, session_id, metadata FROM audit_log WHERE 1=1`
 	var args []interface{}
@@ -425,15 +1000,31 @@ func (s *SQLiteStore) ListAuditEntries(ctx context.Context, filter AuditFilter)
 		query += ` AND status_code = ?`
 		args = append(args, filter.StatusCode)
 	}
+	if filter.StatusCodeMin != 0 {
+		query += ` AND status_code >= ?`
+		args = append(args, filter.StatusCodeMin)
+	}
+	if filter.StatusCodeMax != 0 {
+		query += ` AND status_code <= ?`
+		args = append(args, filter.StatusCodeMax)
+	}
+	if filter.Cursor != "" {
+		ts, id, err := ParseAuditCursor(filter.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		query += ` AND (timestamp < ? OR (timestamp = ? AND id < ?))`
+		args = append(args, ts, ts, id)
+	}
 
-	query += ` ORDER BY timestamp DESC`
+	query += ` ORDER BY timestamp DESC, id DESC`
 
 	limit := filter.Limit
 	if limit <= 0 {
 		limit = 100
 	}
 	query += fmt.Sprintf(` LIMIT %d`, limit)
-	if filter.Offset > 0 {
+	if filter.Offset > 0 && filter.Cursor == "" {
 		query += fmt.Sprintf(` OFFSET %d`, filter.Offset)
 	}
 
@@ -445,26 +1036,238 @@ func (s *SQLiteStore) ListAuditEntries(ctx context.Context, filter AuditFilter)
 
 	var entries []*AuditEntry
 	for rows.Next() {
-		e := &AuditEntry{}
-		var proxyTokenID sql.NullString
-		var metadataStr sql.NullString
-		var timestampStr string
-		if err := rows.Scan(&e.ID, &timestampStr, &e.UserID, &proxyTokenID, &e.Action, &e.Method,
-			&e.Path, &e.Repository, &e.StatusCode, &e.DurationMS, &e.SessionID, &metadataStr); err != nil {
+		e, err := scanAuditEntry(rows.Scan)
+		if err != nil {
 			return nil, err
 		}
-		e.Timestamp = parseTime(timestampStr)
-		if proxyTokenID.Valid {
-			e.ProxyTokenID = &proxyTokenID.String
-		}
-		if metadataStr.Valid {
-			e.Metadata = json.RawMessage(metadataStr.String)
-		}
 		entries = append(entries, e)
 	}
 	return entries, rows.Err()
 }
 
+func (s *SQLiteStore) GetAuditEntryByID(ctx context.Context, id string) (*AuditEntry, error) {
+	row := s.db.QueryRowContext(ctx, `
+		SELECT id, timestamp, user_id, proxy_token_id, action, method, path, repository, status_code, duration_ms, session_id, metadata
+		FROM audit_log WHERE id = ?`, id)
+	e, err := scanAuditEntry(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return e, err
+}
+
+func scanAuditEntry(scan func(dest ...any) error) (*AuditEntry, error) {
+	e := &AuditEntry{}
+	var userID, proxyTokenID sql.NullString
+	var metadataStr sql.NullString
+	var timestampStr string
+	if err := scan(&e.ID, &timestampStr, &userID, &proxyTokenID, &e.Action, &e.Method,
+		&e.Path, &e.Repository, &e.StatusCode, &e.DurationMS, &e.SessionID, &metadataStr); err != nil {
+		return nil, err
+	}
+	e.Timestamp = parseTime(timestampStr)
+	e.UserID = userID.String
+	if proxyTokenID.Valid {
+		e.ProxyTokenID = &proxyTokenID.String
+	}
+	if metadataStr.Valid {
+		e.Metadata = json.RawMessage(metadataStr.String)
+	}
+	return e, nil
+}
+
+// PruneAuditEntries removes audit entries logged before the cutoff, moving
+// them to audit_log_archive if archive is set, and returns how many went.
+func (s *SQLiteStore) PruneAuditEntries(ctx context.Context, before time.Time, archive bool) (int64, error) {
+	// Timestamps are compared as text, which can misorder entries within
+	// the same second; that doesn't matter for a retention cutoff.
+	cutoff := before.UTC().Format(time.RFC3339Nano)
+	var total int64
+	for {
+		n, err := s.pruneAuditBatch(ctx, cutoff, archive)
+		total += n
+		if err != nil || n < auditPruneBatch {
+			return total, err
+		}
+	}
+}
+
+func (s *SQLiteStore) pruneAuditBatch(ctx context.Context, cutoff string, archive bool) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	batch := `SELECT id FROM audit_log WHERE timestamp < ? ORDER BY timestamp, id LIMIT ?`
+	if archive {
+		now := time.Now().UTC().Format(time.RFC3339Nano)
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO audit_log_archive (id, timestamp, user_id, proxy_token_id, action, method, path, repository, status_code, duration_ms, session_id, metadata, created_at, archived_at)
+			SELECT id, timestamp, user_id, proxy_token_id, action, method, path, repository, status_code, duration_ms, session_id, metadata, created_at, ?
+			FROM audit_log WHERE id IN (`+batch+`)`, now, cutoff, auditPruneBatch); err != nil {
+			return 0, fmt.Errorf("archiving audit entries: %w", err)
+		}
+	}
+	result, err := tx.ExecContext(ctx, `DELETE FROM audit_log WHERE id IN (`+batch+`)`, cutoff, auditPruneBatch)
+	if err != nil {
+		return 0, fmt.Errorf("deleting audit entries: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// --- Sessions ---
+
+func (s *SQLiteStore) CreateSession(ctx context.Context, session *Session) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO sessions (token_hash, user_id, username, role, created_at, expires_at, last_used_at, role_checked_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, session.TokenHash, session.UserID, session.Username, session.Role,
+		session.CreatedAt.UTC().Format(time.RFC3339Nano), session.ExpiresAt.UTC().Format(time.RFC3339Nano),
+		session.LastUsedAt.UTC().Format(time.RFC3339Nano), session.RoleCheckedAt.UTC().Format(time.RFC3339Nano))
+	return err
+}
+
+func scanSession(scan func(dest ...any) error) (*Session, error) {
+	session := &Session{}
+	var createdStr, expiresStr, lastUsedStr, roleCheckedStr string
+	if err := scan(&session.TokenHash, &session.UserID, &session.Username, &session.Role,
+		&createdStr, &expiresStr, &lastUsedStr, &roleCheckedStr); err != nil {
+		return nil, err
+	}
+	session.CreatedAt = parseTime(createdStr)
+	session.ExpiresAt = parseTime(expiresStr)
+	session.LastUsedAt = parseTime(lastUsedStr)
+	session.RoleCheckedAt = parseTime(roleCheckedStr)
+	return session, nil
+}
+
+func (s *SQLiteStore) GetSession(ctx context.Context, tokenHash string) (*Session, error) {
+	row := s.db.QueryRowContext(ctx, `
+		SELECT token_hash, user_id, username, role, created_at, expires_at, last_used_at, role_checked_at
+		FROM sessions WHERE token_hash = ?`, tokenHash)
+	session, err := scanSession(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return session, err
+}
+
+// ListUserSessions returns the user's sessions, expired or not, oldest first.
+func (s *SQLiteStore) ListUserSessions(ctx context.Context, userID string) ([]*Session, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT token_hash, user_id, username, role, created_at, expires_at, last_used_at, role_checked_at
+		FROM sessions WHERE user_id = ? ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*Session
+	for rows.Next() {
+		session, err := scanSession(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// TouchSession records that a session authenticated a request.
+func (s *SQLiteStore) TouchSession(ctx context.Context, tokenHash string, lastUsedAt time.Time) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE sessions SET last_used_at = ? WHERE token_hash = ?`,
+		lastUsedAt.UTC().Format(time.RFC3339Nano), tokenHash)
+	return err
+}
+
+// SetUserSessionsRole sets the role of every session of the user.
+func (s *SQLiteStore) SetUserSessionsRole(ctx context.Context, userID, role string, checkedAt time.Time) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE sessions SET role = ?, role_checked_at = ? WHERE user_id = ?`,
+		role, checkedAt.UTC().Format(time.RFC3339Nano), userID)
+	return err
+}
+
+func (s *SQLiteStore) DeleteSession(ctx context.Context, tokenHash string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM sessions WHERE token_hash = ?`, tokenHash)
+	return err
+}
+
+// DeleteUserSessions ends every session of the user and returns how many
+// there were.
+func (s *SQLiteStore) DeleteUserSessions(ctx context.Context, userID string) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM sessions WHERE user_id = ?`, userID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// DeleteExpiredSessions deletes sessions that expired before now and returns
+// how many there were.
+func (s *SQLiteStore) DeleteExpiredSessions(ctx context.Context, now time.Time) (int64, error) {
+	// Expiry is compared in Go (see CountActiveProxyTokensByUser).
+	rows, err := s.db.QueryContext(ctx, `SELECT token_hash, expires_at FROM sessions`)
+	if err != nil {
+		return 0, err
+	}
+	var expired []string
+	for rows.Next() {
+		var hash, expiresStr string
+		if err := rows.Scan(&hash, &expiresStr); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if !parseTime(expiresStr).After(now) {
+			expired = append(expired, hash)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, hash := range expired {
+		if err := s.DeleteSession(ctx, hash); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(expired)), nil
+}
+
+// IncrementRateLimit counts a request against key in the fixed window that
+// began at windowStart and returns the window's count so far. A request in a
+// newer window resets the count. The update is a single statement, so
+// concurrent callers, including other replicas, never lose increments.
+func (s *SQLiteStore) IncrementRateLimit(ctx context.Context, key string, windowStart time.Time) (int64, error) {
+	var count int64
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO rate_limits (key, window_start, count) VALUES (?, ?, 1)
+		ON CONFLICT(key) DO UPDATE SET
+			count = CASE WHEN excluded.window_start > rate_limits.window_start THEN 1 ELSE rate_limits.count + 1 END,
+			window_start = MAX(rate_limits.window_start, excluded.window_start)
+		RETURNING count
+	`, key, windowStart.Unix()).Scan(&count)
+	return count, err
+}
+
+// DeleteExpiredRateLimits removes rate limit rows whose window began before
+// before. Such windows are over, so the rows only take up space until their
+// key is seen again.
+func (s *SQLiteStore) DeleteExpiredRateLimits(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM rate_limits WHERE window_start < ?`, before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 // Ensure SQLiteStore implements all required interfaces.
 var (
 	_ Store             = (*SQLiteStore)(nil)
@@ -3,8 +3,14 @@ package database
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -70,11 +76,15 @@ func TestUserCRUD(t *testing.T) {
 		t.Error("GetUserByID failed")
 	}
 
-	// Upsert again (update).
-	user.GitHubUsername = "alice-updated"
-	if err := store.UpsertUser(ctx, user); err != nil {
+	// Upsert again (update), as a login after a GitHub rename does. The ID,
+	// which metrics use as the user label, must not change.
+	renamed := &User{GitHubID: 12345, GitHubUsername: "alice-updated", Role: "user"}
+	if err := store.UpsertUser(ctx, renamed); err != nil {
 		t.Fatalf("UpsertUser (update): %v", err)
 	}
+	if renamed.ID != user.ID {
+		t.Errorf("ID after rename = %q, want %q", renamed.ID, user.ID)
+	}
 	got3, err := store.GetUserByGitHubID(ctx, 12345)
 	if err != nil {
 		t.Fatal(err)
@@ -183,6 +193,67 @@ func TestProxyTokenCRUD(t *testing.T) {
 	}
 }
 
+func TestRevokeAllProxyTokens(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+
+	tokensFor := func(githubID int64, name string, n int) *User {
+		user := &User{GitHubID: githubID, GitHubUsername: name, Role: "user"}
+		if err := store.UpsertUser(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+		gt := &GitHubToken{UserID: user.ID, AccessToken: "a", RefreshToken: "r",
+			AccessTokenExpiresAt: time.Now().Add(time.Hour), RefreshTokenExpiresAt: time.Now().Add(time.Hour)}
+		if err := store.UpsertGitHubToken(ctx, gt); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			pt := &ProxyToken{
+				TokenHash:     fmt.Sprintf("%s-hash-%d", name, i),
+				TokenPrefix:   "ghp_test",
+				UserID:        user.ID,
+				GitHubTokenID: gt.ID,
+				Repository:    "org/repo",
+				Scopes:        json.RawMessage(`{"contents":"read"}`),
+				ExpiresAt:     time.Now().Add(time.Hour),
+			}
+			if err := store.CreateProxyToken(ctx, pt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return user
+	}
+	alice := tokensFor(1, "alice", 3)
+	bob := tokensFor(2, "bob", 2)
+
+	// One of alice's tokens is already revoked and shouldn't be counted.
+	aliceTokens, _ := store.ListProxyTokens(ctx, alice.ID)
+	if err := store.RevokeProxyToken(ctx, aliceTokens[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := store.RevokeAllProxyTokens(ctx, alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("revoked %d tokens, want 2", n)
+	}
+
+	aliceTokens, _ = store.ListProxyTokens(ctx, alice.ID)
+	for _, pt := range aliceTokens {
+		if pt.RevokedAt == nil {
+			t.Errorf("alice token %s still active", pt.ID)
+		}
+	}
+	bobTokens, _ := store.ListProxyTokens(ctx, bob.ID)
+	for _, pt := range bobTokens {
+		if pt.RevokedAt != nil {
+			t.Errorf("bob token %s was revoked", pt.ID)
+		}
+	}
+}
+
 func TestMigrations(t *testing.T) {
 	dir := t.TempDir()
 	dsn := filepath.Join(dir, "test.db")
@@ -234,6 +305,51 @@ func TestMigrations(t *testing.T) {
 	}
 }
 
+func TestMigrationRedo(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	migrator := NewMigrator(store, "sqlite")
+
+	before, err := migrator.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, steps := range []int{1, len(before)} {
+		redone, err := migrator.Redo(ctx, steps)
+		if err != nil {
+			t.Fatalf("Redo(%d): %v", steps, err)
+		}
+		if len(redone) != steps {
+			t.Errorf("Redo(%d) redid %d migrations", steps, len(redone))
+		}
+		if redone[0] != before[len(before)-1].Name {
+			t.Errorf("Redo(%d) started with %s, want newest %s", steps, redone[0], before[len(before)-1].Name)
+		}
+
+		pending, err := migrator.PendingMigrations(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) != 0 {
+			t.Errorf("after Redo(%d): %d pending migrations", steps, len(pending))
+		}
+
+		// The schema is usable again.
+		user := &User{GitHubID: int64(steps), GitHubUsername: "redo", Role: "user"}
+		if err := store.UpsertUser(ctx, user); err != nil {
+			t.Fatalf("after Redo(%d): UpsertUser: %v", steps, err)
+		}
+		if err := store.CreateAuditEntry(ctx, &AuditEntry{UserID: user.ID, Action: "proxy_request"}); err != nil {
+			t.Fatalf("after Redo(%d): CreateAuditEntry: %v", steps, err)
+		}
+	}
+
+	if _, err := migrator.Redo(ctx, len(before)+1); err == nil {
+		t.Error("expected error redoing more migrations than applied")
+	}
+}
+
 func TestAuditLog(t *testing.T) {
 	store := newTestStore(t)
 	ctx := context.Background()
@@ -269,7 +385,896 @@ func TestAuditLog(t *testing.T) {
 	}
 }
 
+func TestAuditLogCursorPagination(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+
+	user := &User{GitHubID: 1, GitHubUsername: "dana", Role: "user"}
+	if err := store.UpsertUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	const total = 250
+	for i := 0; i < total; i++ {
+		if err := store.CreateAuditEntry(ctx, &AuditEntry{UserID: user.ID, Action: "proxy_request"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The reference ordering is a single unpaginated query.
+	all, err := store.ListAuditEntries(ctx, AuditFilter{UserID: user.ID, Limit: total})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != total {
+		t.Fatalf("ListAuditEntries = %d, want %d", len(all), total)
+	}
+
+	var paged []*AuditEntry
+	filter := AuditFilter{UserID: user.ID, Limit: 40}
+	for pages := 0; ; pages++ {
+		if pages > total {
+			t.Fatal("pagination did not terminate")
+		}
+		page, err := store.ListAuditEntries(ctx, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paged = append(paged, page...)
+		if len(page) < filter.Limit {
+			break
+		}
+		filter.Cursor = AuditCursor(page[len(page)-1])
+	}
+
+	if len(paged) != total {
+		t.Fatalf("paged through %d entries, want %d", len(paged), total)
+	}
+	seen := make(map[string]bool, total)
+	for i, e := range paged {
+		if seen[e.ID] {
+			t.Fatalf("entry %s returned on more than one page", e.ID)
+		}
+		seen[e.ID] = true
+		if e.ID != all[i].ID {
+			t.Fatalf("entry %d = %s, want %s", i, e.ID, all[i].ID)
+		}
+	}
+
+	if _, err := store.ListAuditEntries(ctx, AuditFilter{Cursor: "not a cursor"}); err == nil {
+		t.Error("expected error for malformed cursor")
+	}
+}
+
+func TestAuditLogStatusCodeRange(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+
+	user := &User{GitHubID: 1, GitHubUsername: "erin", Role: "user"}
+	if err := store.UpsertUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	statuses := []int{200, 201, 304, 400, 401, 403, 404, 422, 499, 500, 502}
+	for _, code := range statuses {
+		if err := store.CreateAuditEntry(ctx, &AuditEntry{UserID: user.ID, Action: "proxy_request", StatusCode: code}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		min, max int
+		want     int
+	}{
+		{400, 499, 6},
+		{500, 0, 2},
+		{0, 399, 3},
+		{0, 0, len(statuses)},
+	}
+	for _, tt := range tests {
+		entries, err := store.ListAuditEntries(ctx, AuditFilter{StatusCodeMin: tt.min, StatusCodeMax: tt.max})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != tt.want {
+			t.Errorf("range [%d, %d] returned %d entries, want %d", tt.min, tt.max, len(entries), tt.want)
+		}
+		for _, e := range entries {
+			if (tt.min != 0 && e.StatusCode < tt.min) || (tt.max != 0 && e.StatusCode > tt.max) {
+				t.Errorf("range [%d, %d] returned status %d", tt.min, tt.max, e.StatusCode)
+			}
+		}
+	}
+}
+
 // Ensure temporary files are cleaned up.
 func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
+
+func TestListUsersFiltered(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+
+	for i, u := range []struct{ name, email string }{
+		{"alice", "alice@example.com"},
+		{"Alicia", "ali@corp.test"},
+		{"bob", "bob@example.com"},
+		{"carol", "carol@corp.test"},
+		{"dan_smith", "dan@example.com"},
+		{"danxsmith", "dx@example.com"},
+	} {
+		user := &User{GitHubID: int64(i + 1), GitHubUsername: u.name, GitHubEmail: u.email, Role: "user"}
+		if err := store.UpsertUser(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names := func(users []*User) []string {
+		var out []string
+		for _, u := range users {
+			out = append(out, u.GitHubUsername)
+		}
+		return out
+	}
+
+	tests := []struct {
+		name   string
+		filter UserFilter
+		want   []string
+	}{
+		{"no filter", UserFilter{}, []string{"alice", "Alicia", "bob", "carol", "dan_smith", "danxsmith"}},
+		{"username substring, case-insensitive", UserFilter{Query: "ALI"}, []string{"alice", "Alicia"}},
+		{"email substring", UserFilter{Query: "corp.test"}, []string{"Alicia", "carol"}},
+		{"wildcards match literally", UserFilter{Query: "n_s"}, []string{"dan_smith"}},
+		{"no match", UserFilter{Query: "zed"}, nil},
+		{"first page", UserFilter{Limit: 2}, []string{"alice", "Alicia"}},
+		{"second page", UserFilter{Limit: 2, Offset: 2}, []string{"bob", "carol"}},
+		{"page past the end", UserFilter{Limit: 2, Offset: 10}, nil},
+		{"search with paging", UserFilter{Query: "example.com", Limit: 2, Offset: 1}, []string{"bob", "dan_smith"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, err := store.ListUsersFiltered(ctx, tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := names(users); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCountActiveProxyTokensByUser(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+
+	seed := func(githubID int64, name string, expires ...time.Time) *User {
+		user := &User{GitHubID: githubID, GitHubUsername: name, Role: "user"}
+		if err := store.UpsertUser(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+		gt := &GitHubToken{UserID: user.ID, AccessToken: "a", RefreshToken: "r",
+			AccessTokenExpiresAt: time.Now().Add(time.Hour), RefreshTokenExpiresAt: time.Now().Add(time.Hour)}
+		if err := store.UpsertGitHubToken(ctx, gt); err != nil {
+			t.Fatal(err)
+		}
+		for i, exp := range expires {
+			pt := &ProxyToken{
+				TokenHash:     fmt.Sprintf("%s-hash-%d", name, i),
+				TokenPrefix:   "ghp_test",
+				UserID:        user.ID,
+				GitHubTokenID: gt.ID,
+				Repository:    "org/repo",
+				Scopes:        json.RawMessage(`{"contents":"read"}`),
+				ExpiresAt:     exp,
+			}
+			if err := store.CreateProxyToken(ctx, pt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return user
+	}
+	live, expired := time.Now().Add(time.Hour), time.Now().Add(-time.Hour)
+	alice := seed(1, "alice", live, live, live, expired)
+	bob := seed(2, "bob", live)
+	seed(3, "carol", expired)
+
+	// A revoked token isn't active.
+	aliceTokens, _ := store.ListProxyTokens(ctx, alice.ID)
+	for _, pt := range aliceTokens {
+		if pt.ExpiresAt.After(time.Now()) {
+			if err := store.RevokeProxyToken(ctx, pt.ID); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+
+	counts, err := store.CountActiveProxyTokensByUser(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int64{alice.ID: 2, bob.ID: 1}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("counts = %v, want %v", counts, want)
+	}
+}
+
+func TestIncrementRateLimit(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	w1 := time.Unix(1_700_000_000, 0)
+	w2 := w1.Add(time.Hour)
+
+	steps := []struct {
+		key   string
+		start time.Time
+		want  int64
+	}{
+		{"a", w1, 1},
+		{"a", w1, 2},
+		{"b", w1, 1},
+		{"a", w2, 1}, // A new window resets the count.
+		{"a", w1, 2}, // A straggler from the old window counts in the current one.
+		{"a", w2, 3},
+	}
+	for i, s := range steps {
+		got, err := store.IncrementRateLimit(ctx, s.key, s.start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != s.want {
+			t.Errorf("step %d: count = %d, want %d", i, got, s.want)
+		}
+	}
+}
+
+func TestDeleteExpiredRateLimits(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	w1 := time.Unix(1_700_000_000, 0)
+	w2 := w1.Add(time.Hour)
+
+	for key, start := range map[string]time.Time{"old": w1, "current": w2} {
+		if _, err := store.IncrementRateLimit(ctx, key, start); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := store.DeleteExpiredRateLimits(ctx, w2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("deleted = %d, want 1", n)
+	}
+	// The current window keeps its count; the expired key starts afresh.
+	if got, _ := store.IncrementRateLimit(ctx, "current", w2); got != 2 {
+		t.Errorf("current count = %d, want 2", got)
+	}
+	if got, _ := store.IncrementRateLimit(ctx, "old", w1); got != 1 {
+		t.Errorf("old count = %d, want 1", got)
+	}
+}
+
+func TestQueryPlansUseIndexes(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+
+	// Seed enough rows for the planner's statistics to favour the indexes.
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5000; i++ {
+		ts := time.Unix(1_700_000_000+int64(i), 0).UTC().Format(time.RFC3339Nano)
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO audit_log (id, timestamp, action, repository) VALUES (?, ?, 'proxy_request', ?)`,
+			fmt.Sprintf("a%05d", i), ts, fmt.Sprintf("org/repo%d", i%100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.db.ExecContext(ctx, `ANALYZE`); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		index string
+	}{
+		{`SELECT id FROM audit_log WHERE proxy_token_id = 'x'`, "idx_audit_log_proxy_token_id"},
+		{`SELECT id FROM audit_log WHERE repository = 'org/repo1'`, "idx_audit_log_repository"},
+		{`SELECT id FROM audit_log WHERE user_id = 'x'`, "idx_audit_log_user_id"},
+		{`SELECT id FROM audit_log WHERE timestamp > '2030-01-01'`, "idx_audit_log_timestamp"},
+		{`SELECT id FROM proxy_tokens WHERE user_id = 'x'`, "idx_proxy_tokens_user_id"},
+		{`SELECT id FROM proxy_tokens WHERE expires_at < '2030-01-01'`, "idx_proxy_tokens_expires_at"},
+	}
+	for _, tt := range tests {
+		rows, err := store.db.QueryContext(ctx, "EXPLAIN QUERY PLAN "+tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var plan string
+		for rows.Next() {
+			var id, parent, notused int
+			var detail string
+			if err := rows.Scan(&id, &parent, &notused, &detail); err != nil {
+				t.Fatal(err)
+			}
+			plan += detail + "\n"
+		}
+		rows.Close()
+		if !strings.Contains(plan, tt.index) {
+			t.Errorf("%s: plan does not use %s:\n%s", tt.query, tt.index, plan)
+		}
+	}
+}
+
+func TestPurgeUser(t *testing.T) {
+	ctx := context.Background()
+
+	for _, anonymize := range []bool{true, false} {
+		t.Run(fmt.Sprintf("anonymize=%v", anonymize), func(t *testing.T) {
+			store := newTestStore(t)
+			var ids []string
+			for i, name := range []string{"alice", "bob"} {
+				user := &User{GitHubID: int64(i + 1), GitHubUsername: name, Role: "user"}
+				if err := store.UpsertUser(ctx, user); err != nil {
+					t.Fatal(err)
+				}
+				gt := &GitHubToken{UserID: user.ID, AccessToken: "a", RefreshToken: "r",
+					AccessTokenExpiresAt: time.Now().Add(time.Hour), RefreshTokenExpiresAt: time.Now().Add(time.Hour)}
+				if err := store.UpsertGitHubToken(ctx, gt); err != nil {
+					t.Fatal(err)
+				}
+				pt := &ProxyToken{TokenHash: name + "-hash", TokenPrefix: "ghp_test", UserID: user.ID, GitHubTokenID: gt.ID,
+					Repository: "org/repo", Scopes: json.RawMessage(`{"contents":"read"}`), ExpiresAt: time.Now().Add(time.Hour)}
+				if err := store.CreateProxyToken(ctx, pt); err != nil {
+					t.Fatal(err)
+				}
+				for j := 0; j < 2; j++ {
+					if err := store.CreateAuditEntry(ctx, &AuditEntry{UserID: user.ID, ProxyTokenID: &pt.ID,
+						Action: "proxy_request", SessionID: "agent-1"}); err != nil {
+						t.Fatal(err)
+					}
+				}
+				ids = append(ids, user.ID)
+			}
+			alice, bob := ids[0], ids[1]
+
+			res, err := store.PurgeUser(ctx, alice, anonymize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *res != (PurgeResult{ProxyTokens: 1, GitHubTokens: 1, AuditEntries: 2}) {
+				t.Errorf("result = %+v", res)
+			}
+
+			count := func(query string, args ...interface{}) int {
+				t.Helper()
+				var n int
+				if err := store.db.QueryRowContext(ctx, query, args...).Scan(&n); err != nil {
+					t.Fatal(err)
+				}
+				return n
+			}
+			if n := count(`SELECT COUNT(*) FROM users WHERE id = ?`, alice); n != 0 {
+				t.Errorf("user row remains")
+			}
+			for _, table := range []string{"github_tokens", "proxy_tokens", "audit_log"} {
+				if n := count(`SELECT COUNT(*) FROM `+table+` WHERE user_id = ?`, alice); n != 0 {
+					t.Errorf("%d %s rows remain for the purged user", n, table)
+				}
+			}
+			wantAnon := 0
+			if anonymize {
+				wantAnon = 2
+			}
+			if n := count(`SELECT COUNT(*) FROM audit_log WHERE user_id IS NULL AND session_id = '' AND proxy_token_id IS NULL`); n != wantAnon {
+				t.Errorf("anonymized audit entries = %d, want %d", n, wantAnon)
+			}
+
+			// Other users are untouched.
+			if n := count(`SELECT COUNT(*) FROM audit_log WHERE user_id = ?`, bob); n != 2 {
+				t.Errorf("bob's audit entries = %d, want 2", n)
+			}
+			if n := count(`SELECT COUNT(*) FROM proxy_tokens WHERE user_id = ?`, bob); n != 1 {
+				t.Errorf("bob's proxy tokens = %d, want 1", n)
+			}
+
+			if _, err := store.PurgeUser(ctx, alice, anonymize); err == nil {
+				t.Error("purging a missing user succeeded")
+			}
+		})
+	}
+}
+
+func TestAuditMetadataCap(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	store.SetMaxMetadataBytes(256)
+
+	small := json.RawMessage(`{"count":2}`)
+	big, _ := json.Marshal(map[string]string{"body": strings.Repeat("é\"", 1000)})
+	for _, md := range []json.RawMessage{small, big} {
+		entry := &AuditEntry{Action: "proxy_request", Metadata: md}
+		if err := store.CreateAuditEntry(ctx, entry); err != nil {
+			t.Fatalf("CreateAuditEntry: %v", err)
+		}
+		got, err := store.GetAuditEntryByID(ctx, entry.ID)
+		if err != nil || got == nil {
+			t.Fatalf("GetAuditEntryByID: %v, %v", got, err)
+		}
+		if len(md) <= 256 {
+			if string(got.Metadata) != string(md) {
+				t.Errorf("small metadata = %s, want unchanged", got.Metadata)
+			}
+			continue
+		}
+
+		if len(got.Metadata) > 256 {
+			t.Errorf("stored %d bytes of metadata, want at most 256", len(got.Metadata))
+		}
+		var marker struct {
+			Truncated     bool   `json:"truncated"`
+			OriginalBytes int    `json:"original_bytes"`
+			Preview       string `json:"preview"`
+		}
+		if err := json.Unmarshal(got.Metadata, &marker); err != nil {
+			t.Fatalf("truncated metadata isn't JSON: %v: %s", err, got.Metadata)
+		}
+		if !marker.Truncated || marker.OriginalBytes != len(big) || !strings.HasPrefix(string(big), marker.Preview) || marker.Preview == "" {
+			t.Errorf("marker = %+v", marker)
+		}
+	}
+}
+
+func TestTokenStatsByRepo(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+
+	user := &User{GitHubID: 1, GitHubUsername: "alice", Role: "user"}
+	if err := store.UpsertUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	gt := &GitHubToken{UserID: user.ID, AccessToken: "a", RefreshToken: "r",
+		AccessTokenExpiresAt: time.Now().Add(time.Hour), RefreshTokenExpiresAt: time.Now().Add(time.Hour)}
+	if err := store.UpsertGitHubToken(ctx, gt); err != nil {
+		t.Fatal(err)
+	}
+	live, expired := time.Now().Add(time.Hour), time.Now().Add(-time.Hour)
+	seed := func(repo string, expires time.Time, requests int, revoked bool) {
+		pt := &ProxyToken{
+			TokenHash:     fmt.Sprintf("hash-%s-%d-%d-%v", repo, expires.Unix(), requests, revoked),
+			TokenPrefix:   "ghp_test",
+			UserID:        user.ID,
+			GitHubTokenID: gt.ID,
+			Repository:    repo,
+			Scopes:        json.RawMessage(`{"contents":"read"}`),
+			ExpiresAt:     expires,
+		}
+		if err := store.CreateProxyToken(ctx, pt); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < requests; i++ {
+			if err := store.UpdateProxyTokenUsage(ctx, pt.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if revoked {
+			if err := store.RevokeProxyToken(ctx, pt.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	seed("org/busy", live, 3, false)
+	seed("org/busy", live, 1, false)
+	seed("org/busy", live, 2, true)
+	seed("org/quiet", live, 0, false)
+	seed("org/old", expired, 5, false)
+
+	stats, err := store.TokenStatsByRepo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RepoTokenStats{
+		{Repository: "org/busy", ActiveTokens: 2, Requests: 6},
+		{Repository: "org/quiet", ActiveTokens: 1, Requests: 0},
+		{Repository: "org/old", ActiveTokens: 0, Requests: 5},
+	}
+	var got []RepoTokenStats
+	for _, s := range stats {
+		got = append(got, *s)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+}
+
+func TestIncrementAndCheckUsageConcurrent(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+
+	user := &User{GitHubID: 1, GitHubUsername: "alice", Role: "user"}
+	if err := store.UpsertUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	gt := &GitHubToken{UserID: user.ID, AccessToken: "a", RefreshToken: "r",
+		AccessTokenExpiresAt: time.Now().Add(time.Hour), RefreshTokenExpiresAt: time.Now().Add(time.Hour)}
+	if err := store.UpsertGitHubToken(ctx, gt); err != nil {
+		t.Fatal(err)
+	}
+	const budget = 5
+	pt := &ProxyToken{
+		TokenHash:     "budget-hash",
+		TokenPrefix:   "ghp_test",
+		UserID:        user.ID,
+		GitHubTokenID: gt.ID,
+		Repository:    "org/repo",
+		Scopes:        json.RawMessage(`{"contents":"read"}`),
+		ExpiresAt:     time.Now().Add(time.Hour),
+		MaxRequests:   budget,
+	}
+	if err := store.CreateProxyToken(ctx, pt); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu      sync.Mutex
+		allowed []int64
+		wg      sync.WaitGroup
+	)
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			count, exceeded, err := store.IncrementAndCheckUsage(ctx, pt.ID, budget)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !exceeded {
+				mu.Lock()
+				allowed = append(allowed, count)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(allowed) != budget {
+		t.Errorf("%d requests allowed, want %d", len(allowed), budget)
+	}
+	sort.Slice(allowed, func(i, j int) bool { return allowed[i] < allowed[j] })
+	for i, count := range allowed {
+		if count != int64(i+1) {
+			t.Errorf("allowed counts = %v, want 1..%d", allowed, budget)
+			break
+		}
+	}
+
+	got, err := store.GetProxyTokenByID(ctx, pt.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.RequestCount != budget || got.RevokedAt == nil {
+		t.Errorf("request_count = %d, revoked = %v; want %d and revoked", got.RequestCount, got.RevokedAt != nil, budget)
+	}
+
+	count, exceeded, err := store.IncrementAndCheckUsage(ctx, pt.ID, budget)
+	if err != nil || !exceeded || count != budget {
+		t.Errorf("after budget: count = %d, exceeded = %v, err = %v; want %d, true", count, exceeded, err, budget)
+	}
+
+	// Refunding the request that spent the budget lifts its revocation.
+	if err := store.RefundUsage(ctx, pt.ID); err != nil {
+		t.Fatal(err)
+	}
+	got, err = store.GetProxyTokenByID(ctx, pt.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.RequestCount != budget-1 || got.RevokedAt != nil {
+		t.Errorf("after refund: request_count = %d, revoked = %v; want %d and active", got.RequestCount, got.RevokedAt != nil, budget-1)
+	}
+
+	// A revocation made after the last counted request is kept.
+	if _, _, err := store.IncrementAndCheckUsage(ctx, pt.ID, budget); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RefundUsage(ctx, pt.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RevokeProxyToken(ctx, pt.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RefundUsage(ctx, pt.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.GetProxyTokenByID(ctx, pt.ID); got.RevokedAt == nil {
+		t.Error("refund lifted a later revocation")
+	}
+}
+
+func TestCreateSessionProxyToken(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+
+	user := &User{GitHubID: 1, GitHubUsername: "alice", Role: "user"}
+	if err := store.UpsertUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	gt := &GitHubToken{UserID: user.ID, AccessToken: "a", RefreshToken: "r",
+		AccessTokenExpiresAt: time.Now().Add(time.Hour), RefreshTokenExpiresAt: time.Now().Add(time.Hour)}
+	if err := store.UpsertGitHubToken(ctx, gt); err != nil {
+		t.Fatal(err)
+	}
+	newToken := func(hash, session string, expires time.Time) *ProxyToken {
+		return &ProxyToken{TokenHash: hash, TokenPrefix: "ghp_test", UserID: user.ID, GitHubTokenID: gt.ID,
+			Repository: "org/repo", Scopes: json.RawMessage(`{}`), SessionID: session, ExpiresAt: expires}
+	}
+
+	// Expired tokens and other sessions don't count.
+	if err := store.CreateProxyToken(ctx, newToken("expired", "agent", time.Now().Add(-time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateProxyToken(ctx, newToken("other", "agent-2", time.Now().Add(time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	first := newToken("first", "agent", time.Now().Add(time.Hour))
+	if replaced, err := store.CreateSessionProxyToken(ctx, first, false); err != nil || len(replaced) != 0 {
+		t.Fatalf("first = %v, %v; want created", replaced, err)
+	}
+
+	if _, err := store.CreateSessionProxyToken(ctx, newToken("second", "agent", time.Now().Add(time.Hour)), false); !errors.Is(err, ErrSessionActive) {
+		t.Errorf("second without replace: err = %v, want ErrSessionActive", err)
+	}
+	if got, _ := store.GetProxyTokenByHash(ctx, "second"); got != nil {
+		t.Error("refused token was stored")
+	}
+
+	replaced, err := store.CreateSessionProxyToken(ctx, newToken("second", "agent", time.Now().Add(time.Hour)), true)
+	if err != nil || !reflect.DeepEqual(replaced, []string{first.ID}) {
+		t.Fatalf("second with replace = %v, %v; want [%s]", replaced, err, first.ID)
+	}
+	if got, _ := store.GetProxyTokenByID(ctx, first.ID); got.RevokedAt == nil {
+		t.Error("replaced token not revoked")
+	}
+	if got, _ := store.GetProxyTokenByHash(ctx, "other"); got.RevokedAt != nil {
+		t.Error("another session's token was revoked")
+	}
+}
+
+func TestSessions(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+
+	user := &User{GitHubID: 1, GitHubUsername: "alice", Role: "user"}
+	if err := store.UpsertUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i, hash := range []string{"live", "expired"} {
+		expires := now.Add(time.Hour)
+		if i == 1 {
+			expires = now.Add(-time.Second)
+		}
+		err := store.CreateSession(ctx, &Session{
+			TokenHash: hash, UserID: user.ID, Username: "alice", Role: "user",
+			CreatedAt: now, ExpiresAt: expires, LastUsedAt: now, RoleCheckedAt: now,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	later := now.Add(time.Minute)
+	if err := store.TouchSession(ctx, "live", later); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetUserSessionsRole(ctx, user.ID, "admin", later); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.GetSession(ctx, "live")
+	if err != nil || got == nil {
+		t.Fatalf("GetSession = %v, %v", got, err)
+	}
+	if got.Role != "admin" || !got.LastUsedAt.Equal(later) || !got.RoleCheckedAt.Equal(later) {
+		t.Errorf("session = %+v, want admin used and checked at %v", got, later)
+	}
+
+	if n, err := store.DeleteExpiredSessions(ctx, now); err != nil || n != 1 {
+		t.Errorf("DeleteExpiredSessions = %d, %v; want 1", n, err)
+	}
+	if got, _ := store.GetSession(ctx, "expired"); got != nil {
+		t.Error("expired session survived")
+	}
+
+	// Purging the user ends their sessions.
+	if _, err := store.PurgeUser(ctx, user.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if sessions, err := store.ListUserSessions(ctx, user.ID); err != nil || len(sessions) != 0 {
+		t.Errorf("ListUserSessions after purge = %d, %v", len(sessions), err)
+	}
+}
+
+func TestArchiveProxyTokens(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+
+	user := &User{GitHubID: 1, GitHubUsername: "alice", Role: "user"}
+	if err := store.UpsertUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	gt := &GitHubToken{UserID: user.ID, AccessToken: "a", RefreshToken: "r",
+		AccessTokenExpiresAt: time.Now().Add(time.Hour), RefreshTokenExpiresAt: time.Now().Add(time.Hour)}
+	if err := store.UpsertGitHubToken(ctx, gt); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	ids := make(map[string]string)
+	for name, expires := range map[string]time.Time{
+		"live":             now.Add(time.Hour),
+		"expired":          now.Add(-48 * time.Hour),
+		"recently-expired": now.Add(-time.Hour),
+		"revoked":          now.Add(time.Hour),
+	} {
+		pt := &ProxyToken{TokenHash: name, TokenPrefix: "ghp_" + name, UserID: user.ID, GitHubTokenID: gt.ID,
+			Repository: "org/" + name, Scopes: json.RawMessage(`{"contents":"read"}`), ExpiresAt: expires}
+		if err := store.CreateProxyToken(ctx, pt); err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = pt.ID
+	}
+	if err := store.UpdateProxyTokenUsage(ctx, ids["expired"]); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RevokeProxyToken(ctx, ids["revoked"]); err != nil {
+		t.Fatal(err)
+	}
+	expiredID := ids["expired"]
+	if err := store.CreateAuditEntry(ctx, &AuditEntry{UserID: user.ID, ProxyTokenID: &expiredID, Action: "proxy_request"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the token dead for more than a day is archived.
+	if n, err := store.ArchiveProxyTokens(ctx, now.Add(-24*time.Hour)); err != nil || n != 1 {
+		t.Fatalf("ArchiveProxyTokens = %d, %v; want 1", n, err)
+	}
+	if pt, _ := store.GetProxyTokenByID(ctx, ids["expired"]); pt != nil {
+		t.Error("archived token is still live")
+	}
+	archived, err := store.ListArchivedProxyTokens(ctx, ArchiveFilter{UserID: user.ID})
+	if err != nil || len(archived) != 1 {
+		t.Fatalf("ListArchivedProxyTokens = %d, %v; want 1", len(archived), err)
+	}
+	if a := archived[0]; a.ID != ids["expired"] || a.Repository != "org/expired" || a.RequestCount != 1 || a.ArchivedAt.IsZero() {
+		t.Errorf("archived token = %+v", a)
+	}
+
+	// Its audit entry still names it, and its requests still count.
+	entries, err := store.ListAuditEntries(ctx, AuditFilter{TokenID: ids["expired"]})
+	if err != nil || len(entries) != 1 {
+		t.Errorf("audit entries for the archived token = %d, %v; want 1", len(entries), err)
+	}
+	stats, err := store.TokenStatsByRepo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests int64
+	for _, st := range stats {
+		requests += st.Requests
+	}
+	if len(stats) != 4 || requests != 1 {
+		t.Errorf("TokenStatsByRepo = %d repositories, %d requests; want 4, 1", len(stats), requests)
+	}
+
+	// A later cutoff archives every dead token.
+	if n, err := store.ArchiveProxyTokens(ctx, time.Now()); err != nil || n != 2 {
+		t.Fatalf("ArchiveProxyTokens = %d, %v; want 2", n, err)
+	}
+	for filter, want := range map[ArchiveFilter]int{
+		{}:                          3,
+		{Repository: "org/revoked"}: 1,
+		{UserID: "nobody"}:          0,
+		{Limit: 2}:                  2,
+		{Limit: 2, Offset: 2}:       1,
+	} {
+		if got, err := store.ListArchivedProxyTokens(ctx, filter); err != nil || len(got) != want {
+			t.Errorf("ListArchivedProxyTokens(%+v) = %d, %v; want %d", filter, len(got), err, want)
+		}
+	}
+
+	// Purging the user takes the archive with them.
+	res, err := store.PurgeUser(ctx, user.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ProxyTokens != 4 {
+		t.Errorf("purged %d proxy tokens, want 4", res.ProxyTokens)
+	}
+	if got, _ := store.ListArchivedProxyTokens(ctx, ArchiveFilter{}); len(got) != 0 {
+		t.Errorf("%d archived tokens survived the purge", len(got))
+	}
+	if entries, _ := store.ListAuditEntries(ctx, AuditFilter{TokenID: ids["expired"]}); len(entries) != 0 {
+		t.Error("anonymized audit entry still names the purged token")
+	}
+}
+
+func TestPruneAuditEntries(t *testing.T) {
+	ctx := context.Background()
+
+	for _, archive := range []bool{false, true} {
+		t.Run(fmt.Sprintf("archive=%v", archive), func(t *testing.T) {
+			store := newTestStore(t)
+			user := &User{GitHubID: 1, GitHubUsername: "alice", Role: "user"}
+			if err := store.UpsertUser(ctx, user); err != nil {
+				t.Fatal(err)
+			}
+
+			// More old entries than one batch holds, and a recent one.
+			old := auditPruneBatch + 5
+			tx, err := store.db.BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < old; i++ {
+				ts := time.Now().Add(-48*time.Hour + time.Duration(i)*time.Second).UTC().Format(time.RFC3339Nano)
+				if _, err := tx.ExecContext(ctx,
+					`INSERT INTO audit_log (id, timestamp, user_id, action) VALUES (?, ?, ?, 'proxy_request')`,
+					fmt.Sprintf("a%05d", i), ts, user.ID); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.CreateAuditEntry(ctx, &AuditEntry{UserID: user.ID, Action: "proxy_request"}); err != nil {
+				t.Fatal(err)
+			}
+
+			n, err := store.PruneAuditEntries(ctx, time.Now().Add(-24*time.Hour), archive)
+			if err != nil || n != int64(old) {
+				t.Fatalf("PruneAuditEntries = %d, %v; want %d", n, err, old)
+			}
+			count := func(table string) int {
+				t.Helper()
+				var n int
+				if err := store.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM `+table).Scan(&n); err != nil {
+					t.Fatal(err)
+				}
+				return n
+			}
+			if n := count("audit_log"); n != 1 {
+				t.Errorf("%d entries kept, want 1", n)
+			}
+			wantArchived := 0
+			if archive {
+				wantArchived = old
+			}
+			if n := count("audit_log_archive"); n != wantArchived {
+				t.Errorf("%d entries archived, want %d", n, wantArchived)
+			}
+			if n, err := store.PruneAuditEntries(ctx, time.Now().Add(-24*time.Hour), archive); err != nil || n != 0 {
+				t.Errorf("second PruneAuditEntries = %d, %v; want 0", n, err)
+			}
+
+			// Purging the user reaches their archived entries too.
+			res, err := store.PurgeUser(ctx, user.ID, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.AuditEntries != int64(1+wantArchived) {
+				t.Errorf("purged %d audit entries, want %d", res.AuditEntries, 1+wantArchived)
+			}
+			if n := count("audit_log_archive"); n != 0 {
+				t.Errorf("%d archived entries survived the purge", n)
+			}
+		})
+	}
+}
@@ -2,14 +2,27 @@
 package metrics
 
 import (
+	"crypto/subtle"
+	"fmt"
+	"hash/fnv"
 	"log/slog"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goodtune/ghp/internal/config"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// The vecs below carry user and repo labels; record them through the helper
+// functions, which apply the configured label mode. The user label is the ghp
+// user ID rather than the GitHub login, so a renamed user keeps their series.
 var (
 	ProxyRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Name:    "ghp_proxy_request_duration_seconds",
@@ -22,6 +35,11 @@ var (
 		Help: "Total number of proxied requests.",
 	}, []string{"user", "repo", "method", "status"})
 
+	ProxyResponseClassTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ghp_proxy_response_class_total",
+		Help: "Total number of GitHub responses relayed by the proxy, by status class.",
+	}, []string{"class"})
+
 	TokenActive = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "ghp_token_active",
 		Help: "Number of active tokens per user.",
@@ -51,15 +69,287 @@ var (
 		Name: "ghp_github_token_refresh_total",
 		Help: "Total number of GitHub token refresh attempts.",
 	}, []string{"user", "status"})
+
+	UserRequestRate = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ghp_user_request_rate",
+		Help: "Estimated proxied requests per minute per user, over a sliding minute.",
+	}, []string{"user"})
+
+	PendingMigrations = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ghp_pending_migrations",
+		Help: "Number of database migrations not yet applied, as seen at startup.",
+	})
+
+	AuditPrunedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ghp_audit_pruned_total",
+		Help: "Total number of audit entries pruned by the retention policy, by action (delete or archive).",
+	}, []string{"action"})
+
+	AuditPrunedLastCycle = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ghp_audit_pruned_last_cycle",
+		Help: "Number of audit entries pruned by the most recent pruning cycle.",
+	})
+)
+
+// Label modes for the high-cardinality user and repo labels.
+const (
+	LabelModeFull     = "full"
+	LabelModeHash     = "hash"
+	LabelModeCollapse = "collapse"
+)
+
+// collapsedLabel replaces user and repo values in collapse mode.
+const collapsedLabel = "_"
+
+var (
+	labelMode    = LabelModeFull
+	labelBuckets = 32
+)
+
+// SetLabelMode sets how user and repo label values are recorded. It must be
+// called before any metrics are recorded.
+func SetLabelMode(mode string, buckets int) error {
+	switch mode {
+	case "", LabelModeFull:
+		mode = LabelModeFull
+	case LabelModeCollapse:
+	case LabelModeHash:
+		if buckets <= 0 {
+			return fmt.Errorf("metrics.label_buckets must be positive, got %d", buckets)
+		}
+	default:
+		return fmt.Errorf("unknown metrics.label_mode %q (want full, hash or collapse)", mode)
+	}
+	labelMode, labelBuckets = mode, buckets
+	return nil
+}
+
+// label maps a user or repo value according to the label mode.
+func label(v string) string {
+	switch labelMode {
+	case LabelModeCollapse:
+		return collapsedLabel
+	case LabelModeHash:
+		h := fnv.New32a()
+		h.Write([]byte(v))
+		return "bucket-" + strconv.Itoa(int(h.Sum32()%uint32(labelBuckets)))
+	}
+	return v
+}
+
+// ObserveProxyRequest records a proxied request.
+func ObserveProxyRequest(user, repo, method string, status int, d time.Duration) {
+	lv := []string{label(user), label(repo), method, strconv.Itoa(status)}
+	ProxyRequestDuration.WithLabelValues(lv...).Observe(d.Seconds())
+	ProxyRequestTotal.WithLabelValues(lv...).Inc()
+}
+
+var (
+	classMu     sync.Mutex
+	classCounts = make(map[string]int64)
+)
+
+// ProxyResponse records the status class (2xx to 5xx) of a response relayed
+// from GitHub.
+func ProxyResponse(status int) {
+	class := fmt.Sprintf("%dxx", status/100)
+	ProxyResponseClassTotal.WithLabelValues(class).Inc()
+	classMu.Lock()
+	classCounts[class]++
+	classMu.Unlock()
+}
+
+// TakeResponseClasses returns the responses recorded by ProxyResponse since
+// the previous call, by status class.
+func TakeResponseClasses() map[string]int64 {
+	classMu.Lock()
+	defer classMu.Unlock()
+	counts := classCounts
+	classCounts = make(map[string]int64)
+	return counts
+}
+
+// SetActiveTokens replaces the active token gauge with counts, keyed by
+// user. Users that collapse into the same label are summed.
+func SetActiveTokens(counts map[string]int64) {
+	byLabel := make(map[string]int64, len(counts))
+	for user, n := range counts {
+		byLabel[label(user)] += n
+	}
+	TokenActive.Reset()
+	for l, n := range byLabel {
+		TokenActive.WithLabelValues(l).Set(float64(n))
+	}
+}
+
+// TokenCreated counts a token created by user.
+func TokenCreated(user string) {
+	TokenCreatedTotal.WithLabelValues(label(user)).Inc()
+}
+
+// TokenRevoked counts a token of user's being revoked.
+func TokenRevoked(user string) {
+	TokenRevokedTotal.WithLabelValues(label(user)).Inc()
+}
+
+// SetGitHubRateLimit records the rate limit reported for user's GitHub token.
+func SetGitHubRateLimit(user string, remaining, limit int) {
+	GitHubRateLimitRemaining.WithLabelValues(label(user)).Set(float64(remaining))
+	GitHubRateLimitLimit.WithLabelValues(label(user)).Set(float64(limit))
+}
+
+var (
+	rateMu     sync.Mutex
+	userRates  = make(map[string]float64)         // keyed by user
+	labelRates = make(map[string]map[string]bool) // users under each label
 )
 
-// Serve starts the Prometheus metrics server on the given address.
-func Serve(addr string, logger *slog.Logger) {
+// SetUserRequestRate records user's estimated requests per minute. Users
+// that collapse into the same label are summed.
+func SetUserRequestRate(user string, perMinute float64) {
+	rateMu.Lock()
+	defer rateMu.Unlock()
+	l := label(user)
+	if labelRates[l] == nil {
+		labelRates[l] = make(map[string]bool)
+	}
+	labelRates[l][user] = true
+	userRates[user] = perMinute
+	setLabelRate(l)
+}
+
+// ForgetUserRequestRate drops user's request rate once they are idle. The
+// series goes when no other user shares its label.
+func ForgetUserRequestRate(user string) {
+	rateMu.Lock()
+	defer rateMu.Unlock()
+	l := label(user)
+	delete(userRates, user)
+	delete(labelRates[l], user)
+	if len(labelRates[l]) == 0 {
+		delete(labelRates, l)
+		UserRequestRate.DeleteLabelValues(l)
+		return
+	}
+	setLabelRate(l)
+}
+
+// setLabelRate sets the rate gauge for l to the sum of its users' rates.
+// rateMu must be held.
+func setLabelRate(l string) {
+	var sum float64
+	for user := range labelRates[l] {
+		sum += userRates[user]
+	}
+	UserRequestRate.WithLabelValues(l).Set(sum)
+}
+
+// GitHubTokenRefresh counts a GitHub token refresh attempt with its outcome.
+func GitHubTokenRefresh(user, status string) {
+	GitHubTokenRefreshTotal.WithLabelValues(label(user), status).Inc()
+}
+
+// AuditPruned records a pruning cycle that deleted or archived n entries.
+func AuditPruned(action string, n int64) {
+	AuditPrunedTotal.WithLabelValues(action).Add(float64(n))
+	AuditPrunedLastCycle.Set(float64(n))
+}
+
+// Serve starts the Prometheus metrics server on the configured address. It
+// returns once the listener is bound, so a bad configuration or an address in
+// use is reported to the caller rather than only logged.
+func Serve(cfg config.MetricsConfig, logger *slog.Logger) error {
+	h, err := Handler(cfg)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return fmt.Errorf("metrics.listen: %w", err)
+	}
 	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/metrics", h)
+
+	logger.Info("metrics server starting", "listen", ln.Addr().String())
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			logger.Error("metrics server failed", "error", err)
+		}
+	}()
+	return nil
+}
+
+// Handler returns the /metrics handler, wrapped with the source network
+// restriction and authentication configured in cfg.
+func Handler(cfg config.MetricsConfig) (http.Handler, error) {
+	var nets []*net.IPNet
+	for _, c := range cfg.AllowedCIDRs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("metrics.allowed_cidrs: %w", err)
+		}
+		nets = append(nets, n)
+	}
+	if (cfg.Auth.Username == "") != (cfg.Auth.Password == "") {
+		return nil, fmt.Errorf("metrics.auth: username and password must be set together")
+	}
+
+	next := promhttp.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(nets) > 0 && !sourceAllowed(r.RemoteAddr, nets) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if !authorized(r, cfg.Auth) {
+			if cfg.Auth.Username != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="ghp metrics"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}), nil
+}
 
-	logger.Info("metrics server starting", "listen", addr)
-	if err := http.ListenAndServe(addr, mux); err != nil {
-		logger.Error("metrics server failed", "error", err)
+// authorized reports whether r carries the configured credentials. Either a
+// bearer token or basic auth is accepted when configured; with neither set
+// every request is authorized.
+func authorized(r *http.Request, a config.MetricsAuthConfig) bool {
+	if a.BearerToken == "" && a.Username == "" {
+		return true
+	}
+	if a.BearerToken != "" {
+		if tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && equal(tok, a.BearerToken) {
+			return true
+		}
+	}
+	if a.Username != "" {
+		if user, pass, ok := r.BasicAuth(); ok && equal(user, a.Username) && equal(pass, a.Password) {
+			return true
+		}
+	}
+	return false
+}
+
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func sourceAllowed(remoteAddr string, nets []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
 	}
+	return false
 }
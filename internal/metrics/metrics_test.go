@@ -0,0 +1,205 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/goodtune/ghp/internal/config"
+)
+
+func TestHandlerUnauthenticatedByDefault(t *testing.T) {
+	h, err := Handler(config.MetricsConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want 200", rec.Code)
+	}
+}
+
+func TestHandlerBearerToken(t *testing.T) {
+	h, err := Handler(config.MetricsConfig{Auth: config.MetricsAuthConfig{BearerToken: "s3cret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"missing", "", http.StatusUnauthorized},
+		{"wrong", "Bearer nope", http.StatusUnauthorized},
+		{"wrong scheme", "Basic s3cret", http.StatusUnauthorized},
+		{"correct", "Bearer s3cret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if tt.want == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("missing WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestHandlerBasicAuth(t *testing.T) {
+	h, err := Handler(config.MetricsConfig{Auth: config.MetricsAuthConfig{Username: "prom", Password: "pw"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		user, pass string
+		want       int
+	}{
+		{"prom", "pw", http.StatusOK},
+		{"prom", "bad", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.SetBasicAuth(tt.user, tt.pass)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s:%s: status = %d, want %d", tt.user, tt.pass, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestHandlerAllowedCIDRs(t *testing.T) {
+	h, err := Handler(config.MetricsConfig{AllowedCIDRs: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]int{
+		"10.1.2.3:5555":    http.StatusOK,
+		"192.168.1.1:5555": http.StatusForbidden,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.RemoteAddr = addr
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("%s: status = %d, want %d", addr, rec.Code, want)
+		}
+	}
+
+	if _, err := Handler(config.MetricsConfig{AllowedCIDRs: []string{"not-a-cidr"}}); err == nil {
+		t.Error("expected error for invalid CIDR")
+	}
+}
+
+func TestServeReportsBadConfig(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if err := Serve(config.MetricsConfig{Listen: "127.0.0.1:0", AllowedCIDRs: []string{"not-a-cidr"}}, logger); err == nil {
+		t.Error("Serve with an invalid CIDR succeeded, want error")
+	}
+	if err := Serve(config.MetricsConfig{Listen: "not-an-address"}, logger); err == nil {
+		t.Error("Serve with an invalid listen address succeeded, want error")
+	}
+}
+
+func TestLabelModeCollapse(t *testing.T) {
+	if err := SetLabelMode(LabelModeCollapse, 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetLabelMode(LabelModeFull, 32) })
+
+	ObserveProxyRequest("alice", "org/repo", "GET", 200, time.Second)
+	ObserveProxyRequest("bob", "org/other", "GET", 200, time.Second)
+
+	if got := testutil.ToFloat64(ProxyRequestTotal.WithLabelValues(collapsedLabel, collapsedLabel, "GET", "200")); got != 2 {
+		t.Errorf("collapsed series = %v, want 2", got)
+	}
+	for _, user := range []string{"alice", "bob"} {
+		if got := testutil.ToFloat64(ProxyRequestTotal.WithLabelValues(user, "org/repo", "GET", "200")); got != 0 {
+			t.Errorf("series for %s = %v, want 0", user, got)
+		}
+	}
+}
+
+func TestLabelModeHash(t *testing.T) {
+	if err := SetLabelMode(LabelModeHash, 4); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetLabelMode(LabelModeFull, 32) })
+
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		seen[label(fmt.Sprintf("user%d", i))] = true
+	}
+	if len(seen) > 4 {
+		t.Errorf("got %d distinct labels, want at most 4", len(seen))
+	}
+	if label("alice") != label("alice") {
+		t.Error("hash labels are not stable")
+	}
+
+	if err := SetLabelMode(LabelModeHash, 0); err == nil {
+		t.Error("expected error for zero buckets")
+	}
+	if err := SetLabelMode("bogus", 0); err == nil {
+		t.Error("expected error for unknown mode")
+	}
+}
+
+func TestSetActiveTokens(t *testing.T) {
+	SetActiveTokens(map[string]int64{"alice": 2, "bob": 1})
+	if got := testutil.ToFloat64(TokenActive.WithLabelValues("alice")); got != 2 {
+		t.Errorf("alice = %v, want 2", got)
+	}
+
+	// A later reconcile drops users that no longer hold tokens.
+	SetActiveTokens(map[string]int64{"bob": 3})
+	if n := testutil.CollectAndCount(TokenActive); n != 1 {
+		t.Errorf("got %d series, want 1", n)
+	}
+
+	if err := SetLabelMode(LabelModeCollapse, 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetLabelMode(LabelModeFull, 32) })
+	SetActiveTokens(map[string]int64{"alice": 2, "bob": 3})
+	if got := testutil.ToFloat64(TokenActive.WithLabelValues(collapsedLabel)); got != 5 {
+		t.Errorf("collapsed = %v, want 5", got)
+	}
+}
+
+func TestUserRequestRateCollapse(t *testing.T) {
+	if err := SetLabelMode(LabelModeCollapse, 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetLabelMode(LabelModeFull, 32) })
+
+	SetUserRequestRate("alice", 10)
+	SetUserRequestRate("bob", 5)
+	if got := testutil.ToFloat64(UserRequestRate.WithLabelValues(collapsedLabel)); got != 15 {
+		t.Errorf("collapsed rate = %v, want 15", got)
+	}
+
+	// An idle user leaves the others' rate in place.
+	ForgetUserRequestRate("alice")
+	if got := testutil.ToFloat64(UserRequestRate.WithLabelValues(collapsedLabel)); got != 5 {
+		t.Errorf("collapsed rate after alice idles = %v, want 5", got)
+	}
+	ForgetUserRequestRate("bob")
+	if n := testutil.CollectAndCount(UserRequestRate); n != 0 {
+		t.Errorf("got %d series once everyone idles, want 0", n)
+	}
+}
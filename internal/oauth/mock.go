@@ -0,0 +1,40 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+)
+
+// Mock is a Client for tests, answering with its functions. A nil function
+// fails the call.
+type Mock struct {
+	ExchangeCodeFunc func(ctx context.Context, code string) (*Token, error)
+	GetUserFunc      func(ctx context.Context, accessToken string) (*User, error)
+	RefreshTokenFunc func(ctx context.Context, refreshToken string) (*Token, error)
+}
+
+var errNotMocked = errors.New("oauth: call not mocked")
+
+// ExchangeCode implements Client.
+func (m *Mock) ExchangeCode(ctx context.Context, code string) (*Token, error) {
+	if m.ExchangeCodeFunc == nil {
+		return nil, errNotMocked
+	}
+	return m.ExchangeCodeFunc(ctx, code)
+}
+
+// GetUser implements Client.
+func (m *Mock) GetUser(ctx context.Context, accessToken string) (*User, error) {
+	if m.GetUserFunc == nil {
+		return nil, errNotMocked
+	}
+	return m.GetUserFunc(ctx, accessToken)
+}
+
+// RefreshToken implements Client.
+func (m *Mock) RefreshToken(ctx context.Context, refreshToken string) (*Token, error) {
+	if m.RefreshTokenFunc == nil {
+		return nil, errNotMocked
+	}
+	return m.RefreshTokenFunc(ctx, refreshToken)
+}
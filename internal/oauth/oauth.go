@@ -0,0 +1,178 @@
+// Package oauth talks to GitHub's OAuth endpoints on behalf of ghp's GitHub
+// App: exchanging login codes, refreshing user tokens and identifying users.
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/goodtune/ghp/internal/config"
+)
+
+// defaultExpiresIn is assumed, in seconds, when GitHub doesn't say how long
+// an access token lasts.
+const defaultExpiresIn = 8 * 60 * 60
+
+// RefreshSkew is how long before its expiry a stored access token is
+// refreshed rather than used.
+const RefreshSkew = 5 * time.Minute
+
+// ErrInvalidClient reports that GitHub rejected the configured OAuth app
+// credentials, so no stored refresh token can be exchanged until users sign in
+// again.
+var ErrInvalidClient = errors.New("OAuth app credentials rejected")
+
+// Token is GitHub's response to a code exchange or token refresh.
+type Token struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	// Scope lists the granted OAuth scopes, comma-separated; it is empty
+	// for GitHub App user-to-server tokens.
+	Scope string `json:"scope"`
+}
+
+// User is the GitHub account an access token belongs to.
+type User struct {
+	ID    int64  `json:"id"`
+	Login string `json:"login"`
+	Email string `json:"email"`
+}
+
+// Client is the part of GitHub that ghp's logins and token refreshes need.
+type Client interface {
+	// ExchangeCode trades the code from an OAuth callback for tokens.
+	ExchangeCode(ctx context.Context, code string) (*Token, error)
+	// GetUser returns the user an access token belongs to.
+	GetUser(ctx context.Context, accessToken string) (*User, error)
+	// RefreshToken trades a refresh token for new tokens. It returns an
+	// error wrapping ErrInvalidClient if GitHub rejects the app's
+	// credentials.
+	RefreshToken(ctx context.Context, refreshToken string) (*Token, error)
+}
+
+// HTTPClient is the Client that calls GitHub.
+type HTTPClient struct {
+	cfg     config.GitHubConfig
+	apiBase string
+	client  *http.Client
+}
+
+// NewClient returns a Client for the OAuth app in cfg, making its requests
+// with client.
+func NewClient(cfg config.GitHubConfig, client *http.Client) *HTTPClient {
+	return &HTTPClient{cfg: cfg, apiBase: strings.TrimSuffix(cfg.APIBaseURL, "/"), client: client}
+}
+
+// tokenResponse is the JSON from GitHub's OAuth token endpoint.
+type tokenResponse struct {
+	Token
+	Error     string `json:"error"`
+	ErrorDesc string `json:"error_description"`
+}
+
+// ExchangeCode implements Client.
+func (c *HTTPClient) ExchangeCode(ctx context.Context, code string) (*Token, error) {
+	resp, body, err := c.postToken(ctx, url.Values{"code": {code}})
+	if err != nil {
+		return nil, err
+	}
+	var result tokenResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("parsing token response (status %d): %w", resp.StatusCode, err)
+	}
+	if result.Error != "" {
+		return nil, fmt.Errorf("OAuth error: %s", result.Error)
+	}
+	if result.ExpiresIn == 0 {
+		result.ExpiresIn = defaultExpiresIn
+	}
+	return &result.Token, nil
+}
+
+// RefreshToken implements Client.
+func (c *HTTPClient) RefreshToken(ctx context.Context, refreshToken string) (*Token, error) {
+	resp, body, err := c.postToken(ctx, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// invalid_client may come with an error status or a 200.
+	var result tokenResponse
+	jsonErr := json.Unmarshal(body, &result)
+	if result.Error == "invalid_client" {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidClient, result.ErrorDesc)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("refresh endpoint returned %d: %s", resp.StatusCode, body)
+	}
+	if jsonErr != nil {
+		return nil, fmt.Errorf("parsing refresh response: %w", jsonErr)
+	}
+	if result.Error != "" {
+		return nil, fmt.Errorf("refresh error: %s: %s", result.Error, result.ErrorDesc)
+	}
+	return &result.Token, nil
+}
+
+// postToken posts form, with the app's credentials, to GitHub's OAuth token
+// endpoint and returns the response with its body read.
+func (c *HTTPClient) postToken(ctx context.Context, form url.Values) (*http.Response, []byte, error) {
+	form.Set("client_id", c.cfg.ClientID)
+	form.Set("client_secret", c.cfg.ClientSecret)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.cfg.OAuthURL("/login/oauth/access_token"),
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("executing token request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading token response: %w", err)
+	}
+	return resp, body, nil
+}
+
+// GetUser implements Client.
+func (c *HTTPClient) GetUser(ctx context.Context, accessToken string) (*User, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.apiBase+"/user", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("GitHub API returned %d: %s", resp.StatusCode, body)
+	}
+
+	var user User
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
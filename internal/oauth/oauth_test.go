@@ -0,0 +1,86 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/goodtune/ghp/internal/config"
+)
+
+func TestExchangeCodeUsesOAuthHost(t *testing.T) {
+	var gotPath, gotCode string
+	ghes := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotCode = r.PostFormValue("code")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  "ghu_access",
+			"refresh_token": "ghr_refresh",
+			"expires_in":    3600,
+		})
+	}))
+	defer ghes.Close()
+
+	cfg := config.Defaults()
+	cfg.GitHub.OAuthHost = ghes.URL
+	tok, err := NewClient(cfg.GitHub, ghes.Client()).ExchangeCode(context.Background(), "code123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotPath != "/login/oauth/access_token" || gotCode != "code123" {
+		t.Errorf("token exchange posted code %q to %q", gotCode, gotPath)
+	}
+	if tok.AccessToken != "ghu_access" || tok.RefreshToken != "ghr_refresh" || tok.ExpiresIn != 3600 {
+		t.Errorf("ExchangeCode = %+v", tok)
+	}
+}
+
+func TestGetUser(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/user" || r.Header.Get("Authorization") != "Bearer ghu_access" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"id":42,"login":"alice","email":"alice@example.com"}`))
+	}))
+	defer api.Close()
+
+	c := NewClient(config.Defaults().GitHub, api.Client())
+	c.apiBase = api.URL
+	user, err := c.GetUser(context.Background(), "ghu_access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *user != (User{ID: 42, Login: "alice", Email: "alice@example.com"}) {
+		t.Errorf("GetUser = %+v", user)
+	}
+	if _, err := c.GetUser(context.Background(), "ghu_other"); err == nil {
+		t.Error("GetUser with a rejected token succeeded")
+	}
+}
+
+func TestRefreshTokenInvalidClient(t *testing.T) {
+	for _, status := range []int{http.StatusOK, http.StatusUnauthorized} {
+		oauth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/login/oauth/access_token" || r.PostFormValue("grant_type") != "refresh_token" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			w.Write([]byte(`{"error":"invalid_client","error_description":"The client_id and/or client_secret passed are incorrect."}`))
+		}))
+
+		cfg := config.Defaults()
+		cfg.GitHub.OAuthHost = oauth.URL
+		_, err := NewClient(cfg.GitHub, oauth.Client()).RefreshToken(context.Background(), "ghr_refresh")
+		if !errors.Is(err, ErrInvalidClient) {
+			t.Errorf("status %d: RefreshToken err = %v, want ErrInvalidClient", status, err)
+		}
+		oauth.Close()
+	}
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// auditCoalescer remembers each token's latest audit entry so that rapid
+// identical repeats can be folded into it instead of adding new rows.
+type auditCoalescer struct {
+	window time.Duration
+
+	mu    sync.Mutex
+	last  map[string]*coalescedEntry // keyed by proxy token ID
+	swept time.Time
+}
+
+type coalescedEntry struct {
+	key     string
+	entryID string
+	meta    json.RawMessage
+	count   int
+	seen    time.Time
+}
+
+func newAuditCoalescer(window time.Duration) *auditCoalescer {
+	return &auditCoalescer{window: window, last: make(map[string]*coalescedEntry)}
+}
+
+// repeat reports whether a request keyed by key repeats the token's previous
+// entry within the window. If so it returns that entry's ID and its metadata
+// updated with the new repeat count.
+func (c *auditCoalescer) repeat(tokenID, key string, now time.Time) (string, json.RawMessage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.last[tokenID]
+	if e == nil || e.key != key || now.Sub(e.seen) > c.window {
+		return "", nil, false
+	}
+	e.count++
+	e.seen = now
+	return e.entryID, withCount(e.meta, e.count), true
+}
+
+// record remembers a newly written entry as the token's latest.
+func (c *auditCoalescer) record(tokenID, key, entryID string, meta json.RawMessage, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Once a window, forget tokens whose entries can no longer coalesce.
+	if now.Sub(c.swept) > c.window {
+		for id, e := range c.last {
+			if now.Sub(e.seen) > c.window {
+				delete(c.last, id)
+			}
+		}
+		c.swept = now
+	}
+	c.last[tokenID] = &coalescedEntry{key: key, entryID: entryID, meta: meta, count: 1, seen: now}
+}
+
+// coalesceKey identifies requests that coalesce with one another.
+func coalesceKey(action, method, path string, status int) string {
+	return action + " " + method + " " + path + " " + strconv.Itoa(status)
+}
+
+// withCount returns meta with its "count" field set to n.
+func withCount(meta json.RawMessage, n int) json.RawMessage {
+	m := map[string]any{}
+	if len(meta) > 0 {
+		if err := json.Unmarshal(meta, &m); err != nil {
+			m = map[string]any{}
+		}
+	}
+	m["count"] = n
+	b, _ := json.Marshal(m)
+	return b
+}
@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/goodtune/ghp/internal/apierr"
+	"github.com/goodtune/ghp/internal/database"
+	"github.com/goodtune/ghp/internal/metrics"
+	"github.com/goodtune/ghp/internal/token"
+)
+
+// Git smart HTTP services. git-upload-pack serves clones and fetches,
+// git-receive-pack serves pushes.
+const (
+	gitUploadPack  = "git-upload-pack"
+	gitReceivePack = "git-receive-pack"
+)
+
+// gitRequestHeaders are the git client headers relayed to GitHub.
+// Git-Protocol selects protocol v2.
+var gitRequestHeaders = []string{"Accept", "Content-Type", "Content-Encoding", "User-Agent", "Git-Protocol"}
+
+// gitResponseHeaders are the GitHub response headers relayed to git.
+var gitResponseHeaders = []string{"Content-Type", "Cache-Control", "Expires", "Pragma"}
+
+// gitPath matches the git smart HTTP endpoints of a repository:
+// /{owner}/{repo}.git/info/refs and the pack services.
+var gitPath = regexp.MustCompile(`^/([^/]+)/([^/]+)\.git/(info/refs|` + gitUploadPack + `|` + gitReceivePack + `)$`)
+
+// IsGitPath reports whether path is a git smart HTTP endpoint GitRoutes
+// serves rather than passing on.
+func IsGitPath(path string) bool {
+	return gitPath.MatchString(path)
+}
+
+// GitRoutes serves git smart HTTP requests, so agents can clone, fetch and
+// push https://<ghp>/{owner}/{repo}.git with their ghp_ token as the
+// password, and passes every other request to next.
+func (h *Handler) GitRoutes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := gitPath.FindStringSubmatch(r.URL.Path)
+		if m == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h.handleGit(w, r, m[1], m[2], m[3])
+	})
+}
+
+// handleGit proxies one git smart HTTP request. Fetching needs
+// contents:read and pushing contents:write on the token's repository.
+func (h *Handler) handleGit(w http.ResponseWriter, r *http.Request, owner, name, endpoint string) {
+	start := time.Now()
+	repo := owner + "/" + name
+
+	// Refs are advertised by GET .../info/refs?service=...; the service
+	// itself is a POST to its own endpoint.
+	service, method := endpoint, http.MethodPost
+	if endpoint == "info/refs" {
+		service, method = r.URL.Query().Get("service"), http.MethodGet
+	}
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, apierr.MethodNotAllowed, fmt.Sprintf("%s requests are not allowed here", r.Method))
+		return
+	}
+	upstreamPath := "/" + url.PathEscape(owner) + "/" + url.PathEscape(name) + ".git/" + endpoint
+	level := "read"
+	switch service {
+	case gitUploadPack:
+	case gitReceivePack:
+		level = "write"
+	default:
+		// The dumb HTTP protocol isn't supported.
+		writeError(w, http.StatusBadRequest, apierr.InvalidRequest, "Only the git smart HTTP protocol is supported")
+		return
+	}
+
+	ghpToken := extractGitToken(r)
+	if ghpToken == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="ghp"`)
+		writeError(w, http.StatusUnauthorized, apierr.Unauthenticated, "Use a ghp_ token as the password")
+		return
+	}
+	pt := h.admit(w, r, ghpToken, start)
+	if pt == nil {
+		return
+	}
+
+	if !strings.EqualFold(repo, pt.Repository) {
+		writeError(w, http.StatusForbidden, apierr.ScopeDenied,
+			fmt.Sprintf("Token is scoped to %s, not %s", pt.Repository, repo))
+		h.logRequest(r, pt, r.URL.Path, repo, http.StatusForbidden, time.Since(start), "proxy_scope_denied", nil)
+		return
+	}
+	scopes, err := database.ParseScopes(pt.Scopes)
+	if err != nil {
+		h.logger.Error("failed to parse token scopes", "error", err)
+		writeError(w, http.StatusInternalServerError, apierr.Internal, "Internal error")
+		return
+	}
+	if !scopes.HasPermission("contents", level) {
+		writeError(w, http.StatusForbidden, apierr.ScopeDenied,
+			fmt.Sprintf("Token does not have permission for contents:%s on %s", level, pt.Repository))
+		h.logRequest(r, pt, r.URL.Path, repo, http.StatusForbidden, time.Since(start), "proxy_scope_denied", nil)
+		return
+	}
+
+	// A clone or push is one ref advertisement plus one pack request; only
+	// the pack request counts against the token's budget.
+	charged := endpoint != "info/refs"
+
+	if h.recordOnly() {
+		if !charged || h.charge(w, r, pt, r.URL.Path, repo, start) {
+			h.recordRequest(w, r, pt, r.URL.Path, repo, "contents", level, start)
+		}
+		return
+	}
+
+	gt, err := h.loadGitHubToken(r.Context(), pt)
+	if err != nil {
+		h.logger.Error("failed to get GitHub token", "error", err)
+		writeError(w, http.StatusInternalServerError, apierr.GitHubTokenMissing, "Failed to retrieve GitHub credentials")
+		return
+	}
+	if level == "write" && h.cfg.Proxy.GitHubScopeCheck == "block" {
+		if missing := token.MissingOAuthScopes(gt.Scopes, map[string]string{"contents": level}); len(missing) > 0 {
+			writeError(w, http.StatusForbidden, apierr.InsufficientScope,
+				fmt.Sprintf("Your GitHub token lacks the %s scope needed for contents:write; sign in to ghp again to grant it",
+					strings.Join(missing, ", ")))
+			h.logRequest(r, pt, r.URL.Path, repo, http.StatusForbidden, time.Since(start), "proxy_github_scope_missing", nil)
+			return
+		}
+	}
+	if charged && !h.charge(w, r, pt, r.URL.Path, repo, start) {
+		return
+	}
+	githubToken, err := h.accessToken(r.Context(), gt)
+	if err != nil {
+		h.logger.Error("failed to get GitHub token", "error", err)
+		writeError(w, http.StatusInternalServerError, apierr.GitHubTokenMissing, "Failed to retrieve GitHub credentials")
+		if charged {
+			h.refund(r.Context(), pt)
+		}
+		return
+	}
+
+	status := h.forwardGit(w, r, upstreamPath, githubToken)
+	if pt.MaxRequests == 0 {
+		if err := h.tokenService.RecordUsage(r.Context(), pt.ID); err != nil {
+			h.logger.Error("failed to record token usage", "error", err)
+		}
+	} else if charged && status >= http.StatusInternalServerError {
+		h.refund(r.Context(), pt)
+	}
+	h.logRequest(r, pt, r.URL.Path, repo, status, time.Since(start), "proxy_request", nil)
+}
+
+// forwardGit streams a git request to GitHub and its response back, with
+// the user's GitHub token as the credential. Packs can be large and slow,
+// so nothing is buffered and the proxy's request timeout doesn't apply.
+func (h *Handler) forwardGit(w http.ResponseWriter, r *http.Request, path, githubToken string) int {
+	targetURL := h.gitBase + path
+	if r.URL.RawQuery != "" {
+		targetURL += "?" + r.URL.RawQuery
+	}
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, targetURL, r.Body)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, apierr.Internal, "Failed to create upstream request")
+		return http.StatusInternalServerError
+	}
+	for _, key := range gitRequestHeaders {
+		if v := r.Header.Get(key); v != "" {
+			req.Header.Set(key, v)
+		}
+	}
+	req.ContentLength = r.ContentLength
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x-access-token:"+githubToken)))
+
+	resp, err := h.gitClient.Do(req)
+	if err != nil {
+		h.logger.Error("upstream git request failed", "error", err)
+		writeError(w, http.StatusBadGateway, apierr.UpstreamError, "Upstream request failed")
+		return http.StatusBadGateway
+	}
+	defer resp.Body.Close()
+
+	for _, key := range gitResponseHeaders {
+		if v := resp.Header.Get(key); v != "" {
+			w.Header().Set(key, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				break
+			}
+			rc.Flush()
+		}
+		if err != nil {
+			if err != io.EOF {
+				h.logger.Warn("upstream git response interrupted", "error", err)
+			}
+			break
+		}
+	}
+
+	metrics.ProxyResponse(resp.StatusCode)
+	return resp.StatusCode
+}
+
+// extractGitToken extracts the ghp_ token from a git request. Git sends
+// credentials with Basic auth; the token may be the password (any
+// username) or the username. Token and Bearer headers work as for the API.
+func extractGitToken(r *http.Request) string {
+	if tok := extractToken(r); tok != "" {
+		return tok
+	}
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return ""
+	}
+	for _, tok := range []string{pass, user} {
+		if strings.HasPrefix(tok, token.Prefix) {
+			return tok
+		}
+	}
+	return ""
+}
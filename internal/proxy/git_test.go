@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goodtune/ghp/internal/apierr"
+	"github.com/goodtune/ghp/internal/config"
+	"github.com/goodtune/ghp/internal/token"
+)
+
+func TestGitRoutes(t *testing.T) {
+	var got *http.Request
+	var gotBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ := io.ReadAll(r.Body)
+		gotBody = string(body)
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Write([]byte("0008NAK\n"))
+	}))
+	defer upstream.Close()
+
+	store := newTestStore(t)
+	store.addToken("ghp_reader", time.Now().Add(time.Hour), false)
+	store.addScopedToken("ghp_writer", `{"contents":"write"}`, time.Now().Add(time.Hour), false)
+	cfg := config.Defaults()
+	h := NewHandler(cfg, token.NewService(store, cfg.Tokens.MaxDuration), store, store.enc,
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	h.gitBase = upstream.URL
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	routes := h.GitRoutes(next)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		wantStatus int
+		wantCode   string
+	}{
+		{"not git", "GET", "/org/repo/info/refs", "ghp_reader", http.StatusTeapot, ""},
+		{"no credentials", "GET", "/org/repo.git/info/refs?service=git-upload-pack", "", http.StatusUnauthorized, apierr.Unauthenticated},
+		{"advertise for fetch", "GET", "/org/repo.git/info/refs?service=git-upload-pack", "ghp_reader", http.StatusOK, ""},
+		{"fetch", "POST", "/org/repo.git/git-upload-pack", "ghp_reader", http.StatusOK, ""},
+		{"dumb protocol", "GET", "/org/repo.git/info/refs", "ghp_reader", http.StatusBadRequest, apierr.InvalidRequest},
+		{"wrong method", "GET", "/org/repo.git/git-upload-pack", "ghp_reader", http.StatusMethodNotAllowed, apierr.MethodNotAllowed},
+		{"other repository", "GET", "/org/other.git/info/refs?service=git-upload-pack", "ghp_reader", http.StatusForbidden, apierr.ScopeDenied},
+		{"advertise for push without write", "GET", "/org/repo.git/info/refs?service=git-receive-pack", "ghp_reader", http.StatusForbidden, apierr.ScopeDenied},
+		{"push without write", "POST", "/org/repo.git/git-receive-pack", "ghp_reader", http.StatusForbidden, apierr.ScopeDenied},
+		{"push", "POST", "/org/repo.git/git-receive-pack", "ghp_writer", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = nil
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader("0000"))
+			req.Header.Set("Git-Protocol", "version=2")
+			req.Header.Set("Cookie", "ghp_session=x")
+			if tt.token != "" {
+				req.SetBasicAuth("x-access-token", tt.token)
+			}
+			rec := httptest.NewRecorder()
+			routes.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d; body = %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantCode != "" && !strings.Contains(rec.Body.String(), tt.wantCode) {
+				t.Errorf("body = %s, want code %s", rec.Body, tt.wantCode)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if got != nil {
+					t.Error("refused request reached GitHub")
+				}
+				return
+			}
+
+			if got == nil {
+				t.Fatal("request did not reach GitHub")
+			}
+			if got.URL.Path != strings.Split(tt.path, "?")[0] || got.URL.RawQuery != req.URL.RawQuery {
+				t.Errorf("upstream URL = %s", got.URL)
+			}
+			if user, pass, _ := got.BasicAuth(); user != "x-access-token" || pass != "gho_real" {
+				t.Errorf("upstream credentials = %s:%s, want the user's GitHub token", user, pass)
+			}
+			if got.Header.Get("Git-Protocol") != "version=2" || got.Header.Get("Cookie") != "" {
+				t.Errorf("upstream headers = %v", got.Header)
+			}
+			if tt.method == "POST" && gotBody != "0000" {
+				t.Errorf("upstream body = %q", gotBody)
+			}
+			if rec.Body.String() != "0008NAK\n" || rec.Header().Get("Content-Type") != "application/x-git-upload-pack-result" ||
+				rec.Header().Get("Set-Cookie") != "" {
+				t.Errorf("response = %v %q", rec.Header(), rec.Body)
+			}
+		})
+	}
+}
+
+func TestGitCloneChargesOnce(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0008NAK\n"))
+	}))
+	defer upstream.Close()
+
+	store := newTestStore(t)
+	store.addProxyToken("ghp_clone", `{"contents":"read"}`, time.Now().Add(time.Hour), false, 1)
+	cfg := config.Defaults()
+	h := NewHandler(cfg, token.NewService(store, cfg.Tokens.MaxDuration), store, store.enc,
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	h.gitBase = upstream.URL
+	routes := h.GitRoutes(http.NotFoundHandler())
+
+	// A clone is a ref advertisement and a pack request, together worth one
+	// request of the budget.
+	for _, step := range []struct{ method, path string }{
+		{"GET", "/org/repo.git/info/refs?service=git-upload-pack"},
+		{"POST", "/org/repo.git/git-upload-pack"},
+	} {
+		req := httptest.NewRequest(step.method, step.path, strings.NewReader("0000"))
+		req.SetBasicAuth("x-access-token", "ghp_clone")
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s %s: status = %d, want 200; body = %s", step.method, step.path, rec.Code, rec.Body)
+		}
+	}
+
+	tokens, err := store.ListProxyTokens(context.Background(), store.user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].RequestCount != 1 {
+		t.Errorf("token = %+v, want 1 request counted", tokens[0])
+	}
+}
@@ -0,0 +1,546 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// This file holds a small parser for GraphQL executable documents: enough
+// to see which operations, fields, arguments and fragments a request uses
+// so its scopes can be checked. It does not validate against GitHub's
+// schema; GitHub still does that.
+
+// gqlDocument is a parsed GraphQL request document.
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+// gqlOperation is a query, mutation or subscription.
+type gqlOperation struct {
+	kind       string // "query", "mutation" or "subscription"
+	name       string
+	defaults   map[string]any // variable default values
+	selections []gqlSelection
+}
+
+// gqlFragment is a named fragment definition.
+type gqlFragment struct {
+	typeCondition string
+	selections    []gqlSelection
+}
+
+// gqlSelection is a field, a fragment spread (spread set) or an inline
+// fragment (neither name nor spread set).
+type gqlSelection struct {
+	name       string
+	args       map[string]any
+	spread     string
+	selections []gqlSelection
+}
+
+// gqlVariable is a $variable reference in an argument value. Other values
+// parse to strings, numbers (as strings), bools, nil, []any and
+// map[string]any.
+type gqlVariable string
+
+// parseGraphQL parses a GraphQL executable document.
+func parseGraphQL(src string) (*gqlDocument, error) {
+	p := &gqlParser{lex: gqlLexer{src: src}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	doc := &gqlDocument{fragments: make(map[string]*gqlFragment)}
+	for p.tok.kind != gqlEOF {
+		switch {
+		case p.peek("{"):
+			sels, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &gqlOperation{kind: "query", selections: sels})
+		case p.peekName("query"), p.peekName("mutation"), p.peekName("subscription"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		case p.peekName("fragment"):
+			name, frag, err := p.fragment()
+			if err != nil {
+				return nil, err
+			}
+			if _, dup := doc.fragments[name]; dup {
+				return nil, fmt.Errorf("fragment %q is defined more than once", name)
+			}
+			doc.fragments[name] = frag
+		default:
+			return nil, p.unexpected()
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, fmt.Errorf("document has no operations")
+	}
+	return doc, nil
+}
+
+type gqlParser struct {
+	lex gqlLexer
+	tok gqlToken
+}
+
+func (p *gqlParser) advance() error {
+	tok, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *gqlParser) peek(punct string) bool {
+	return p.tok.kind == gqlPunct && p.tok.value == punct
+}
+
+func (p *gqlParser) peekName(name string) bool {
+	return p.tok.kind == gqlName && p.tok.value == name
+}
+
+func (p *gqlParser) unexpected() error {
+	if p.tok.kind == gqlEOF {
+		return fmt.Errorf("unexpected end of document")
+	}
+	return fmt.Errorf("unexpected %q at offset %d", p.tok.value, p.tok.pos)
+}
+
+func (p *gqlParser) expect(punct string) error {
+	if !p.peek(punct) {
+		return p.unexpected()
+	}
+	return p.advance()
+}
+
+func (p *gqlParser) name() (string, error) {
+	if p.tok.kind != gqlName {
+		return "", p.unexpected()
+	}
+	name := p.tok.value
+	return name, p.advance()
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	op := &gqlOperation{kind: p.tok.value, defaults: make(map[string]any)}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	if p.tok.kind == gqlName {
+		op.name = p.tok.value
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	if p.peek("(") {
+		if err := p.variableDefinitions(op.defaults); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.directives(); err != nil {
+		return nil, err
+	}
+	sels, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.selections = sels
+	return op, nil
+}
+
+func (p *gqlParser) variableDefinitions(defaults map[string]any) error {
+	if err := p.expect("("); err != nil {
+		return err
+	}
+	for !p.peek(")") {
+		if err := p.expect("$"); err != nil {
+			return err
+		}
+		name, err := p.name()
+		if err != nil {
+			return err
+		}
+		if err := p.expect(":"); err != nil {
+			return err
+		}
+		if err := p.typeRef(); err != nil {
+			return err
+		}
+		if p.peek("=") {
+			if err := p.advance(); err != nil {
+				return err
+			}
+			v, err := p.value()
+			if err != nil {
+				return err
+			}
+			defaults[name] = v
+		}
+		if err := p.directives(); err != nil {
+			return err
+		}
+	}
+	return p.advance()
+}
+
+func (p *gqlParser) typeRef() error {
+	if p.peek("[") {
+		if err := p.advance(); err != nil {
+			return err
+		}
+		if err := p.typeRef(); err != nil {
+			return err
+		}
+		if err := p.expect("]"); err != nil {
+			return err
+		}
+	} else if _, err := p.name(); err != nil {
+		return err
+	}
+	if p.peek("!") {
+		return p.advance()
+	}
+	return nil
+}
+
+func (p *gqlParser) fragment() (string, *gqlFragment, error) {
+	if err := p.advance(); err != nil {
+		return "", nil, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return "", nil, err
+	}
+	if !p.peekName("on") {
+		return "", nil, p.unexpected()
+	}
+	if err := p.advance(); err != nil {
+		return "", nil, err
+	}
+	typ, err := p.name()
+	if err != nil {
+		return "", nil, err
+	}
+	if err := p.directives(); err != nil {
+		return "", nil, err
+	}
+	sels, err := p.selectionSet()
+	if err != nil {
+		return "", nil, err
+	}
+	return name, &gqlFragment{typeCondition: typ, selections: sels}, nil
+}
+
+func (p *gqlParser) selectionSet() ([]gqlSelection, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var sels []gqlSelection
+	for !p.peek("}") {
+		sel, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		sels = append(sels, sel)
+	}
+	if len(sels) == 0 {
+		return nil, fmt.Errorf("empty selection set at offset %d", p.tok.pos)
+	}
+	return sels, p.advance()
+}
+
+func (p *gqlParser) selection() (gqlSelection, error) {
+	var sel gqlSelection
+	if p.peek("...") {
+		if err := p.advance(); err != nil {
+			return sel, err
+		}
+		if p.tok.kind == gqlName && p.tok.value != "on" {
+			sel.spread = p.tok.value
+			if err := p.advance(); err != nil {
+				return sel, err
+			}
+			return sel, p.directives()
+		}
+		if p.peekName("on") {
+			if err := p.advance(); err != nil {
+				return sel, err
+			}
+			if _, err := p.name(); err != nil {
+				return sel, err
+			}
+		}
+		if err := p.directives(); err != nil {
+			return sel, err
+		}
+		sels, err := p.selectionSet()
+		sel.selections = sels
+		return sel, err
+	}
+
+	name, err := p.name()
+	if err != nil {
+		return sel, err
+	}
+	if p.peek(":") {
+		if err := p.advance(); err != nil {
+			return sel, err
+		}
+		if name, err = p.name(); err != nil {
+			return sel, err
+		}
+	}
+	sel.name = name
+	if p.peek("(") {
+		if sel.args, err = p.arguments(); err != nil {
+			return sel, err
+		}
+	}
+	if err := p.directives(); err != nil {
+		return sel, err
+	}
+	if p.peek("{") {
+		sel.selections, err = p.selectionSet()
+	}
+	return sel, err
+}
+
+func (p *gqlParser) arguments() (map[string]any, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	args := make(map[string]any)
+	for !p.peek(")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		args[name] = v
+	}
+	return args, p.advance()
+}
+
+// directives skips any @directive(args) annotations.
+func (p *gqlParser) directives() error {
+	for p.peek("@") {
+		if err := p.advance(); err != nil {
+			return err
+		}
+		if _, err := p.name(); err != nil {
+			return err
+		}
+		if p.peek("(") {
+			if _, err := p.arguments(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *gqlParser) value() (any, error) {
+	tok := p.tok
+	switch {
+	case p.peek("$"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		return gqlVariable(name), err
+	case p.peek("["):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		list := []any{}
+		for !p.peek("]") {
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, p.advance()
+	case p.peek("{"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		obj := make(map[string]any)
+		for !p.peek("}") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			obj[name] = v
+		}
+		return obj, p.advance()
+	case tok.kind == gqlString, tok.kind == gqlNumber:
+		return tok.value, p.advance()
+	case tok.kind == gqlName:
+		var v any = tok.value
+		switch tok.value {
+		case "true":
+			v = true
+		case "false":
+			v = false
+		case "null":
+			v = nil
+		}
+		return v, p.advance()
+	}
+	return nil, p.unexpected()
+}
+
+// resolveValue replaces variable references in v with their values from
+// vars, falling back to the operation's defaults.
+func resolveValue(v any, vars, defaults map[string]any) any {
+	switch v := v.(type) {
+	case gqlVariable:
+		if val, ok := vars[string(v)]; ok {
+			return val
+		}
+		return resolveValue(defaults[string(v)], nil, nil)
+	case []any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			out[i] = resolveValue(e, vars, defaults)
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, e := range v {
+			out[k] = resolveValue(e, vars, defaults)
+		}
+		return out
+	}
+	return v
+}
+
+type gqlTokenKind int
+
+const (
+	gqlEOF gqlTokenKind = iota
+	gqlPunct
+	gqlName
+	gqlNumber
+	gqlString
+)
+
+type gqlToken struct {
+	kind  gqlTokenKind
+	value string
+	pos   int
+}
+
+type gqlLexer struct {
+	src string
+	pos int
+}
+
+func (l *gqlLexer) next() (gqlToken, error) {
+	// Skip ignored tokens: whitespace, commas, comments and a BOM.
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			l.pos++
+			continue
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' && l.src[l.pos] != '\r' {
+				l.pos++
+			}
+			continue
+		case strings.HasPrefix(l.src[l.pos:], "\uFEFF"):
+			l.pos += len("\uFEFF")
+			continue
+		}
+		break
+	}
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return gqlToken{kind: gqlEOF, pos: start}, nil
+	}
+
+	c := l.src[l.pos]
+	switch {
+	case strings.HasPrefix(l.src[l.pos:], "..."):
+		l.pos += 3
+		return gqlToken{kind: gqlPunct, value: "...", pos: start}, nil
+	case strings.IndexByte("!$&():=@[]{}|", c) >= 0:
+		l.pos++
+		return gqlToken{kind: gqlPunct, value: string(c), pos: start}, nil
+	case c == '_' || isLetter(c):
+		for l.pos < len(l.src) && (l.src[l.pos] == '_' || isLetter(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		return gqlToken{kind: gqlName, value: l.src[start:l.pos], pos: start}, nil
+	case c == '-' || isDigit(c):
+		l.pos++
+		for l.pos < len(l.src) && strings.IndexByte("0123456789.eE+-", l.src[l.pos]) >= 0 {
+			l.pos++
+		}
+		return gqlToken{kind: gqlNumber, value: l.src[start:l.pos], pos: start}, nil
+	case strings.HasPrefix(l.src[l.pos:], `"""`):
+		end := strings.Index(l.src[l.pos+3:], `"""`)
+		for end >= 0 && strings.HasSuffix(l.src[:l.pos+3+end], `\`) {
+			next := strings.Index(l.src[l.pos+3+end+3:], `"""`)
+			if next < 0 {
+				end = -1
+				break
+			}
+			end += 3 + next
+		}
+		if end < 0 {
+			return gqlToken{}, fmt.Errorf("unterminated block string at offset %d", start)
+		}
+		value := strings.ReplaceAll(l.src[l.pos+3:l.pos+3+end], `\"""`, `"""`)
+		l.pos += 3 + end + 3
+		return gqlToken{kind: gqlString, value: value, pos: start}, nil
+	case c == '"':
+		l.pos++
+		for l.pos < len(l.src) && l.src[l.pos] != '"' {
+			if l.src[l.pos] == '\n' || l.src[l.pos] == '\r' {
+				break
+			}
+			if l.src[l.pos] == '\\' {
+				l.pos++
+			}
+			l.pos++
+		}
+		if l.pos >= len(l.src) || l.src[l.pos] != '"' {
+			return gqlToken{}, fmt.Errorf("unterminated string at offset %d", start)
+		}
+		l.pos++
+		value, err := strconv.Unquote(strings.ReplaceAll(l.src[start:l.pos], `\/`, "/"))
+		if err != nil {
+			return gqlToken{}, fmt.Errorf("invalid string at offset %d", start)
+		}
+		return gqlToken{kind: gqlString, value: value, pos: start}, nil
+	}
+	return gqlToken{}, fmt.Errorf("unexpected character %q at offset %d", c, start)
+}
+
+func isLetter(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestAnalyzeGraphQL(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantScopes map[string]string
+		wantRepos  []string
+		wantIDs    []string
+	}{
+		{
+			name:       "viewer",
+			body:       `{"query":"{ viewer { login } }"}`,
+			wantScopes: map[string]string{"metadata": "read"},
+		},
+		{
+			name:       "repository fields",
+			body:       `{"query":"query Q($n: String!) { repository(owner: \"org\", name: $n) { name pullRequest(number: 1) { title ...F } } } fragment F on PullRequest { labels(first: 5) { nodes { name } } }","variables":{"n":"repo"}}`,
+			wantScopes: map[string]string{"metadata": "read", "pulls": "read"},
+			wantRepos:  []string{"org/repo"},
+		},
+		{
+			name:       "variable default",
+			body:       `{"query":"query($owner: String = \"org\") { repository(owner: $owner, name: \"repo\") { issues(first: 1) { totalCount } } }"}`,
+			wantScopes: map[string]string{"metadata": "read", "issues": "read"},
+			wantRepos:  []string{"org/repo"},
+		},
+		{
+			name:       "mutation",
+			body:       `{"query":"mutation($input: CreateIssueInput!) { createIssue(input: $input) { issue { number } } }","variables":{"input":{"repositoryId":"R_1","title":"t","assigneeIds":["U_1"],"clientMutationId":"x"}}}`,
+			wantScopes: map[string]string{"metadata": "read", "issues": "write"},
+			wantIDs:    []string{"R_1", "U_1"},
+		},
+		{
+			name:       "read and write of one permission",
+			body:       `{"query":"mutation { addComment(input: {subjectId: \"I_1\", body: \"\"\"hi \"there\" \"\"\"}) { clientMutationId } } query { repository(owner: \"org\", name: \"repo\") { issue(number: 1) { id } } }"}`,
+			wantScopes: map[string]string{"metadata": "read", "issues": "write"},
+			wantRepos:  []string{"org/repo"},
+			wantIDs:    []string{"I_1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			access, err := analyzeGraphQL([]byte(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(access.scopes, tt.wantScopes) {
+				t.Errorf("scopes = %v, want %v", access.scopes, tt.wantScopes)
+			}
+			if !reflect.DeepEqual(access.repos, tt.wantRepos) {
+				t.Errorf("repos = %v, want %v", access.repos, tt.wantRepos)
+			}
+			if ids := access.nodeIDs(); !reflect.DeepEqual(ids, tt.wantIDs) {
+				t.Errorf("node IDs = %v, want %v", ids, tt.wantIDs)
+			}
+		})
+	}
+}
+
+func TestAnalyzeGraphQLRefuses(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		denied bool
+	}{
+		{"not json", `query`, false},
+		{"no query", `{}`, false},
+		{"syntax error", `{"query":"{ viewer { login }"}`, false},
+		{"unknown fragment", `{"query":"{ ...F }"}`, false},
+		{"fragment cycle", `{"query":"{ ...F } fragment F on Query { ...F }"}`, false},
+		{"search", `{"query":"{ search(query: \"x\", type: ISSUE, first: 1) { issueCount } }"}`, true},
+		{"node", `{"query":"{ node(id: \"R_1\") { id } }"}`, true},
+		{"viewer repositories", `{"query":"{ viewer { login repositories(first: 1) { totalCount } } }"}`, true},
+		{"repository without name", `{"query":"{ repository(owner: \"org\") { name } }"}`, true},
+		{"owner's repositories", `{"query":"{ repository(owner: \"org\", name: \"repo\") { owner { repositories(first: 1) { totalCount } } } }"}`, true},
+		{"nested repository lookup", `{"query":"{ repository(owner: \"org\", name: \"repo\") { issue(number: 1) { author { ... on User { repository(name: \"x\") { name } } } } } }"}`, true},
+		{"linked repository data", `{"query":"{ repository(owner: \"org\", name: \"repo\") { pullRequest(number: 1) { headRepository { issues(first: 1) { totalCount } } } } }"}`, true},
+		{"user gists", `{"query":"{ repository(owner: \"org\", name: \"repo\") { assignableUsers(first: 1) { nodes { gists(first: 1) { totalCount } } } } }"}`, true},
+		{"assignee's issues", `{"query":"{ repository(owner: \"org\", name: \"repo\") { issue(number: 1) { assignees(first: 1) { nodes { issues(first: 1) { totalCount } } } } } }"}`, true},
+		{"linked repository connection", `{"query":"{ repository(owner: \"org\", name: \"repo\") { pullRequest(number: 1) { headRepository { collaborators(first: 1) { totalCount } } } } }"}`, true},
+		{"unknown mutation", `{"query":"mutation { deleteRepository(input: {repositoryId: \"R_1\"}) { clientMutationId } }"}`, true},
+		{"mutation without target", `{"query":"mutation { createIssue(input: {title: \"t\"}) { clientMutationId } }"}`, true},
+		{"subscription", `{"query":"subscription { x }"}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := analyzeGraphQL([]byte(tt.body))
+			if err == nil {
+				t.Fatal("analyzeGraphQL succeeded, want an error")
+			}
+			var denied *graphQLDenied
+			if errors.As(err, &denied) != tt.denied {
+				t.Errorf("error %q: denied = %v, want %v", err, !tt.denied, tt.denied)
+			}
+		})
+	}
+}
+
+func TestCheckMutationTargets(t *testing.T) {
+	nodes := map[string]string{"R_1": "org/repo", "R_2": "org/other", "U_1": ""}
+	tests := []struct {
+		name   string
+		target gqlMutationTarget
+		ok     bool
+	}{
+		{"same repository", gqlMutationTarget{nodeIDs: []string{"R_1", "U_1"}}, true},
+		{"name with owner", gqlMutationTarget{repos: []string{"ORG/repo"}}, true},
+		{"other repository", gqlMutationTarget{nodeIDs: []string{"R_1", "R_2"}}, false},
+		{"no repository", gqlMutationTarget{nodeIDs: []string{"U_1"}}, false},
+		{"unknown node", gqlMutationTarget{nodeIDs: []string{"R_9"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkMutationTargets([]gqlMutationTarget{tt.target}, nodes, "org/repo")
+			if (err == nil) != tt.ok {
+				t.Errorf("checkMutationTargets = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,661 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// gqlRepositoryFields maps fields of a repository(owner:, name:) query to
+// the permission reading them needs. Other repository fields need
+// metadata:read, like GET /repos/{owner}/{repo}.
+var gqlRepositoryFields = map[string]string{
+	"issue":                 "issues",
+	"issues":                "issues",
+	"issueOrPullRequest":    "issues",
+	"label":                 "issues",
+	"labels":                "issues",
+	"milestone":             "issues",
+	"milestones":            "issues",
+	"pullRequest":           "pulls",
+	"pullRequests":          "pulls",
+	"object":                "contents",
+	"ref":                   "contents",
+	"refs":                  "contents",
+	"defaultBranchRef":      "contents",
+	"release":               "contents",
+	"releases":              "contents",
+	"latestRelease":         "contents",
+	"discussion":            "discussions",
+	"discussions":           "discussions",
+	"discussionCategory":    "discussions",
+	"discussionCategories":  "discussions",
+	"branchProtectionRules": "administration",
+	"deployKeys":            "administration",
+}
+
+// gqlMutations maps the mutations a token may run to the permission they
+// need at write level. Any other mutation is refused.
+var gqlMutations = map[string]string{
+	"createIssue":                   "issues",
+	"updateIssue":                   "issues",
+	"closeIssue":                    "issues",
+	"reopenIssue":                   "issues",
+	"addComment":                    "issues",
+	"updateIssueComment":            "issues",
+	"deleteIssueComment":            "issues",
+	"addLabelsToLabelable":          "issues",
+	"removeLabelsFromLabelable":     "issues",
+	"clearLabelsFromLabelable":      "issues",
+	"addAssigneesToAssignable":      "issues",
+	"removeAssigneesFromAssignable": "issues",
+	"addReaction":                   "issues",
+	"removeReaction":                "issues",
+
+	"createPullRequest":               "pulls",
+	"updatePullRequest":               "pulls",
+	"closePullRequest":                "pulls",
+	"reopenPullRequest":               "pulls",
+	"mergePullRequest":                "pulls",
+	"markPullRequestReadyForReview":   "pulls",
+	"convertPullRequestToDraft":       "pulls",
+	"requestReviews":                  "pulls",
+	"addPullRequestReview":            "pulls",
+	"submitPullRequestReview":         "pulls",
+	"updatePullRequestReview":         "pulls",
+	"deletePullRequestReview":         "pulls",
+	"dismissPullRequestReview":        "pulls",
+	"addPullRequestReviewComment":     "pulls",
+	"addPullRequestReviewThread":      "pulls",
+	"addPullRequestReviewThreadReply": "pulls",
+	"resolveReviewThread":             "pulls",
+	"unresolveReviewThread":           "pulls",
+	"enablePullRequestAutoMerge":      "pulls",
+	"disablePullRequestAutoMerge":     "pulls",
+	"updatePullRequestBranch":         "pulls",
+
+	"createCommitOnBranch": "contents",
+	"createRef":            "contents",
+	"updateRef":            "contents",
+	"deleteRef":            "contents",
+
+	"createDiscussion":                "discussions",
+	"updateDiscussion":                "discussions",
+	"closeDiscussion":                 "discussions",
+	"reopenDiscussion":                "discussions",
+	"addDiscussionComment":            "discussions",
+	"updateDiscussionComment":         "discussions",
+	"deleteDiscussionComment":         "discussions",
+	"markDiscussionCommentAsAnswer":   "discussions",
+	"unmarkDiscussionCommentAsAnswer": "discussions",
+
+	"updateRepository":           "administration",
+	"updateTopics":               "administration",
+	"createBranchProtectionRule": "administration",
+	"updateBranchProtectionRule": "administration",
+	"deleteBranchProtectionRule": "administration",
+}
+
+// gqlRootFields are the query root fields a token may use besides
+// repository and viewer; none of them reads repository data.
+var gqlRootFields = map[string]bool{
+	"__typename": true,
+	"__schema":   true,
+	"__type":     true,
+	"rateLimit":  true,
+	"meta":       true,
+}
+
+// gqlViewerFields are the viewer fields a token may read: the same profile
+// GET /user returns, and nothing that leads to other repositories.
+var gqlViewerFields = map[string]bool{
+	"__typename": true,
+	"id":         true,
+	"databaseId": true,
+	"login":      true,
+	"name":       true,
+	"email":      true,
+	"avatarUrl":  true,
+	"url":        true,
+}
+
+// gqlCrossRepoFields lead from an object to other repositories, so they
+// are refused at any depth. Root fields such as node and search are refused
+// by omission from gqlRootFields.
+var gqlCrossRepoFields = map[string]bool{
+	"organization":              true,
+	"organizations":             true,
+	"repositoryOwner":           true,
+	"repositories":              true,
+	"repositoriesContributedTo": true,
+	"topRepositories":           true,
+	"starredRepositories":       true,
+	"watching":                  true,
+	"pinnedItems":               true,
+	"pinnableItems":             true,
+	"forks":                     true,
+}
+
+// gqlUserConnections list a user's activity across every repository their
+// GitHub token can reach, so they are refused at any depth. A user's issues
+// and pullRequests are refused with the other gqlRepositoryFields below
+// objects other than the token's repository.
+var gqlUserConnections = map[string]bool{
+	"gists":                        true,
+	"gistComments":                 true,
+	"contributionsCollection":      true,
+	"issueComments":                true,
+	"commitComments":               true,
+	"repositoryDiscussions":        true,
+	"repositoryDiscussionComments": true,
+	"followers":                    true,
+	"following":                    true,
+	"sponsors":                     true,
+	"sponsoring":                   true,
+	"sponsorshipsAsMaintainer":     true,
+	"sponsorshipsAsSponsor":        true,
+	"packages":                     true,
+	"projects":                     true,
+	"projectsV2":                   true,
+	"recentProjects":               true,
+	"lists":                        true,
+	"savedReplies":                 true,
+}
+
+// gqlRepoLinkFields reach a repository from another object. That may be a
+// different repository than the token's (a fork, or the source of a cross
+// reference), so only its metadata can be read through them.
+var gqlRepoLinkFields = map[string]bool{
+	"repository":         true,
+	"headRepository":     true,
+	"baseRepository":     true,
+	"parent":             true,
+	"templateRepository": true,
+	"commitRepository":   true,
+}
+
+// gqlForeignLinkFields reach objects that need not belong to the token's
+// repository: users, organizations, and issues or pull requests elsewhere.
+// Only gqlForeignFields can be read through them.
+var gqlForeignLinkFields = map[string]bool{
+	"owner":                   true,
+	"author":                  true,
+	"editor":                  true,
+	"actor":                   true,
+	"user":                    true,
+	"creator":                 true,
+	"mergedBy":                true,
+	"requestedReviewer":       true,
+	"headRepositoryOwner":     true,
+	"source":                  true,
+	"subject":                 true,
+	"canonical":               true,
+	"duplicate":               true,
+	"closingIssuesReferences": true,
+	"enterprise":              true,
+	"sponsorable":             true,
+	"sponsorEntity":           true,
+}
+
+// gqlForeignFields are the fields that identify an object reached through
+// gqlForeignLinkFields, without reading anything it holds.
+var gqlForeignFields = map[string]bool{
+	"__typename":   true,
+	"id":           true,
+	"databaseId":   true,
+	"login":        true,
+	"name":         true,
+	"slug":         true,
+	"avatarUrl":    true,
+	"url":          true,
+	"resourcePath": true,
+}
+
+// gqlObjectRepoFields are the gqlRepositoryFields an issue or pull request
+// of the token's repository may still read: its own labels and milestone,
+// which belong to the same repository.
+var gqlObjectRepoFields = map[string]bool{
+	"labels":    true,
+	"milestone": true,
+}
+
+// gqlPlace is where in the token's reach a field is read.
+type gqlPlace int
+
+const (
+	// gqlOnRepository is a field of the token's repository, or of a
+	// mutation's payload.
+	gqlOnRepository gqlPlace = iota
+	// gqlOnObject is a field of an object within the token's repository,
+	// such as an issue.
+	gqlOnObject
+	// gqlOnLinkedRepository is a field of a repository reached through
+	// gqlRepoLinkFields.
+	gqlOnLinkedRepository
+	// gqlOnForeign is a field of an object reached through
+	// gqlForeignLinkFields.
+	gqlOnForeign
+)
+
+// maxGraphQLBytes caps the GraphQL request bodies read for checking.
+const maxGraphQLBytes = 1 << 20
+
+// graphQLRequest is the JSON body of a GraphQL call.
+type graphQLRequest struct {
+	Query     string         `json:"query"`
+	Variables map[string]any `json:"variables"`
+}
+
+// graphQLAccess is what a GraphQL document needs from a token.
+type graphQLAccess struct {
+	// scopes maps each permission the document uses to the level it needs.
+	scopes map[string]string
+	// repos are the repositories named by repository(owner:, name:).
+	repos []string
+	// mutations are the repositories and node IDs each mutation targets.
+	mutations []gqlMutationTarget
+}
+
+// gqlMutationTarget is what one mutation's input refers to.
+type gqlMutationTarget struct {
+	name    string
+	repos   []string
+	nodeIDs []string
+}
+
+// graphQLDenied is a reason to refuse a GraphQL document for the token's
+// scope, as opposed to failing to parse it.
+type graphQLDenied struct {
+	message string
+}
+
+func (e *graphQLDenied) Error() string { return e.message }
+
+func denyf(format string, args ...any) error {
+	return &graphQLDenied{message: fmt.Sprintf(format, args...)}
+}
+
+// analyzeGraphQL works out the permissions, repositories and node IDs a
+// GraphQL request body uses. Every operation in the document is checked,
+// whichever one operationName selects. The error is a *graphQLDenied when
+// the document uses something a token can never be granted.
+func analyzeGraphQL(body []byte) (*graphQLAccess, error) {
+	var req graphQLRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("invalid GraphQL request body: %w", err)
+	}
+	if strings.TrimSpace(req.Query) == "" {
+		return nil, fmt.Errorf("GraphQL request has no query")
+	}
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GraphQL query: %w", err)
+	}
+
+	a := &gqlAnalyzer{doc: doc, vars: req.Variables,
+		access: &graphQLAccess{scopes: map[string]string{"metadata": "read"}}}
+	for _, op := range doc.operations {
+		a.op = op
+		if err := a.operation(); err != nil {
+			return nil, err
+		}
+	}
+	return a.access, nil
+}
+
+type gqlAnalyzer struct {
+	doc    *gqlDocument
+	vars   map[string]any
+	op     *gqlOperation
+	access *graphQLAccess
+}
+
+func (a *gqlAnalyzer) need(permission, level string) {
+	if a.access.scopes[permission] != "write" {
+		a.access.scopes[permission] = level
+	}
+}
+
+func (a *gqlAnalyzer) operation() error {
+	fields, err := a.fields(a.op.selections, nil)
+	if err != nil {
+		return err
+	}
+	switch a.op.kind {
+	case "query":
+		for _, f := range fields {
+			if err := a.rootField(f); err != nil {
+				return err
+			}
+		}
+	case "mutation":
+		for _, f := range fields {
+			if err := a.mutation(f); err != nil {
+				return err
+			}
+		}
+	default:
+		return denyf("GraphQL %s operations are not supported", a.op.kind)
+	}
+	return nil
+}
+
+// fields flattens fragment spreads and inline fragments out of sels.
+func (a *gqlAnalyzer) fields(sels []gqlSelection, seen map[string]bool) ([]gqlSelection, error) {
+	var out []gqlSelection
+	for _, sel := range sels {
+		switch {
+		case sel.name != "":
+			out = append(out, sel)
+		case sel.spread != "":
+			frag, ok := a.doc.fragments[sel.spread]
+			if !ok {
+				return nil, fmt.Errorf("invalid GraphQL query: unknown fragment %q", sel.spread)
+			}
+			if seen[sel.spread] {
+				return nil, fmt.Errorf("invalid GraphQL query: fragment %q spreads itself", sel.spread)
+			}
+			inner := map[string]bool{sel.spread: true}
+			for k := range seen {
+				inner[k] = true
+			}
+			more, err := a.fields(frag.selections, inner)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, more...)
+		default:
+			more, err := a.fields(sel.selections, seen)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, more...)
+		}
+	}
+	return out, nil
+}
+
+func (a *gqlAnalyzer) arg(f gqlSelection, name string) any {
+	return resolveValue(f.args[name], a.vars, a.op.defaults)
+}
+
+func (a *gqlAnalyzer) rootField(f gqlSelection) error {
+	switch {
+	case gqlRootFields[f.name]:
+		return nil
+	case f.name == "viewer":
+		fields, err := a.fields(f.selections, nil)
+		if err != nil {
+			return err
+		}
+		for _, vf := range fields {
+			if !gqlViewerFields[vf.name] {
+				return denyf("viewer.%s is not available to repository-scoped tokens", vf.name)
+			}
+		}
+		return nil
+	case f.name == "repository":
+		owner, _ := a.arg(f, "owner").(string)
+		name, _ := a.arg(f, "name").(string)
+		if owner == "" || name == "" {
+			return denyf("repository needs owner and name arguments")
+		}
+		a.access.repos = append(a.access.repos, owner+"/"+name)
+		fields, err := a.fields(f.selections, nil)
+		if err != nil {
+			return err
+		}
+		for _, rf := range fields {
+			if permission, ok := gqlRepositoryFields[rf.name]; ok {
+				a.need(permission, "read")
+			}
+			if err := a.nested(rf, gqlOnRepository); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return denyf("GraphQL field %s is not available to repository-scoped tokens", f.name)
+}
+
+// nested checks a field below the root for ways out of the token's
+// repository. Where a field may be read depends on place: the token's
+// repository allows every field not refused outright, objects within it
+// lose the repository-wide connections, and objects that may lie outside it
+// allow only their metadata or identity.
+func (a *gqlAnalyzer) nested(f gqlSelection, place gqlPlace) error {
+	if gqlCrossRepoFields[f.name] || gqlUserConnections[f.name] {
+		return denyf("GraphQL field %s is not available to repository-scoped tokens", f.name)
+	}
+	if f.name == "repository" && len(f.args) > 0 {
+		return denyf("repository can only be looked up at the root of a query")
+	}
+	_, repoField := gqlRepositoryFields[f.name]
+	switch place {
+	case gqlOnObject:
+		if repoField && !gqlObjectRepoFields[f.name] {
+			return denyf("%s can only be read from the token's repository", f.name)
+		}
+	case gqlOnLinkedRepository:
+		if repoField {
+			return denyf("%s cannot be read from a linked repository, which may not be the token's", f.name)
+		}
+		if len(f.selections) > 0 && !gqlRepoLinkFields[f.name] && !gqlForeignLinkFields[f.name] {
+			return denyf("only the metadata of a linked repository can be read, not %s", f.name)
+		}
+	case gqlOnForeign:
+		if !gqlForeignFields[f.name] {
+			return denyf("%s cannot be read from an object outside the token's repository", f.name)
+		}
+	}
+
+	next := gqlOnObject
+	switch {
+	case gqlRepoLinkFields[f.name]:
+		next = gqlOnLinkedRepository
+	case gqlForeignLinkFields[f.name]:
+		next = gqlOnForeign
+	}
+	fields, err := a.fields(f.selections, nil)
+	if err != nil {
+		return err
+	}
+	for _, child := range fields {
+		if err := a.nested(child, next); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *gqlAnalyzer) mutation(f gqlSelection) error {
+	permission, ok := gqlMutations[f.name]
+	if !ok {
+		return denyf("GraphQL mutation %s is not available to repository-scoped tokens", f.name)
+	}
+	a.need(permission, "write")
+
+	target := gqlMutationTarget{name: f.name}
+	for name := range f.args {
+		collectTargets(&target, name, a.arg(f, name))
+	}
+	if len(target.repos) == 0 && len(target.nodeIDs) == 0 {
+		return denyf("GraphQL mutation %s does not name a repository or object", f.name)
+	}
+	a.access.mutations = append(a.access.mutations, target)
+
+	fields, err := a.fields(f.selections, nil)
+	if err != nil {
+		return err
+	}
+	for _, pf := range fields {
+		if err := a.nested(pf, gqlOnRepository); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectTargets gathers the repositories (repositoryNameWithOwner) and
+// node IDs (id, *Id and *Ids) a mutation input refers to.
+func collectTargets(t *gqlMutationTarget, key string, v any) {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			collectTargets(t, k, e)
+		}
+	case []any:
+		if strings.HasSuffix(key, "Ids") {
+			for _, e := range v {
+				if id, ok := e.(string); ok && id != "" {
+					t.nodeIDs = append(t.nodeIDs, id)
+				}
+			}
+			return
+		}
+		for _, e := range v {
+			collectTargets(t, key, e)
+		}
+	case string:
+		switch {
+		case key == "repositoryNameWithOwner":
+			t.repos = append(t.repos, v)
+		case key == "clientMutationId" || v == "":
+		case key == "id" || strings.HasSuffix(key, "Id"):
+			t.nodeIDs = append(t.nodeIDs, v)
+		}
+	}
+}
+
+// gqlNodeRepositoryQuery looks up the repository that each node belongs
+// to. Types not listed, such as users and teams, belong to none.
+const gqlNodeRepositoryQuery = `query($ids: [ID!]!) {
+  nodes(ids: $ids) {
+    __typename
+    id
+    ... on Repository { nameWithOwner }
+    ... on Issue { repository { nameWithOwner } }
+    ... on PullRequest { repository { nameWithOwner } }
+    ... on IssueComment { repository { nameWithOwner } }
+    ... on PullRequestReview { repository { nameWithOwner } }
+    ... on PullRequestReviewComment { repository { nameWithOwner } }
+    ... on PullRequestReviewThread { repository { nameWithOwner } }
+    ... on CommitComment { repository { nameWithOwner } }
+    ... on Commit { repository { nameWithOwner } }
+    ... on Ref { repository { nameWithOwner } }
+    ... on Label { repository { nameWithOwner } }
+    ... on Milestone { repository { nameWithOwner } }
+    ... on Release { repository { nameWithOwner } }
+    ... on Discussion { repository { nameWithOwner } }
+    ... on DiscussionComment { discussion { repository { nameWithOwner } } }
+  }
+}`
+
+// nodeRepositories asks GitHub which repository each node ID belongs to.
+// The result maps an ID to its owner/name, or to "" for nodes outside any
+// repository; IDs GitHub could not find are left out.
+func (h *Handler) nodeRepositories(ctx context.Context, githubToken string, ids []string) (map[string]string, error) {
+	body, err := json.Marshal(map[string]any{
+		"query":     gqlNodeRepositoryQuery,
+		"variables": map[string]any{"ids": ids},
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", graphQLURL(h.apiBase), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+githubToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GitHub returned %d", resp.StatusCode)
+	}
+
+	type repo struct {
+		NameWithOwner string `json:"nameWithOwner"`
+	}
+	var result struct {
+		Data struct {
+			Nodes []*struct {
+				ID            string `json:"id"`
+				NameWithOwner string `json:"nameWithOwner"`
+				Repository    *repo  `json:"repository"`
+				Discussion    *struct {
+					Repository *repo `json:"repository"`
+				} `json:"discussion"`
+			} `json:"nodes"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decoding nodes: %w", err)
+	}
+
+	repos := make(map[string]string)
+	for _, n := range result.Data.Nodes {
+		switch {
+		case n == nil:
+		case n.NameWithOwner != "":
+			repos[n.ID] = n.NameWithOwner
+		case n.Repository != nil:
+			repos[n.ID] = n.Repository.NameWithOwner
+		case n.Discussion != nil && n.Discussion.Repository != nil:
+			repos[n.ID] = n.Discussion.Repository.NameWithOwner
+		default:
+			repos[n.ID] = ""
+		}
+	}
+	return repos, nil
+}
+
+// checkMutationTargets refuses mutations that touch a repository other
+// than repository, or that don't touch any repository at all. nodes is
+// the result of nodeRepositories for their node IDs.
+func checkMutationTargets(mutations []gqlMutationTarget, nodes map[string]string, repository string) error {
+	for _, m := range mutations {
+		bound := append([]string(nil), m.repos...)
+		for _, id := range m.nodeIDs {
+			repo, ok := nodes[id]
+			if !ok {
+				return denyf("GraphQL mutation %s refers to %s, which could not be found", m.name, id)
+			}
+			if repo != "" {
+				bound = append(bound, repo)
+			}
+		}
+		if len(bound) == 0 {
+			return denyf("GraphQL mutation %s does not refer to a repository", m.name)
+		}
+		for _, repo := range bound {
+			if !strings.EqualFold(repo, repository) {
+				return denyf("Token is scoped to %s, not %s", repository, repo)
+			}
+		}
+	}
+	return nil
+}
+
+// nodeIDs returns the distinct node IDs the mutations refer to, sorted.
+func (a *graphQLAccess) nodeIDs() []string {
+	seen := make(map[string]bool)
+	var ids []string
+	for _, m := range a.mutations {
+		for _, id := range m.nodeIDs {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
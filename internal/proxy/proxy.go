@@ -1,27 +1,46 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/url"
+	"path"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/goodtune/ghp/internal/apierr"
 	"github.com/goodtune/ghp/internal/config"
 	"github.com/goodtune/ghp/internal/crypto"
 	"github.com/goodtune/ghp/internal/database"
+	"github.com/goodtune/ghp/internal/metrics"
+	"github.com/goodtune/ghp/internal/oauth"
 	"github.com/goodtune/ghp/internal/token"
+	"github.com/google/uuid"
 )
 
+// forwardedRequestHeaders are the agent request headers relayed upstream.
+var forwardedRequestHeaders = []string{"Content-Type", "Accept", "User-Agent", apiVersionHeader}
+
+// apiVersionHeader selects the REST API version. Requests without one get
+// proxy.api_version, if set.
+const apiVersionHeader = "X-GitHub-Api-Version"
+
+// Path styles the proxy can be addressed with (proxy.path_styles).
 const (
-	githubAPIBase    = "https://api.github.com"
-	githubTokenURL   = "https://github.com/login/oauth/access_token"
-	tokenRefreshSkew = 5 * time.Minute
+	// styleGHES is /api/v3/... and /api/graphql, as on GitHub Enterprise
+	// Server.
+	styleGHES = "ghes"
+	// styleBare is /... and /graphql, as on api.github.com.
+	styleBare = "bare"
 )
 
 // Handler is the reverse proxy HTTP handler.
@@ -32,57 +51,158 @@ type Handler struct {
 	encryptor    *crypto.Encryptor
 	logger       *slog.Logger
 	client       *http.Client
+	// gitClient streams git requests to gitBase, GitHub's web host, and
+	// release asset uploads to uploadBase; unlike client it has no overall
+	// timeout.
+	gitClient *http.Client
+	gitBase   string
+	// oauth refreshes GitHub tokens; see SetOAuthClient.
+	oauth   oauth.Client
+	apiBase string
+	// uploadBase is where /api/uploads/... requests go.
+	uploadBase string
+	coalescer  *auditCoalescer
+	rules      []endpointRule
+	// methods is the proxy.allowed_methods set, nil when every method is
+	// allowed; allow lists them for the Allow header.
+	methods map[string]bool
+	allow   string
+	// styles is the proxy.path_styles set.
+	styles map[string]bool
+	rates  *userRates
 }
 
 // NewHandler creates a new reverse proxy handler.
 func NewHandler(cfg *config.Config, ts *token.Service, store database.Store, enc *crypto.Encryptor, logger *slog.Logger) *Handler {
-	return &Handler{
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsCfg, err := cfg.Proxy.TLS.Config(); err != nil {
+		logger.Error("using default upstream TLS settings", "error", err)
+	} else {
+		transport.TLSClientConfig = tlsCfg
+	}
+	if up, err := cfg.Proxy.Upstream(); err != nil {
+		logger.Error("using upstream proxy from environment", "error", err)
+	} else {
+		transport.Proxy = up.Proxy
+		logger.Info("upstream_proxy", "proxy", up.String())
+	}
+	client.Transport = transport
+	if !cfg.Proxy.FollowRedirects {
+		// Relay redirects to the agent rather than following them with the
+		// user's GitHub credentials.
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	h := &Handler{
 		cfg:          cfg,
 		tokenService: ts,
 		store:        store,
 		encryptor:    enc,
 		logger:       logger,
-		client: &http.Client{
-			Timeout: 30 * time.Second,
-		},
+		client:       client,
+		gitClient:    &http.Client{Transport: transport, CheckRedirect: client.CheckRedirect},
+		gitBase:      strings.TrimSuffix(cfg.GitHub.OAuthURL(""), "/"),
+		oauth:        oauth.NewClient(cfg.GitHub, client),
+		apiBase:      strings.TrimSuffix(cfg.GitHub.APIBaseURL, "/"),
+		uploadBase:   strings.TrimSuffix(cfg.GitHub.UploadBaseURL, "/"),
+		rules:        rules,
+		styles:       make(map[string]bool),
+		rates:        newUserRates(metrics.ForgetUserRequestRate),
+	}
+	for _, style := range cfg.Proxy.PathStyles {
+		h.styles[style] = true
+	}
+	// Inline overrides come first, then those from proxy.scope_rules_file.
+	overrides := append(slices.Clone(cfg.Proxy.ScopeOverrides), cfg.Proxy.ScopeRules.Rules...)
+	if len(overrides) > 0 {
+		r, err := overrideRules(overrides, cfg.Proxy.ScopeRules.ReplaceBuiltin)
+		if err != nil {
+			logger.Error("ignoring scope overrides", "error", err)
+		} else {
+			h.rules = r
+		}
 	}
+	if cfg.Audit.CoalesceWindow > 0 {
+		h.coalescer = newAuditCoalescer(cfg.Audit.CoalesceWindow)
+	}
+	if len(cfg.Proxy.AllowedMethods) > 0 {
+		h.methods = make(map[string]bool, len(cfg.Proxy.AllowedMethods))
+		var allow []string
+		for _, m := range cfg.Proxy.AllowedMethods {
+			m = strings.ToUpper(m)
+			if !h.methods[m] {
+				h.methods[m] = true
+				allow = append(allow, m)
+			}
+		}
+		sort.Strings(allow)
+		h.allow = strings.Join(allow, ", ")
+	}
+	return h
+}
+
+// SetOAuthClient replaces the client used to refresh GitHub tokens, which
+// by default calls GitHub.
+func (h *Handler) SetOAuthClient(c oauth.Client) {
+	h.oauth = c
+}
+
+// RequiredScope returns the permission and level the handler requires for a
+// method and API path (without the /api/v3 prefix), taking configured scope
+// overrides into account. Empty strings mean the endpoint isn't restricted.
+func (h *Handler) RequiredScope(method, path string) (permission, level string) {
+	return matchRule(h.rules, method, path)
+}
+
+// Permissions returns the distinct permissions the handler's rules require,
+// sorted, including those of configured scope overrides.
+func (h *Handler) Permissions() []string {
+	return permissions(h.rules)
 }
 
 // ServeHTTP handles proxied requests.
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 
+	if h.methods != nil && !h.methods[r.Method] {
+		w.Header().Set("Allow", h.allow)
+		writeError(w, http.StatusMethodNotAllowed, apierr.MethodNotAllowed, fmt.Sprintf("%s requests are not allowed through this proxy", r.Method))
+		return
+	}
+
+	// Requests come in as /api/v3/... or /api/graphql (GHE-style),
+	// or directly as /... or /graphql (when proxied as api.github.com virtualhost).
+	style, apiPath, api := splitAPIPath(r.URL.Path)
+	if !h.styles[style] {
+		writeError(w, http.StatusNotFound, apierr.NotFound, "Not Found")
+		return
+	}
+
 	// Extract the ghp_ token from the Authorization header.
 	ghpToken := extractToken(r)
 	if ghpToken == "" {
-		writeError(w, http.StatusUnauthorized, "Missing or invalid Authorization header")
+		writeError(w, http.StatusUnauthorized, apierr.Unauthenticated, "Missing or invalid Authorization header")
 		return
 	}
 
-	// Resolve the token.
-	pt, err := h.tokenService.Resolve(r.Context(), ghpToken)
-	if err != nil {
-		h.logger.Warn("token resolution failed", "error", err)
-		writeError(w, http.StatusUnauthorized, err.Error())
-		return
-	}
+	pt := h.admit(w, r, ghpToken, start)
 	if pt == nil {
-		writeError(w, http.StatusUnauthorized, "Invalid token")
 		return
 	}
 
-	// Determine the actual API path.
-	// Requests come in as /api/v3/... or /api/graphql (GHE-style),
-	// or directly as /... or /graphql (when proxied as api.github.com virtualhost).
-	apiPath := r.URL.Path
-	if strings.HasPrefix(apiPath, "/api/v3") {
-		apiPath = strings.TrimPrefix(apiPath, "/api/v3")
-	} else if apiPath == "/api/graphql" || apiPath == "/graphql" {
+	if api == graphQLAPI {
 		// GraphQL handled separately.
 		h.handleGraphQL(w, r, pt, start)
 		return
 	}
 
+	// Canonicalize before any checks so the path that was authorized is the
+	// path that gets forwarded.
+	apiPath = canonicalPath(apiPath)
 	if apiPath == "" {
 		apiPath = "/"
 	}
@@ -92,82 +212,314 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// If a repo is identified, enforce the token's repository scope.
 	if repo != "" && !strings.EqualFold(repo, pt.Repository) {
-		writeError(w, http.StatusForbidden,
+		writeError(w, http.StatusForbidden, apierr.ScopeDenied,
 			fmt.Sprintf("Token is scoped to %s, not %s", pt.Repository, repo))
-		h.logRequest(r.Context(), pt, r.Method, apiPath, repo, http.StatusForbidden, time.Since(start), "proxy_scope_denied")
+		h.logRequest(r, pt, apiPath, repo, http.StatusForbidden, time.Since(start), "proxy_scope_denied", nil)
+		return
+	}
+
+	// App-scoped endpoints need an installation token or the app's JWT, but
+	// every proxy token is backed by its user's own GitHub token, so GitHub
+	// would only refuse them.
+	if appEndpoint.MatchString(apiPath) {
+		writeError(w, http.StatusForbidden, apierr.ScopeDenied,
+			fmt.Sprintf("%s needs a GitHub App installation credential, but this token is backed by a user's GitHub token", apiPath))
+		h.logRequest(r, pt, apiPath, repo, http.StatusForbidden, time.Since(start), "proxy_scope_denied", nil)
 		return
 	}
 
 	// Check endpoint permission scope for known endpoints.
-	// Unrecognized endpoints are forwarded — GitHub's token handles access.
-	permission, level := EndpointScope(r.Method, apiPath)
-	if permission != "" && permission != "metadata" {
+	// Unrecognized endpoints are forwarded — GitHub's token handles access —
+	// unless proxy.unmatched_policy asks for a token with some real scope.
+	permission, level := matchRule(h.rules, r.Method, apiPath)
+	requireAny := permission == "" && h.cfg.Proxy.UnmatchedPolicy == "require_scope"
+	if (permission != "" && permission != "metadata") || requireAny {
 		scopes, err := database.ParseScopes(pt.Scopes)
 		if err != nil {
 			h.logger.Error("failed to parse token scopes", "error", err)
-			writeError(w, http.StatusInternalServerError, "Internal error")
+			writeError(w, http.StatusInternalServerError, apierr.Internal, "Internal error")
 			return
 		}
 
-		if !scopes.HasPermission(permission, level) {
-			writeError(w, http.StatusForbidden,
+		if requireAny && !hasRepoScope(scopes) {
+			writeError(w, http.StatusForbidden, apierr.ScopeDenied,
+				fmt.Sprintf("Token has no scopes on %s for an endpoint ghp does not recognize", pt.Repository))
+			h.logRequest(r, pt, apiPath, repo, http.StatusForbidden, time.Since(start), "proxy_scope_denied", nil)
+			return
+		}
+		if !requireAny && !scopes.HasPermission(permission, level) {
+			writeError(w, http.StatusForbidden, apierr.ScopeDenied,
 				fmt.Sprintf("Token does not have permission for %s:%s on %s", permission, level, pt.Repository))
-			h.logRequest(r.Context(), pt, r.Method, apiPath, repo, http.StatusForbidden, time.Since(start), "proxy_scope_denied")
+			h.logRequest(r, pt, apiPath, repo, http.StatusForbidden, time.Since(start), "proxy_scope_denied", nil)
 			return
 		}
 	}
 
+	if h.recordOnly() {
+		if h.charge(w, r, pt, apiPath, repo, start) {
+			h.recordRequest(w, r, pt, apiPath, repo, permission, level, start)
+		}
+		return
+	}
+
+	gt, err := h.loadGitHubToken(r.Context(), pt)
+	if err != nil {
+		h.logger.Error("failed to get GitHub token", "error", err)
+		writeError(w, http.StatusInternalServerError, apierr.GitHubTokenMissing, "Failed to retrieve GitHub credentials")
+		return
+	}
+
+	// A write ghp allows can still be refused by GitHub if the OAuth token
+	// behind it lacks the scope; say so rather than relaying a bare 403.
+	if level == "write" && h.cfg.Proxy.GitHubScopeCheck == "block" {
+		if missing := token.MissingOAuthScopes(gt.Scopes, map[string]string{permission: level}); len(missing) > 0 {
+			writeError(w, http.StatusForbidden, apierr.InsufficientScope,
+				fmt.Sprintf("Your GitHub token lacks the %s scope needed for %s:%s; sign in to ghp again to grant it",
+					strings.Join(missing, ", "), permission, level))
+			h.logRequest(r, pt, apiPath, repo, http.StatusForbidden, time.Since(start), "proxy_github_scope_missing", nil)
+			return
+		}
+	}
+	if !h.charge(w, r, pt, apiPath, repo, start) {
+		return
+	}
+
 	// Get the real GitHub access token.
-	githubToken, err := h.getGitHubToken(r, pt)
+	githubToken, err := h.accessToken(r.Context(), gt)
 	if err != nil {
 		h.logger.Error("failed to get GitHub token", "error", err)
-		writeError(w, http.StatusInternalServerError, "Failed to retrieve GitHub credentials")
+		writeError(w, http.StatusInternalServerError, apierr.GitHubTokenMissing, "Failed to retrieve GitHub credentials")
+		h.refund(r.Context(), pt)
 		return
 	}
 
 	// Forward the request to GitHub.
-	status := h.forwardRequest(w, r, apiPath, githubToken)
+	upstream := h.apiBase
+	if api == uploadsAPI {
+		upstream = h.uploadBase
+	}
+	status, trace := h.forwardRequest(w, r, pt, upstream+apiPath, githubToken)
 
 	// Record usage.
-	if err := h.tokenService.RecordUsage(r.Context(), pt.ID); err != nil {
-		h.logger.Error("failed to record token usage", "error", err)
+	if pt.MaxRequests == 0 {
+		if err := h.tokenService.RecordUsage(r.Context(), pt.ID); err != nil {
+			h.logger.Error("failed to record token usage", "error", err)
+		}
+	} else if status >= http.StatusInternalServerError {
+		h.refund(r.Context(), pt)
 	}
 
-	h.logRequest(r.Context(), pt, r.Method, apiPath, repo, status, time.Since(start), "proxy_request")
+	h.logRequest(r, pt, apiPath, repo, status, time.Since(start), "proxy_request", trace)
+}
+
+// admit resolves a ghp token and counts the request against its rate limit.
+// It writes the error response and returns nil when the request may not
+// proceed. The token's request budget is charged separately, by charge, once
+// every other check has passed.
+func (h *Handler) admit(w http.ResponseWriter, r *http.Request, ghpToken string, start time.Time) *database.ProxyToken {
+	// Resolve the token.
+	pt, err := h.tokenService.Resolve(r.Context(), ghpToken)
+	if err != nil {
+		h.logger.Warn("token resolution failed", "error", err)
+		writeError(w, http.StatusUnauthorized, resolveErrorCode(err), err.Error())
+		return nil
+	}
+	if pt == nil {
+		writeError(w, http.StatusUnauthorized, apierr.InvalidToken, "Invalid token")
+		return nil
+	}
+	if pt.Revoking {
+		// Revoked but inside the grace period: let in-flight work finish,
+		// but tell the agent the token is on its way out.
+		h.logger.Warn("revoked token used during grace", "token_id", pt.ID, "session", pt.SessionID)
+		w.Header().Set("X-GHP-Token-Status", "revoking")
+	}
+
+	h.observeUserRate(r, pt)
+
+	allowed, reset, err := h.tokenService.Allow(r.Context(), pt.ID)
+	if err != nil {
+		h.logger.Error("rate limit check failed", "error", err)
+		writeError(w, http.StatusInternalServerError, apierr.Internal, "Internal error")
+		return nil
+	}
+	if !allowed {
+		retry := int(time.Until(reset).Seconds()) + 1
+		w.Header().Set("Retry-After", strconv.Itoa(retry))
+		writeError(w, http.StatusTooManyRequests, apierr.RateLimited, "Token rate limit exceeded")
+		h.logRequest(r, pt, r.URL.Path, pt.Repository, http.StatusTooManyRequests, time.Since(start), "proxy_rate_limited", nil)
+		return nil
+	}
+	return pt
+}
+
+// charge spends one of a budgeted token's requests. It is called only once
+// ghp has decided to serve the request, so denied requests don't use up the
+// budget, and before forwarding, so concurrent requests can't overspend it;
+// refund gives the request back if GitHub doesn't serve it.
+// It writes the error response and returns false when the budget is spent.
+func (h *Handler) charge(w http.ResponseWriter, r *http.Request, pt *database.ProxyToken, path, repo string, start time.Time) bool {
+	ok, err := h.tokenService.Consume(r.Context(), pt)
+	if err != nil {
+		h.logger.Error("failed to consume token request", "error", err)
+		writeError(w, http.StatusInternalServerError, apierr.Internal, "Internal error")
+		return false
+	}
+	if !ok {
+		writeError(w, http.StatusUnauthorized, apierr.TokenRevoked, "token has used all of its allowed requests")
+		h.logRequest(r, pt, path, repo, http.StatusUnauthorized, time.Since(start), "proxy_budget_exhausted", nil)
+		return false
+	}
+	return true
+}
+
+// refund returns a charged request to the token's budget when it wasn't
+// served: ghp couldn't reach GitHub, or GitHub answered with a server error.
+func (h *Handler) refund(ctx context.Context, pt *database.ProxyToken) {
+	if err := h.tokenService.Refund(ctx, pt); err != nil {
+		h.logger.Error("failed to refund token request", "token_id", pt.ID, "error", err)
+	}
 }
 
 func (h *Handler) handleGraphQL(w http.ResponseWriter, r *http.Request, pt *database.ProxyToken, start time.Time) {
-	// For GraphQL, we forward the request and check the token's scopes in a simplified manner.
-	// Full GraphQL query parsing is complex; for now, we require that the token has at least one scope.
+	// A single GraphQL request can batch many operations, so it never counts
+	// as finishing in-flight work for a token in its revocation grace.
+	if pt.Revoking {
+		writeError(w, http.StatusUnauthorized, apierr.TokenRevoked, "token has been revoked")
+		h.logRequest(r, pt, "/graphql", "", http.StatusUnauthorized, time.Since(start), "proxy_request", nil)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxGraphQLBytes))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, apierr.PayloadTooLarge, "GraphQL request body too large")
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	// Check the document against the token before anything reaches GitHub:
+	// the permissions its fields and mutations need, and the repositories
+	// it names.
+	access, err := analyzeGraphQL(body)
+	var denied *graphQLDenied
+	if errors.As(err, &denied) {
+		h.denyGraphQL(w, r, pt, denied.message, start)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, apierr.InvalidRequest, err.Error())
+		return
+	}
+	scopes, err := database.ParseScopes(pt.Scopes)
+	if err != nil {
+		h.logger.Error("failed to parse token scopes", "error", err)
+		writeError(w, http.StatusInternalServerError, apierr.Internal, "Internal error")
+		return
+	}
+	permissions := make([]string, 0, len(access.scopes))
+	for permission := range access.scopes {
+		permissions = append(permissions, permission)
+	}
+	sort.Strings(permissions)
+	for _, permission := range permissions {
+		level := access.scopes[permission]
+		if permission != "metadata" && !scopes.HasPermission(permission, level) {
+			h.denyGraphQL(w, r, pt, fmt.Sprintf("Token does not have permission for %s:%s on %s", permission, level, pt.Repository), start)
+			return
+		}
+	}
+	for _, repo := range access.repos {
+		if !strings.EqualFold(repo, pt.Repository) {
+			h.denyGraphQL(w, r, pt, fmt.Sprintf("Token is scoped to %s, not %s", pt.Repository, repo), start)
+			return
+		}
+	}
+
+	// Node IDs in mutation inputs can only be tied to a repository by
+	// asking GitHub, so record-only mode takes the other checks as enough.
+	if h.recordOnly() {
+		if h.charge(w, r, pt, "/graphql", pt.Repository, start) {
+			h.recordRequest(w, r, pt, "/graphql", pt.Repository, "", "", start)
+		}
+		return
+	}
+
 	githubToken, err := h.getGitHubToken(r, pt)
 	if err != nil {
 		h.logger.Error("failed to get GitHub token for GraphQL", "error", err)
-		writeError(w, http.StatusInternalServerError, "Failed to retrieve GitHub credentials")
+		writeError(w, http.StatusInternalServerError, apierr.GitHubTokenMissing, "Failed to retrieve GitHub credentials")
+		return
+	}
+
+	if len(access.mutations) > 0 {
+		var nodes map[string]string
+		if ids := access.nodeIDs(); len(ids) > 0 {
+			nodes, err = h.nodeRepositories(r.Context(), githubToken, ids)
+			if err != nil {
+				h.logger.Error("failed to look up GraphQL mutation targets", "error", err)
+				writeError(w, http.StatusBadGateway, apierr.UpstreamError, "Failed to look up the objects this mutation changes")
+				return
+			}
+		}
+		if err := checkMutationTargets(access.mutations, nodes, pt.Repository); err != nil {
+			h.denyGraphQL(w, r, pt, err.Error(), start)
+			return
+		}
+	}
+	if !h.charge(w, r, pt, "/graphql", pt.Repository, start) {
 		return
 	}
 
-	status := h.forwardRequest(w, r, "/graphql", githubToken)
+	status, trace := h.forwardRequest(w, r, pt, graphQLURL(h.apiBase), githubToken)
 
-	if err := h.tokenService.RecordUsage(r.Context(), pt.ID); err != nil {
-		h.logger.Error("failed to record token usage", "error", err)
+	if pt.MaxRequests == 0 {
+		if err := h.tokenService.RecordUsage(r.Context(), pt.ID); err != nil {
+			h.logger.Error("failed to record token usage", "error", err)
+		}
+	} else if status >= http.StatusInternalServerError {
+		h.refund(r.Context(), pt)
 	}
 
-	h.logRequest(r.Context(), pt, r.Method, "/graphql", pt.Repository, status, time.Since(start), "proxy_request")
+	h.logRequest(r, pt, "/graphql", pt.Repository, status, time.Since(start), "proxy_request", trace)
+}
+
+// denyGraphQL refuses a GraphQL request the token's scopes don't cover.
+func (h *Handler) denyGraphQL(w http.ResponseWriter, r *http.Request, pt *database.ProxyToken, message string, start time.Time) {
+	writeError(w, http.StatusForbidden, apierr.ScopeDenied, message)
+	h.logRequest(r, pt, "/graphql", pt.Repository, http.StatusForbidden, time.Since(start), "proxy_scope_denied", nil)
 }
 
 func (h *Handler) getGitHubToken(r *http.Request, pt *database.ProxyToken) (string, error) {
-	gt, err := h.store.GetGitHubTokenByID(r.Context(), pt.GitHubTokenID)
+	gt, err := h.loadGitHubToken(r.Context(), pt)
+	if err != nil {
+		return "", err
+	}
+	return h.accessToken(r.Context(), gt)
+}
+
+// loadGitHubToken loads the GitHub token backing pt.
+func (h *Handler) loadGitHubToken(ctx context.Context, pt *database.ProxyToken) (*database.GitHubToken, error) {
+	gt, err := h.store.GetGitHubTokenByID(ctx, pt.GitHubTokenID)
 	if err != nil {
-		return "", fmt.Errorf("loading github token: %w", err)
+		return nil, fmt.Errorf("loading github token: %w", err)
 	}
 	if gt == nil {
-		return "", fmt.Errorf("github token not found")
+		return nil, fmt.Errorf("github token not found")
 	}
+	return gt, nil
+}
 
+// accessToken returns gt's plaintext access token, refreshing it first if it
+// expires soon.
+func (h *Handler) accessToken(ctx context.Context, gt *database.GitHubToken) (string, error) {
 	// If the access token expires soon, attempt a refresh.
-	if time.Until(gt.AccessTokenExpiresAt) < tokenRefreshSkew {
-		newToken, err := h.refreshGitHubToken(r.Context(), gt)
-		if err != nil {
+	if time.Until(gt.AccessTokenExpiresAt) < oauth.RefreshSkew {
+		newToken, err := h.refreshGitHubToken(ctx, gt)
+		if errors.Is(err, oauth.ErrInvalidClient) {
+			h.logger.Error("github_oauth_client_invalid",
+				"msg", "GitHub rejected the OAuth app credentials; if github.client_id or github.client_secret changed, users must re-authenticate",
+				"token_id", gt.ID, "error", err)
+		} else if err != nil {
 			h.logger.Warn("github token refresh failed, using existing token",
 				"token_id", gt.ID, "error", err)
 		} else {
@@ -184,15 +536,6 @@ func (h *Handler) getGitHubToken(r *http.Request, pt *database.ProxyToken) (stri
 	return plaintext, nil
 }
 
-// tokenRefreshResponse represents the JSON response from GitHub's OAuth token endpoint.
-type tokenRefreshResponse struct {
-	AccessToken  string `json:"access_token"`
-	RefreshToken string `json:"refresh_token"`
-	ExpiresIn    int    `json:"expires_in"`
-	Error        string `json:"error"`
-	ErrorDesc    string `json:"error_description"`
-}
-
 // refreshGitHubToken exchanges a refresh token for a new access token via
 // GitHub's OAuth token endpoint. On success it persists the new encrypted
 // tokens and returns the new plaintext access token.
@@ -202,42 +545,9 @@ func (h *Handler) refreshGitHubToken(ctx context.Context, gt *database.GitHubTok
 		return "", fmt.Errorf("decrypting refresh token: %w", err)
 	}
 
-	form := url.Values{
-		"grant_type":    {"refresh_token"},
-		"client_id":     {h.cfg.GitHub.ClientID},
-		"client_secret": {h.cfg.GitHub.ClientSecret},
-		"refresh_token": {refreshPlaintext},
-	}
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, githubTokenURL, strings.NewReader(form.Encode()))
-	if err != nil {
-		return "", fmt.Errorf("creating refresh request: %w", err)
-	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("Accept", "application/json")
-
-	resp, err := h.client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("executing refresh request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
+	tokenResp, err := h.oauth.RefreshToken(ctx, refreshPlaintext)
 	if err != nil {
-		return "", fmt.Errorf("reading refresh response: %w", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("refresh endpoint returned %d: %s", resp.StatusCode, body)
-	}
-
-	var tokenResp tokenRefreshResponse
-	if err := json.Unmarshal(body, &tokenResp); err != nil {
-		return "", fmt.Errorf("parsing refresh response: %w", err)
-	}
-
-	if tokenResp.Error != "" {
-		return "", fmt.Errorf("refresh error: %s: %s", tokenResp.Error, tokenResp.ErrorDesc)
+		return "", err
 	}
 
 	// Encrypt and persist the new tokens.
@@ -266,36 +576,64 @@ func (h *Handler) refreshGitHubToken(ctx context.Context, gt *database.GitHubTok
 		"token_id", gt.ID,
 		"expires_at", gt.AccessTokenExpiresAt.Format(time.RFC3339))
 
+	// Track scope changes so token creation can flag proxy scopes the
+	// GitHub token no longer backs.
+	if tokenResp.Scope != "" && tokenResp.Scope != gt.Scopes {
+		if err := h.store.UpdateGitHubTokenScopes(ctx, gt.ID, tokenResp.Scope); err != nil {
+			h.logger.Error("failed to update github token scopes", "token_id", gt.ID, "error", err)
+		} else {
+			h.logger.Info("github token scopes changed", "token_id", gt.ID, "from", gt.Scopes, "to", tokenResp.Scope)
+			gt.Scopes = tokenResp.Scope
+		}
+	}
+
 	return tokenResp.AccessToken, nil
 }
 
-func (h *Handler) forwardRequest(w http.ResponseWriter, r *http.Request, path, githubToken string) int {
-	targetURL := githubAPIBase + path
+// correlationHeader carries ghp's request ID to GitHub when
+// proxy.correlation_id is enabled.
+const correlationHeader = "X-GHP-Request-Id"
+
+// forwardRequest relays the request to targetURL (which carries no query)
+// and copies back the response.
+// It returns the response status and, when proxy.correlation_id is enabled,
+// audit metadata pairing ghp's request ID with GitHub's X-GitHub-Request-Id.
+func (h *Handler) forwardRequest(w http.ResponseWriter, r *http.Request, pt *database.ProxyToken, targetURL, githubToken string) (int, json.RawMessage) {
 	if r.URL.RawQuery != "" {
 		targetURL += "?" + r.URL.RawQuery
 	}
 
 	proxyReq, err := http.NewRequestWithContext(r.Context(), r.Method, targetURL, r.Body)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "Failed to create upstream request")
-		return http.StatusInternalServerError
+		writeError(w, http.StatusInternalServerError, apierr.Internal, "Failed to create upstream request")
+		return http.StatusInternalServerError, nil
 	}
 
-	// Copy relevant headers.
-	for _, key := range []string{"Content-Type", "Accept", "User-Agent"} {
-		if v := r.Header.Get(key); v != "" {
-			proxyReq.Header.Set(key, v)
-		}
+	proxyReq.Header = h.upstreamHeaders(r, pt)
+	proxyReq.Host = proxyReq.URL.Host
+	proxyReq.ContentLength = r.ContentLength
+
+	var correlationID string
+	if h.cfg.Proxy.CorrelationID {
+		correlationID = uuid.New().String()
+		proxyReq.Header.Set(correlationHeader, correlationID)
+		w.Header().Set(correlationHeader, correlationID)
 	}
 
 	// Set the real GitHub token.
 	proxyReq.Header.Set("Authorization", "Bearer "+githubToken)
 
-	resp, err := h.client.Do(proxyReq)
+	// Uploads stream large assets, which the API client's timeout would cut
+	// short.
+	client := h.client
+	if strings.HasPrefix(targetURL, h.uploadBase+"/") {
+		client = h.gitClient
+	}
+	resp, err := client.Do(proxyReq)
 	if err != nil {
 		h.logger.Error("upstream request failed", "error", err)
-		writeError(w, http.StatusBadGateway, "Upstream request failed")
-		return http.StatusBadGateway
+		writeError(w, http.StatusBadGateway, apierr.UpstreamError, "Upstream request failed")
+		return http.StatusBadGateway, traceMetadata(correlationID, "")
 	}
 	defer resp.Body.Close()
 
@@ -317,30 +655,176 @@ func (h *Handler) forwardRequest(w http.ResponseWriter, r *http.Request, path, g
 
 	// Copy other response headers.
 	for key, vals := range resp.Header {
-		if strings.HasPrefix(key, "X-GitHub") || key == "Link" || key == "Content-Type" {
+		if strings.HasPrefix(key, "X-GitHub") || key == "Link" {
 			for _, v := range vals {
+				if key == "Link" && h.cfg.Proxy.RewriteURLs {
+					v = h.rewriteLinks(r, v)
+				}
 				w.Header().Add(key, v)
 			}
 		}
 	}
 
+	// Relay the Content-Type exactly, including the text/plain of diffs and
+	// patches. Without one, a nil entry stops net/http sniffing its own.
+	w.Header()["Content-Type"] = resp.Header["Content-Type"]
+
+	if loc := resp.Header.Get("Location"); loc != "" {
+		if h.cfg.Proxy.RewriteURLs {
+			loc = h.rewriteUpstreamURL(r, loc)
+		}
+		w.Header().Set("Location", loc)
+	}
+
+	var body io.Reader = resp.Body
+	if h.cfg.Proxy.RewriteURLs && strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		body = h.rewriteBody(r, resp.Body)
+	}
+
 	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	io.Copy(w, body)
+
+	metrics.ProxyResponse(resp.StatusCode)
+	return resp.StatusCode, traceMetadata(correlationID, resp.Header.Get("X-GitHub-Request-Id"))
+}
+
+// traceMetadata returns the audit metadata correlating a ghp request with
+// GitHub's, or nil when correlation is disabled.
+func traceMetadata(correlationID, githubRequestID string) json.RawMessage {
+	if correlationID == "" {
+		return nil
+	}
+	meta, _ := json.Marshal(map[string]string{
+		"ghp_request_id":    correlationID,
+		"github_request_id": githubRequestID,
+	})
+	return meta
+}
+
+// rewriteUpstreamURL maps a URL on the upstream API to the equivalent URL on
+// ghp. URLs on other hosts (e.g. codeload) are returned unchanged.
+func (h *Handler) rewriteUpstreamURL(r *http.Request, u string) string {
+	rest, ok := strings.CutPrefix(u, h.apiBase)
+	if !ok || (rest != "" && !strings.HasPrefix(rest, "/") && !strings.HasPrefix(rest, "?")) {
+		return u
+	}
+	return h.proxyAPIBase(r) + rest
+}
+
+// rewriteLinks maps the upstream API URLs in a Link header (pagination) to
+// ghp.
+func (h *Handler) rewriteLinks(r *http.Request, link string) string {
+	return strings.ReplaceAll(link, "<"+h.apiBase+"/", "<"+h.proxyAPIBase(r)+"/")
+}
+
+// proxyAPIBase returns the base URL agents use for the REST API on ghp, in
+// the path style of r: server.base_url plus /api/v3 for GHES-style requests,
+// and the host the client addressed for bare ones, which only arrive through
+// the api.github.com virtualhost. The scheme comes from server.base_url, as
+// behind a TLS-terminating load balancer r itself arrives over plain HTTP.
+func (h *Handler) proxyAPIBase(r *http.Request) string {
+	scheme := "http"
+	if u, err := url.Parse(h.cfg.Server.BaseURL); err == nil && u.Scheme != "" {
+		scheme = u.Scheme
+	} else if r.TLS != nil {
+		scheme = "https"
+	}
+	if style, _, _ := splitAPIPath(r.URL.Path); style == styleBare {
+		return scheme + "://" + r.Host
+	}
+	base := strings.TrimSuffix(h.cfg.Server.BaseURL, "/")
+	if base == "" {
+		base = scheme + "://" + r.Host
+	}
+	return base + "/api/v3"
+}
+
+// The GitHub APIs a request can be for.
+const (
+	restAPI = iota
+	graphQLAPI
+	uploadsAPI
+)
+
+// splitAPIPath reports the path style of a request path, the API path
+// within it, and which API it is for. Uploads only have a GHES-style path,
+// /api/uploads/...; bare-style clients upload to uploads.github.com.
+func splitAPIPath(p string) (style, apiPath string, api int) {
+	if p == "/api/graphql" {
+		return styleGHES, "/graphql", graphQLAPI
+	}
+	if rest, ok := strings.CutPrefix(p, "/api/v3"); ok && (rest == "" || rest[0] == '/') {
+		return styleGHES, rest, restAPI
+	}
+	if rest, ok := strings.CutPrefix(p, "/api/uploads"); ok && (rest == "" || rest[0] == '/') {
+		return styleGHES, rest, uploadsAPI
+	}
+	if p == "/graphql" {
+		return styleBare, p, graphQLAPI
+	}
+	return styleBare, p, restAPI
+}
 
-	return resp.StatusCode
+// graphQLURL returns the GraphQL endpoint beside a REST API root: /graphql
+// on api.github.com, and /api/graphql beside a GHES server's /api/v3.
+func graphQLURL(apiBase string) string {
+	if root, ok := strings.CutSuffix(apiBase, "/api/v3"); ok {
+		return root + "/api/graphql"
+	}
+	return apiBase + "/graphql"
+}
+
+// rewriteBody rewrites upstream API URLs in a response body to point at ghp.
+// Only bodies up to proxy.max_buffered_body are buffered and rewritten;
+// larger ones are streamed through unmodified.
+func (h *Handler) rewriteBody(r *http.Request, body io.Reader) io.Reader {
+	limit := h.cfg.Proxy.MaxBufferedBody
+	buf, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil || int64(len(buf)) > limit {
+		if err == nil {
+			h.logger.Debug("response too large to rewrite, streaming", "limit", limit)
+		}
+		return io.MultiReader(bytes.NewReader(buf), body)
+	}
+	buf = bytes.ReplaceAll(buf, []byte(h.apiBase+"/"), []byte(h.proxyAPIBase(r)+"/"))
+	// Release upload_url templates point at the upload API, which agents
+	// reach through ghp at /api/uploads.
+	if base := h.proxyAPIBase(r); strings.HasSuffix(base, "/api/v3") {
+		buf = bytes.ReplaceAll(buf, []byte(h.uploadBase+"/"), []byte(strings.TrimSuffix(base, "/v3")+"/uploads/"))
+	}
+	return bytes.NewReader(buf)
 }
 
-func (h *Handler) logRequest(ctx context.Context, pt *database.ProxyToken, method, path, repo string, status int, dur time.Duration, action string) {
-	h.logger.Info(action,
+// logRequest logs a proxied request at the level logging.proxy sets for its
+// status, and records its metrics and audit entry.
+func (h *Handler) logRequest(r *http.Request, pt *database.ProxyToken, path, repo string, status int, dur time.Duration, action string, meta json.RawMessage) {
+	ctx, method := r.Context(), r.Method
+	class := h.cfg.Logging.Proxy
+	attrs := []any{
 		"token_id", pt.ID,
 		"user_id", pt.UserID,
 		"session", pt.SessionID,
 		"repo", repo,
 		"method", method,
-		"path", path,
 		"status", status,
 		"duration_ms", dur.Milliseconds(),
-	)
+	}
+	h.logger.Log(ctx, class.LevelFor(status), action, append(attrs, class.Attrs(r, path)...)...)
+	metrics.ObserveProxyRequest(pt.UserID, repo, method, status, dur)
+	if h.auditExcluded(method, path, status) {
+		return
+	}
+
+	var key string
+	if h.coalescer != nil {
+		key = coalesceKey(action, method, path, status)
+		if id, merged, ok := h.coalescer.repeat(pt.ID, key, time.Now()); ok {
+			if err := h.store.UpdateAuditEntryMetadata(ctx, id, merged); err != nil {
+				h.logger.Error("failed to update audit entry", "error", err)
+			}
+			return
+		}
+	}
 
 	entry := &database.AuditEntry{
 		UserID:     pt.UserID,
@@ -351,13 +835,104 @@ func (h *Handler) logRequest(ctx context.Context, pt *database.ProxyToken, metho
 		StatusCode: status,
 		DurationMS: int(dur.Milliseconds()),
 		SessionID:  pt.SessionID,
+		Metadata:   meta,
 	}
 	tokenID := pt.ID
 	entry.ProxyTokenID = &tokenID
 
 	if err := h.store.CreateAuditEntry(ctx, entry); err != nil {
 		h.logger.Error("failed to create audit entry", "error", err)
+		return
 	}
+	if h.coalescer != nil {
+		h.coalescer.record(pt.ID, key, entry.ID, meta, time.Now())
+	}
+}
+
+// DecayUserRates re-estimates every tracked user's request rate, so
+// ghp_user_request_rate falls while a user is idle instead of holding the
+// rate of their last request.
+func (h *Handler) DecayUserRates() {
+	h.rates.sweep(time.Now(), metrics.SetUserRequestRate)
+}
+
+// observeUserRate updates the token owner's request rate and warns, without
+// refusing the request, when it passes proxy.user_rate_warning.
+func (h *Handler) observeUserRate(r *http.Request, pt *database.ProxyToken) {
+	threshold := h.cfg.Proxy.UserRateWarning
+	rate, warn := h.rates.observe(pt.UserID, time.Now(), threshold)
+	metrics.SetUserRequestRate(pt.UserID, rate)
+	if !warn {
+		return
+	}
+	h.logger.Warn("user_rate_high", "user_id", pt.UserID, "token_id", pt.ID,
+		"rate_per_minute", int(rate), "threshold", threshold)
+	meta, _ := json.Marshal(map[string]int{"rate_per_minute": int(rate), "threshold": threshold})
+	tokenID := pt.ID
+	entry := &database.AuditEntry{
+		UserID:       pt.UserID,
+		ProxyTokenID: &tokenID,
+		Action:       "user_rate_high",
+		Method:       r.Method,
+		Path:         r.URL.Path,
+		Repository:   pt.Repository,
+		SessionID:    pt.SessionID,
+		Metadata:     meta,
+	}
+	if err := h.store.CreateAuditEntry(r.Context(), entry); err != nil {
+		h.logger.Error("failed to create audit entry", "error", err)
+	}
+}
+
+// auditExcluded reports whether a request matches audit.exclude_paths and
+// is a successful read, so it needn't be persisted.
+func (h *Handler) auditExcluded(method, apiPath string, status int) bool {
+	if method != http.MethodGet && method != http.MethodHead || status >= 400 {
+		return false
+	}
+	for _, pattern := range h.cfg.Audit.ExcludePaths {
+		if ok, _ := path.Match(pattern, apiPath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamHeaders returns the agent request headers relayed to GitHub. Only
+// an allowlist is relayed, so cookies, hop-by-hop and X-Forwarded-* headers
+// from the agent never reach GitHub.
+func (h *Handler) upstreamHeaders(r *http.Request, pt *database.ProxyToken) http.Header {
+	header := make(http.Header)
+	for _, key := range forwardedRequestHeaders {
+		if v := r.Header.Get(key); v != "" {
+			header.Set(key, v)
+		}
+	}
+	if header.Get(apiVersionHeader) == "" && h.cfg.Proxy.APIVersion != "" {
+		header.Set(apiVersionHeader, h.cfg.Proxy.APIVersion)
+	}
+	if h.cfg.Proxy.IdentifyAgent {
+		header.Set("User-Agent", agentUserAgent(r.Header.Get("User-Agent"), pt))
+	}
+	for _, key := range h.cfg.Proxy.StripHeaders {
+		header.Del(key)
+	}
+	return header
+}
+
+// agentUserAgent decorates the agent's User-Agent with the token prefix and
+// session ID. GitHub doesn't support impersonation, but the User-Agent is
+// recorded in its logs and lets requests be traced back to an agent.
+func agentUserAgent(ua string, pt *database.ProxyToken) string {
+	ident := "ghp (token=" + pt.TokenPrefix
+	if pt.SessionID != "" {
+		ident += "; session=" + pt.SessionID
+	}
+	ident += ")"
+	if ua == "" {
+		return ident
+	}
+	return ua + " " + ident
 }
 
 // extractToken extracts the ghp_ token from the Authorization header.
@@ -382,11 +957,26 @@ func extractToken(r *http.Request) string {
 	return ""
 }
 
-func writeError(w http.ResponseWriter, status int, message string) {
+// resolveErrorCode maps a token.Service.Resolve error to its API error code.
+func resolveErrorCode(err error) string {
+	switch {
+	case errors.Is(err, token.ErrTokenExpired):
+		return apierr.TokenExpired
+	case errors.Is(err, token.ErrTokenRevoked):
+		return apierr.TokenRevoked
+	case errors.Is(err, token.ErrUserDisabled):
+		return apierr.UserDisabled
+	}
+	return apierr.InvalidToken
+}
+
+// writeError writes a GitHub-style error body with an additional ghp error code.
+func writeError(w http.ResponseWriter, status int, code, message string) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(map[string]string{
 		"message":           message,
+		"code":              code,
 		"documentation_url": "https://docs.github.com/rest",
 	})
 }
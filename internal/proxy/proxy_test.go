@@ -0,0 +1,1499 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goodtune/ghp/internal/apierr"
+	"github.com/goodtune/ghp/internal/config"
+	"github.com/goodtune/ghp/internal/crypto"
+	"github.com/goodtune/ghp/internal/database"
+	"github.com/goodtune/ghp/internal/metrics"
+	"github.com/goodtune/ghp/internal/oauth"
+	"github.com/goodtune/ghp/internal/token"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newTestHandler returns a Handler that forwards to the given upstream.
+func newTestHandler(t *testing.T, cfg *config.Config, upstream *httptest.Server) *Handler {
+	t.Helper()
+	h := NewHandler(cfg, nil, nil, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	h.apiBase = upstream.URL
+	return h
+}
+
+func TestForwardRequestIdentifyAgent(t *testing.T) {
+	var gotUA string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUA = r.Header.Get("User-Agent")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	pt := &database.ProxyToken{ID: "tok-1", TokenPrefix: "ghp_a1b2", SessionID: "agent-session-42"}
+
+	for _, enabled := range []bool{true, false} {
+		cfg := config.Defaults()
+		cfg.Proxy.IdentifyAgent = enabled
+		h := newTestHandler(t, cfg, upstream)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v3/user", nil)
+		req.Header.Set("User-Agent", "gh/2.40.0")
+		h.forwardRequest(httptest.NewRecorder(), req, pt, h.apiBase+"/user", "gho_real")
+
+		if !strings.HasPrefix(gotUA, "gh/2.40.0") {
+			t.Errorf("enabled=%v: User-Agent = %q, want original agent preserved", enabled, gotUA)
+		}
+		hasSession := strings.Contains(gotUA, "agent-session-42")
+		if hasSession != enabled {
+			t.Errorf("enabled=%v: User-Agent = %q, session present = %v", enabled, gotUA, hasSession)
+		}
+		if enabled && !strings.Contains(gotUA, "ghp_a1b2") {
+			t.Errorf("User-Agent = %q, want token prefix", gotUA)
+		}
+	}
+}
+
+func TestForwardRequestStripsHeaders(t *testing.T) {
+	var got *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	cfg := config.Defaults()
+	cfg.Proxy.StripHeaders = []string{"user-agent"}
+	h := newTestHandler(t, cfg, upstream)
+
+	req := httptest.NewRequest(http.MethodGet, "http://ghp.example.com/api/v3/user", nil)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("User-Agent", "gh/2.40.0")
+	req.Header.Set("Cookie", "ghp_session=ghpr_secret")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	req.Header.Set("Connection", "keep-alive, X-Custom")
+	h.forwardRequest(httptest.NewRecorder(), req, &database.ProxyToken{}, h.apiBase+"/user", "gho_real")
+
+	if got == nil {
+		t.Fatal("request not forwarded")
+	}
+	for _, key := range []string{"Cookie", "X-Forwarded-For", "X-Custom"} {
+		if v := got.Header.Get(key); v != "" {
+			t.Errorf("%s forwarded upstream: %q", key, v)
+		}
+	}
+	// The Go client substitutes its own default when User-Agent is stripped.
+	if ua := got.Header.Get("User-Agent"); strings.Contains(ua, "gh/2.40.0") {
+		t.Errorf("stripped User-Agent forwarded upstream: %q", ua)
+	}
+	if got.Header.Get("Accept") != "application/vnd.github+json" {
+		t.Errorf("Accept = %q, want it forwarded", got.Header.Get("Accept"))
+	}
+	if got.Header.Get("Authorization") != "Bearer gho_real" {
+		t.Errorf("Authorization = %q, want real GitHub token", got.Header.Get("Authorization"))
+	}
+	if want := strings.TrimPrefix(upstream.URL, "http://"); got.Host != want {
+		t.Errorf("Host = %q, want upstream host %q", got.Host, want)
+	}
+}
+
+func TestForwardRequestRelaysRedirects(t *testing.T) {
+	var followed bool
+	var upstream *httptest.Server
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/old/name":
+			http.Redirect(w, r, upstream.URL+"/repos/new/name", http.StatusFound)
+		case "/repos/org/repo/tarball/main":
+			http.Redirect(w, r, "https://codeload.github.com/org/repo/legacy.tar.gz/main", http.StatusFound)
+		default:
+			followed = true
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		rewrite      bool
+		path         string
+		wantLocation string
+	}{
+		{false, "/repos/old/name", upstream.URL + "/repos/new/name"},
+		{true, "/repos/old/name", "https://ghp.example.com/api/v3/repos/new/name"},
+		{true, "/repos/org/repo/tarball/main", "https://codeload.github.com/org/repo/legacy.tar.gz/main"},
+	}
+
+	for _, tt := range tests {
+		cfg := config.Defaults()
+		cfg.Server.BaseURL = "https://ghp.example.com"
+		cfg.Proxy.RewriteURLs = tt.rewrite
+		h := newTestHandler(t, cfg, upstream)
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/api/v3"+tt.path, nil)
+		status, _ := h.forwardRequest(rec, req, &database.ProxyToken{}, h.apiBase+tt.path, "gho_real")
+
+		if status != http.StatusFound || rec.Code != http.StatusFound {
+			t.Errorf("%s: status = %d, want 302 relayed", tt.path, rec.Code)
+		}
+		if loc := rec.Header().Get("Location"); loc != tt.wantLocation {
+			t.Errorf("%s (rewrite=%v): Location = %q, want %q", tt.path, tt.rewrite, loc, tt.wantLocation)
+		}
+	}
+	if followed {
+		t.Error("ghp followed an upstream redirect")
+	}
+}
+
+// testStore is a migrated SQLite store seeded with one user and their
+// (encrypted) GitHub token.
+type testStore struct {
+	*database.SQLiteStore
+	t    *testing.T
+	enc  *crypto.Encryptor
+	user *database.User
+	gt   *database.GitHubToken
+}
+
+func newTestStore(t *testing.T) *testStore {
+	t.Helper()
+	ctx := context.Background()
+	store, err := database.NewSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if err := store.EnsureMigrationsTable(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.NewMigrator(store, "sqlite").Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	enc, err := crypto.NewEncryptor(strings.Repeat("ab", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &database.User{GitHubID: 1, GitHubUsername: "alice", Role: "user"}
+	if err := store.UpsertUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	access, err := enc.Encrypt("gho_real")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gt := &database.GitHubToken{UserID: user.ID, AccessToken: access, RefreshToken: access,
+		AccessTokenExpiresAt: time.Now().Add(time.Hour), RefreshTokenExpiresAt: time.Now().Add(time.Hour)}
+	if err := store.UpsertGitHubToken(ctx, gt); err != nil {
+		t.Fatal(err)
+	}
+	return &testStore{SQLiteStore: store, t: t, enc: enc, user: user, gt: gt}
+}
+
+// addToken stores a contents:read proxy token for org/repo.
+func (s *testStore) addToken(plaintext string, expires time.Time, revoked bool) {
+	s.t.Helper()
+	s.addScopedToken(plaintext, `{"contents":"read"}`, expires, revoked)
+}
+
+// addScopedToken stores a proxy token for org/repo with the given scopes.
+func (s *testStore) addScopedToken(plaintext, scopes string, expires time.Time, revoked bool) {
+	s.t.Helper()
+	s.addProxyToken(plaintext, scopes, expires, revoked, 0)
+}
+
+// addProxyToken stores a proxy token for org/repo with the given scopes and
+// request budget.
+func (s *testStore) addProxyToken(plaintext, scopes string, expires time.Time, revoked bool, maxRequests int64) {
+	s.t.Helper()
+	ctx := context.Background()
+	pt := &database.ProxyToken{
+		TokenHash:     token.Hash(plaintext),
+		TokenPrefix:   plaintext[:8],
+		UserID:        s.user.ID,
+		GitHubTokenID: s.gt.ID,
+		Repository:    "org/repo",
+		Scopes:        json.RawMessage(scopes),
+		ExpiresAt:     expires,
+		MaxRequests:   maxRequests,
+	}
+	if err := s.CreateProxyToken(ctx, pt); err != nil {
+		s.t.Fatal(err)
+	}
+	if revoked {
+		if err := s.RevokeProxyToken(ctx, pt.ID); err != nil {
+			s.t.Fatal(err)
+		}
+	}
+}
+
+func TestServeHTTPErrorCodes(t *testing.T) {
+	store := newTestStore(t)
+	store.addToken("ghp_valid", time.Now().Add(time.Hour), false)
+	store.addToken("ghp_expired", time.Now().Add(-time.Hour), false)
+	store.addToken("ghp_revoked", time.Now().Add(time.Hour), true)
+
+	cfg := config.Defaults()
+	h := NewHandler(cfg, token.NewService(store, cfg.Tokens.MaxDuration), store, store.enc,
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		wantStatus int
+		wantCode   string
+	}{
+		{"no token", "GET", "/api/v3/repos/org/repo", "", http.StatusUnauthorized, apierr.Unauthenticated},
+		{"unknown token", "GET", "/api/v3/repos/org/repo", "ghp_unknown", http.StatusUnauthorized, apierr.InvalidToken},
+		{"expired token", "GET", "/api/v3/repos/org/repo", "ghp_expired", http.StatusUnauthorized, apierr.TokenExpired},
+		{"revoked token", "GET", "/api/v3/repos/org/repo", "ghp_revoked", http.StatusUnauthorized, apierr.TokenRevoked},
+		{"other repository", "GET", "/api/v3/repos/org/other", "ghp_valid", http.StatusForbidden, apierr.ScopeDenied},
+		{"missing permission", "POST", "/api/v3/repos/org/repo/pulls", "ghp_valid", http.StatusForbidden, apierr.ScopeDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "token "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			var body map[string]string
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body["code"] != tt.wantCode {
+				t.Errorf("code = %q, want %q", body["code"], tt.wantCode)
+			}
+			if body["message"] == "" || body["documentation_url"] == "" {
+				t.Errorf("body = %v, want message and documentation_url", body)
+			}
+		})
+	}
+
+	// Inside the revocation grace a revoked token is flagged, and GraphQL
+	// requests are refused outright.
+	ts := token.NewService(store, cfg.Tokens.MaxDuration)
+	ts.SetRevocationGrace(time.Hour)
+	h = NewHandler(cfg, ts, store, store.enc, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	req := httptest.NewRequest("POST", "/api/graphql", strings.NewReader(`{"query":"{viewer{login}}"}`))
+	req.Header.Set("Authorization", "token ghp_revoked")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized || !strings.Contains(rec.Body.String(), apierr.TokenRevoked) {
+		t.Errorf("graphql during grace: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("X-GHP-Token-Status"); got != "revoking" {
+		t.Errorf("X-GHP-Token-Status = %q, want revoking", got)
+	}
+}
+
+func TestServeHTTPCorrelationID(t *testing.T) {
+	var gotCorrelation string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotCorrelation = r.Header.Get("X-GHP-Request-Id")
+		w.Header().Set("X-GitHub-Request-Id", "CAFE:1234:5678")
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	store := newTestStore(t)
+	store.addToken("ghp_valid", time.Now().Add(time.Hour), false)
+	cfg := config.Defaults()
+	cfg.Proxy.CorrelationID = true
+	h := NewHandler(cfg, token.NewService(store, cfg.Tokens.MaxDuration), store, store.enc,
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	h.apiBase = upstream.URL
+
+	req := httptest.NewRequest("GET", "/api/v3/repos/org/repo", nil)
+	req.Header.Set("Authorization", "token ghp_valid")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if gotCorrelation == "" {
+		t.Fatal("upstream did not receive X-GHP-Request-Id")
+	}
+	if got := rec.Header().Get("X-GHP-Request-Id"); got != gotCorrelation {
+		t.Errorf("response X-GHP-Request-Id = %q, want %q", got, gotCorrelation)
+	}
+
+	entries, err := store.ListAuditEntries(context.Background(), database.AuditFilter{Action: "proxy_request"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d audit entries, want 1", len(entries))
+	}
+	var meta map[string]string
+	if err := json.Unmarshal(entries[0].Metadata, &meta); err != nil {
+		t.Fatalf("metadata %s: %v", entries[0].Metadata, err)
+	}
+	if meta["ghp_request_id"] != gotCorrelation {
+		t.Errorf("ghp_request_id = %q, want %q", meta["ghp_request_id"], gotCorrelation)
+	}
+	if meta["github_request_id"] != "CAFE:1234:5678" {
+		t.Errorf("github_request_id = %q, want CAFE:1234:5678", meta["github_request_id"])
+	}
+}
+
+func TestServeHTTPBranchProtectionNeedsAdministration(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	store := newTestStore(t)
+	store.addScopedToken("ghp_contents", `{"contents":"write"}`, time.Now().Add(time.Hour), false)
+	store.addScopedToken("ghp_adminread", `{"administration":"read"}`, time.Now().Add(time.Hour), false)
+	store.addScopedToken("ghp_admin", `{"administration":"write"}`, time.Now().Add(time.Hour), false)
+	cfg := config.Defaults()
+	h := NewHandler(cfg, token.NewService(store, cfg.Tokens.MaxDuration), store, store.enc,
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	h.apiBase = upstream.URL
+
+	tests := []struct {
+		token      string
+		wantStatus int
+	}{
+		{"ghp_contents", http.StatusForbidden},
+		{"ghp_adminread", http.StatusForbidden},
+		{"ghp_admin", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("PUT", "/api/v3/repos/org/repo/branches/main/protection", strings.NewReader(`{}`))
+		req.Header.Set("Authorization", "token "+tt.token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d (%s)", tt.token, rec.Code, tt.wantStatus, rec.Body)
+		}
+	}
+}
+
+func TestForwardRequestRewritesBufferedBodies(t *testing.T) {
+	var upstream *httptest.Server
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		pad := ""
+		if r.URL.Path == "/repos/org/big" {
+			pad = strings.Repeat("x", 256)
+		}
+		fmt.Fprintf(w, `{"url":"%s/repos/org/repo","pad":"%s"}`, upstream.URL, pad)
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		path    string
+		wantURL string
+	}{
+		{"/repos/org/small", "https://ghp.example.com/api/v3/repos/org/repo"},
+		{"/repos/org/big", upstream.URL + "/repos/org/repo"},
+	}
+	for _, tt := range tests {
+		cfg := config.Defaults()
+		cfg.Server.BaseURL = "https://ghp.example.com"
+		cfg.Proxy.RewriteURLs = true
+		cfg.Proxy.MaxBufferedBody = 128
+		h := newTestHandler(t, cfg, upstream)
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/api/v3"+tt.path, nil)
+		h.forwardRequest(rec, req, &database.ProxyToken{}, h.apiBase+tt.path, "gho_real")
+
+		var body struct {
+			URL string `json:"url"`
+			Pad string `json:"pad"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatalf("%s: %v", tt.path, err)
+		}
+		if body.URL != tt.wantURL {
+			t.Errorf("%s: url = %q, want %q", tt.path, body.URL, tt.wantURL)
+		}
+		if tt.path == "/repos/org/big" && len(body.Pad) != 256 {
+			t.Errorf("%s: streamed body truncated (pad %d bytes)", tt.path, len(body.Pad))
+		}
+	}
+}
+
+func TestServeHTTPCoalescesAuditEntries(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		window      time.Duration
+		wantEntries int
+	}{
+		{"disabled", 0, 3},
+		{"enabled", time.Minute, 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore(t)
+			store.addToken("ghp_valid", time.Now().Add(time.Hour), false)
+			cfg := config.Defaults()
+			cfg.Audit.CoalesceWindow = tt.window
+			h := NewHandler(cfg, token.NewService(store, cfg.Tokens.MaxDuration), store, store.enc,
+				slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+			for i := 0; i < 3; i++ {
+				req := httptest.NewRequest("POST", "/api/v3/repos/org/repo/pulls", nil)
+				req.Header.Set("Authorization", "token ghp_valid")
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, req)
+				if rec.Code != http.StatusForbidden {
+					t.Fatalf("status = %d, want 403", rec.Code)
+				}
+			}
+
+			entries, err := store.ListAuditEntries(context.Background(), database.AuditFilter{Action: "proxy_scope_denied"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != tt.wantEntries {
+				t.Fatalf("got %d audit entries, want %d", len(entries), tt.wantEntries)
+			}
+			if tt.window == 0 {
+				return
+			}
+			var meta map[string]any
+			if err := json.Unmarshal(entries[0].Metadata, &meta); err != nil {
+				t.Fatalf("metadata %s: %v", entries[0].Metadata, err)
+			}
+			if meta["count"] != float64(3) {
+				t.Errorf("count = %v, want 3", meta["count"])
+			}
+		})
+	}
+}
+
+func TestAuditCoalescerSweeps(t *testing.T) {
+	c := newAuditCoalescer(time.Minute)
+	base := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	c.record("t1", "k", "e1", nil, base)
+	c.record("t2", "k", "e2", nil, base.Add(30*time.Second))
+
+	// However few tokens are tracked, entries past the window are dropped.
+	c.record("t3", "k", "e3", nil, base.Add(80*time.Second))
+	if _, ok := c.last["t1"]; ok || len(c.last) != 2 {
+		t.Errorf("tracking %d tokens after a window, want t2 and t3", len(c.last))
+	}
+}
+
+func TestServeHTTPRateLimit(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	store := newTestStore(t)
+	store.addToken("ghp_valid", time.Now().Add(time.Hour), false)
+	cfg := config.Defaults()
+	ts := token.NewService(store, cfg.Tokens.MaxDuration)
+	if err := ts.SetRateLimit(2, time.Hour, token.RateLimitDB); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(cfg, ts, store, store.enc, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	h.apiBase = upstream.URL
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		req := httptest.NewRequest("GET", "/api/v3/repos/org/repo", nil)
+		req.Header.Set("Authorization", "token ghp_valid")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Fatalf("request %d: status = %d, want %d", i, rec.Code, want)
+		}
+		if want == http.StatusTooManyRequests {
+			if rec.Header().Get("Retry-After") == "" || !strings.Contains(rec.Body.String(), apierr.RateLimited) {
+				t.Errorf("Retry-After = %q, body = %s", rec.Header().Get("Retry-After"), rec.Body)
+			}
+		}
+	}
+}
+
+func TestServeHTTPSingleUseToken(t *testing.T) {
+	failures := 1
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	store := newTestStore(t)
+	store.addProxyToken("ghp_once", `{"contents":"read"}`, time.Now().Add(time.Hour), false, 1)
+	cfg := config.Defaults()
+	ts := token.NewService(store, cfg.Tokens.MaxDuration)
+	// The spent token stays resolvable, so the budget check itself refuses it.
+	ts.SetRevocationGrace(time.Hour)
+	h := NewHandler(cfg, ts, store, store.enc, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	h.apiBase = upstream.URL
+
+	// Requests ghp denies or GitHub fails don't spend the budget.
+	steps := []struct {
+		method, path string
+		want         int
+	}{
+		{"GET", "/api/v3/repos/other/repo", http.StatusForbidden},
+		{"POST", "/api/v3/repos/org/repo/issues", http.StatusForbidden},
+		{"GET", "/api/v3/repos/org/repo", http.StatusServiceUnavailable},
+		{"GET", "/api/v3/repos/org/repo", http.StatusOK},
+		{"GET", "/api/v3/repos/org/repo", http.StatusUnauthorized},
+	}
+	for i, step := range steps {
+		req := httptest.NewRequest(step.method, step.path, nil)
+		req.Header.Set("Authorization", "token ghp_once")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != step.want {
+			t.Fatalf("request %d: status = %d, want %d", i, rec.Code, step.want)
+		}
+	}
+
+	tokens, err := store.ListProxyTokens(context.Background(), store.user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].RevokedAt == nil || tokens[0].RequestCount != 1 {
+		t.Errorf("token = %+v, want revoked after 1 request", tokens[0])
+	}
+	entries, err := store.ListAuditEntries(context.Background(), database.AuditFilter{Action: "proxy_budget_exhausted"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].StatusCode != http.StatusUnauthorized {
+		t.Errorf("budget exhausted audit entries = %+v, want one 401", entries)
+	}
+}
+
+func TestServeHTTPGitHubScopeMissing(t *testing.T) {
+	var upstreamHits int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHits++
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	store := newTestStore(t)
+	store.addProxyToken("ghp_issues", `{"issues":"write"}`, time.Now().Add(time.Hour), false, 0)
+	if err := store.UpdateGitHubTokenScopes(context.Background(), store.gt.ID, "public_repo"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		check      string
+		method     string
+		wantStatus int
+		wantHit    bool
+	}{
+		{"write blocked", "block", "POST", http.StatusForbidden, false},
+		{"read allowed", "block", "GET", http.StatusOK, true},
+		{"check off", "off", "POST", http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreamHits = 0
+			cfg := config.Defaults()
+			cfg.Proxy.GitHubScopeCheck = tt.check
+			h := NewHandler(cfg, token.NewService(store, cfg.Tokens.MaxDuration), store, store.enc,
+				slog.New(slog.NewTextHandler(io.Discard, nil)))
+			h.apiBase = upstream.URL
+
+			req := httptest.NewRequest(tt.method, "/api/v3/repos/org/repo/issues", nil)
+			req.Header.Set("Authorization", "token ghp_issues")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if (upstreamHits > 0) != tt.wantHit {
+				t.Errorf("upstream hits = %d, want hit %v", upstreamHits, tt.wantHit)
+			}
+			if tt.wantStatus == http.StatusForbidden {
+				body := rec.Body.String()
+				if !strings.Contains(body, apierr.InsufficientScope) || !strings.Contains(body, "GitHub token lacks the repo scope") {
+					t.Errorf("body = %s, want a GitHub scope error", body)
+				}
+			}
+		})
+	}
+}
+
+func TestServeHTTPRecordOnly(t *testing.T) {
+	var upstreamHits int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHits++
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	store := newTestStore(t)
+	store.addToken("ghp_valid", time.Now().Add(time.Hour), false)
+	cfg := config.Defaults()
+	cfg.DevMode = true
+	cfg.Proxy.RecordOnly = true
+	h := NewHandler(cfg, token.NewService(store, cfg.Tokens.MaxDuration), store, store.enc,
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	h.apiBase = upstream.URL
+
+	req := httptest.NewRequest("GET", "/api/v3/repos/org/repo/contents/README.md?ref=main", nil)
+	req.Header.Set("Authorization", "token ghp_valid")
+	req.Header.Set("Accept", "application/vnd.github+json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK || rec.Header().Get("X-GHP-Record-Only") != "true" {
+		t.Fatalf("status = %d, headers = %v, want a recorded 200", rec.Code, rec.Header())
+	}
+
+	// Scope denials are still enforced.
+	req = httptest.NewRequest("POST", "/api/v3/repos/org/repo/pulls", nil)
+	req.Header.Set("Authorization", "token ghp_valid")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("denied request status = %d, want 403", rec.Code)
+	}
+
+	if upstreamHits != 0 {
+		t.Errorf("upstream hits = %d, want 0", upstreamHits)
+	}
+
+	entries, err := store.ListAuditEntries(context.Background(), database.AuditFilter{Action: "proxy_recorded"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("recorded entries = %d, want 1", len(entries))
+	}
+	var got recordedRequest
+	if err := json.Unmarshal(entries[0].Metadata, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Query != "ref=main" || got.Permission != "contents" || got.Level != "read" ||
+		len(got.Headers["Accept"]) != 1 || got.Headers["Authorization"] != nil {
+		t.Errorf("recorded = %+v", got)
+	}
+}
+
+func TestServeHTTPCanonicalizesPath(t *testing.T) {
+	var upstreamPath string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamPath = r.URL.Path
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	store := newTestStore(t)
+	store.addToken("ghp_valid", time.Now().Add(time.Hour), false)
+	cfg := config.Defaults()
+	h := NewHandler(cfg, token.NewService(store, cfg.Tokens.MaxDuration), store, store.enc,
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	h.apiBase = upstream.URL
+
+	tests := []struct {
+		method     string
+		path       string
+		wantStatus int
+		wantPath   string
+	}{
+		{"GET", "/api/v3/repos/org/repo//contents/README.md/", http.StatusOK, "/repos/org/repo/contents/README.md"},
+		{"POST", "/api/v3/repos/org/repo/pulls/", http.StatusForbidden, ""},
+		{"POST", "/api/v3/repos/org/repo//pulls", http.StatusForbidden, ""},
+		// Dot segments can't step outside the token's repository.
+		{"GET", "/api/v3/repos/org/repo/../../victim/secret/contents/key", http.StatusForbidden, ""},
+		{"GET", "/repos/org/repo/../../victim/secret/contents/key", http.StatusForbidden, ""},
+		{"GET", "/repos/org/repo/issues/../contents/./README.md", http.StatusOK, "/repos/org/repo/contents/README.md"},
+	}
+	for _, tt := range tests {
+		upstreamPath = ""
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		req.Header.Set("Authorization", "token ghp_valid")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s %s: status = %d, want %d", tt.method, tt.path, rec.Code, tt.wantStatus)
+		}
+		if upstreamPath != tt.wantPath {
+			t.Errorf("%s %s: upstream path = %q, want %q", tt.method, tt.path, upstreamPath, tt.wantPath)
+		}
+	}
+}
+
+func TestServeHTTPUpstreamTLSMinVersion(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	upstream.TLS = &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	store := newTestStore(t)
+	store.addToken("ghp_valid", time.Now().Add(time.Hour), false)
+	cfg := config.Defaults()
+	h := NewHandler(cfg, token.NewService(store, cfg.Tokens.MaxDuration), store, store.enc,
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	h.apiBase = upstream.URL
+
+	req := httptest.NewRequest("GET", "/api/v3/repos/org/repo", nil)
+	req.Header.Set("Authorization", "token ghp_valid")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502 for an upstream limited to TLS 1.1", rec.Code)
+	}
+}
+
+func TestServeHTTPAuditExcludePaths(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("fail") {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	store := newTestStore(t)
+	store.addToken("ghp_valid", time.Now().Add(time.Hour), false)
+	cfg := config.Defaults()
+	cfg.Audit.ExcludePaths = []string{"/user", "/repos/*/*/branches"}
+	h := NewHandler(cfg, token.NewService(store, cfg.Tokens.MaxDuration), store, store.enc,
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	h.apiBase = upstream.URL
+
+	for _, tt := range []struct{ method, path string }{
+		{"GET", "/api/v3/user"},
+		{"GET", "/api/v3/repos/org/repo/branches"},
+		{"GET", "/api/v3/user?fail=1"},                       // Failures are kept.
+		{"GET", "/api/v3/repos/org/repo/contents/README.md"}, // Not excluded.
+		{"POST", "/api/v3/repos/org/repo/pulls"},             // Denials are kept.
+	} {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		req.Header.Set("Authorization", "token ghp_valid")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	entries, err := store.ListAuditEntries(context.Background(), database.AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]bool)
+	for _, e := range entries {
+		got[e.Method+" "+e.Path+" "+strconv.Itoa(e.StatusCode)] = true
+	}
+	for _, want := range []string{"GET /user 404", "GET /repos/org/repo/contents/README.md 200", "POST /repos/org/repo/pulls 403"} {
+		if !got[want] {
+			t.Errorf("missing audit entry %q", want)
+		}
+	}
+	if len(entries) != 3 {
+		t.Errorf("got %d audit entries (%v), want 3", len(entries), got)
+	}
+}
+
+func TestServeHTTPRelaysDiffMediaType(t *testing.T) {
+	const diff = "diff --git a/README.md b/README.md\n--- a/README.md\n+++ b/README.md\n@@ -1 +1 @@\n-old\n+new\n"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "application/vnd.github.v3.diff" {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Write([]byte(`{}`))
+			return
+		}
+		if r.URL.Query().Has("untyped") {
+			w.Header()["Content-Type"] = nil
+		} else {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
+		w.Write([]byte(diff))
+	}))
+	defer upstream.Close()
+
+	store := newTestStore(t)
+	store.addProxyToken("ghp_pulls", `{"pulls":"read"}`, time.Now().Add(time.Hour), false, 0)
+	cfg := config.Defaults()
+	h := NewHandler(cfg, token.NewService(store, cfg.Tokens.MaxDuration), store, store.enc,
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	h.apiBase = upstream.URL
+
+	for query, wantType := range map[string]string{"": "text/plain; charset=utf-8", "?untyped=1": ""} {
+		req := httptest.NewRequest("GET", "/api/v3/repos/org/repo/pulls/1"+query, nil)
+		req.Header.Set("Authorization", "token ghp_pulls")
+		req.Header.Set("Accept", "application/vnd.github.v3.diff")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%q: status = %d, want 200", query, rec.Code)
+		}
+		if got := rec.Header().Get("Content-Type"); got != wantType {
+			t.Errorf("%q: Content-Type = %q, want %q", query, got, wantType)
+		}
+		if rec.Body.String() != diff {
+			t.Errorf("%q: body = %q, want the diff", query, rec.Body.String())
+		}
+	}
+}
+
+func TestServeHTTPAllowedMethods(t *testing.T) {
+	var upstreamMethods []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamMethods = append(upstreamMethods, r.Method)
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	store := newTestStore(t)
+	store.addProxyToken("ghp_writer", `{"contents":"write","issues":"write"}`, time.Now().Add(time.Hour), false, 0)
+	cfg := config.Defaults()
+	cfg.Proxy.AllowedMethods = []string{"get", "HEAD", "POST", "PATCH"}
+	h := NewHandler(cfg, token.NewService(store, cfg.Tokens.MaxDuration), store, store.enc,
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	h.apiBase = upstream.URL
+
+	for _, tt := range []struct {
+		method, path string
+		want         int
+	}{
+		{"GET", "/api/v3/repos/org/repo/issues", http.StatusOK},
+		{"POST", "/api/v3/repos/org/repo/issues", http.StatusOK},
+		{"DELETE", "/api/v3/repos/org/repo/git/refs/heads/main", http.StatusMethodNotAllowed},
+	} {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		req.Header.Set("Authorization", "token ghp_writer")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s %s: status = %d, want %d", tt.method, tt.path, rec.Code, tt.want)
+		}
+		if tt.want == http.StatusMethodNotAllowed {
+			if got := rec.Header().Get("Allow"); got != "GET, HEAD, PATCH, POST" {
+				t.Errorf("Allow = %q", got)
+			}
+			if !strings.Contains(rec.Body.String(), apierr.MethodNotAllowed) {
+				t.Errorf("body = %s, want code %s", rec.Body, apierr.MethodNotAllowed)
+			}
+		}
+	}
+	if got := strings.Join(upstreamMethods, ","); got != "GET,POST" {
+		t.Errorf("upstream saw %s, want GET,POST", got)
+	}
+}
+
+func TestAccessTokenInvalidClient(t *testing.T) {
+	store := newTestStore(t)
+	cfg := config.Defaults()
+	var logs bytes.Buffer
+	h := NewHandler(cfg, token.NewService(store, cfg.Tokens.MaxDuration), store, store.enc,
+		slog.New(slog.NewTextHandler(&logs, nil)))
+	h.SetOAuthClient(&oauth.Mock{
+		RefreshTokenFunc: func(context.Context, string) (*oauth.Token, error) {
+			return nil, fmt.Errorf("%w: The client_id and/or client_secret passed are incorrect.", oauth.ErrInvalidClient)
+		},
+	})
+
+	gt := *store.gt
+	gt.AccessTokenExpiresAt = time.Now().Add(time.Minute)
+	if _, err := h.refreshGitHubToken(context.Background(), &gt); !errors.Is(err, oauth.ErrInvalidClient) {
+		t.Fatalf("refreshGitHubToken err = %v, want ErrInvalidClient", err)
+	}
+
+	// The existing access token is still used, and the log says why refreshes fail.
+	got, err := h.accessToken(context.Background(), &gt)
+	if err != nil || got != "gho_real" {
+		t.Fatalf("accessToken = %q, %v", got, err)
+	}
+	if out := logs.String(); !strings.Contains(out, "github_oauth_client_invalid") || !strings.Contains(out, "users must re-authenticate") {
+		t.Errorf("log lacks the credentials message:\n%s", out)
+	}
+}
+
+func TestServeHTTPLogLevels(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	store := newTestStore(t)
+	store.addToken("ghp_valid", time.Now().Add(time.Hour), false)
+	cfg := config.Defaults()
+	cfg.Logging.Proxy = config.LogClassConfig{Level: "debug", DeniedLevel: "warn"}
+	var logs bytes.Buffer
+	h := NewHandler(cfg, token.NewService(store, cfg.Tokens.MaxDuration), store, store.enc,
+		slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	h.apiBase = upstream.URL
+
+	tests := []struct {
+		path      string
+		wantLevel string
+	}{
+		{"/api/v3/repos/org/repo", "level=DEBUG"},
+		{"/api/v3/repos/org/other", "level=WARN"},
+	}
+	for _, tt := range tests {
+		logs.Reset()
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.Header.Set("Authorization", "token ghp_valid")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		out := logs.String()
+		if !strings.Contains(out, tt.wantLevel) {
+			t.Errorf("%s: log lacks %s:\n%s", tt.path, tt.wantLevel, out)
+		}
+		if strings.Contains(out, "path=") {
+			t.Errorf("%s: path logged without include_path:\n%s", tt.path, out)
+		}
+	}
+}
+
+func TestServeHTTPUnmatchedPolicy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	store := newTestStore(t)
+	store.addScopedToken("ghp_metadata", `{"metadata":"read"}`, time.Now().Add(time.Hour), false)
+	store.addScopedToken("ghp_contents", `{"contents":"read"}`, time.Now().Add(time.Hour), false)
+
+	tests := []struct {
+		policy     string
+		token      string
+		path       string
+		wantStatus int
+	}{
+		{"forward", "ghp_metadata", "/api/v3/zen", http.StatusOK},
+		{"require_scope", "ghp_metadata", "/api/v3/zen", http.StatusForbidden},
+		{"require_scope", "ghp_contents", "/api/v3/zen", http.StatusOK},
+		// Endpoints with a rule are unaffected.
+		{"require_scope", "ghp_metadata", "/api/v3/repos/org/repo", http.StatusOK},
+	}
+	for _, tt := range tests {
+		cfg := config.Defaults()
+		cfg.Proxy.UnmatchedPolicy = tt.policy
+		h := NewHandler(cfg, token.NewService(store, cfg.Tokens.MaxDuration), store, store.enc,
+			slog.New(slog.NewTextHandler(io.Discard, nil)))
+		h.apiBase = upstream.URL
+
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.Header.Set("Authorization", "token "+tt.token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s %s %s: status = %d, want %d (%s)", tt.policy, tt.token, tt.path, rec.Code, tt.wantStatus, rec.Body)
+		}
+	}
+}
+
+func TestServeHTTPUpstreamProxy(t *testing.T) {
+	var proxied []string
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		w.Write([]byte(`{}`))
+	}))
+	defer stub.Close()
+
+	store := newTestStore(t)
+	store.addToken("ghp_valid", time.Now().Add(time.Hour), false)
+	cfg := config.Defaults()
+	cfg.Proxy.HTTPProxy = stub.URL
+	h := NewHandler(cfg, token.NewService(store, cfg.Tokens.MaxDuration), store, store.enc,
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	h.apiBase = "http://github.example"
+
+	req := httptest.NewRequest("GET", "/api/v3/repos/org/repo", nil)
+	req.Header.Set("Authorization", "token ghp_valid")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d (%s)", rec.Code, rec.Body)
+	}
+	if len(proxied) != 1 || proxied[0] != "http://github.example/repos/org/repo" {
+		t.Errorf("proxied = %v, want the request to github.example", proxied)
+	}
+}
+
+func TestCheckRepository(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer gho_real" {
+			t.Errorf("Authorization = %q", r.Header.Get("Authorization"))
+		}
+		switch r.URL.Path {
+		case "/repos/org/repo":
+			w.Write([]byte(`{"full_name":"org/repo","archived":false}`))
+		case "/repos/org/old":
+			w.Write([]byte(`{"full_name":"org/old","archived":true}`))
+		case "/repos/org/renamed":
+			// GitHub's answer for a renamed repository.
+			http.Redirect(w, r, "http://"+r.Host+"/repositories/42", http.StatusMovedPermanently)
+		case "/repositories/42":
+			w.Write([]byte(`{"full_name":"org/new-name","archived":true}`))
+		case "/repos/org/elsewhere":
+			http.Redirect(w, r, "https://elsewhere.example/repositories/42", http.StatusMovedPermanently)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	store := newTestStore(t)
+	tests := []struct {
+		policy, repo string
+		wantErr      bool
+	}{
+		{"exists", "org/repo", false},
+		{"exists", "org/typo", true},
+		{"exists", "org/old", false},
+		{"unarchived", "org/old", true},
+		{"exists", "org/renamed", false},
+		{"unarchived", "org/renamed", true},
+		{"unarchived", "org/elsewhere", false},
+	}
+	for _, tt := range tests {
+		cfg := config.Defaults()
+		cfg.Tokens.VerifyRepository = tt.policy
+		ts := token.NewService(store, cfg.Tokens.MaxDuration)
+		h := NewHandler(cfg, ts, store, store.enc, slog.New(slog.NewTextHandler(io.Discard, nil)))
+		h.apiBase = upstream.URL
+		ts.SetRepoCheck(h.CheckRepository)
+
+		_, err := ts.Create(context.Background(), token.CreateRequest{
+			UserID:        store.user.ID,
+			GitHubTokenID: store.gt.ID,
+			Repository:    tt.repo,
+			Scopes:        map[string]string{"contents": "read"},
+			Duration:      time.Hour,
+		})
+		var verr *token.ValidationError
+		if tt.wantErr && (!errors.As(err, &verr) || verr.Field != "repository") {
+			t.Errorf("%s %s: err = %v, want a repository validation error", tt.policy, tt.repo, err)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("%s %s: %v", tt.policy, tt.repo, err)
+		}
+	}
+}
+
+func TestServeHTTPResponseClassMetrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/repos/org/repo/contents/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	store := newTestStore(t)
+	store.addToken("ghp_valid", time.Now().Add(time.Hour), false)
+	cfg := config.Defaults()
+	h := NewHandler(cfg, token.NewService(store, cfg.Tokens.MaxDuration), store, store.enc,
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	h.apiBase = upstream.URL
+
+	count := func(class string) float64 {
+		return testutil.ToFloat64(metrics.ProxyResponseClassTotal.WithLabelValues(class))
+	}
+	ok, notFound := count("2xx"), count("4xx")
+	metrics.TakeResponseClasses()
+	for _, path := range []string{"/api/v3/repos/org/repo", "/api/v3/repos/org/repo/contents/missing"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "token ghp_valid")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if got := count("2xx") - ok; got != 1 {
+		t.Errorf("2xx incremented by %v, want 1", got)
+	}
+	if got := count("4xx") - notFound; got != 1 {
+		t.Errorf("4xx incremented by %v, want 1", got)
+	}
+	if got := metrics.TakeResponseClasses(); got["2xx"] != 1 || got["4xx"] != 1 {
+		t.Errorf("TakeResponseClasses = %v, want one 2xx and one 4xx", got)
+	}
+}
+
+func TestServeHTTPPathStyles(t *testing.T) {
+	var upstream *httptest.Server
+	var gotPath, gotVersion string
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotVersion = r.URL.Path, r.Header.Get("X-GitHub-Api-Version")
+		w.Header().Set("Link", fmt.Sprintf(`<%s/repos/org/repo/issues?page=2>; rel="next", <%s/repos/org/repo/issues?page=5>; rel="last"`, upstream.URL, upstream.URL))
+		w.Write([]byte(`[]`))
+	}))
+	defer upstream.Close()
+
+	store := newTestStore(t)
+	store.addScopedToken("ghp_valid", `{"issues":"read"}`, time.Now().Add(time.Hour), false)
+
+	tests := []struct {
+		styles     []string
+		url        string
+		version    string
+		wantStatus int
+		wantBase   string
+		wantVer    string
+	}{
+		{[]string{"ghes", "bare"}, "https://ghp.example.com/api/v3/repos/org/repo/issues", "", http.StatusOK, "https://ghp.example.com/api/v3", "2022-11-28"},
+		{[]string{"ghes", "bare"}, "https://api.github.com/repos/org/repo/issues", "", http.StatusOK, "https://api.github.com", "2022-11-28"},
+		{[]string{"ghes", "bare"}, "https://api.github.com/repos/org/repo/issues", "2026-03-10", http.StatusOK, "https://api.github.com", "2026-03-10"},
+		// Behind a TLS-terminating load balancer, links keep server.base_url's scheme.
+		{[]string{"ghes", "bare"}, "http://api.github.com/repos/org/repo/issues", "", http.StatusOK, "https://api.github.com", "2022-11-28"},
+		{[]string{"ghes"}, "https://api.github.com/repos/org/repo/issues", "", http.StatusNotFound, "", ""},
+		{[]string{"bare"}, "https://ghp.example.com/api/v3/repos/org/repo/issues", "", http.StatusNotFound, "", ""},
+	}
+	for _, tt := range tests {
+		cfg := config.Defaults()
+		cfg.Server.BaseURL = "https://ghp.example.com"
+		cfg.Proxy.PathStyles = tt.styles
+		cfg.Proxy.RewriteURLs = true
+		cfg.Proxy.APIVersion = "2022-11-28"
+		h := NewHandler(cfg, token.NewService(store, cfg.Tokens.MaxDuration), store, store.enc,
+			slog.New(slog.NewTextHandler(io.Discard, nil)))
+		h.apiBase = upstream.URL
+
+		gotPath, gotVersion = "", ""
+		req := httptest.NewRequest("GET", tt.url, nil)
+		req.Header.Set("Authorization", "token ghp_valid")
+		if tt.version != "" {
+			req.Header.Set("X-GitHub-Api-Version", tt.version)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%v %s: status = %d, want %d (%s)", tt.styles, tt.url, rec.Code, tt.wantStatus, rec.Body)
+			continue
+		}
+		if tt.wantStatus != http.StatusOK {
+			if gotPath != "" {
+				t.Errorf("%v %s: forwarded a refused style", tt.styles, tt.url)
+			}
+			continue
+		}
+		if gotPath != "/repos/org/repo/issues" {
+			t.Errorf("%s: upstream path = %q", tt.url, gotPath)
+		}
+		if gotVersion != tt.wantVer {
+			t.Errorf("%s: X-GitHub-Api-Version = %q, want %q", tt.url, gotVersion, tt.wantVer)
+		}
+		wantLink := fmt.Sprintf(`<%s/repos/org/repo/issues?page=2>; rel="next", <%s/repos/org/repo/issues?page=5>; rel="last"`, tt.wantBase, tt.wantBase)
+		if link := rec.Header().Get("Link"); link != wantLink {
+			t.Errorf("%s: Link = %q, want %q", tt.url, link, wantLink)
+		}
+	}
+}
+
+func TestServeHTTPAppEndpoints(t *testing.T) {
+	var forwarded []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = append(forwarded, r.URL.Path)
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	store := newTestStore(t)
+	store.addScopedToken("ghp_valid", `{"contents":"read"}`, time.Now().Add(time.Hour), false)
+	cfg := config.Defaults()
+	h := NewHandler(cfg, token.NewService(store, cfg.Tokens.MaxDuration), store, store.enc,
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	h.apiBase = upstream.URL
+
+	tests := []struct {
+		path       string
+		wantStatus int
+	}{
+		// Proxy tokens are backed by user OAuth tokens, never installations.
+		{"/api/v3/installation/repositories", http.StatusForbidden},
+		{"/api/v3/installation//repositories/", http.StatusForbidden},
+		{"/api/v3/app/installations", http.StatusForbidden},
+		// User-to-server endpoints listing installations are the user's own.
+		{"/api/v3/user/installations", http.StatusOK},
+	}
+	for _, tt := range tests {
+		forwarded = nil
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.Header.Set("Authorization", "token ghp_valid")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d (%s)", tt.path, rec.Code, tt.wantStatus, rec.Body)
+		}
+		if (len(forwarded) > 0) != (tt.wantStatus == http.StatusOK) {
+			t.Errorf("%s: forwarded = %v", tt.path, forwarded)
+		}
+	}
+}
+
+func TestUserRatesObserve(t *testing.T) {
+	var dropped []string
+	rates := newUserRates(func(id string) { dropped = append(dropped, id) })
+	base := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	var warnings int
+	for i := 0; i < 5; i++ {
+		_, warn := rates.observe("u1", base.Add(time.Duration(i)*time.Second), 3)
+		if warn {
+			warnings++
+			if i != 3 {
+				t.Errorf("warned on request %d, want the 4th", i+1)
+			}
+		}
+	}
+	if warnings != 1 {
+		t.Errorf("warnings in one window = %d, want 1", warnings)
+	}
+
+	// Halfway through the next minute, half of the previous one still
+	// counts: 5/2 + 1.
+	rate, warn := rates.observe("u1", base.Add(90*time.Second), 3)
+	if rate != 3.5 || !warn {
+		t.Errorf("next window: rate, warn = %v, %v; want 3.5, true", rate, warn)
+	}
+
+	// Other users are counted separately and below the threshold.
+	if rate, warn := rates.observe("u2", base.Add(91*time.Second), 3); rate != 1 || warn {
+		t.Errorf("u2: rate, warn = %v, %v; want 1, false", rate, warn)
+	}
+
+	// Between requests, a sweep lets the rates fall: halfway through the
+	// minute after, each user's single request in the previous one counts
+	// half.
+	swept := map[string]float64{}
+	rates.sweep(base.Add(150*time.Second), func(id string, rate float64) { swept[id] = rate })
+	if swept["u1"] != 0.5 || swept["u2"] != 0.5 {
+		t.Errorf("swept rates = %v, want 0.5 each", swept)
+	}
+
+	// Idle users are forgotten.
+	rates.observe("u3", base.Add(5*time.Minute), 3)
+	sort.Strings(dropped)
+	if !reflect.DeepEqual(dropped, []string{"u1", "u2"}) || len(rates.users) != 1 {
+		t.Errorf("dropped = %v, tracking %d users; want [u1 u2] dropped and only u3 tracked", dropped, len(rates.users))
+	}
+}
+
+func TestServeHTTPUserRateWarning(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	store := newTestStore(t)
+	store.addToken("ghp_valid", time.Now().Add(time.Hour), false)
+	cfg := config.Defaults()
+	cfg.Proxy.UserRateWarning = 3
+	h := NewHandler(cfg, token.NewService(store, cfg.Tokens.MaxDuration), store, store.enc,
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	h.apiBase = upstream.URL
+
+	for i := 0; i < 6; i++ {
+		req := httptest.NewRequest("GET", "/api/v3/repos/org/repo", nil)
+		req.Header.Set("Authorization", "token ghp_valid")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want the soft limit not to block", i+1, rec.Code)
+		}
+	}
+
+	entries, err := store.ListAuditEntries(context.Background(), database.AuditFilter{Action: "user_rate_high"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 {
+		t.Fatal("no user_rate_high audit entry past the threshold")
+	}
+	if !strings.Contains(string(entries[0].Metadata), `"threshold":3`) {
+		t.Errorf("metadata = %s, want the threshold", entries[0].Metadata)
+	}
+}
+
+func TestServeHTTPGraphQLScopes(t *testing.T) {
+	var forwarded []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "nodes(ids: $ids)") {
+			w.Write([]byte(`{"data":{"nodes":[
+				{"__typename":"Repository","id":"R_repo","nameWithOwner":"org/repo"},
+				{"__typename":"Issue","id":"I_other","repository":{"nameWithOwner":"org/other"}},
+				null]}}`))
+			return
+		}
+		forwarded = append(forwarded, string(body))
+		w.Write([]byte(`{"data":{}}`))
+	}))
+	defer upstream.Close()
+
+	store := newTestStore(t)
+	store.addScopedToken("ghp_reader", `{"issues":"read"}`, time.Now().Add(time.Hour), false)
+	store.addScopedToken("ghp_writer", `{"issues":"write"}`, time.Now().Add(time.Hour), false)
+	cfg := config.Defaults()
+	h := NewHandler(cfg, token.NewService(store, cfg.Tokens.MaxDuration), store, store.enc,
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	h.apiBase = upstream.URL
+
+	const (
+		readIssues  = `{"query":"{ repository(owner: \"org\", name: \"repo\") { issues(first: 1) { totalCount } } }"}`
+		readPulls   = `{"query":"{ repository(owner: \"org\", name: \"repo\") { pullRequests(first: 1) { totalCount } } }"}`
+		otherRepo   = `{"query":"{ repository(owner: \"org\", name: \"other\") { name } }"}`
+		createIssue = `{"query":"mutation($id: ID!) { createIssue(input: {repositoryId: $id, title: \"t\"}) { issue { number } } }","variables":{"id":"R_repo"}}`
+		otherIssue  = `{"query":"mutation { addComment(input: {subjectId: \"I_other\", body: \"b\"}) { clientMutationId } }"}`
+		unknownNode = `{"query":"mutation { closeIssue(input: {issueId: \"I_gone\"}) { clientMutationId } }"}`
+		issueAuthor = `{"query":"{ repository(owner: \"org\", name: \"repo\") { issue(number: 1) { title author { login } labels(first: 5) { nodes { name } } } } }"}`
+
+		// Each of these reaches data in other repositories through an
+		// object linked from the token's repository.
+		ownerIssues  = `{"query":"{ repository(owner: \"org\", name: \"repo\") { owner { ... on User { issues(first: 5) { nodes { title body repository { nameWithOwner } } } } } } }"}`
+		authorPulls  = `{"query":"{ repository(owner: \"org\", name: \"repo\") { issue(number: 1) { author { ... on User { pullRequests(first: 5) { nodes { body } } } } } } }"}`
+		crossRefBody = `{"query":"{ repository(owner: \"org\", name: \"repo\") { issue(number: 1) { timelineItems(first: 5) { nodes { ... on CrossReferencedEvent { source { ... on Issue { body } } } } } } } }"}`
+	)
+	tests := []struct {
+		name       string
+		token      string
+		body       string
+		wantStatus int
+		wantCode   string
+	}{
+		{"read", "ghp_reader", readIssues, http.StatusOK, ""},
+		{"missing permission", "ghp_reader", readPulls, http.StatusForbidden, apierr.ScopeDenied},
+		{"other repository", "ghp_writer", otherRepo, http.StatusForbidden, apierr.ScopeDenied},
+		{"read-only mutation", "ghp_reader", createIssue, http.StatusForbidden, apierr.ScopeDenied},
+		{"mutation", "ghp_writer", createIssue, http.StatusOK, ""},
+		{"mutation on other repository", "ghp_writer", otherIssue, http.StatusForbidden, apierr.ScopeDenied},
+		{"mutation on unknown node", "ghp_writer", unknownNode, http.StatusForbidden, apierr.ScopeDenied},
+		{"invalid query", "ghp_writer", `{"query":"{"}`, http.StatusBadRequest, apierr.InvalidRequest},
+		{"issue author and labels", "ghp_reader", issueAuthor, http.StatusOK, ""},
+		{"owner's issues", "ghp_writer", ownerIssues, http.StatusForbidden, apierr.ScopeDenied},
+		{"author's pull requests", "ghp_writer", authorPulls, http.StatusForbidden, apierr.ScopeDenied},
+		{"cross-referenced issue", "ghp_writer", crossRefBody, http.StatusForbidden, apierr.ScopeDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forwarded = nil
+			req := httptest.NewRequest("POST", "/api/graphql", strings.NewReader(tt.body))
+			req.Header.Set("Authorization", "token "+tt.token)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d; body = %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantCode != "" {
+				if !strings.Contains(rec.Body.String(), tt.wantCode) {
+					t.Errorf("body = %s, want code %s", rec.Body, tt.wantCode)
+				}
+				if len(forwarded) != 0 {
+					t.Errorf("denied request was forwarded")
+				}
+			} else if len(forwarded) != 1 || forwarded[0] != tt.body {
+				t.Errorf("forwarded = %q, want the original body", forwarded)
+			}
+		})
+	}
+}
+
+func TestServeHTTPUploadStreams(t *testing.T) {
+	var gotLength int64
+	var gotBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotLength = r.ContentLength
+		b, _ := io.ReadAll(r.Body)
+		gotBody = string(b)
+		// Outlast the API client's timeout.
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer upstream.Close()
+
+	store := newTestStore(t)
+	store.addScopedToken("ghp_valid", `{"contents":"write"}`, time.Now().Add(time.Hour), false)
+	cfg := config.Defaults()
+	h := NewHandler(cfg, token.NewService(store, cfg.Tokens.MaxDuration), store, store.enc,
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	h.apiBase = upstream.URL
+	h.uploadBase = upstream.URL
+	h.client.Timeout = 50 * time.Millisecond
+
+	req := httptest.NewRequest("POST", "/api/uploads/repos/org/repo/releases/1/assets?name=a.zip", strings.NewReader("zipdata"))
+	req.Header.Set("Authorization", "token ghp_valid")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want 201 (%s)", rec.Code, rec.Body)
+	}
+	if gotLength != int64(len("zipdata")) || gotBody != "zipdata" {
+		t.Errorf("upstream got Content-Length %d, body %q; want %d, %q", gotLength, gotBody, len("zipdata"), "zipdata")
+	}
+}
+
+func TestServeHTTPEnterpriseServer(t *testing.T) {
+	var upstream *httptest.Server
+	var gotPath string
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"url":"%s/api/v3/repos/org/repo/releases/1","upload_url":"%s/api/uploads/repos/org/repo/releases/1/assets{?name,label}"}`,
+			upstream.URL, upstream.URL)
+	}))
+	defer upstream.Close()
+
+	store := newTestStore(t)
+	store.addScopedToken("ghp_valid", `{"contents":"write"}`, time.Now().Add(time.Hour), false)
+	cfg := config.Defaults()
+	cfg.Server.BaseURL = "https://ghp.example.com"
+	cfg.Proxy.RewriteURLs = true
+	cfg.GitHub.APIBaseURL = upstream.URL + "/api/v3/"
+	cfg.GitHub.UploadBaseURL = upstream.URL + "/api/uploads"
+	h := NewHandler(cfg, token.NewService(store, cfg.Tokens.MaxDuration), store, store.enc,
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	tests := []struct {
+		method, path, body, wantPath string
+	}{
+		{"GET", "/api/v3/repos/org/repo/releases/1", "", "/api/v3/repos/org/repo/releases/1"},
+		{"POST", "/api/uploads/repos/org/repo/releases/1/assets?name=a.zip", "zip", "/api/uploads/repos/org/repo/releases/1/assets"},
+		{"POST", "/api/graphql", `{"query":"{ viewer { login } }"}`, "/api/graphql"},
+	}
+	for _, tt := range tests {
+		gotPath = ""
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		req.Header.Set("Authorization", "token ghp_valid")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || gotPath != tt.wantPath {
+			t.Errorf("%s %s: status %d, upstream path %q; want 200 from %q", tt.method, tt.path, rec.Code, gotPath, tt.wantPath)
+		}
+		if tt.method == "GET" {
+			want := `{"url":"https://ghp.example.com/api/v3/repos/org/repo/releases/1","upload_url":"https://ghp.example.com/api/uploads/repos/org/repo/releases/1/assets{?name,label}"}`
+			if rec.Body.String() != want {
+				t.Errorf("body = %s, want %s", rec.Body, want)
+			}
+		}
+	}
+}
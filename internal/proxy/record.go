@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/goodtune/ghp/internal/database"
+)
+
+// recordOnly reports whether requests are recorded instead of forwarded.
+// Like /auth/test-login it only takes effect in dev mode.
+func (h *Handler) recordOnly() bool {
+	return h.cfg.Proxy.RecordOnly && h.cfg.DevMode
+}
+
+// recordedRequest is what ghp would have sent GitHub for a request made in
+// record-only mode. It is stored as the audit entry's metadata.
+type recordedRequest struct {
+	Query      string              `json:"query,omitempty"`
+	Headers    map[string][]string `json:"headers,omitempty"`
+	Permission string              `json:"permission,omitempty"`
+	Level      string              `json:"level,omitempty"`
+}
+
+// recordRequest audits the upstream request ghp would have made for r and
+// answers with a canned 200, without contacting GitHub or loading the user's
+// GitHub credentials. Requests only get this far once the scope checks have
+// allowed them.
+func (h *Handler) recordRequest(w http.ResponseWriter, r *http.Request, pt *database.ProxyToken, path, repo, permission, level string, start time.Time) {
+	meta, err := json.Marshal(recordedRequest{
+		Query:      r.URL.RawQuery,
+		Headers:    h.upstreamHeaders(r, pt),
+		Permission: permission,
+		Level:      level,
+	})
+	if err != nil {
+		h.logger.Error("failed to encode recorded request", "error", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-GHP-Record-Only", "true")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("{}"))
+
+	if pt.MaxRequests == 0 {
+		if err := h.tokenService.RecordUsage(r.Context(), pt.ID); err != nil {
+			h.logger.Error("failed to record token usage", "error", err)
+		}
+	}
+	h.logRequest(r, pt, path, repo, http.StatusOK, time.Since(start), "proxy_recorded", meta)
+}
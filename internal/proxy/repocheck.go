@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/goodtune/ghp/internal/token"
+)
+
+// CheckRepository is a token.RepoCheck: it asks GitHub, with the user's
+// credentials, whether repository exists and is visible to them, and under
+// tokens.verify_repository "unarchived" whether it is archived.
+func (h *Handler) CheckRepository(ctx context.Context, gitHubTokenID, repository string) error {
+	owner, name, ok := strings.Cut(repository, "/")
+	if !ok || owner == "" || name == "" || strings.Contains(name, "/") {
+		return &token.ValidationError{Field: "repository", Message: fmt.Sprintf("repository %q must be owner/name", repository)}
+	}
+	gt, err := h.store.GetGitHubTokenByID(ctx, gitHubTokenID)
+	if err != nil {
+		return fmt.Errorf("loading github token: %w", err)
+	}
+	if gt == nil {
+		return fmt.Errorf("github token not found")
+	}
+	githubToken, err := h.accessToken(ctx, gt)
+	if err != nil {
+		return err
+	}
+
+	resp, err := h.getRepository(ctx, h.apiBase+"/repos/"+url.PathEscape(owner)+"/"+url.PathEscape(name), githubToken)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// A renamed or transferred repository answers with a redirect to its
+	// new location. Follow it on the API, where the token may be sent.
+	if isRedirect(resp.StatusCode) {
+		loc, err := resp.Location()
+		if err != nil || !strings.HasPrefix(loc.String(), h.apiBase+"/") {
+			// It exists; where it went can't be asked about.
+			return nil
+		}
+		resp.Body.Close()
+		if resp, err = h.getRepository(ctx, loc.String(), githubToken); err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return &token.ValidationError{Field: "repository",
+			Message: fmt.Sprintf("repository %s does not exist or is not visible to you on GitHub", repository)}
+	default:
+		return fmt.Errorf("GitHub returned %d", resp.StatusCode)
+	}
+
+	var repo struct {
+		Archived bool `json:"archived"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&repo); err != nil {
+		return fmt.Errorf("decoding repository: %w", err)
+	}
+	if repo.Archived && h.cfg.Tokens.VerifyRepository == "unarchived" {
+		return &token.ValidationError{Field: "repository", Message: fmt.Sprintf("repository %s is archived", repository)}
+	}
+	return nil
+}
+
+// getRepository fetches a repository from the GitHub API without following
+// redirects.
+func (h *Handler) getRepository(ctx context.Context, u, githubToken string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+githubToken)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	return h.client.Do(req)
+}
+
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
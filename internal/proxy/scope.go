@@ -2,8 +2,14 @@
 package proxy
 
 import (
+	"fmt"
+	"path"
 	"regexp"
+	"sort"
 	"strings"
+
+	"github.com/goodtune/ghp/internal/config"
+	"github.com/goodtune/ghp/internal/database"
 )
 
 // endpointRule maps a URL pattern + method to a permission category and level.
@@ -35,6 +41,13 @@ func init() {
 		{`^/repos/[^/]+/[^/]+/git/(refs|trees|blobs|commits|tags)(/.*)?$`, "POST", "contents", "write"},
 		{`^/repos/[^/]+/[^/]+/git/(refs|trees|blobs|commits|tags)(/.*)?$`, "PATCH", "contents", "write"},
 
+		// Branch protection (administration; before the general branches rule)
+		{`^/repos/[^/]+/[^/]+/branches/[^/]+/protection(/.*)?$`, "GET", "administration", "read"},
+		{`^/repos/[^/]+/[^/]+/branches/[^/]+/protection(/.*)?$`, "PUT", "administration", "write"},
+		{`^/repos/[^/]+/[^/]+/branches/[^/]+/protection(/.*)?$`, "POST", "administration", "write"},
+		{`^/repos/[^/]+/[^/]+/branches/[^/]+/protection(/.*)?$`, "PATCH", "administration", "write"},
+		{`^/repos/[^/]+/[^/]+/branches/[^/]+/protection(/.*)?$`, "DELETE", "administration", "write"},
+
 		// Branches
 		{`^/repos/[^/]+/[^/]+/branches(/.*)?$`, "GET", "contents", "read"},
 
@@ -83,6 +96,15 @@ func init() {
 		{`^/repos/[^/]+/[^/]+/releases(/.*)?$`, "GET", "contents", "read"},
 		{`^/repos/[^/]+/[^/]+/releases(/.*)?$`, "POST", "contents", "write"},
 
+		// Repository settings, topics and collaborators
+		{`^/repos/[^/]+/[^/]+$`, "PATCH", "administration", "write"},
+		{`^/repos/[^/]+/[^/]+$`, "DELETE", "administration", "write"},
+		{`^/repos/[^/]+/[^/]+/topics$`, "GET", "metadata", "read"},
+		{`^/repos/[^/]+/[^/]+/topics$`, "PUT", "administration", "write"},
+		{`^/repos/[^/]+/[^/]+/collaborators(/.*)?$`, "GET", "metadata", "read"},
+		{`^/repos/[^/]+/[^/]+/collaborators/[^/]+$`, "PUT", "administration", "write"},
+		{`^/repos/[^/]+/[^/]+/collaborators/[^/]+$`, "DELETE", "administration", "write"},
+
 		// Repository metadata (always allowed with any scope)
 		{`^/repos/[^/]+/[^/]+$`, "GET", "metadata", "read"},
 
@@ -103,6 +125,53 @@ func init() {
 // EndpointScope returns the permission and level required for a given method and path.
 // Returns empty strings if the endpoint is not recognized.
 func EndpointScope(method, path string) (permission, level string) {
+	return matchRule(rules, method, path)
+}
+
+// Permissions returns the distinct permissions the built-in rules require,
+// sorted.
+func Permissions() []string {
+	return permissions(rules)
+}
+
+func permissions(rules []endpointRule) []string {
+	seen := make(map[string]bool)
+	var perms []string
+	for _, r := range rules {
+		if !seen[r.permission] {
+			seen[r.permission] = true
+			perms = append(perms, r.permission)
+		}
+	}
+	sort.Strings(perms)
+	return perms
+}
+
+// overrideRules compiles the configured scope overrides and prepends them
+// to the built-in rules, or with replaceBuiltin uses them alone. Overrides
+// with invalid patterns (rejected by config.Load) are returned as an error.
+func overrideRules(overrides []config.ScopeOverride, replaceBuiltin bool) ([]endpointRule, error) {
+	out := make([]endpointRule, 0, len(overrides)+len(rules))
+	for i, o := range overrides {
+		re, err := regexp.Compile(o.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("scope override %d: %w", i, err)
+		}
+		out = append(out, endpointRule{
+			pattern:    re,
+			method:     strings.ToUpper(o.Method),
+			permission: o.Permission,
+			level:      o.Level,
+		})
+	}
+	if replaceBuiltin {
+		return out, nil
+	}
+	return append(out, rules...), nil
+}
+
+func matchRule(rules []endpointRule, method, path string) (permission, level string) {
+	path = canonicalPath(path)
 	for _, r := range rules {
 		if r.method != "" && r.method != method {
 			continue
@@ -114,6 +183,32 @@ func EndpointScope(method, path string) (permission, level string) {
 	return "", ""
 }
 
+// appEndpoint matches endpoints that only accept GitHub App credentials: an
+// installation token (/installation/...) or the app's own JWT (/app/...).
+var appEndpoint = regexp.MustCompile(`^/(app|installation)(/.*)?$`)
+
+// hasRepoScope reports whether scopes grant anything beyond metadata, which
+// every token implicitly has.
+func hasRepoScope(scopes database.Scopes) bool {
+	for permission := range scopes {
+		if permission != "metadata" {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalPath resolves "." and ".." segments in an API path, collapses
+// repeated slashes and strips a trailing slash (other than the root's), so
+// variants such as /repos/o/r//pulls/ match the same rules as
+// /repos/o/r/pulls and /repos/o/r/../../x/y can't pass for o/r.
+func canonicalPath(p string) string {
+	if p == "" {
+		return ""
+	}
+	return path.Clean(p)
+}
+
 // ExtractRepoFromPath extracts the owner/repo from a /repos/{owner}/{repo}/... path.
 // Returns empty string if the path doesn't match.
 func ExtractRepoFromPath(path string) string {
@@ -1,7 +1,10 @@
 package proxy
 
 import (
+	"slices"
 	"testing"
+
+	"github.com/goodtune/ghp/internal/config"
 )
 
 func TestEndpointScope(t *testing.T) {
@@ -27,6 +30,19 @@ func TestEndpointScope(t *testing.T) {
 		{"GET", "/user", "metadata", "read"},
 		{"GET", "/repos/org/repo/pulls/1/files", "pulls", "read"},
 		{"POST", "/repos/org/repo/pulls/1/reviews", "pulls", "write"},
+		{"GET", "/repos/org/repo/branches/main/protection", "administration", "read"},
+		{"PUT", "/repos/org/repo/branches/main/protection", "administration", "write"},
+		{"DELETE", "/repos/org/repo/branches/main/protection/required_signatures", "administration", "write"},
+		{"GET", "/repos/org/repo/branches/main", "contents", "read"},
+		{"PATCH", "/repos/org/repo", "administration", "write"},
+		{"PUT", "/repos/org/repo/topics", "administration", "write"},
+		{"GET", "/repos/org/repo/topics", "metadata", "read"},
+		{"PUT", "/repos/org/repo/collaborators/octocat", "administration", "write"},
+		{"GET", "/repos/org/repo/collaborators", "metadata", "read"},
+		// Trailing and duplicate slashes match the canonical path's rule.
+		{"POST", "/repos/org/repo/pulls/", "pulls", "write"},
+		{"POST", "/repos/org/repo//pulls", "pulls", "write"},
+		{"PATCH", "//repos/org/repo/pulls/123//", "pulls", "write"},
 		// Unknown endpoint.
 		{"GET", "/unknown/path", "", ""},
 	}
@@ -60,3 +76,80 @@ func TestExtractRepoFromPath(t *testing.T) {
 		}
 	}
 }
+
+func TestCanonicalPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/repos/org/repo/pulls", "/repos/org/repo/pulls"},
+		{"/repos/org/repo/pulls/", "/repos/org/repo/pulls"},
+		{"/repos/org/repo//pulls", "/repos/org/repo/pulls"},
+		{"/repos///org/repo/pulls//", "/repos/org/repo/pulls"},
+		{"/", "/"},
+		{"//", "/"},
+		{"/repos/org/repo/../../victim/secret/contents", "/repos/victim/secret/contents"},
+		{"/repos/org/repo/./pulls", "/repos/org/repo/pulls"},
+		{"/repos/org/../../..", "/"},
+	}
+
+	for _, tt := range tests {
+		if got := canonicalPath(tt.path); got != tt.want {
+			t.Errorf("canonicalPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestOverrideRules(t *testing.T) {
+	r, err := overrideRules([]config.ScopeOverride{
+		{Pattern: `^/repos/[^/]+/[^/]+/compare/.*$`, Method: "get", Permission: "pulls", Level: "read"},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The override wins over the built-in contents:read rule.
+	if perm, level := matchRule(r, "GET", "/repos/org/repo/compare/main...feature"); perm != "pulls" || level != "read" {
+		t.Errorf("compare = (%q, %q), want (pulls, read)", perm, level)
+	}
+	// Other endpoints keep their built-in rules.
+	if perm, level := matchRule(r, "GET", "/repos/org/repo/commits"); perm != "contents" || level != "read" {
+		t.Errorf("commits = (%q, %q), want (contents, read)", perm, level)
+	}
+	// The built-in table itself is untouched.
+	if perm, _ := EndpointScope("GET", "/repos/org/repo/compare/main...feature"); perm != "contents" {
+		t.Errorf("built-in compare permission = %q, want contents", perm)
+	}
+
+	if _, err := overrideRules([]config.ScopeOverride{{Pattern: `(`, Permission: "pulls", Level: "read"}}, false); err == nil {
+		t.Error("expected error for invalid pattern")
+	}
+
+	// Replacing the built-in rules leaves only the overrides.
+	r, err = overrideRules([]config.ScopeOverride{
+		{Pattern: `^/repos/[^/]+/[^/]+/commits$`, Permission: "pulls", Level: "read"},
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm, level := matchRule(r, "GET", "/repos/org/repo/commits"); perm != "pulls" || level != "read" {
+		t.Errorf("commits = (%q, %q), want (pulls, read)", perm, level)
+	}
+	if perm, _ := matchRule(r, "GET", "/repos/org/repo/pulls"); perm != "" {
+		t.Errorf("pulls permission = %q, want none once built-in rules are replaced", perm)
+	}
+	if perms := permissions(r); !slices.Equal(perms, []string{"pulls"}) {
+		t.Errorf("permissions = %v, want only the replacement's", perms)
+	}
+
+	// Overrides can introduce permissions the built-in rules never require.
+	r, err = overrideRules([]config.ScopeOverride{
+		{Pattern: `^/repos/[^/]+/[^/]+/custom$`, Permission: "custom_properties", Level: "read"},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perms := permissions(r); !slices.Contains(perms, "custom_properties") || !slices.Contains(perms, "contents") {
+		t.Errorf("permissions = %v, want the override's and the built-in ones", perms)
+	}
+}
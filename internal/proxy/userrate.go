@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// userRateWindow is the window over which each user's request rate is
+// estimated.
+const userRateWindow = time.Minute
+
+// userRates estimates each user's requests per minute with a sliding window:
+// the current minute's count plus the previous minute's, weighted by how
+// much of it still overlaps the last sixty seconds.
+type userRates struct {
+	mu     sync.Mutex
+	users  map[string]*userRate // keyed by user ID
+	swept  time.Time
+	onDrop func(userID string)
+}
+
+type userRate struct {
+	start    time.Time // start of the current fixed window
+	current  int64
+	previous int64
+	warned   time.Time // window in which the user was last warned about
+}
+
+func newUserRates(onDrop func(userID string)) *userRates {
+	return &userRates{users: make(map[string]*userRate), onDrop: onDrop}
+}
+
+// observe counts a request by userID at now and returns the user's
+// estimated rate. warn is true the first time in a window that the rate
+// exceeds threshold (zero never warns).
+func (u *userRates) observe(userID string, now time.Time, threshold int) (rate float64, warn bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	start := now.Truncate(userRateWindow)
+	if now.Sub(u.swept) > userRateWindow {
+		// Forget users idle for a whole window; their rate is zero.
+		for id, r := range u.users {
+			if r.start.Before(start.Add(-userRateWindow)) {
+				delete(u.users, id)
+				if u.onDrop != nil {
+					u.onDrop(id)
+				}
+			}
+		}
+		u.swept = now
+	}
+
+	r := u.users[userID]
+	if r == nil {
+		r = &userRate{start: start}
+		u.users[userID] = r
+	}
+	r.advance(start)
+	r.current++
+
+	rate = r.estimate(now, start)
+	if threshold > 0 && rate > float64(threshold) && !r.warned.Equal(start) {
+		r.warned = start
+		warn = true
+	}
+	return rate, warn
+}
+
+// sweep re-estimates every user's rate at now without counting a request,
+// passing each to set, and forgets users idle for a whole window.
+func (u *userRates) sweep(now time.Time, set func(userID string, rate float64)) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	start := now.Truncate(userRateWindow)
+	for id, r := range u.users {
+		if r.start.Before(start.Add(-userRateWindow)) {
+			delete(u.users, id)
+			if u.onDrop != nil {
+				u.onDrop(id)
+			}
+			continue
+		}
+		r.advance(start)
+		set(id, r.estimate(now, start))
+	}
+	u.swept = now
+}
+
+// advance moves r to the fixed window beginning at start.
+func (r *userRate) advance(start time.Time) {
+	if r.start.Equal(start) {
+		return
+	}
+	if r.start.Add(userRateWindow).Equal(start) {
+		r.previous = r.current
+	} else {
+		r.previous = 0
+	}
+	r.current, r.start = 0, start
+}
+
+// estimate returns r's rate at now, within the window beginning at start.
+func (r *userRate) estimate(now, start time.Time) float64 {
+	overlap := 1 - float64(now.Sub(start))/float64(userRateWindow)
+	return float64(r.previous)*overlap + float64(r.current)
+}
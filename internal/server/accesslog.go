@@ -0,0 +1,76 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/goodtune/ghp/internal/config"
+	"github.com/goodtune/ghp/internal/proxy"
+)
+
+// requestClass names the logging class of a request to ghp's own routes, or
+// "" for routes that log elsewhere (the proxy) or not at all.
+func requestClass(path string) string {
+	switch {
+	case strings.HasPrefix(path, "/api/v3/"), strings.HasPrefix(path, "/api/uploads/"),
+		path == "/api/graphql", proxy.IsGitPath(path),
+		path == "/healthz", path == "/webhooks":
+		return ""
+	case strings.HasPrefix(path, "/api/"):
+		return "api"
+	case strings.HasPrefix(path, "/auth/"):
+		return "auth"
+	}
+	return "web"
+}
+
+// statusRecorder captures the status code a handler writes.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter { return r.ResponseWriter }
+
+// accessLog logs each API, auth and web request at the level its class sets
+// in the logging config. Proxied requests are logged by the proxy.
+func accessLog(cfg config.LoggingConfig, logger *slog.Logger, next http.Handler) http.Handler {
+	classes := map[string]config.LogClassConfig{"api": cfg.API, "auth": cfg.Auth, "web": cfg.Web}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := requestClass(r.URL.Path)
+		if name == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		class := classes[name]
+		attrs := []any{
+			"class", name,
+			"method", r.Method,
+			"status", rec.status,
+			"duration_ms", time.Since(start).Milliseconds(),
+		}
+		logger.Log(r.Context(), class.LevelFor(rec.status), "http_request", append(attrs, class.Attrs(r, r.URL.Path)...)...)
+	})
+}
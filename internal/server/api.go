@@ -3,13 +3,20 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/goodtune/ghp/internal/apierr"
 	"github.com/goodtune/ghp/internal/auth"
 	"github.com/goodtune/ghp/internal/config"
 	"github.com/goodtune/ghp/internal/database"
+	"github.com/goodtune/ghp/internal/proxy"
 	"github.com/goodtune/ghp/internal/token"
 )
 
@@ -20,16 +27,35 @@ type API struct {
 	tokenService *token.Service
 	authHandler  *auth.Handler
 	logger       *slog.Logger
+
+	// adminNets restricts the admin endpoints to clients in these networks,
+	// located through trustedProxies; see requireAdminNetwork.
+	adminNets      []*net.IPNet
+	trustedProxies []*net.IPNet
+
+	// endpointScope resolves the scope an API request needs and permissions
+	// lists those the rules know. They default to the built-in rules; the
+	// server substitutes the proxy's, which include any configured overrides.
+	endpointScope func(method, path string) (permission, level string)
+	permissions   func() []string
 }
 
 // NewAPI creates a new API handler.
 func NewAPI(cfg *config.Config, store database.Store, ts *token.Service, ah *auth.Handler, logger *slog.Logger) *API {
+	// Both lists were validated when the configuration was loaded.
+	adminNets, _ := config.ParseCIDRs(cfg.Server.AdminAllowedCIDRs)
+	trustedProxies, _ := config.ParseCIDRs(cfg.Server.TrustedProxies)
 	return &API{
 		cfg:          cfg,
 		store:        store,
 		tokenService: ts,
 		authHandler:  ah,
 		logger:       logger,
+
+		adminNets:      adminNets,
+		trustedProxies: trustedProxies,
+		endpointScope:  proxy.EndpointScope,
+		permissions:    proxy.Permissions,
 	}
 }
 
@@ -41,17 +67,33 @@ func (a *API) RegisterRoutes(mux *http.ServeMux) {
 	mux.Handle("GET /api/tokens/{id}", a.authHandler.RequireAuth(http.HandlerFunc(a.handleGetToken)))
 	mux.Handle("DELETE /api/tokens/{id}", a.authHandler.RequireAuth(http.HandlerFunc(a.handleRevokeToken)))
 
-	mux.Handle("GET /api/users", a.authHandler.RequireAdmin(http.HandlerFunc(a.handleListUsers)))
-	mux.Handle("GET /api/users/{id}/tokens", a.authHandler.RequireAdmin(http.HandlerFunc(a.handleListUserTokens)))
+	mux.Handle("GET /api/users", a.requireAdminNetwork(a.authHandler.RequireAdmin(http.HandlerFunc(a.handleListUsers))))
+	mux.Handle("GET /api/users/{id}/tokens", a.requireAdminNetwork(a.authHandler.RequireAdmin(http.HandlerFunc(a.handleListUserTokens))))
+	mux.Handle("DELETE /api/users/{id}", a.requireAdminNetwork(a.authHandler.RequireAdmin(http.HandlerFunc(a.handlePurgeUser))))
+	mux.Handle("POST /api/users/{id}/disable", a.requireAdminNetwork(a.authHandler.RequireAdmin(http.HandlerFunc(a.handleDisableUser))))
+	mux.Handle("POST /api/users/{id}/enable", a.requireAdminNetwork(a.authHandler.RequireAdmin(http.HandlerFunc(a.handleEnableUser))))
+	mux.Handle("POST /api/users/{id}/tokens/revoke-all", a.requireAdminNetwork(a.authHandler.RequireAuth(http.HandlerFunc(a.handleRevokeAllUserTokens))))
+
+	mux.Handle("GET /api/admin/config", a.requireAdminNetwork(a.authHandler.RequireAdmin(http.HandlerFunc(a.handleGetConfig))))
+	mux.Handle("GET /api/admin/tokens/archive", a.requireAdminNetwork(a.authHandler.RequireAdmin(http.HandlerFunc(a.handleListArchivedTokens))))
+	mux.Handle("GET /api/stats/repos", a.requireAdminNetwork(a.authHandler.RequireAdmin(http.HandlerFunc(a.handleRepoStats))))
 
-	mux.Handle("GET /api/audit", a.authHandler.RequireAuth(http.HandlerFunc(a.handleListAudit)))
+	mux.Handle("GET /api/scopes", a.authHandler.RequireAuth(http.HandlerFunc(a.handleListScopes)))
+	mux.Handle("POST /api/scopes/check", a.authHandler.RequireAuth(http.HandlerFunc(a.handleCheckScopes)))
+
+	mux.Handle("GET /api/audit", a.requireAdminNetwork(a.authHandler.RequireAuth(http.HandlerFunc(a.handleListAudit))))
+	mux.Handle("GET /api/audit/export", a.requireAdminNetwork(a.authHandler.RequireAuth(http.HandlerFunc(a.handleExportAudit))))
+	mux.Handle("GET /api/audit/{id}", a.requireAdminNetwork(a.authHandler.RequireAuth(http.HandlerFunc(a.handleGetAudit))))
 }
 
 type createTokenRequest struct {
-	Repository string `json:"repository"`
-	Scopes     string `json:"scopes"`
-	Duration   string `json:"duration"`
-	SessionID  string `json:"session_id"`
+	Repository  string `json:"repository"`
+	Scopes      string `json:"scopes"`
+	Duration    string `json:"duration"`
+	SessionID   string `json:"session_id"`
+	MaxRequests int64  `json:"max_requests"`
+	SingleUse   bool   `json:"single_use"`
+	Description string `json:"description"`
 }
 
 func (a *API) handleCreateToken(w http.ResponseWriter, r *http.Request) {
@@ -59,21 +101,27 @@ func (a *API) handleCreateToken(w http.ResponseWriter, r *http.Request) {
 
 	var req createTokenRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "Invalid request body"})
+		writeError(w, http.StatusBadRequest, apierr.InvalidRequest, "Invalid request body")
 		return
 	}
 
-	scopes, err := token.ParseScopeString(req.Scopes)
-	if err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
-		return
+	// No scopes at all is left to the token service, which either rejects
+	// the request or, with tokens.allow_metadata_only, grants metadata:read.
+	var scopes map[string]string
+	if strings.TrimSpace(req.Scopes) != "" {
+		var err error
+		scopes, err = token.ParseScopeString(req.Scopes)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, apierr.InvalidScope, err.Error())
+			return
+		}
 	}
 
 	duration := a.cfg.Tokens.DefaultDuration
 	if req.Duration != "" {
 		d, err := time.ParseDuration(req.Duration)
 		if err != nil {
-			writeJSON(w, http.StatusBadRequest, map[string]string{"message": "Invalid duration format"})
+			writeError(w, http.StatusBadRequest, apierr.InvalidDuration, "Invalid duration format")
 			return
 		}
 		duration = d
@@ -82,10 +130,41 @@ func (a *API) handleCreateToken(w http.ResponseWriter, r *http.Request) {
 	// Get the user's GitHub token.
 	gt, err := a.store.GetGitHubToken(r.Context(), session.UserID)
 	if err != nil || gt == nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "No GitHub token found. Please re-authenticate."})
+		writeError(w, http.StatusBadRequest, apierr.GitHubTokenMissing, "No GitHub token found. Please re-authenticate.")
 		return
 	}
 
+	// Keep the proxy token from outliving the GitHub credential backing it.
+	if remaining := time.Until(gt.RefreshTokenExpiresAt); duration > remaining {
+		switch a.cfg.Tokens.GitHubExpiryPolicy {
+		case "cap":
+			if remaining >= time.Minute {
+				duration = remaining.Truncate(time.Second)
+				break
+			}
+			// Too little left to be useful: treat as a rejection.
+			fallthrough
+		case "reject":
+			writeError(w, http.StatusBadRequest, apierr.InvalidDuration, fmt.Sprintf(
+				"Duration %s exceeds your GitHub authorization, which expires in %s; re-authenticate or request a shorter token",
+				duration, remaining.Truncate(time.Minute)))
+			return
+		}
+	}
+
+	// Flag proxy scopes the underlying GitHub token can't actually exercise.
+	var warnings []string
+	if missing := token.MissingOAuthScopes(gt.Scopes, scopes); len(missing) > 0 {
+		msg := fmt.Sprintf("Your GitHub authorization lacks the %s scope(s) these permissions need; re-authenticate to grant them",
+			strings.Join(missing, ", "))
+		if a.cfg.Tokens.ScopePolicy == "block" {
+			writeError(w, http.StatusBadRequest, apierr.InsufficientScope, msg)
+			return
+		}
+		a.logger.Warn("token_scope_stale", "user", session.Username, "missing", missing)
+		warnings = append(warnings, msg)
+	}
+
 	result, err := a.tokenService.Create(r.Context(), token.CreateRequest{
 		UserID:        session.UserID,
 		GitHubTokenID: gt.ID,
@@ -93,9 +172,22 @@ func (a *API) handleCreateToken(w http.ResponseWriter, r *http.Request) {
 		Scopes:        scopes,
 		Duration:      duration,
 		SessionID:     req.SessionID,
+		MaxRequests:   req.MaxRequests,
+		SingleUse:     req.SingleUse,
+		Description:   req.Description,
 	})
-	if err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+	var verr *token.ValidationError
+	switch {
+	case errors.As(err, &verr):
+		writeError(w, http.StatusBadRequest, createErrorCode(verr), verr.Error())
+		return
+	case errors.Is(err, token.ErrRepoCheck):
+		a.logger.Error("failed to verify repository", "user", session.Username, "repo", req.Repository, "error", err)
+		writeError(w, http.StatusBadGateway, apierr.UpstreamError, "Could not verify the repository on GitHub")
+		return
+	case err != nil:
+		a.logger.Error("failed to create token", "user", session.Username, "error", err)
+		writeError(w, http.StatusInternalServerError, apierr.Internal, "Internal error")
 		return
 	}
 
@@ -112,14 +204,41 @@ func (a *API) handleCreateToken(w http.ResponseWriter, r *http.Request) {
 		"session", req.SessionID,
 	)
 
-	writeJSON(w, http.StatusCreated, map[string]interface{}{
+	for _, id := range result.Replaced {
+		tokenID := id
+		a.store.CreateAuditEntry(r.Context(), &database.AuditEntry{
+			UserID:       session.UserID,
+			ProxyTokenID: &tokenID,
+			Action:       "token_revoked",
+			SessionID:    req.SessionID,
+			Metadata:     json.RawMessage(`{"reason":"session_replaced"}`),
+		})
+		a.logger.Info("token_revoked", "user", session.Username, "token_id", id, "reason", "session_replaced")
+	}
+
+	resp := map[string]interface{}{
 		"token":      result.Token,
 		"id":         result.ID,
 		"repository": result.Repository,
 		"scopes":     result.Scopes,
 		"expires_at": result.ExpiresAt.Format(time.RFC3339),
+		// Seconds until expiry, as in OAuth token responses.
+		"expires_in": int64(time.Until(result.ExpiresAt).Seconds()),
 		"session_id": result.SessionID,
-	})
+	}
+	if result.MaxRequests > 0 {
+		resp["max_requests"] = result.MaxRequests
+	}
+	if result.Description != "" {
+		resp["description"] = result.Description
+	}
+	if len(result.Replaced) > 0 {
+		resp["replaced_tokens"] = result.Replaced
+	}
+	if len(warnings) > 0 {
+		resp["warnings"] = warnings
+	}
+	writeJSON(w, http.StatusCreated, resp)
 }
 
 func (a *API) handleListTokens(w http.ResponseWriter, r *http.Request) {
@@ -137,7 +256,7 @@ func (a *API) handleListTokens(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		a.logger.Error("failed to list tokens", "error", err)
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "Internal error"})
+		writeError(w, http.StatusInternalServerError, apierr.Internal, "Internal error")
 		return
 	}
 
@@ -155,15 +274,15 @@ func (a *API) handleGetToken(w http.ResponseWriter, r *http.Request) {
 	pt, err := a.store.GetProxyTokenByID(r.Context(), id)
 	if err != nil {
 		a.logger.Error("failed to get token", "error", err)
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "Internal error"})
+		writeError(w, http.StatusInternalServerError, apierr.Internal, "Internal error")
 		return
 	}
 	if pt == nil {
-		writeJSON(w, http.StatusNotFound, map[string]string{"message": "Token not found"})
+		writeError(w, http.StatusNotFound, apierr.NotFound, "Token not found")
 		return
 	}
 	if pt.UserID != session.UserID && session.Role != "admin" {
-		writeJSON(w, http.StatusForbidden, map[string]string{"message": "Access denied"})
+		writeError(w, http.StatusForbidden, apierr.Forbidden, "Access denied")
 		return
 	}
 
@@ -177,20 +296,20 @@ func (a *API) handleRevokeToken(w http.ResponseWriter, r *http.Request) {
 	pt, err := a.store.GetProxyTokenByID(r.Context(), id)
 	if err != nil {
 		a.logger.Error("failed to get token for revocation", "error", err)
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "Internal error"})
+		writeError(w, http.StatusInternalServerError, apierr.Internal, "Internal error")
 		return
 	}
 	if pt == nil {
-		writeJSON(w, http.StatusNotFound, map[string]string{"message": "Token not found"})
+		writeError(w, http.StatusNotFound, apierr.NotFound, "Token not found")
 		return
 	}
 	if pt.UserID != session.UserID && session.Role != "admin" {
-		writeJSON(w, http.StatusForbidden, map[string]string{"message": "Access denied"})
+		writeError(w, http.StatusForbidden, apierr.Forbidden, "Access denied")
 		return
 	}
 
 	if err := a.tokenService.Revoke(r.Context(), id); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+		writeError(w, http.StatusBadRequest, apierr.InvalidRequest, err.Error())
 		return
 	}
 
@@ -205,22 +324,114 @@ func (a *API) handleRevokeToken(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, map[string]string{"message": "Token revoked"})
 }
 
+// maxUserPageSize caps ?limit= on GET /api/users.
+const maxUserPageSize = 500
+
 func (a *API) handleListUsers(w http.ResponseWriter, r *http.Request) {
-	users, err := a.store.ListUsers(r.Context())
+	q := r.URL.Query()
+
+	// Without search or paging parameters, return every user as before.
+	var users []*database.User
+	var err error
+	if !q.Has("q") && !q.Has("limit") && !q.Has("offset") {
+		users, err = a.store.ListUsers(r.Context())
+	} else {
+		filter := database.UserFilter{Query: q.Get("q"), Limit: 100}
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 || n > maxUserPageSize {
+				writeError(w, http.StatusBadRequest, apierr.InvalidRequest,
+					fmt.Sprintf("Invalid limit (must be 1-%d)", maxUserPageSize))
+				return
+			}
+			filter.Limit = n
+		}
+		if v := q.Get("offset"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				writeError(w, http.StatusBadRequest, apierr.InvalidRequest, "Invalid offset")
+				return
+			}
+			filter.Offset = n
+		}
+		users, err = a.store.ListUsersFiltered(r.Context(), filter)
+	}
 	if err != nil {
 		a.logger.Error("failed to list users", "error", err)
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "Internal error"})
+		writeError(w, http.StatusInternalServerError, apierr.Internal, "Internal error")
 		return
 	}
+	if users == nil {
+		users = []*database.User{}
+	}
 	writeJSON(w, http.StatusOK, users)
 }
 
+// handleGetConfig returns the effective configuration, after the config file
+// and environment are merged, with secrets redacted.
+func (a *API) handleGetConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.cfg.Redacted())
+}
+
+// handleRepoStats reports active tokens and request totals per repository,
+// busiest first.
+func (a *API) handleRepoStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := a.store.TokenStatsByRepo(r.Context())
+	if err != nil {
+		a.logger.Error("failed to compute repository stats", "error", err)
+		writeError(w, http.StatusInternalServerError, apierr.Internal, "Internal error")
+		return
+	}
+	if stats == nil {
+		stats = []*database.RepoTokenStats{}
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// maxArchivePageSize caps ?limit= on GET /api/admin/tokens/archive.
+const maxArchivePageSize = 500
+
+// handleListArchivedTokens lists tokens archived by the token reconciler,
+// most recently archived first, optionally for one user_id or repository.
+func (a *API) handleListArchivedTokens(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := database.ArchiveFilter{UserID: q.Get("user_id"), Repository: q.Get("repository"), Limit: 100}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxArchivePageSize {
+			writeError(w, http.StatusBadRequest, apierr.InvalidRequest,
+				fmt.Sprintf("Invalid limit (must be 1-%d)", maxArchivePageSize))
+			return
+		}
+		filter.Limit = n
+	}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, apierr.InvalidRequest, "Invalid offset")
+			return
+		}
+		filter.Offset = n
+	}
+
+	tokens, err := a.store.ListArchivedProxyTokens(r.Context(), filter)
+	if err != nil {
+		a.logger.Error("failed to list archived tokens", "error", err)
+		writeError(w, http.StatusInternalServerError, apierr.Internal, "Internal error")
+		return
+	}
+	if tokens == nil {
+		tokens = []*database.ArchivedProxyToken{}
+	}
+	writeJSON(w, http.StatusOK, tokens)
+}
+
 func (a *API) handleListUserTokens(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 	tokens, err := a.store.ListProxyTokens(r.Context(), id)
 	if err != nil {
 		a.logger.Error("failed to list user tokens", "error", err)
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "Internal error"})
+		writeError(w, http.StatusInternalServerError, apierr.Internal, "Internal error")
 		return
 	}
 	if tokens == nil {
@@ -229,35 +440,338 @@ func (a *API) handleListUserTokens(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, tokens)
 }
 
-func (a *API) handleListAudit(w http.ResponseWriter, r *http.Request) {
+// handlePurgeUser erases a user and their tokens for right-to-erasure
+// requests. The confirm query parameter must repeat the user's GitHub
+// username. Their audit entries are anonymized unless audit=delete is given.
+func (a *API) handlePurgeUser(w http.ResponseWriter, r *http.Request) {
 	session := auth.SessionFromContext(r.Context())
+	id := r.PathValue("id")
 
-	filter := database.AuditFilter{
-		Repository: r.URL.Query().Get("repository"),
-		TokenID:    r.URL.Query().Get("token_id"),
-		Action:     r.URL.Query().Get("action"),
-		Limit:      100,
+	if id == session.UserID {
+		writeError(w, http.StatusBadRequest, apierr.InvalidRequest, "You cannot purge your own account")
+		return
 	}
 
-	// Non-admins can only see their own audit entries.
-	if session.Role != "admin" {
-		filter.UserID = session.UserID
-	} else if uid := r.URL.Query().Get("user_id"); uid != "" {
-		filter.UserID = uid
+	q := r.URL.Query()
+	anonymize := true
+	switch q.Get("audit") {
+	case "", "anonymize":
+	case "delete":
+		anonymize = false
+	default:
+		writeError(w, http.StatusBadRequest, apierr.InvalidRequest, "audit must be anonymize or delete")
+		return
+	}
+
+	user, err := a.store.GetUserByID(r.Context(), id)
+	if err != nil {
+		a.logger.Error("failed to get user", "error", err)
+		writeError(w, http.StatusInternalServerError, apierr.Internal, "Internal error")
+		return
+	}
+	if user == nil {
+		writeError(w, http.StatusNotFound, apierr.NotFound, "User not found")
+		return
+	}
+	if q.Get("confirm") != user.GitHubUsername {
+		writeError(w, http.StatusBadRequest, apierr.InvalidRequest,
+			"Purging a user cannot be undone; repeat their GitHub username in the confirm parameter")
+		return
+	}
+
+	res, err := a.store.PurgeUser(r.Context(), id, anonymize)
+	if err != nil {
+		a.logger.Error("failed to purge user", "error", err)
+		writeError(w, http.StatusInternalServerError, apierr.Internal, "Internal error")
+		return
+	}
+	// PurgeUser deleted the stored sessions; this drops the cached ones.
+	if _, err := a.authHandler.EndUserSessions(r.Context(), id); err != nil {
+		a.logger.Error("failed to end purged user's sessions", "error", err)
+	}
+
+	// The purged user's name is deliberately left out of the record.
+	meta, _ := json.Marshal(map[string]interface{}{"target_user_id": id, "anonymized_audit": anonymize, "purged": res})
+	a.store.CreateAuditEntry(r.Context(), &database.AuditEntry{
+		UserID:   session.UserID,
+		Action:   "user_purged",
+		Metadata: meta,
+	})
+
+	a.logger.Info("user_purged", "user", session.Username, "target_user_id", id,
+		"proxy_tokens", res.ProxyTokens, "audit_entries", res.AuditEntries, "anonymized_audit", anonymize)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"message": "User purged", "purged": res})
+}
+
+func (a *API) handleDisableUser(w http.ResponseWriter, r *http.Request) {
+	a.setUserDisabled(w, r, true)
+}
+
+func (a *API) handleEnableUser(w http.ResponseWriter, r *http.Request) {
+	a.setUserDisabled(w, r, false)
+}
+
+// setUserDisabled disables or re-enables a user. A disabled user can't sign
+// in and their tokens stop resolving; disabling also ends their sessions and
+// revokes their tokens, which stay revoked if the user is enabled again.
+func (a *API) setUserDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	session := auth.SessionFromContext(r.Context())
+	id := r.PathValue("id")
+
+	if disabled && id == session.UserID {
+		writeError(w, http.StatusBadRequest, apierr.InvalidRequest, "You cannot disable your own account")
+		return
+	}
+	user, err := a.store.GetUserByID(r.Context(), id)
+	if err != nil {
+		a.logger.Error("failed to get user", "error", err)
+		writeError(w, http.StatusInternalServerError, apierr.Internal, "Internal error")
+		return
+	}
+	if user == nil {
+		writeError(w, http.StatusNotFound, apierr.NotFound, "User not found")
+		return
+	}
+	if err := a.store.SetUserDisabled(r.Context(), id, disabled); err != nil {
+		a.logger.Error("failed to update user", "error", err)
+		writeError(w, http.StatusInternalServerError, apierr.Internal, "Internal error")
+		return
+	}
+
+	action, message := "user_enabled", "User enabled"
+	var revoked int64
+	var ended int
+	if disabled {
+		action, message = "user_disabled", "User disabled"
+		if revoked, err = a.tokenService.RevokeAll(r.Context(), id); err != nil {
+			// Their tokens no longer resolve; the reconciler revokes them.
+			a.logger.Error("failed to revoke user tokens", "error", err)
+		}
+		if ended, err = a.authHandler.EndUserSessions(r.Context(), id); err != nil {
+			a.logger.Error("failed to end user sessions", "error", err)
+			writeError(w, http.StatusInternalServerError, apierr.Internal, "User disabled, but their sessions could not be ended; try again")
+			return
+		}
+	}
+
+	meta, _ := json.Marshal(map[string]interface{}{"target_user_id": id, "revoked": revoked, "sessions_ended": ended})
+	a.store.CreateAuditEntry(r.Context(), &database.AuditEntry{
+		UserID:   session.UserID,
+		Action:   action,
+		Metadata: meta,
+	})
+	a.logger.Info(action, "user", session.Username, "target", user.GitHubUsername, "revoked", revoked, "sessions_ended", ended)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"message": message, "revoked": revoked, "sessions_ended": ended})
+}
+
+// handleRevokeAllUserTokens revokes every active token of a user. Users may
+// revoke their own tokens; admins may revoke anyone's.
+func (a *API) handleRevokeAllUserTokens(w http.ResponseWriter, r *http.Request) {
+	session := auth.SessionFromContext(r.Context())
+	id := r.PathValue("id")
+
+	if id != session.UserID && session.Role != "admin" {
+		writeError(w, http.StatusForbidden, apierr.Forbidden, "Access denied")
+		return
+	}
+
+	n, err := a.tokenService.RevokeAll(r.Context(), id)
+	if err != nil {
+		a.logger.Error("failed to revoke user tokens", "error", err)
+		writeError(w, http.StatusInternalServerError, apierr.Internal, "Internal error")
+		return
+	}
+
+	// Audit log.
+	a.store.CreateAuditEntry(r.Context(), &database.AuditEntry{
+		UserID:   session.UserID,
+		Action:   "tokens_revoked_all",
+		Metadata: json.RawMessage(fmt.Sprintf(`{"target_user_id":%q,"revoked":%d}`, id, n)),
+	})
+
+	a.logger.Info("tokens_revoked_all", "user", session.Username, "target_user_id", id, "revoked", n)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"message": "Tokens revoked", "revoked": n})
+}
+
+func (a *API) handleListAudit(w http.ResponseWriter, r *http.Request) {
+	filter, err := a.auditFilterFromRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, apierr.InvalidRequest, err.Error())
+		return
 	}
 
 	entries, err := a.store.ListAuditEntries(r.Context(), filter)
 	if err != nil {
 		a.logger.Error("failed to list audit entries", "error", err)
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "Internal error"})
+		writeError(w, http.StatusInternalServerError, apierr.Internal, "Internal error")
 		return
 	}
 	if entries == nil {
 		entries = []*database.AuditEntry{}
 	}
+
+	// A full page may have more behind it; hand back the cursor for the next one.
+	if len(entries) == filter.Limit {
+		w.Header().Set("X-Next-Cursor", database.AuditCursor(entries[len(entries)-1]))
+	}
 	writeJSON(w, http.StatusOK, entries)
 }
 
+func (a *API) handleListScopes(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string][]string{
+		"permissions": a.permissions(),
+		"levels":      {"read", "write"},
+	})
+}
+
+type checkScopesRequest struct {
+	Scopes string `json:"scopes"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+}
+
+type checkScopesResponse struct {
+	Allowed    bool   `json:"allowed"`
+	Permission string `json:"permission,omitempty"`
+	Level      string `json:"level,omitempty"`
+}
+
+// handleCheckScopes reports whether a token with the given scopes would be
+// allowed to make a request, without creating one.
+func (a *API) handleCheckScopes(w http.ResponseWriter, r *http.Request) {
+	var req checkScopesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, apierr.InvalidRequest, "Invalid request body")
+		return
+	}
+	scopes, err := token.ParseScopeString(req.Scopes)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, apierr.InvalidScope, err.Error())
+		return
+	}
+	if req.Method == "" || !strings.HasPrefix(req.Path, "/") {
+		writeError(w, http.StatusBadRequest, apierr.InvalidRequest, "method and an absolute path are required")
+		return
+	}
+
+	path := strings.TrimPrefix(req.Path, "/api/v3")
+	permission, level := a.endpointScope(strings.ToUpper(req.Method), path)
+	allowed := permission == "" || permission == "metadata" ||
+		database.Scopes(scopes).HasPermission(permission, level)
+
+	writeJSON(w, http.StatusOK, checkScopesResponse{
+		Allowed:    allowed,
+		Permission: permission,
+		Level:      level,
+	})
+}
+
+// handleGetAudit returns a single audit entry, including its full metadata.
+// Non-admins may only fetch their own entries.
+func (a *API) handleGetAudit(w http.ResponseWriter, r *http.Request) {
+	session := auth.SessionFromContext(r.Context())
+
+	entry, err := a.store.GetAuditEntryByID(r.Context(), r.PathValue("id"))
+	if err != nil {
+		a.logger.Error("failed to get audit entry", "error", err)
+		writeError(w, http.StatusInternalServerError, apierr.Internal, "Internal error")
+		return
+	}
+	if entry == nil {
+		writeError(w, http.StatusNotFound, apierr.NotFound, "Audit entry not found")
+		return
+	}
+	if entry.UserID != session.UserID && session.Role != "admin" {
+		writeError(w, http.StatusForbidden, apierr.Forbidden, "Access denied")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, entry)
+}
+
+// auditFilterFromRequest builds an audit filter from the query string,
+// restricting non-admins to their own entries.
+func (a *API) auditFilterFromRequest(r *http.Request) (database.AuditFilter, error) {
+	session := auth.SessionFromContext(r.Context())
+	q := r.URL.Query()
+
+	filter := database.AuditFilter{
+		Repository: q.Get("repository"),
+		TokenID:    q.Get("token_id"),
+		Action:     q.Get("action"),
+		Cursor:     q.Get("cursor"),
+		Limit:      100,
+	}
+
+	// Honour ?limit= up to the configured maximum. Large result sets should
+	// be paged with ?cursor= (keyset) rather than ?offset=.
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return filter, fmt.Errorf("Invalid limit")
+		}
+		filter.Limit = n
+	}
+	if max := a.cfg.Audit.MaxResults; max > 0 && filter.Limit > max {
+		filter.Limit = max
+	}
+	for param, dst := range map[string]*int{
+		"status_min": &filter.StatusCodeMin,
+		"status_max": &filter.StatusCodeMax,
+	} {
+		if v := q.Get(param); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 100 || n > 599 {
+				return filter, fmt.Errorf("Invalid %s", param)
+			}
+			*dst = n
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return filter, fmt.Errorf("Invalid offset")
+		}
+		filter.Offset = n
+	}
+	if filter.Cursor != "" {
+		if _, _, err := database.ParseAuditCursor(filter.Cursor); err != nil {
+			return filter, fmt.Errorf("Invalid cursor")
+		}
+	}
+
+	// Non-admins can only see their own audit entries.
+	if session.Role != "admin" {
+		filter.UserID = session.UserID
+	} else if uid := q.Get("user_id"); uid != "" {
+		filter.UserID = uid
+	}
+
+	return filter, nil
+}
+
+// createErrorCode maps a token.Service.Create validation error to its API
+// error code.
+func createErrorCode(verr *token.ValidationError) string {
+	switch verr.Field {
+	case "repository":
+		return apierr.InvalidRepository
+	case "scopes":
+		return apierr.InvalidScope
+	case "duration":
+		return apierr.InvalidDuration
+	}
+	return apierr.InvalidRequest
+}
+
+// writeError writes a JSON error response carrying a stable error code.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	apierr.Write(w, status, code, message)
+}
+
 func writeJSON(w http.ResponseWriter, status int, v interface{}) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(status)
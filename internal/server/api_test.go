@@ -0,0 +1,712 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goodtune/ghp/internal/apierr"
+	"github.com/goodtune/ghp/internal/auth"
+	"github.com/goodtune/ghp/internal/config"
+	"github.com/goodtune/ghp/internal/database"
+	"github.com/goodtune/ghp/internal/token"
+)
+
+// newTestAPI returns a mux serving the API against a migrated SQLite store,
+// along with the store and auth handler for seeding users and sessions.
+func newTestAPI(t *testing.T, cfg *config.Config) (*http.ServeMux, *database.SQLiteStore, *auth.Handler) {
+	t.Helper()
+	store := newTestStore(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ah := auth.NewHandler(cfg, store, nil, logger)
+	mux := http.NewServeMux()
+	NewAPI(cfg, store, token.NewService(store, cfg.Tokens.MaxDuration), ah, logger).RegisterRoutes(mux)
+	return mux, store, ah
+}
+
+func TestAPIErrorCodes(t *testing.T) {
+	ctx := context.Background()
+	mux, store, ah := newTestAPI(t, config.Defaults())
+
+	alice := &database.User{GitHubID: 1, GitHubUsername: "alice", Role: "user"}
+	bob := &database.User{GitHubID: 2, GitHubUsername: "bob", Role: "user"}
+	for _, u := range []*database.User{alice, bob} {
+		if err := store.UpsertUser(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only alice has GitHub credentials.
+	gt := &database.GitHubToken{UserID: alice.ID, AccessToken: "a", RefreshToken: "r",
+		AccessTokenExpiresAt: time.Now().Add(time.Hour), RefreshTokenExpiresAt: time.Now().Add(time.Hour)}
+	if err := store.UpsertGitHubToken(ctx, gt); err != nil {
+		t.Fatal(err)
+	}
+	aliceSession := ah.CreateTestSession(alice.ID, alice.GitHubUsername, "user")
+	bobSession := ah.CreateTestSession(bob.ID, bob.GitHubUsername, "user")
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		session    string
+		body       string
+		wantStatus int
+		wantCode   string
+	}{
+		{"unauthenticated", "GET", "/api/tokens", "", "", http.StatusUnauthorized, apierr.Unauthenticated},
+		{"proxy token", "POST", "/api/tokens", "ghp_" + strings.Repeat("a", 40),
+			`{"repository":"org/repo","scopes":"contents:read"}`, http.StatusUnauthorized, apierr.ProxyTokenNotAllowed},
+		{"not admin", "GET", "/api/users", aliceSession, "", http.StatusForbidden, apierr.AdminRequired},
+		{"config not admin", "GET", "/api/admin/config", aliceSession, "", http.StatusForbidden, apierr.AdminRequired},
+		{"archive not admin", "GET", "/api/admin/tokens/archive", aliceSession, "", http.StatusForbidden, apierr.AdminRequired},
+		{"malformed body", "POST", "/api/tokens", aliceSession, "{", http.StatusBadRequest, apierr.InvalidRequest},
+		{"bad scope", "POST", "/api/tokens", aliceSession,
+			`{"repository":"org/repo","scopes":"contents"}`, http.StatusBadRequest, apierr.InvalidScope},
+		{"unparseable duration", "POST", "/api/tokens", aliceSession,
+			`{"repository":"org/repo","scopes":"contents:read","duration":"soon"}`, http.StatusBadRequest, apierr.InvalidDuration},
+		{"duration over maximum", "POST", "/api/tokens", aliceSession,
+			`{"repository":"org/repo","scopes":"contents:read","duration":"1000h"}`, http.StatusBadRequest, apierr.InvalidDuration},
+		{"missing repository", "POST", "/api/tokens", aliceSession,
+			`{"scopes":"contents:read"}`, http.StatusBadRequest, apierr.InvalidRepository},
+		{"no github token", "POST", "/api/tokens", bobSession,
+			`{"repository":"org/repo","scopes":"contents:read"}`, http.StatusBadRequest, apierr.GitHubTokenMissing},
+		{"token not found", "GET", "/api/tokens/nope", aliceSession, "", http.StatusNotFound, apierr.NotFound},
+		{"revoke others' tokens", "POST", "/api/users/" + bob.ID + "/tokens/revoke-all", aliceSession, "",
+			http.StatusForbidden, apierr.Forbidden},
+		{"bad audit limit", "GET", "/api/audit?limit=many", aliceSession, "", http.StatusBadRequest, apierr.InvalidRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.session != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.session)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			var body apierr.Response
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Code != tt.wantCode {
+				t.Errorf("code = %q, want %q (message %q)", body.Code, tt.wantCode, body.Message)
+			}
+		})
+	}
+}
+
+func TestCreateTokenRepoCheckFails(t *testing.T) {
+	ctx := context.Background()
+	cfg := config.Defaults()
+	store := newTestStore(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ah := auth.NewHandler(cfg, store, nil, logger)
+	ts := token.NewService(store, cfg.Tokens.MaxDuration)
+	ts.SetRepoCheck(func(context.Context, string, string) error {
+		return errors.New("dial tcp 10.0.0.1:443: connection refused")
+	})
+	mux := http.NewServeMux()
+	NewAPI(cfg, store, ts, ah, logger).RegisterRoutes(mux)
+
+	alice := &database.User{GitHubID: 1, GitHubUsername: "alice", Role: "user"}
+	if err := store.UpsertUser(ctx, alice); err != nil {
+		t.Fatal(err)
+	}
+	gt := &database.GitHubToken{UserID: alice.ID, AccessToken: "a", RefreshToken: "r",
+		AccessTokenExpiresAt: time.Now().Add(time.Hour), RefreshTokenExpiresAt: time.Now().Add(time.Hour)}
+	if err := store.UpsertGitHubToken(ctx, gt); err != nil {
+		t.Fatal(err)
+	}
+	session := ah.CreateTestSession(alice.ID, alice.GitHubUsername, "user")
+
+	req := httptest.NewRequest("POST", "/api/tokens", strings.NewReader(`{"repository":"org/repo","scopes":"contents:read"}`))
+	req.Header.Set("Authorization", "Bearer "+session)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), apierr.UpstreamError) || strings.Contains(rec.Body.String(), "10.0.0.1") {
+		t.Errorf("body = %s, want upstream_error without the underlying error", rec.Body)
+	}
+}
+
+func TestListUsersPagination(t *testing.T) {
+	ctx := context.Background()
+	mux, store, ah := newTestAPI(t, config.Defaults())
+
+	for i, name := range []string{"admin", "alice", "alicia", "bob"} {
+		if err := store.UpsertUser(ctx, &database.User{GitHubID: int64(i + 1), GitHubUsername: name, Role: "user"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	session := ah.CreateTestSession("admin-id", "admin", "admin")
+
+	tests := []struct {
+		query      string
+		wantStatus int
+		wantCount  int
+	}{
+		{"", http.StatusOK, 4},
+		{"?q=ali", http.StatusOK, 2},
+		{"?q=ALI&limit=1", http.StatusOK, 1},
+		{"?limit=2&offset=3", http.StatusOK, 1},
+		{"?offset=10", http.StatusOK, 0},
+		{"?limit=0", http.StatusBadRequest, 0},
+		{"?limit=501", http.StatusBadRequest, 0},
+		{"?offset=-1", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/users"+tt.query, nil)
+		req.Header.Set("Authorization", "Bearer "+session)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.query, rec.Code, tt.wantStatus)
+			continue
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+		var users []*database.User
+		if err := json.NewDecoder(rec.Body).Decode(&users); err != nil {
+			t.Fatal(err)
+		}
+		if len(users) != tt.wantCount {
+			t.Errorf("%s: got %d users, want %d", tt.query, len(users), tt.wantCount)
+		}
+	}
+}
+
+func TestCreateTokenStaleGitHubScopes(t *testing.T) {
+	ctx := context.Background()
+
+	for _, policy := range []string{"block", "warn"} {
+		t.Run(policy, func(t *testing.T) {
+			cfg := config.Defaults()
+			cfg.Tokens.ScopePolicy = policy
+			mux, store, ah := newTestAPI(t, cfg)
+			user := &database.User{GitHubID: 1, GitHubUsername: "alice", Role: "user"}
+			if err := store.UpsertUser(ctx, user); err != nil {
+				t.Fatal(err)
+			}
+			// The GitHub token was granted read:user only, without repo.
+			gt := &database.GitHubToken{UserID: user.ID, AccessToken: "a", RefreshToken: "r", Scopes: "read:user",
+				AccessTokenExpiresAt: time.Now().Add(time.Hour), RefreshTokenExpiresAt: time.Now().Add(time.Hour)}
+			if err := store.UpsertGitHubToken(ctx, gt); err != nil {
+				t.Fatal(err)
+			}
+			session := ah.CreateTestSession(user.ID, user.GitHubUsername, "user")
+
+			req := httptest.NewRequest("POST", "/api/tokens",
+				strings.NewReader(`{"repository":"org/repo","scopes":"contents:write"}`))
+			req.Header.Set("Authorization", "Bearer "+session)
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			var body map[string]interface{}
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			switch policy {
+			case "block":
+				if rec.Code != http.StatusBadRequest || body["code"] != apierr.InsufficientScope {
+					t.Errorf("status = %d, body = %v; want 400 %s", rec.Code, body, apierr.InsufficientScope)
+				}
+				if !strings.Contains(body["message"].(string), "repo") {
+					t.Errorf("message %q doesn't name the missing scope", body["message"])
+				}
+			case "warn":
+				if rec.Code != http.StatusCreated {
+					t.Fatalf("status = %d, body = %v; want 201", rec.Code, body)
+				}
+				if warnings, _ := body["warnings"].([]interface{}); len(warnings) != 1 {
+					t.Errorf("warnings = %v, want one", body["warnings"])
+				}
+			}
+		})
+	}
+}
+
+func TestCreateTokenGitHubExpiryPolicy(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		policy     string
+		duration   string
+		wantStatus int
+		wantMax    time.Duration // upper bound on the created token's lifetime
+	}{
+		{"off", "48h", http.StatusCreated, 48 * time.Hour},
+		{"cap", "48h", http.StatusCreated, 10 * time.Hour},
+		{"cap", "1h", http.StatusCreated, time.Hour},
+		{"reject", "48h", http.StatusBadRequest, 0},
+		{"reject", "1h", http.StatusCreated, time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy+"/"+tt.duration, func(t *testing.T) {
+			cfg := config.Defaults()
+			cfg.Tokens.GitHubExpiryPolicy = tt.policy
+			mux, store, ah := newTestAPI(t, cfg)
+			user := &database.User{GitHubID: 1, GitHubUsername: "alice", Role: "user"}
+			if err := store.UpsertUser(ctx, user); err != nil {
+				t.Fatal(err)
+			}
+			// The GitHub refresh token can only be renewed for another 10 hours.
+			gt := &database.GitHubToken{UserID: user.ID, AccessToken: "a", RefreshToken: "r",
+				AccessTokenExpiresAt: time.Now().Add(time.Hour), RefreshTokenExpiresAt: time.Now().Add(10 * time.Hour)}
+			if err := store.UpsertGitHubToken(ctx, gt); err != nil {
+				t.Fatal(err)
+			}
+			session := ah.CreateTestSession(user.ID, user.GitHubUsername, "user")
+
+			req := httptest.NewRequest("POST", "/api/tokens", strings.NewReader(
+				`{"repository":"org/repo","scopes":"contents:read","duration":"`+tt.duration+`"}`))
+			req.Header.Set("Authorization", "Bearer "+session)
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if rec.Code != http.StatusCreated {
+				var body apierr.Response
+				json.NewDecoder(rec.Body).Decode(&body)
+				if body.Code != apierr.InvalidDuration {
+					t.Errorf("code = %q, want %q", body.Code, apierr.InvalidDuration)
+				}
+				return
+			}
+			var body struct {
+				ExpiresAt time.Time `json:"expires_at"`
+				ExpiresIn *int64    `json:"expires_in"`
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			lifetime := time.Until(body.ExpiresAt)
+			if lifetime > tt.wantMax || lifetime < tt.wantMax-time.Minute {
+				t.Errorf("token lifetime = %s, want about %s", lifetime, tt.wantMax)
+			}
+			if body.ExpiresIn == nil {
+				t.Fatal("expires_in missing")
+			}
+			if in := time.Duration(*body.ExpiresIn) * time.Second; in > tt.wantMax || in < tt.wantMax-time.Minute {
+				t.Errorf("expires_in = %s, want about %s", in, tt.wantMax)
+			}
+		})
+	}
+}
+
+func TestGetAuditEntry(t *testing.T) {
+	ctx := context.Background()
+	mux, store, ah := newTestAPI(t, config.Defaults())
+
+	alice := &database.User{GitHubID: 1, GitHubUsername: "alice", Role: "user"}
+	bob := &database.User{GitHubID: 2, GitHubUsername: "bob", Role: "user"}
+	for _, u := range []*database.User{alice, bob} {
+		if err := store.UpsertUser(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entry := &database.AuditEntry{UserID: alice.ID, Action: "proxy_request", Method: "GET",
+		Path: "/repos/org/repo", Metadata: json.RawMessage(`{"github_request_id":"CAFE"}`)}
+	if err := store.CreateAuditEntry(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		id         string
+		session    string
+		wantStatus int
+	}{
+		{"owner", entry.ID, ah.CreateTestSession(alice.ID, alice.GitHubUsername, "user"), http.StatusOK},
+		{"admin", entry.ID, ah.CreateTestSession("admin-id", "admin", "admin"), http.StatusOK},
+		{"other user", entry.ID, ah.CreateTestSession(bob.ID, bob.GitHubUsername, "user"), http.StatusForbidden},
+		{"not found", "nope", ah.CreateTestSession("admin-id", "admin", "admin"), http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/audit/"+tt.id, nil)
+			req.Header.Set("Authorization", "Bearer "+tt.session)
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+			var got database.AuditEntry
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != entry.ID || string(got.Metadata) != `{"github_request_id":"CAFE"}` {
+				t.Errorf("entry = %+v, metadata %s", got, got.Metadata)
+			}
+		})
+	}
+}
+
+func TestCheckScopes(t *testing.T) {
+	mux, _, ah := newTestAPI(t, config.Defaults())
+	session := ah.CreateTestSession("user-id", "alice", "user")
+
+	tests := []struct {
+		body        string
+		wantStatus  int
+		wantAllowed bool
+	}{
+		{`{"scopes":"pulls:write","method":"POST","path":"/repos/o/r/pulls"}`, http.StatusOK, true},
+		{`{"scopes":"pulls:read","method":"POST","path":"/api/v3/repos/o/r/pulls"}`, http.StatusOK, false},
+		{`{"scopes":"contents:read","method":"GET","path":"/repos/o/r"}`, http.StatusOK, true},
+		{`{"scopes":"pulls","method":"GET","path":"/repos/o/r/pulls"}`, http.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/api/scopes/check", strings.NewReader(tt.body))
+		req.Header.Set("Authorization", "Bearer "+session)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.body, rec.Code, tt.wantStatus)
+			continue
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+		var got checkScopesResponse
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Allowed != tt.wantAllowed {
+			t.Errorf("%s: allowed = %v, want %v", tt.body, got.Allowed, tt.wantAllowed)
+		}
+	}
+}
+
+func TestGetConfig(t *testing.T) {
+	cfg := config.Defaults()
+	cfg.GitHub.ClientID = "client-id"
+	cfg.GitHub.ClientSecret = "client-secret"
+	cfg.EncryptionKey = "encryption-key"
+	mux, _, ah := newTestAPI(t, cfg)
+
+	req := httptest.NewRequest("GET", "/api/admin/config", nil)
+	req.Header.Set("Authorization", "Bearer "+ah.CreateTestSession("admin-id", "admin", "admin"))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	if body := rec.Body.String(); strings.Contains(body, "client-secret") || strings.Contains(body, "encryption-key") {
+		t.Fatalf("response leaks a secret: %s", body)
+	}
+	var got struct {
+		EncryptionKey string `json:"encryption_key"`
+		GitHub        struct {
+			ClientID     string `json:"client_id"`
+			ClientSecret string `json:"client_secret"`
+		} `json:"github"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.EncryptionKey != "***" || got.GitHub.ClientSecret != "***" || got.GitHub.ClientID != "client-id" {
+		t.Errorf("config = %+v", got)
+	}
+}
+
+func TestAdminAllowedCIDRs(t *testing.T) {
+	cfg := config.Defaults()
+	cfg.Server.AdminAllowedCIDRs = []string{"10.0.0.0/8"}
+	cfg.Server.TrustedProxies = []string{"192.168.1.1/32"}
+	mux, _, ah := newTestAPI(t, cfg)
+	admin := ah.CreateTestSession("admin-id", "admin", "admin")
+
+	tests := []struct {
+		name, remoteAddr, forwardedFor string
+		session                        string
+		want                           int
+	}{
+		{"in range", "10.1.2.3:5000", "", admin, http.StatusOK},
+		{"out of range", "203.0.113.7:5000", "", admin, http.StatusForbidden},
+		{"out of range before auth", "203.0.113.7:5000", "", "", http.StatusForbidden},
+		{"via trusted proxy", "192.168.1.1:5000", "203.0.113.7, 10.1.2.3", admin, http.StatusOK},
+		{"spoofed via trusted proxy", "192.168.1.1:5000", "10.1.2.3, 203.0.113.7", admin, http.StatusForbidden},
+		{"forwarded by untrusted peer", "203.0.113.7:5000", "10.1.2.3", admin, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/users", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			if tt.session != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.session)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+
+	req := httptest.NewRequest("POST", "/api/users/admin-id/tokens/revoke-all", nil)
+	req.RemoteAddr = "203.0.113.7:5000"
+	req.Header.Set("Authorization", "Bearer "+admin)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("revoke-all out of range: status = %d, want 403", rec.Code)
+	}
+}
+
+func TestPurgeUser(t *testing.T) {
+	ctx := context.Background()
+	mux, store, ah := newTestAPI(t, config.Defaults())
+
+	admin := &database.User{GitHubID: 1, GitHubUsername: "root", Role: "admin"}
+	alice := &database.User{GitHubID: 2, GitHubUsername: "alice", Role: "user"}
+	for _, u := range []*database.User{admin, alice} {
+		if err := store.UpsertUser(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	adminSession := ah.CreateTestSession(admin.ID, admin.GitHubUsername, "admin")
+	aliceSession := ah.CreateTestSession(alice.ID, alice.GitHubUsername, "user")
+
+	purge := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("DELETE", "/api/users/"+alice.ID+query, nil)
+		req.Header.Set("Authorization", "Bearer "+adminSession)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+	for _, query := range []string{"", "?confirm=bob", "?confirm=alice&audit=keep"} {
+		if rec := purge(query); rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: status = %d, want 400", query, rec.Code)
+		}
+	}
+	if u, _ := store.GetUserByID(ctx, alice.ID); u == nil {
+		t.Fatal("user purged without confirmation")
+	}
+
+	if rec := purge("?confirm=alice"); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if u, _ := store.GetUserByID(ctx, alice.ID); u != nil {
+		t.Error("user still exists")
+	}
+	if rec := purge("?confirm=alice"); rec.Code != http.StatusNotFound {
+		t.Errorf("second purge: status = %d, want 404", rec.Code)
+	}
+
+	// The purged user's sessions end with them.
+	req := httptest.NewRequest("GET", "/api/tokens", nil)
+	req.Header.Set("Authorization", "Bearer "+aliceSession)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("purged user's session: status = %d, want 401", rec.Code)
+	}
+}
+
+func TestDisableUser(t *testing.T) {
+	ctx := context.Background()
+	mux, store, ah := newTestAPI(t, config.Defaults())
+
+	admin := &database.User{GitHubID: 1, GitHubUsername: "root", Role: "admin"}
+	alice := &database.User{GitHubID: 2, GitHubUsername: "alice", Role: "user"}
+	for _, u := range []*database.User{admin, alice} {
+		if err := store.UpsertUser(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gt := &database.GitHubToken{UserID: alice.ID, AccessToken: "a", RefreshToken: "r",
+		AccessTokenExpiresAt: time.Now().Add(time.Hour), RefreshTokenExpiresAt: time.Now().Add(time.Hour)}
+	if err := store.UpsertGitHubToken(ctx, gt); err != nil {
+		t.Fatal(err)
+	}
+	pt := &database.ProxyToken{TokenHash: "h", TokenPrefix: "ghp_test", UserID: alice.ID, GitHubTokenID: gt.ID,
+		Repository: "org/repo", Scopes: []byte(`{"contents":"read"}`), ExpiresAt: time.Now().Add(time.Hour)}
+	if err := store.CreateProxyToken(ctx, pt); err != nil {
+		t.Fatal(err)
+	}
+	adminSession := ah.CreateTestSession(admin.ID, admin.GitHubUsername, "admin")
+	aliceSession := ah.CreateTestSession(alice.ID, alice.GitHubUsername, "user")
+
+	do := func(method, path, session string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+session)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do("POST", "/api/users/"+alice.ID+"/disable", aliceSession); rec.Code != http.StatusForbidden {
+		t.Errorf("non-admin: status = %d, want 403", rec.Code)
+	}
+	if rec := do("POST", "/api/users/"+admin.ID+"/disable", adminSession); rec.Code != http.StatusBadRequest {
+		t.Errorf("self: status = %d, want 400", rec.Code)
+	}
+	if rec := do("POST", "/api/users/no-such-user/disable", adminSession); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown user: status = %d, want 404", rec.Code)
+	}
+	if rec := do("POST", "/api/users/"+alice.ID+"/disable", adminSession); rec.Code != http.StatusOK {
+		t.Fatalf("disable: status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+
+	if u, _ := store.GetUserByID(ctx, alice.ID); u.DisabledAt == nil {
+		t.Error("user not disabled")
+	}
+	if got, _ := store.GetProxyTokenByID(ctx, pt.ID); got.RevokedAt == nil {
+		t.Error("token not revoked")
+	}
+	if rec := do("GET", "/api/tokens", aliceSession); rec.Code != http.StatusUnauthorized {
+		t.Errorf("disabled user's session: status = %d, want 401", rec.Code)
+	}
+	// Signing in again refreshes the user row but keeps them disabled.
+	if err := store.UpsertUser(ctx, alice); err != nil || alice.DisabledAt == nil {
+		t.Errorf("UpsertUser = %v, disabled_at = %v; want it reported", err, alice.DisabledAt)
+	}
+
+	if rec := do("POST", "/api/users/"+alice.ID+"/enable", adminSession); rec.Code != http.StatusOK {
+		t.Fatalf("enable: status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if u, _ := store.GetUserByID(ctx, alice.ID); u.DisabledAt != nil {
+		t.Error("user still disabled")
+	}
+	entries, err := store.ListAuditEntries(ctx, database.AuditFilter{UserID: admin.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Action != "user_enabled" || entries[1].Action != "user_disabled" {
+		t.Errorf("audit entries = %+v, want user_enabled and user_disabled", entries)
+	}
+}
+
+func TestListArchivedTokens(t *testing.T) {
+	ctx := context.Background()
+	mux, store, ah := newTestAPI(t, config.Defaults())
+
+	alice := &database.User{GitHubID: 1, GitHubUsername: "alice", Role: "user"}
+	if err := store.UpsertUser(ctx, alice); err != nil {
+		t.Fatal(err)
+	}
+	gt := &database.GitHubToken{UserID: alice.ID, AccessToken: "a", RefreshToken: "r",
+		AccessTokenExpiresAt: time.Now().Add(time.Hour), RefreshTokenExpiresAt: time.Now().Add(time.Hour)}
+	if err := store.UpsertGitHubToken(ctx, gt); err != nil {
+		t.Fatal(err)
+	}
+	for i, expires := range []time.Time{time.Now().Add(time.Hour), time.Now().Add(-48 * time.Hour), time.Now().Add(-72 * time.Hour)} {
+		pt := &database.ProxyToken{TokenHash: fmt.Sprint(i), TokenPrefix: "ghp_test", UserID: alice.ID, GitHubTokenID: gt.ID,
+			Repository: fmt.Sprintf("org/repo%d", i), Scopes: []byte(`{"contents":"read"}`), ExpiresAt: expires}
+		if err := store.CreateProxyToken(ctx, pt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The reconciler archives tokens dead for longer than tokens.archive_after.
+	srv := newTestServer(t)
+	srv.archiveTokens(ctx, store)
+	if archived, _ := store.ListArchivedProxyTokens(ctx, database.ArchiveFilter{}); len(archived) != 0 {
+		t.Fatalf("archived %d tokens with archiving off", len(archived))
+	}
+	srv.cfg.Tokens.ArchiveAfter = 24 * time.Hour
+	srv.archiveTokens(ctx, store)
+
+	session := ah.CreateTestSession("admin-id", "admin", "admin")
+	tests := []struct {
+		query      string
+		wantStatus int
+		wantCount  int
+	}{
+		{"", http.StatusOK, 2},
+		{"?user_id=" + alice.ID, http.StatusOK, 2},
+		{"?repository=org/repo2", http.StatusOK, 1},
+		{"?repository=org/repo0", http.StatusOK, 0},
+		{"?limit=1&offset=1", http.StatusOK, 1},
+		{"?limit=0", http.StatusBadRequest, 0},
+		{"?offset=-1", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/admin/tokens/archive"+tt.query, nil)
+		req.Header.Set("Authorization", "Bearer "+session)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.query, rec.Code, tt.wantStatus)
+			continue
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+		var tokens []*database.ArchivedProxyToken
+		if err := json.NewDecoder(rec.Body).Decode(&tokens); err != nil {
+			t.Fatal(err)
+		}
+		if len(tokens) != tt.wantCount {
+			t.Errorf("%s: got %d tokens, want %d", tt.query, len(tokens), tt.wantCount)
+		}
+	}
+}
+
+func TestStrictAccept(t *testing.T) {
+	mux, _, ah := newTestAPI(t, config.Defaults())
+	session := ah.CreateTestSession("alice-id", "alice", "user")
+
+	tests := []struct {
+		path, accept string
+		strict       bool
+		want         int
+	}{
+		{"/api/tokens", "application/xml", true, http.StatusNotAcceptable},
+		{"/api/tokens", "application/xml", false, http.StatusOK},
+		{"/api/tokens", "", true, http.StatusOK},
+		{"/api/tokens", "application/json", true, http.StatusOK},
+		{"/api/tokens", "text/html, */*;q=0.1", true, http.StatusOK},
+		{"/api/tokens", "application/vnd.github+json", true, http.StatusOK},
+		{"/api/tokens", "application/json;q=0, application/xml", true, http.StatusNotAcceptable},
+		{"/api/audit/export?format=logfmt", "text/plain", true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.Header.Set("Authorization", "Bearer "+session)
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		rec := httptest.NewRecorder()
+		strictAccept(tt.strict, mux).ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s Accept %q (strict %v): status = %d, want %d", tt.path, tt.accept, tt.strict, rec.Code, tt.want)
+		}
+		if tt.want == http.StatusNotAcceptable && !strings.Contains(rec.Body.String(), apierr.NotAcceptable) {
+			t.Errorf("body = %s, want code %s", rec.Body, apierr.NotAcceptable)
+		}
+	}
+
+	// Proxied paths pass through untouched; GitHub decides what it serves.
+	if got := offeredTypes("/api/v3/repos/org/repo"); got != nil {
+		t.Errorf("offeredTypes(proxy path) = %v, want nil", got)
+	}
+}
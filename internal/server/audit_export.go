@@ -0,0 +1,207 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goodtune/ghp/internal/apierr"
+	"github.com/goodtune/ghp/internal/database"
+)
+
+// auditExportFields lists the exportable audit fields in output order.
+// Names match the JSON field names of database.AuditEntry.
+var auditExportFields = []string{
+	"id", "timestamp", "user_id", "proxy_token_id", "action", "method", "path",
+	"repository", "status_code", "duration_ms", "session_id", "metadata",
+}
+
+// auditFieldAliases maps shorthand field names to their canonical names.
+var auditFieldAliases = map[string]string{
+	"status":   "status_code",
+	"duration": "duration_ms",
+	"repo":     "repository",
+}
+
+// handleExportAudit streams every audit entry matching the request's filter
+// as newline-delimited JSON or logfmt, optionally projected to ?fields=.
+func (a *API) handleExportAudit(w http.ResponseWriter, r *http.Request) {
+	filter, err := a.auditFilterFromRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, apierr.InvalidRequest, err.Error())
+		return
+	}
+
+	fields, err := parseAuditFields(r.URL.Query().Get("fields"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, apierr.InvalidRequest, err.Error())
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = a.cfg.Audit.ExportFormat
+	}
+	var write func(io.Writer, *database.AuditEntry, []string) error
+	switch format {
+	case "json":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		write = writeAuditJSON
+	case "logfmt":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		write = writeAuditLogfmt
+	default:
+		writeError(w, http.StatusBadRequest, apierr.InvalidRequest, fmt.Sprintf("Unsupported format %q (must be json or logfmt)", format))
+		return
+	}
+
+	// Page through with the keyset cursor so large exports never use OFFSET.
+	filter.Offset = 0
+	for {
+		entries, err := a.store.ListAuditEntries(r.Context(), filter)
+		if err != nil {
+			// Headers may already be sent; all we can do is stop and log.
+			a.logger.Error("failed to export audit entries", "error", err)
+			return
+		}
+		for _, e := range entries {
+			if err := write(w, e, fields); err != nil {
+				return
+			}
+		}
+		if len(entries) < filter.Limit {
+			return
+		}
+		filter.Cursor = database.AuditCursor(entries[len(entries)-1])
+	}
+}
+
+// parseAuditFields parses a comma-separated field selector. An empty
+// selector selects every field.
+func parseAuditFields(s string) ([]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return auditExportFields, nil
+	}
+	var fields []string
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if canonical, ok := auditFieldAliases[f]; ok {
+			f = canonical
+		}
+		if !isAuditField(f) {
+			return nil, fmt.Errorf("Unknown audit field %q", f)
+		}
+		fields = append(fields, f)
+	}
+	if len(fields) == 0 {
+		return auditExportFields, nil
+	}
+	return fields, nil
+}
+
+func isAuditField(name string) bool {
+	for _, f := range auditExportFields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// auditFieldValue returns the value of the named field, or nil if the field
+// is unknown or unset.
+func auditFieldValue(e *database.AuditEntry, field string) interface{} {
+	switch field {
+	case "id":
+		return e.ID
+	case "timestamp":
+		return e.Timestamp.UTC().Format(time.RFC3339Nano)
+	case "user_id":
+		return e.UserID
+	case "proxy_token_id":
+		if e.ProxyTokenID == nil {
+			return nil
+		}
+		return *e.ProxyTokenID
+	case "action":
+		return e.Action
+	case "method":
+		return e.Method
+	case "path":
+		return e.Path
+	case "repository":
+		return e.Repository
+	case "status_code":
+		return e.StatusCode
+	case "duration_ms":
+		return e.DurationMS
+	case "session_id":
+		return e.SessionID
+	case "metadata":
+		if len(e.Metadata) == 0 {
+			return nil
+		}
+		return e.Metadata
+	}
+	return nil
+}
+
+// writeAuditJSON writes one entry as a JSON object on its own line, with
+// keys in the order requested.
+func writeAuditJSON(w io.Writer, e *database.AuditEntry, fields []string) error {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(f)
+		val, err := json.Marshal(auditFieldValue(e, f))
+		if err != nil {
+			return err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(val)
+	}
+	buf.WriteString("}\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// writeAuditLogfmt writes one entry as a logfmt line.
+func writeAuditLogfmt(w io.Writer, e *database.AuditEntry, fields []string) error {
+	var buf bytes.Buffer
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		var val string
+		switch v := auditFieldValue(e, f).(type) {
+		case nil:
+		case string:
+			val = v
+		case json.RawMessage:
+			val = string(v)
+		default:
+			val = fmt.Sprint(v)
+		}
+		buf.WriteString(f)
+		buf.WriteByte('=')
+		if val == "" || strings.ContainsAny(val, " =\"\t\n") {
+			val = strconv.Quote(val)
+		}
+		buf.WriteString(val)
+	}
+	buf.WriteByte('\n')
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goodtune/ghp/internal/database"
+)
+
+func testAuditEntry() *database.AuditEntry {
+	tokenID := "tok-1"
+	return &database.AuditEntry{
+		ID:           "entry-1",
+		Timestamp:    time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+		UserID:       "user-1",
+		ProxyTokenID: &tokenID,
+		Action:       "proxy_request",
+		Method:       "GET",
+		Path:         "/repos/org/repo/pulls",
+		Repository:   "org/repo",
+		StatusCode:   404,
+		DurationMS:   12,
+		SessionID:    "agent session",
+	}
+}
+
+func TestParseAuditFields(t *testing.T) {
+	fields, err := parseAuditFields("timestamp, action,status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"timestamp", "action", "status_code"}
+	if strings.Join(fields, ",") != strings.Join(want, ",") {
+		t.Errorf("fields = %v, want %v", fields, want)
+	}
+
+	all, err := parseAuditFields("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != len(auditExportFields) {
+		t.Errorf("empty selector returned %d fields, want %d", len(all), len(auditExportFields))
+	}
+
+	if _, err := parseAuditFields("action,token_hash"); err == nil {
+		t.Error("expected error for unknown field")
+	}
+}
+
+func TestWriteAuditJSONProjection(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeAuditJSON(&buf, testAuditEntry(), []string{"timestamp", "action", "status_code"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON %q: %v", buf.String(), err)
+	}
+	if len(got) != 3 {
+		t.Errorf("got %d fields, want 3: %v", len(got), got)
+	}
+	if got["action"] != "proxy_request" || got["status_code"] != float64(404) || got["timestamp"] != "2025-01-02T03:04:05Z" {
+		t.Errorf("unexpected projection: %v", got)
+	}
+	if !strings.HasPrefix(buf.String(), `{"timestamp":`) {
+		t.Errorf("fields not in requested order: %s", buf.String())
+	}
+}
+
+func TestWriteAuditLogfmtProjection(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeAuditLogfmt(&buf, testAuditEntry(), []string{"action", "status_code", "session_id"}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "action=proxy_request status_code=404 session_id=\"agent session\"\n"
+	if buf.String() != want {
+		t.Errorf("logfmt = %q, want %q", buf.String(), want)
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/goodtune/ghp/internal/apierr"
+)
+
+// clientIP returns the address of the client that made r. When the peer is a
+// trusted proxy (or a Unix socket, which only a local proxy can reach), the
+// nearest untrusted address in X-Forwarded-For is used instead. It returns nil
+// if no address can be determined.
+func clientIP(r *http.Request, trusted []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && !inNetworks(ip, trusted) {
+		return ip
+	}
+
+	// Walk X-Forwarded-For from the nearest hop, skipping our own proxies.
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			return nil
+		}
+		ip = hop
+		if !inNetworks(hop, trusted) {
+			break
+		}
+	}
+	return ip
+}
+
+func inNetworks(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requireAdminNetwork refuses requests from clients outside
+// server.admin_allowed_cidrs, before any authentication or role check.
+func (a *API) requireAdminNetwork(next http.Handler) http.Handler {
+	if len(a.adminNets) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := clientIP(r, a.trustedProxies); ip == nil || !inNetworks(ip, a.adminNets) {
+			a.logger.Warn("admin_network_denied", "remote_addr", r.RemoteAddr, "client_ip", ip, "path", r.URL.Path)
+			writeError(w, http.StatusForbidden, apierr.Forbidden, "Admin endpoints are not reachable from your network")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,22 @@
+package server
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// debugServer returns a server for the net/http/pprof endpoints on
+// debug.pprof_listen, or nil when that isn't set. The endpoints get their own
+// mux so they can never leak onto the main listener.
+func (s *Server) debugServer() *http.Server {
+	if s.cfg.Debug.PprofListen == "" {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return &http.Server{Addr: s.cfg.Debug.PprofListen, Handler: mux}
+}
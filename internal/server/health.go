@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// staleAfter is how many of its intervals a background worker may miss
+// before /healthz reports it stalled.
+const staleAfter = 3
+
+// liveness tracks the heartbeats of the server's background workers.
+type liveness struct {
+	mu      sync.Mutex
+	workers map[string]*worker
+}
+
+type worker struct {
+	interval time.Duration
+	lastBeat time.Time
+}
+
+func newLiveness() *liveness {
+	return &liveness{workers: make(map[string]*worker)}
+}
+
+// register starts tracking a worker that beats every interval. It counts as
+// having just beaten, so it isn't stale before its first run.
+func (l *liveness) register(name string, interval time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.workers[name] = &worker{interval: interval, lastBeat: time.Now()}
+}
+
+// beat records that the named worker is alive.
+func (l *liveness) beat(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if w, ok := l.workers[name]; ok {
+		w.lastBeat = time.Now()
+	}
+}
+
+// workerStatus is a worker's entry in the /healthz response.
+type workerStatus struct {
+	Name          string    `json:"name"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+	Stale         bool      `json:"stale"`
+}
+
+// status reports every worker, sorted by name, and whether all are live.
+func (l *liveness) status(now time.Time) ([]workerStatus, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ok := true
+	out := make([]workerStatus, 0, len(l.workers))
+	for name, w := range l.workers {
+		stale := now.Sub(w.lastBeat) > staleAfter*w.interval
+		if stale {
+			ok = false
+		}
+		out = append(out, workerStatus{Name: name, LastHeartbeat: w.lastBeat.UTC(), Stale: stale})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, ok
+}
+
+// handleHealthz reports 200 when every background worker has beaten
+// recently and 503 "degraded" when any has stalled.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	workers, ok := s.live.status(time.Now())
+	status, code := "ok", http.StatusOK
+	if !ok {
+		status, code = "degraded", http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, map[string]any{"status": status, "workers": workers})
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimitListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := newLimitListener(inner, 2)
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 3)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+
+	// Two connections are accepted; the third waits for a free slot.
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		select {
+		case c := <-accepted:
+			conns = append(conns, c)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("connection %d not accepted", i+1)
+		}
+	}
+	select {
+	case <-accepted:
+		t.Fatal("third connection accepted beyond the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Closing one frees its slot for the queued connection.
+	conns[0].Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("queued connection not accepted after a slot freed")
+	}
+	conns[1].Close()
+}
+
+func TestLimitListenerClose(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := newLimitListener(inner, 1)
+
+	c, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	held, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+
+	// An Accept blocked on the limit returns once the listener closes.
+	errc := make(chan error, 1)
+	go func() {
+		_, err := ln.Accept()
+		errc <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	ln.Close()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("Accept after Close returned no error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Accept still blocked after Close")
+	}
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/goodtune/ghp/internal/apierr"
+)
+
+// offeredTypes returns the media types ghp's own API can answer path with,
+// or nil for paths outside it (including the proxied /api/v3/, /api/uploads/
+// and /api/graphql, whose responses come from GitHub).
+func offeredTypes(path string) []string {
+	switch {
+	case !strings.HasPrefix(path, "/api/"),
+		strings.HasPrefix(path, "/api/v3/"),
+		strings.HasPrefix(path, "/api/uploads/"),
+		path == "/api/graphql":
+		return nil
+	case path == "/api/audit/export":
+		return []string{"application/x-ndjson", "text/plain", "application/json"}
+	}
+	return []string{"application/json"}
+}
+
+// strictAccept answers 406 Not Acceptable to API requests whose Accept header
+// rules out every type the endpoint can produce, when server.strict_accept
+// is set. By default the API answers in JSON whatever the client asks for.
+func strictAccept(enabled bool, next http.Handler) http.Handler {
+	if !enabled {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		offered := offeredTypes(r.URL.Path)
+		if offered != nil && !acceptable(r.Header.Values("Accept"), offered) {
+			writeError(w, http.StatusNotAcceptable, apierr.NotAcceptable,
+				"This endpoint can only respond with "+strings.Join(offered, " or "))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// acceptable reports whether the Accept header values admit any of offered.
+// A missing header accepts anything.
+func acceptable(accept []string, offered []string) bool {
+	if len(accept) == 0 {
+		return true
+	}
+	for _, value := range accept {
+		for _, rng := range strings.Split(value, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(rng))
+			if err != nil {
+				continue
+			}
+			if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+				continue
+			}
+			for _, o := range offered {
+				if mediaRangeMatches(mediaType, o) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// mediaRangeMatches reports whether an Accept media range such as "*/*",
+// "text/*" or "application/json" covers mediaType. JSON-based vendor types
+// like application/vnd.github+json are taken to accept plain JSON.
+func mediaRangeMatches(rng, mediaType string) bool {
+	if rng == "*/*" || rng == mediaType {
+		return true
+	}
+	if mediaType == "application/json" && strings.HasPrefix(rng, "application/") && strings.HasSuffix(rng, "+json") {
+		return true
+	}
+	typ, _, _ := strings.Cut(mediaType, "/")
+	return rng == typ+"/*"
+}
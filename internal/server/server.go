@@ -2,13 +2,16 @@ package server
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"strings"
+	"time"
 
 	"github.com/goodtune/ghp/internal/auth"
 	"github.com/goodtune/ghp/internal/config"
@@ -18,37 +21,38 @@ import (
 	"github.com/goodtune/ghp/internal/proxy"
 	"github.com/goodtune/ghp/internal/token"
 	"github.com/goodtune/ghp/internal/web"
+	"github.com/goodtune/ghp/internal/webhook"
 )
 
 // Server is the main ghp server.
 type Server struct {
 	cfg    *config.Config
 	logger *slog.Logger
+	live   *liveness
+	// proxy is the proxy handler built by handler, for background work.
+	proxy *proxy.Handler
 }
 
 // New creates a new Server.
 func New(cfg *config.Config, logger *slog.Logger) *Server {
-	return &Server{cfg: cfg, logger: logger}
+	return &Server{cfg: cfg, logger: logger, live: newLiveness()}
 }
 
 // Run starts the server and blocks until shutdown.
 func (s *Server) Run(ctx context.Context) error {
+	if s.cfg.Proxy.RecordOnly && !s.cfg.DevMode {
+		return fmt.Errorf("proxy.record_only requires dev_mode; it must never be used in production")
+	}
+
+	s.logSettings(ctx)
+
 	// Open database.
-	store, err := database.Open(s.cfg.Database.Driver, s.cfg.Database.DSN)
+	store, err := database.Open(s.cfg.Database)
 	if err != nil {
 		return fmt.Errorf("opening database: %w", err)
 	}
 	defer store.Close()
-
-	// Check for pending migrations.
-	migrator := database.NewMigrator(store, s.cfg.Database.Driver)
-	pending, err := migrator.PendingMigrations(ctx)
-	if err != nil {
-		// If the migration table doesn't exist yet, that counts as pending.
-		s.logger.Warn("could not check migrations", "error", err)
-	} else if len(pending) > 0 {
-		return fmt.Errorf("database has %d pending migration(s): run 'ghp migrate' first", len(pending))
-	}
+	store.SetMaxMetadataBytes(s.cfg.Audit.MaxMetadataBytes)
 
 	// Set up encryption.
 	encKey := s.cfg.EncryptionKey
@@ -62,43 +66,54 @@ func (s *Server) Run(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("initializing encryption: %w", err)
 	}
+	// Before any auto-migration, so a refused dev server leaves the
+	// database untouched.
+	if err := s.checkDevModeData(ctx, store, enc); err != nil {
+		return err
+	}
+	if err := s.prepareDatabase(ctx, store); err != nil {
+		return err
+	}
+	s.checkAdmins(ctx, store)
 
-	// Create services.
-	tokenSvc := token.NewService(store, s.cfg.Tokens.MaxDuration)
-	authHandler := auth.NewHandler(s.cfg, store, enc, s.logger)
-	proxyHandler := proxy.NewHandler(s.cfg, tokenSvc, store, enc, s.logger)
-	api := NewAPI(s.cfg, store, tokenSvc, authHandler, s.logger)
-	webUI := web.NewHandler(authHandler, s.cfg.DevMode, s.logger)
-
-	// Build HTTP mux.
-	mux := http.NewServeMux()
-
-	// Auth routes.
-	authHandler.RegisterRoutes(mux)
-
-	// API routes.
-	api.RegisterRoutes(mux)
-
-	// Web UI routes.
-	webUI.RegisterRoutes(mux)
-
-	// Proxy routes — these catch /api/v3/* and /api/graphql.
-	mux.Handle("/api/v3/", proxyHandler)
-	mux.Handle("/api/graphql", proxyHandler)
+	handler := s.handler(store, enc)
 
 	// Create listener.
 	ln, err := s.createListener()
 	if err != nil {
 		return fmt.Errorf("creating listener: %w", err)
 	}
-
-	httpServer := &http.Server{
-		Handler: hostRoutingHandler(mux, proxyHandler),
+	if n := s.cfg.Server.MaxConnections; n > 0 {
+		ln = newLimitListener(ln, n)
 	}
 
+	httpServer := s.httpServer(handler)
+
 	// Start metrics server if enabled.
 	if s.cfg.Metrics.Enabled {
-		go metrics.Serve(s.cfg.Metrics.Listen, s.logger)
+		if err := metrics.SetLabelMode(s.cfg.Metrics.LabelMode, s.cfg.Metrics.LabelBuckets); err != nil {
+			return fmt.Errorf("configuring metrics: %w", err)
+		}
+		if err := metrics.Serve(s.cfg.Metrics, s.logger); err != nil {
+			return fmt.Errorf("starting metrics server: %w", err)
+		}
+		go s.reconcileMetrics(ctx, store)
+		go s.runEvery(ctx, "user_request_rate", userRateDecayInterval, s.proxy.DecayUserRates)
+	}
+
+	go s.reconcileTokens(ctx, store)
+	go s.pruneAudit(ctx, store)
+	go s.summarizeResponses(ctx)
+
+	// Start the pprof server if configured.
+	if ds := s.debugServer(); ds != nil {
+		go func() {
+			s.logger.Info("debug server starting", "listen", ds.Addr)
+			if err := ds.ListenAndServe(); err != http.ErrServerClosed {
+				s.logger.Error("debug server failed", "error", err)
+			}
+		}()
+		defer ds.Close()
 	}
 
 	// Graceful shutdown.
@@ -119,7 +134,7 @@ func (s *Server) Run(ctx context.Context) error {
 	// Notify systemd if available.
 	notifySystemd("READY=1")
 
-	if err := httpServer.Serve(ln); err != http.ErrServerClosed {
+	if err := s.serve(httpServer, ln); err != http.ErrServerClosed {
 		return fmt.Errorf("server error: %w", err)
 	}
 
@@ -127,6 +142,377 @@ func (s *Server) Run(ctx context.Context) error {
 	return nil
 }
 
+// logSettings logs a one-line summary of the effective configuration at
+// startup, and at debug level the whole configuration with secrets redacted.
+func (s *Server) logSettings(ctx context.Context) {
+	c := s.cfg
+	s.logger.Info("server_config",
+		"driver", c.Database.Driver,
+		"listen", c.Server.Listen,
+		"socket_activation", c.Server.SystemdSocketActivation,
+		"tls", c.Server.TLS.CertFile != "",
+		"dev_mode", c.DevMode,
+		"metrics", c.Metrics.Enabled,
+		"metrics_listen", c.Metrics.Listen,
+		"otel", c.OTEL.Enabled,
+		"pprof_listen", c.Debug.PprofListen,
+		"web", c.Web.Enabled,
+		"webhooks", c.Webhooks.Enabled(),
+		"record_only", c.Proxy.RecordOnly,
+		"default_duration", c.Tokens.DefaultDuration,
+		"max_duration", c.Tokens.MaxDuration,
+	)
+	if s.logger.Enabled(ctx, slog.LevelDebug) {
+		s.logger.Debug("server_config_full", "config", c.Redacted())
+	}
+}
+
+// httpServer returns the http.Server that serves handler, accepting
+// cleartext HTTP/2 (h2c) alongside HTTP/1.1 when server.h2c is set.
+func (s *Server) httpServer(handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Handler: handler,
+	}
+	if s.cfg.Server.H2C {
+		var p http.Protocols
+		p.SetHTTP1(true)
+		p.SetUnencryptedHTTP2(true)
+		srv.Protocols = &p
+	}
+	return srv
+}
+
+// serve serves srv on ln, over TLS when server.tls.cert_file is set.
+func (s *Server) serve(srv *http.Server, ln net.Listener) error {
+	t := s.cfg.Server.TLS
+	if t.CertFile == "" {
+		return srv.Serve(ln)
+	}
+	tlsCfg, err := t.Config()
+	if err != nil {
+		return fmt.Errorf("server.tls: %w", err)
+	}
+	srv.TLSConfig = tlsCfg
+	return srv.ServeTLS(ln, t.CertFile, t.KeyFile)
+}
+
+// handler creates the services and returns the server's routed handler.
+func (s *Server) handler(store database.Store, enc *crypto.Encryptor) http.Handler {
+	// Create services.
+	tokenSvc := token.NewService(store, s.cfg.Tokens.MaxDuration)
+	tokenSvc.SetRevocationGrace(s.cfg.Tokens.RevocationGrace)
+	tokenSvc.SetMaxScopes(s.cfg.Tokens.MaxScopes)
+	tokenSvc.SetAllowMetadataOnly(s.cfg.Tokens.AllowMetadataOnly)
+	tokenSvc.SetSessionIDPolicy(s.cfg.Tokens.SessionIDPolicy)
+	tokenSvc.SetExpiryJitter(s.cfg.Tokens.ExpiryJitter)
+	var policies []token.RepoPolicy
+	for _, p := range s.cfg.Tokens.RepoPolicies {
+		policies = append(policies, token.RepoPolicy{Pattern: p.Repository, MaxLevel: p.MaxLevel, Downgrade: p.Action == "downgrade"})
+	}
+	tokenSvc.SetRepoPolicies(policies)
+	rl := s.cfg.Tokens.RateLimit
+	if err := tokenSvc.SetRateLimit(rl.Requests, rl.Window, rl.Backend); err != nil {
+		s.logger.Error("token rate limit disabled", "error", err)
+	}
+	authHandler := auth.NewHandler(s.cfg, store, enc, s.logger)
+	proxyHandler := proxy.NewHandler(s.cfg, tokenSvc, store, enc, s.logger)
+	s.proxy = proxyHandler
+	if s.cfg.Tokens.VerifyRepository != "off" {
+		tokenSvc.SetRepoCheck(proxyHandler.CheckRepository)
+	}
+	api := NewAPI(s.cfg, store, tokenSvc, authHandler, s.logger)
+	api.endpointScope = proxyHandler.RequiredScope
+	api.permissions = proxyHandler.Permissions
+
+	// Build HTTP mux.
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", s.handleHealthz)
+
+	// Auth routes.
+	authHandler.RegisterRoutes(mux)
+
+	// API routes.
+	api.RegisterRoutes(mux)
+
+	// Web UI routes. Headless deployments leave these unmounted.
+	if s.cfg.Web.Enabled {
+		webHandler := web.NewHandler(s.cfg, authHandler, s.logger)
+		authHandler.SetLoginErrorPage(webHandler.LoginErrorPage)
+		webHandler.RegisterRoutes(mux)
+	} else {
+		s.logger.Info("web UI disabled")
+	}
+
+	// Inbound GitHub webhooks.
+	if s.cfg.Webhooks.Enabled() {
+		webhook.NewHandler(s.cfg, store, s.logger).RegisterRoutes(mux)
+	}
+
+	// Proxy routes — these catch /api/v3/*, /api/graphql and /api/uploads/*.
+	mux.Handle("/api/v3/", proxyHandler)
+	mux.Handle("/api/graphql", proxyHandler)
+	mux.Handle("/api/uploads/", proxyHandler)
+	// Git smart HTTP (/{owner}/{repo}.git/...) is routed around the mux by
+	// proxyHandler.GitRoutes, as its paths overlap the web UI's.
+
+	return securityHeaders(s.cfg.Server.Security, hostRoutingHandler(canonicalHost(s.cfg.Server, accessLog(s.cfg.Logging, s.logger, strictAccept(s.cfg.Server.StrictAccept, proxyHandler.GitRoutes(mux)))), proxyHandler))
+}
+
+// runEvery calls fn every interval until ctx is done, reporting each run to
+// the liveness check under name. A non-positive interval never runs fn.
+func (s *Server) runEvery(ctx context.Context, name string, interval time.Duration, fn func()) {
+	if interval <= 0 {
+		return
+	}
+	s.live.register(name, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fn()
+			s.live.beat(name)
+		}
+	}
+}
+
+// userRateDecayInterval is how often users' request rates are re-estimated
+// between their requests.
+const userRateDecayInterval = 10 * time.Second
+
+// reconcileMetrics sets the database-derived gauges at startup and then every
+// metrics.reconcile_interval, so they don't drift from missed updates.
+func (s *Server) reconcileMetrics(ctx context.Context, store database.Store) {
+	s.updateActiveTokens(ctx, store)
+	s.runEvery(ctx, "reconcile_metrics", s.cfg.Metrics.ReconcileInterval, func() {
+		s.updateActiveTokens(ctx, store)
+	})
+}
+
+func (s *Server) updateActiveTokens(ctx context.Context, store database.Store) {
+	counts, err := store.CountActiveProxyTokensByUser(ctx)
+	if err != nil {
+		s.logger.Warn("could not count active tokens", "error", err)
+		return
+	}
+	metrics.SetActiveTokens(counts)
+}
+
+// summarizeResponses logs the status classes of proxied responses every
+// metrics.response_summary_interval, for a health signal without scraping.
+func (s *Server) summarizeResponses(ctx context.Context) {
+	interval := s.cfg.Metrics.ResponseSummaryInterval
+	s.runEvery(ctx, "response_summary", interval, func() {
+		counts := metrics.TakeResponseClasses()
+		s.logger.Info("proxy_response_summary", "interval", interval.String(),
+			"2xx", counts["2xx"], "3xx", counts["3xx"], "4xx", counts["4xx"], "5xx", counts["5xx"])
+	})
+}
+
+// reconcileTokens revokes tokens of disabled or deleted users, and archives
+// long-dead tokens, at startup and then every tokens.reconcile_interval.
+func (s *Server) reconcileTokens(ctx context.Context, store database.Store) {
+	reconcile := func() {
+		s.revokeOrphanedTokens(ctx, store)
+		s.archiveTokens(ctx, store)
+		s.pruneRateLimits(ctx, store)
+	}
+	reconcile()
+	s.runEvery(ctx, "reconcile_tokens", s.cfg.Tokens.ReconcileInterval, reconcile)
+}
+
+func (s *Server) revokeOrphanedTokens(ctx context.Context, store database.Store) {
+	tokens, err := store.ListOrphanedProxyTokens(ctx)
+	if err != nil {
+		s.logger.Warn("could not list orphaned tokens", "error", err)
+		return
+	}
+	for _, pt := range tokens {
+		if err := store.RevokeProxyToken(ctx, pt.ID); err != nil {
+			s.logger.Warn("could not revoke orphaned token", "token_id", pt.ID, "error", err)
+			continue
+		}
+		metrics.TokenRevoked(pt.UserID)
+		s.logger.Info("token_revoked", "token_id", pt.ID, "user_id", pt.UserID, "reason", "user_disabled")
+
+		// The user may no longer exist, so the entry isn't attributed to them.
+		tokenID := pt.ID
+		meta, _ := json.Marshal(map[string]string{"reason": "user_disabled", "user_id": pt.UserID})
+		store.CreateAuditEntry(ctx, &database.AuditEntry{
+			ProxyTokenID: &tokenID,
+			Action:       "token_revoked",
+			Repository:   pt.Repository,
+			Metadata:     meta,
+		})
+	}
+}
+
+// archiveTokens moves tokens that expired or were revoked more than
+// tokens.archive_after ago into the token archive.
+func (s *Server) archiveTokens(ctx context.Context, store database.Store) {
+	if s.cfg.Tokens.ArchiveAfter <= 0 {
+		return
+	}
+	n, err := store.ArchiveProxyTokens(ctx, time.Now().Add(-s.cfg.Tokens.ArchiveAfter))
+	if err != nil {
+		s.logger.Warn("could not archive tokens", "error", err)
+		return
+	}
+	if n > 0 {
+		s.logger.Info("tokens_archived", "count", n, "archive_after", s.cfg.Tokens.ArchiveAfter.String())
+	}
+}
+
+// pruneRateLimits deletes database rate limit windows that have ended.
+func (s *Server) pruneRateLimits(ctx context.Context, store database.Store) {
+	rl := s.cfg.Tokens.RateLimit
+	if rl.Backend != "db" || rl.Requests <= 0 || rl.Window <= 0 {
+		return
+	}
+	n, err := store.DeleteExpiredRateLimits(ctx, time.Now().Truncate(rl.Window))
+	if err != nil {
+		s.logger.Warn("could not prune rate limits", "error", err)
+		return
+	}
+	if n > 0 {
+		s.logger.Debug("rate_limits_pruned", "count", n)
+	}
+}
+
+// pruneAudit deletes or archives audit entries older than
+// logging.audit_retention at startup and then every
+// logging.audit_prune_interval.
+func (s *Server) pruneAudit(ctx context.Context, store database.Store) {
+	if s.cfg.Logging.AuditRetention <= 0 {
+		return
+	}
+	s.pruneAuditEntries(ctx, store)
+	s.runEvery(ctx, "prune_audit", s.cfg.Logging.AuditPruneInterval, func() {
+		s.pruneAuditEntries(ctx, store)
+	})
+}
+
+func (s *Server) pruneAuditEntries(ctx context.Context, store database.Store) {
+	action := s.cfg.Logging.AuditRetentionAction
+	n, err := store.PruneAuditEntries(ctx, time.Now().Add(-s.cfg.Logging.AuditRetention), action == "archive")
+	metrics.AuditPruned(action, n)
+	if err != nil {
+		s.logger.Warn("could not prune audit log", "pruned", n, "error", err)
+		return
+	}
+	if n > 0 {
+		s.logger.Info("audit_pruned", "count", n, "action", action, "retention", s.cfg.Logging.AuditRetention.String())
+	}
+}
+
+// prepareDatabase makes sure the schema is current before serving. Pending
+// migrations are applied when database.auto_migrate is set; otherwise they
+// stop the server so they can be run deliberately with 'ghp migrate'.
+func (s *Server) prepareDatabase(ctx context.Context, store database.Store) error {
+	migrator := database.NewMigrator(store, s.cfg.Database.Driver)
+
+	if s.cfg.Database.AutoMigrate {
+		applied, err := migrator.Apply(ctx)
+		for _, name := range applied {
+			s.logger.Info("migration_applied", "name", name)
+		}
+		if err != nil {
+			return fmt.Errorf("auto-migrating database: %w", err)
+		}
+	}
+
+	// Check for pending migrations.
+	pending, err := s.checkMigrations(ctx, migrator)
+	if err != nil {
+		// If the migration table doesn't exist yet, that counts as pending.
+		s.logger.Warn("could not check migrations", "error", err)
+	} else if len(pending) > 0 {
+		return fmt.Errorf("database has %d pending migration(s): run 'ghp migrate' first", len(pending))
+	}
+	return nil
+}
+
+// checkDevModeData refuses dev mode against a database holding real GitHub
+// tokens: any stored token other than a test login's, including ones the key
+// can't decrypt. dev_mode_allow_real_data turns the check off. It runs before
+// migrations, so a database without any applied migration counts as empty.
+func (s *Server) checkDevModeData(ctx context.Context, store database.Store, enc *crypto.Encryptor) error {
+	if !s.cfg.DevMode || s.cfg.DevModeAllowRealData {
+		return nil
+	}
+	if executor, ok := store.(database.MigrationExecutor); ok {
+		// A brand new database has no migrations table yet; create it, as
+		// the migrator would, so that case reads as empty rather than failing.
+		if err := executor.EnsureMigrationsTable(ctx); err != nil {
+			return fmt.Errorf("checking for real data: %w", err)
+		}
+		applied, err := executor.AppliedMigrations(ctx)
+		if err != nil {
+			return fmt.Errorf("checking for real data: %w", err)
+		}
+		if len(applied) == 0 {
+			return nil
+		}
+	}
+	tokens, err := store.ListGitHubTokens(ctx)
+	if err != nil {
+		return fmt.Errorf("checking for real data: %w", err)
+	}
+	var real int
+	for _, gt := range tokens {
+		if plain, err := enc.Decrypt(gt.AccessToken); err != nil || plain != auth.TestGitHubToken {
+			real++
+		}
+	}
+	if real > 0 {
+		return fmt.Errorf("dev_mode refused: the database holds %d real GitHub token(s); use a separate database for development (or set dev_mode_allow_real_data)", real)
+	}
+	return nil
+}
+
+// checkAdmins logs the configured admins, warning when there are none and
+// nothing else can grant the admin role: no existing admin users and no dev
+// mode test logins. Admin status is granted on login, so a typo in the list
+// otherwise goes unnoticed until someone needs it.
+func (s *Server) checkAdmins(ctx context.Context, store database.Store) {
+	if len(s.cfg.Admins) > 0 || len(s.cfg.Auth.AdminTeams) > 0 {
+		s.logger.Info("admins_configured", "admins", strings.Join(s.cfg.Admins, ","),
+			"teams", strings.Join(s.cfg.Auth.AdminTeams, ","))
+		return
+	}
+	if s.cfg.DevMode {
+		return
+	}
+	users, err := store.ListUsers(ctx)
+	if err != nil {
+		s.logger.Warn("could not check for admin users", "error", err)
+		return
+	}
+	for _, u := range users {
+		if u.Role == "admin" {
+			return
+		}
+	}
+	s.logger.Warn("no_admins", "msg", "no admins configured and no admin users exist; set admins (GHP_ADMINS) to grant the admin role on login")
+}
+
+// checkMigrations reports the pending migrations, publishing the count on
+// the ghp_pending_migrations gauge and logging their names so drift is
+// visible even where migrations are applied out of band.
+func (s *Server) checkMigrations(ctx context.Context, migrator *database.Migrator) ([]string, error) {
+	pending, err := migrator.PendingMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	metrics.PendingMigrations.Set(float64(len(pending)))
+	if len(pending) > 0 {
+		s.logger.Warn("pending_migrations", "count", len(pending), "names", pending)
+	}
+	return pending, nil
+}
+
 func (s *Server) createListener() (net.Listener, error) {
 	addr := s.cfg.Server.Listen
 
@@ -154,7 +540,7 @@ func (s *Server) createListener() (net.Listener, error) {
 // If the host is api.github.com (as when ghp is deployed as a virtualhost),
 // all requests are sent directly to the proxy handler. Otherwise, the
 // standard mux is used.
-func hostRoutingHandler(mux *http.ServeMux, proxyHandler http.Handler) http.Handler {
+func hostRoutingHandler(mux, proxyHandler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		host := r.Host
 		if h, _, err := net.SplitHostPort(host); err == nil {
@@ -168,6 +554,62 @@ func hostRoutingHandler(mux *http.ServeMux, proxyHandler http.Handler) http.Hand
 	})
 }
 
+// canonicalHost redirects requests for hosts other than
+// server.canonical_host to the same path on it, keeping cookies and OAuth
+// redirects on one origin. Health checks are answered on any host. The
+// redirect uses the scheme of server.base_url, or else of the request.
+func canonicalHost(cfg config.ServerConfig, next http.Handler) http.Handler {
+	canonical := strings.ToLower(cfg.CanonicalHost)
+	if canonical == "" {
+		return next
+	}
+	scheme := ""
+	if u, err := url.Parse(cfg.BaseURL); err == nil {
+		scheme = u.Scheme
+	}
+	_, _, withPort := net.SplitHostPort(canonical)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := strings.ToLower(r.Host)
+		if withPort != nil {
+			// The canonical host has no port, so any port matches.
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+		}
+		if host == canonical || r.URL.Path == "/healthz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		target := *r.URL
+		target.Host = cfg.CanonicalHost
+		target.Scheme = scheme
+		if target.Scheme == "" {
+			target.Scheme = "http"
+			if r.TLS != nil {
+				target.Scheme = "https"
+			}
+		}
+		http.Redirect(w, r, target.String(), http.StatusPermanentRedirect)
+	})
+}
+
+// securityHeaders adds Strict-Transport-Security to responses to HTTPS
+// requests when server.security.hsts is enabled. Requests count as HTTPS if
+// they arrived over TLS or a TLS-terminating ingress says so in
+// X-Forwarded-Proto.
+func securityHeaders(cfg config.SecurityConfig, next http.Handler) http.Handler {
+	if !cfg.HSTS {
+		return next
+	}
+	hsts := fmt.Sprintf("max-age=%d; includeSubDomains", int64(cfg.HSTSMaxAge.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+			w.Header().Set("Strict-Transport-Security", hsts)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func notifySystemd(state string) {
 	socketPath := os.Getenv("NOTIFY_SOCKET")
 	if socketPath == "" {
@@ -0,0 +1,733 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goodtune/ghp/internal/auth"
+	"github.com/goodtune/ghp/internal/config"
+	"github.com/goodtune/ghp/internal/crypto"
+	"github.com/goodtune/ghp/internal/database"
+	"github.com/goodtune/ghp/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	return New(config.Defaults(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+// newTestStore returns a migrated SQLite store.
+func newTestStore(t *testing.T) *database.SQLiteStore {
+	t.Helper()
+	ctx := context.Background()
+	store, err := database.NewSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if err := store.EnsureMigrationsTable(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.NewMigrator(store, "sqlite").Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestWebUIDisabled(t *testing.T) {
+	tests := []struct {
+		path     string
+		enabled  int // status with the web UI enabled
+		disabled int // status with it disabled
+	}{
+		{"/login", http.StatusOK, http.StatusNotFound},
+		{"/admin", http.StatusSeeOther, http.StatusNotFound},
+		{"/api/tokens", http.StatusUnauthorized, http.StatusUnauthorized},
+		{"/auth/status", http.StatusUnauthorized, http.StatusUnauthorized},
+	}
+
+	for _, enabled := range []bool{true, false} {
+		s := newTestServer(t)
+		s.cfg.Web.Enabled = enabled
+		h := s.handler(newTestStore(t), nil)
+
+		for _, tt := range tests {
+			want := tt.enabled
+			if !enabled {
+				want = tt.disabled
+			}
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != want {
+				t.Errorf("web.enabled=%v: GET %s = %d, want %d", enabled, tt.path, rec.Code, want)
+			}
+		}
+	}
+}
+
+func TestCheckMigrationsSetsPendingGauge(t *testing.T) {
+	ctx := context.Background()
+	store, err := database.NewSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.EnsureMigrationsTable(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := newTestServer(t)
+	migrator := database.NewMigrator(store, "sqlite")
+
+	statuses, err := migrator.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := srv.checkMigrations(ctx, migrator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != len(statuses) {
+		t.Fatalf("pending = %d, want %d", len(pending), len(statuses))
+	}
+	if got := testutil.ToFloat64(metrics.PendingMigrations); got != float64(len(statuses)) {
+		t.Errorf("ghp_pending_migrations = %v, want %d", got, len(statuses))
+	}
+
+	if err := migrator.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.checkMigrations(ctx, migrator); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(metrics.PendingMigrations); got != 0 {
+		t.Errorf("ghp_pending_migrations after migrate = %v, want 0", got)
+	}
+}
+
+func TestPrepareDatabaseAutoMigrate(t *testing.T) {
+	ctx := context.Background()
+	openStore := func(t *testing.T) *database.SQLiteStore {
+		store, err := database.NewSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	}
+
+	t.Run("default refuses", func(t *testing.T) {
+		store := openStore(t)
+		if err := store.EnsureMigrationsTable(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := newTestServer(t).prepareDatabase(ctx, store); err == nil {
+			t.Fatal("prepareDatabase succeeded with pending migrations")
+		}
+		pending, err := database.NewMigrator(store, "sqlite").PendingMigrations(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) == 0 {
+			t.Error("migrations were applied without auto_migrate")
+		}
+	})
+
+	t.Run("auto_migrate applies", func(t *testing.T) {
+		store := openStore(t)
+		srv := newTestServer(t)
+		srv.cfg.Database.AutoMigrate = true
+		if err := srv.prepareDatabase(ctx, store); err != nil {
+			t.Fatalf("prepareDatabase: %v", err)
+		}
+		pending, err := database.NewMigrator(store, "sqlite").PendingMigrations(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) != 0 {
+			t.Errorf("pending after auto-migrate = %v", pending)
+		}
+		// The server can start against the migrated store.
+		rec := httptest.NewRecorder()
+		srv.handler(store, nil).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/login", nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET /login = %d, want 200", rec.Code)
+		}
+	})
+}
+
+func TestCheckAdmins(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name     string
+		admins   []string
+		devMode  bool
+		seed     bool
+		wantWarn bool
+	}{
+		{"empty list", nil, false, false, true},
+		{"configured", []string{"alice"}, false, false, false},
+		{"dev mode", nil, true, false, false},
+		{"existing admin user", nil, false, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			cfg := config.Defaults()
+			cfg.Admins = tt.admins
+			cfg.DevMode = tt.devMode
+			srv := New(cfg, slog.New(slog.NewTextHandler(&buf, nil)))
+
+			store := newTestStore(t)
+			if tt.seed {
+				if err := store.UpsertUser(ctx, &database.User{GitHubID: 1, GitHubUsername: "root", Role: "admin"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			srv.checkAdmins(ctx, store)
+
+			if got := strings.Contains(buf.String(), "no_admins"); got != tt.wantWarn {
+				t.Errorf("warned = %v, want %v; log:\n%s", got, tt.wantWarn, buf.String())
+			}
+			if len(tt.admins) > 0 && !strings.Contains(buf.String(), "alice") {
+				t.Errorf("configured admins not logged; log:\n%s", buf.String())
+			}
+		})
+	}
+}
+
+func TestHTTPServerH2C(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		srv := newTestServer(t)
+		srv.cfg.Server.H2C = enabled
+		hs := srv.httpServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Proto))
+		}))
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go hs.Serve(ln)
+		t.Cleanup(func() { hs.Close() })
+
+		var p http.Protocols
+		p.SetUnencryptedHTTP2(true)
+		client := &http.Client{Transport: &http.Transport{Protocols: &p}}
+		resp, err := client.Get("http://" + ln.Addr().String() + "/")
+		if !enabled {
+			if err == nil {
+				resp.Body.Close()
+				t.Error("h2c request succeeded with server.h2c disabled")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("h2c request: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.ProtoMajor != 2 || string(body) != "HTTP/2.0" {
+			t.Errorf("proto = %s, handler saw %q; want HTTP/2.0", resp.Proto, body)
+		}
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name     string
+		hsts     bool
+		proto    string
+		wantHSTS bool
+	}{
+		{"disabled", false, "https", false},
+		{"enabled over https ingress", true, "https", true},
+		{"enabled over plain http", true, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := securityHeaders(config.SecurityConfig{HSTS: tt.hsts, HSTSMaxAge: time.Hour}, ok)
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.proto != "" {
+				req.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			got := rec.Header().Get("Strict-Transport-Security")
+			if tt.wantHSTS && got != "max-age=3600; includeSubDomains" {
+				t.Errorf("Strict-Transport-Security = %q, want max-age=3600", got)
+			}
+			if !tt.wantHSTS && got != "" {
+				t.Errorf("Strict-Transport-Security = %q, want none", got)
+			}
+		})
+	}
+}
+
+func TestDebugServer(t *testing.T) {
+	s := newTestServer(t)
+	if ds := s.debugServer(); ds != nil {
+		t.Fatalf("debug server configured by default on %q", ds.Addr)
+	}
+
+	s.cfg.Debug.PprofListen = "127.0.0.1:6060"
+	ds := s.debugServer()
+	if ds == nil {
+		t.Fatal("debug server not configured")
+	}
+	rec := httptest.NewRecorder()
+	ds.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("debug server /debug/pprof/ status = %d, want 200", rec.Code)
+	}
+
+	// Profiling must never be reachable through the main listener.
+	rec = httptest.NewRecorder()
+	s.handler(newTestStore(t), nil).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))
+	if rec.Code == http.StatusOK {
+		t.Error("main handler served /debug/pprof/")
+	}
+}
+
+func TestRunRefusesRecordOnlyWithoutDevMode(t *testing.T) {
+	s := newTestServer(t)
+	s.cfg.Proxy.RecordOnly = true
+	err := s.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "dev_mode") {
+		t.Fatalf("Run error = %v, want dev_mode refusal", err)
+	}
+}
+
+func TestCheckDevModeData(t *testing.T) {
+	ctx := context.Background()
+	enc, err := crypto.NewEncryptor(strings.Repeat("ab", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed := func(store *database.SQLiteStore, githubID int64, accessToken string) {
+		t.Helper()
+		user := &database.User{GitHubID: githubID, GitHubUsername: fmt.Sprintf("user%d", githubID), Role: "user"}
+		if err := store.UpsertUser(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+		encrypted, _ := enc.Encrypt(accessToken)
+		gt := &database.GitHubToken{UserID: user.ID, AccessToken: encrypted, RefreshToken: encrypted,
+			AccessTokenExpiresAt: time.Now().Add(time.Hour), RefreshTokenExpiresAt: time.Now().Add(time.Hour)}
+		if err := store.UpsertGitHubToken(ctx, gt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := newTestServer(t)
+	s.cfg.DevMode = true
+
+	empty := newTestStore(t)
+	if err := s.checkDevModeData(ctx, empty, enc); err != nil {
+		t.Errorf("empty database: %v", err)
+	}
+
+	// A brand new database is checked before it's migrated.
+	fresh, err := database.NewSQLiteStore(filepath.Join(t.TempDir(), "fresh.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Close()
+	if err := s.checkDevModeData(ctx, fresh, enc); err != nil {
+		t.Errorf("unmigrated database: %v", err)
+	}
+
+	// Test logins' stand-in tokens aren't real data.
+	testOnly := newTestStore(t)
+	seed(testOnly, 900001, auth.TestGitHubToken)
+	if err := s.checkDevModeData(ctx, testOnly, enc); err != nil {
+		t.Errorf("test logins only: %v", err)
+	}
+
+	populated := newTestStore(t)
+	seed(populated, 1, auth.TestGitHubToken)
+	seed(populated, 2, "gho_real")
+	if err := s.checkDevModeData(ctx, populated, enc); err == nil || !strings.Contains(err.Error(), "1 real GitHub token") {
+		t.Errorf("populated database: err = %v, want refusal", err)
+	}
+
+	s.cfg.DevModeAllowRealData = true
+	if err := s.checkDevModeData(ctx, populated, enc); err != nil {
+		t.Errorf("dev_mode_allow_real_data: %v", err)
+	}
+	s.cfg.DevModeAllowRealData = false
+
+	// A database that can't be read isn't assumed to be empty.
+	closed := newTestStore(t)
+	seed(closed, 3, "gho_real")
+	closed.Close()
+	if err := s.checkDevModeData(ctx, closed, enc); err == nil {
+		t.Error("unreadable database: want an error")
+	}
+
+	s.cfg.DevMode = false
+	if err := s.checkDevModeData(ctx, populated, enc); err != nil {
+		t.Errorf("without dev mode: %v", err)
+	}
+}
+
+func TestCanonicalHost(t *testing.T) {
+	s := newTestServer(t)
+	s.cfg.Server.CanonicalHost = "ghp.example.com"
+	s.cfg.Server.BaseURL = "https://ghp.example.com"
+	h := s.handler(newTestStore(t), nil)
+
+	tests := []struct {
+		host, path   string
+		wantLocation string
+	}{
+		{"other.example.com", "/login?next=%2Fadmin", "https://ghp.example.com/login?next=%2Fadmin"},
+		{"GHP.example.com", "/login", ""},
+		{"ghp.example.com:8443", "/login", ""},
+		// Health checks and the proxy virtualhost are exempt.
+		{"10.0.0.5:8080", "/healthz", ""},
+		{"api.github.com", "/user", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		req.Host = tt.host
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if tt.wantLocation == "" {
+			if rec.Code == http.StatusPermanentRedirect {
+				t.Errorf("%s%s: redirected to %s, want it served", tt.host, tt.path, rec.Header().Get("Location"))
+			}
+			continue
+		}
+		if rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Location") != tt.wantLocation {
+			t.Errorf("%s%s: %d to %q, want 308 to %q", tt.host, tt.path, rec.Code, rec.Header().Get("Location"), tt.wantLocation)
+		}
+	}
+}
+
+func TestServeTLSMinVersion(t *testing.T) {
+	s := newTestServer(t)
+	s.cfg.Server.TLS.CertFile, s.cfg.Server.TLS.KeyFile = writeTestCert(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := s.httpServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	go s.serve(srv, ln)
+	defer srv.Close()
+
+	get := func(version uint16) error {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			MinVersion:         version,
+			MaxVersion:         version,
+		}}}
+		resp, err := client.Get("https://" + ln.Addr().String())
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	if err := get(tls.VersionTLS12); err != nil {
+		t.Fatalf("TLS 1.2 client: %v", err)
+	}
+	if err := get(tls.VersionTLS10); err == nil {
+		t.Error("TLS 1.0 client connected, want handshake failure")
+	}
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its key,
+// returning their paths.
+func writeTestCert(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestRevokeOrphanedTokens(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	srv := newTestServer(t)
+
+	tokens := make(map[string]string) // username -> proxy token ID
+	users := make(map[string]*database.User)
+	for i, name := range []string{"alice", "bob"} {
+		u := &database.User{GitHubID: int64(i + 1), GitHubUsername: name, Role: "user"}
+		if err := store.UpsertUser(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+		gt := &database.GitHubToken{UserID: u.ID, AccessToken: "a", RefreshToken: "r",
+			AccessTokenExpiresAt: time.Now().Add(time.Hour), RefreshTokenExpiresAt: time.Now().Add(time.Hour)}
+		if err := store.UpsertGitHubToken(ctx, gt); err != nil {
+			t.Fatal(err)
+		}
+		pt := &database.ProxyToken{TokenHash: name, TokenPrefix: "ghp_" + name, UserID: u.ID, GitHubTokenID: gt.ID,
+			Repository: "org/repo", Scopes: []byte(`{"contents":"read"}`), ExpiresAt: time.Now().Add(time.Hour)}
+		if err := store.CreateProxyToken(ctx, pt); err != nil {
+			t.Fatal(err)
+		}
+		users[name], tokens[name] = u, pt.ID
+	}
+
+	if err := store.SetUserDisabled(ctx, users["bob"].ID, true); err != nil {
+		t.Fatal(err)
+	}
+	srv.revokeOrphanedTokens(ctx, store)
+
+	for name, wantRevoked := range map[string]bool{"alice": false, "bob": true} {
+		pt, err := store.GetProxyTokenByID(ctx, tokens[name])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (pt.RevokedAt != nil) != wantRevoked {
+			t.Errorf("%s's token revoked = %v, want %v", name, pt.RevokedAt != nil, wantRevoked)
+		}
+	}
+	entries, err := store.ListAuditEntries(ctx, database.AuditFilter{Action: "token_revoked"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ProxyTokenID == nil || *entries[0].ProxyTokenID != tokens["bob"] {
+		t.Errorf("audit entries = %+v, want one for bob's token", entries)
+	}
+
+	// A re-enabled user's new tokens are left alone.
+	if err := store.SetUserDisabled(ctx, users["bob"].ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if orphaned, err := store.ListOrphanedProxyTokens(ctx); err != nil || len(orphaned) != 0 {
+		t.Errorf("orphaned = %v, %v; want none", orphaned, err)
+	}
+}
+
+func TestPruneAuditEntries(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	srv := newTestServer(t)
+
+	if err := store.CreateAuditEntry(ctx, &database.AuditEntry{Action: "webhook"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Entries younger than the retention period are kept.
+	srv.cfg.Logging.AuditRetention = time.Hour
+	srv.cfg.Logging.AuditRetentionAction = "archive"
+	srv.pruneAuditEntries(ctx, store)
+	if got := testutil.ToFloat64(metrics.AuditPrunedLastCycle); got != 0 {
+		t.Errorf("pruned last cycle = %v, want 0", got)
+	}
+
+	// A negligible retention period prunes them.
+	srv.cfg.Logging.AuditRetention = time.Nanosecond
+	before := testutil.ToFloat64(metrics.AuditPrunedTotal.WithLabelValues("archive"))
+	srv.pruneAuditEntries(ctx, store)
+	if got := testutil.ToFloat64(metrics.AuditPrunedLastCycle); got != 1 {
+		t.Errorf("pruned last cycle = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(metrics.AuditPrunedTotal.WithLabelValues("archive")) - before; got != 1 {
+		t.Errorf("archived total grew by %v, want 1", got)
+	}
+	if entries, _ := store.ListAuditEntries(ctx, database.AuditFilter{}); len(entries) != 0 {
+		t.Errorf("%d audit entries left, want 0", len(entries))
+	}
+}
+
+func TestHealthzReportsStalledWorker(t *testing.T) {
+	srv := newTestServer(t)
+	srv.live.register("busy", time.Hour)
+
+	rec := httptest.NewRecorder()
+	srv.handleHealthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"status":"ok"`) {
+		t.Fatalf("live workers: %d %s", rec.Code, rec.Body)
+	}
+
+	// A worker that misses its beats is reported, and degrades the whole check.
+	srv.live.register("stalled", time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	srv.live.beat("busy")
+	rec = httptest.NewRecorder()
+	srv.handleHealthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", rec.Code)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, `"status":"degraded"`) || !strings.Contains(body, `"name":"stalled","last_heartbeat":`) {
+		t.Errorf("body = %s", body)
+	}
+}
+
+func TestRunEvery(t *testing.T) {
+	srv := newTestServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// A disabled interval returns at once without registering a worker.
+	srv.runEvery(ctx, "disabled", 0, func() { t.Error("disabled worker ran") })
+	if workers, _ := srv.live.status(time.Now()); len(workers) != 0 {
+		t.Errorf("workers = %+v, want none", workers)
+	}
+
+	runs := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		srv.runEvery(ctx, "tick", time.Millisecond, func() {
+			select {
+			case runs <- struct{}{}:
+			default:
+			}
+		})
+		close(done)
+	}()
+	<-runs
+	<-runs
+	cancel()
+	<-done
+	if workers, _ := srv.live.status(time.Now()); len(workers) != 1 || workers[0].Name != "tick" {
+		t.Errorf("workers = %+v, want tick", workers)
+	}
+}
+
+func TestLogSettings(t *testing.T) {
+	cfg := config.Defaults()
+	cfg.DevMode = true
+	cfg.GitHub.ClientSecret = "client-secret"
+
+	var buf bytes.Buffer
+	New(cfg, slog.New(slog.NewTextHandler(&buf, nil))).logSettings(context.Background())
+	out := buf.String()
+	for _, want := range []string{"msg=server_config", "driver=sqlite", "listen=", "dev_mode=true", "metrics=", "otel=false", "max_duration="} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "server_config_full") {
+		t.Errorf("full configuration logged at info level:\n%s", out)
+	}
+
+	buf.Reset()
+	New(cfg, slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))).logSettings(context.Background())
+	out = buf.String()
+	if !strings.Contains(out, "server_config_full") || !strings.Contains(out, "client_secret:***") {
+		t.Errorf("debug log lacks the redacted configuration:\n%s", out)
+	}
+	if strings.Contains(out, "client-secret") {
+		t.Errorf("secret leaked into the log:\n%s", out)
+	}
+}
+
+func TestRequestClass(t *testing.T) {
+	tests := map[string]string{
+		"/api/v3/repos/org/repo":                        "",
+		"/api/uploads/repos/org/repo/releases/1/assets": "",
+		"/api/graphql":                                  "",
+		"/org/repo.git/info/refs":                       "",
+		"/org/repo.git/git-upload-pack":                 "",
+		"/healthz":                                      "",
+		"/api/tokens":                                   "api",
+		"/auth/status":                                  "auth",
+		"/tokens":                                       "web",
+		"/org/repo.git":                                 "web",
+	}
+	for path, want := range tests {
+		if got := requestClass(path); got != want {
+			t.Errorf("requestClass(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestConcurrentTestLogin(t *testing.T) {
+	ctx := context.Background()
+	cfg := config.Defaults()
+	cfg.DevMode = true
+	store := newTestStore(t)
+	enc, err := crypto.NewEncryptor(strings.Repeat("ab", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	auth.NewHandler(cfg, store, enc, slog.New(slog.NewTextHandler(io.Discard, nil))).RegisterRoutes(mux)
+
+	const n = 20
+	var wg sync.WaitGroup
+	codes := make([]int, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := httptest.NewRequest("POST", "/auth/test-login", strings.NewReader(`{"username":"e2e"}`))
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			codes[i] = rec.Code
+		}(i)
+	}
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("login %d: status = %d", i, code)
+		}
+	}
+
+	users, err := store.ListUsers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 {
+		t.Fatalf("got %d users, want 1", len(users))
+	}
+	gt, err := store.GetGitHubToken(ctx, users[0].ID)
+	if err != nil || gt == nil {
+		t.Fatalf("GetGitHubToken = %v, %v", gt, err)
+	}
+	if got, err := enc.Decrypt(gt.AccessToken); err != nil || got != "gho_test_dummy_token" {
+		t.Errorf("access token = %q, %v", got, err)
+	}
+}
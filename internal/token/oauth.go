@@ -0,0 +1,40 @@
+package token
+
+import (
+	"sort"
+	"strings"
+)
+
+// MissingOAuthScopes returns the GitHub OAuth scopes that the proxy scopes
+// imply but granted (a GitHub token's comma- or space-separated scope list)
+// lacks, sorted. An empty granted list means the scopes are unknown, as for
+// GitHub App user-to-server tokens, and nothing is reported missing.
+func MissingOAuthScopes(granted string, scopes map[string]string) []string {
+	if strings.TrimSpace(granted) == "" {
+		return nil
+	}
+	have := make(map[string]bool)
+	for _, s := range strings.FieldsFunc(granted, func(r rune) bool { return r == ',' || r == ' ' }) {
+		have[s] = true
+	}
+
+	need := make(map[string]bool)
+	for permission, level := range scopes {
+		// Every repository permission needs repo; public_repo covers reads
+		// (private repositories aside).
+		if !have["repo"] && !(level == "read" && have["public_repo"]) {
+			need["repo"] = true
+		}
+		// Changing workflow files additionally needs the workflow scope.
+		if permission == "workflows" && level == "write" && !have["workflow"] {
+			need["workflow"] = true
+		}
+	}
+
+	var missing []string
+	for s := range need {
+		missing = append(missing, s)
+	}
+	sort.Strings(missing)
+	return missing
+}
@@ -0,0 +1,28 @@
+package token
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMissingOAuthScopes(t *testing.T) {
+	tests := []struct {
+		granted string
+		scopes  map[string]string
+		want    []string
+	}{
+		{"", map[string]string{"contents": "write"}, nil},
+		{"repo", map[string]string{"contents": "write", "pulls": "write"}, nil},
+		{"read:user", map[string]string{"contents": "write"}, []string{"repo"}},
+		{"public_repo", map[string]string{"contents": "read"}, nil},
+		{"public_repo", map[string]string{"contents": "write"}, []string{"repo"}},
+		{"repo", map[string]string{"workflows": "write"}, []string{"workflow"}},
+		{"repo, workflow", map[string]string{"workflows": "write"}, nil},
+		{"gist", map[string]string{"workflows": "write"}, []string{"repo", "workflow"}},
+	}
+	for _, tt := range tests {
+		if got := MissingOAuthScopes(tt.granted, tt.scopes); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("MissingOAuthScopes(%q, %v) = %q, want %q", tt.granted, tt.scopes, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package token
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/goodtune/ghp/internal/database"
+)
+
+// Rate limit backends.
+const (
+	RateLimitMemory = "memory"
+	RateLimitDB     = "db"
+)
+
+// rateLimiter counts requests per key in fixed windows.
+type rateLimiter interface {
+	// increment counts a request against key in the window starting at
+	// start and returns the window's count so far.
+	increment(ctx context.Context, key string, start time.Time) (int64, error)
+}
+
+// memoryLimiter keeps counters in process, so each replica enforces the
+// limit separately.
+type memoryLimiter struct {
+	mu      sync.Mutex
+	windows map[string]memoryWindow
+}
+
+type memoryWindow struct {
+	start time.Time
+	count int64
+}
+
+func (m *memoryLimiter) increment(_ context.Context, key string, start time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w := m.windows[key]
+	if start.After(w.start) {
+		// Drop counters from past windows so the map doesn't grow with
+		// every token ever seen.
+		for k, old := range m.windows {
+			if old.start.Before(start) {
+				delete(m.windows, k)
+			}
+		}
+		w = memoryWindow{start: start}
+	}
+	w.count++
+	m.windows[key] = w
+	return w.count, nil
+}
+
+// storeLimiter keeps counters in the database, so every replica sharing it
+// enforces one cluster-wide limit.
+type storeLimiter struct {
+	store database.Store
+}
+
+func (s storeLimiter) increment(ctx context.Context, key string, start time.Time) (int64, error) {
+	return s.store.IncrementRateLimit(ctx, key, start)
+}
+
+// SetRateLimit limits each token to requests per window, counted by the
+// given backend: "memory" (per replica) or "db" (shared through the store).
+// A zero requests or window disables rate limiting.
+func (s *Service) SetRateLimit(requests int, window time.Duration, backend string) error {
+	if requests <= 0 || window <= 0 {
+		s.limiter = nil
+		return nil
+	}
+	switch backend {
+	case "", RateLimitMemory:
+		s.limiter = &memoryLimiter{windows: make(map[string]memoryWindow)}
+	case RateLimitDB:
+		s.limiter = storeLimiter{store: s.store}
+	default:
+		return fmt.Errorf("unknown rate limit backend %q (want memory or db)", backend)
+	}
+	s.rateLimit, s.rateWindow = int64(requests), window
+	return nil
+}
+
+// Allow counts a request made with the given token and reports whether it
+// is within the rate limit, along with when the current window resets.
+func (s *Service) Allow(ctx context.Context, tokenID string) (bool, time.Time, error) {
+	if s.limiter == nil {
+		return true, time.Time{}, nil
+	}
+	start := time.Now().Truncate(s.rateWindow)
+	n, err := s.limiter.increment(ctx, "token:"+tokenID, start)
+	if err != nil {
+		return false, time.Time{}, fmt.Errorf("counting request: %w", err)
+	}
+	return n <= s.rateLimit, start.Add(s.rateWindow), nil
+}
@@ -0,0 +1,68 @@
+package token
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimitBackends(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		backend string
+		// allowed is how many of six requests, alternating between two
+		// services sharing a store, are let through.
+		allowed int
+	}{
+		{RateLimitMemory, 6}, // Each service counts its own three.
+		{RateLimitDB, 3},     // One limit across both.
+	}
+	for _, tt := range tests {
+		t.Run(tt.backend, func(t *testing.T) {
+			store, _, _ := newTestStore(t)
+			var services []*Service
+			for i := 0; i < 2; i++ {
+				svc := NewService(store, 24*time.Hour)
+				if err := svc.SetRateLimit(3, time.Hour, tt.backend); err != nil {
+					t.Fatal(err)
+				}
+				services = append(services, svc)
+			}
+
+			allowed := 0
+			for i := 0; i < 6; i++ {
+				ok, reset, err := services[i%2].Allow(ctx, "token-id")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reset.After(time.Now()) {
+					t.Errorf("reset %v is not in the future", reset)
+				}
+				if ok {
+					allowed++
+				}
+			}
+			if allowed != tt.allowed {
+				t.Errorf("allowed %d requests, want %d", allowed, tt.allowed)
+			}
+
+			// Other tokens have their own budget.
+			if ok, _, err := services[0].Allow(ctx, "other-token"); err != nil || !ok {
+				t.Errorf("other token: ok = %v, err = %v", ok, err)
+			}
+		})
+	}
+}
+
+func TestRateLimitDisabled(t *testing.T) {
+	store, _, _ := newTestStore(t)
+	svc := NewService(store, 24*time.Hour)
+	for i := 0; i < 100; i++ {
+		if ok, _, err := svc.Allow(context.Background(), "token-id"); err != nil || !ok {
+			t.Fatalf("request %d: ok = %v, err = %v", i, ok, err)
+		}
+	}
+	if err := svc.SetRateLimit(1, time.Hour, "redis"); err == nil {
+		t.Error("expected error for unknown backend")
+	}
+}
@@ -7,8 +7,11 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math/big"
+	mathrand "math/rand/v2"
+	"path"
 	"strings"
 	"time"
 
@@ -24,6 +27,26 @@ const (
 	alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
 )
 
+// Errors returned by Resolve. Callers can match them with errors.Is.
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenRevoked = errors.New("token has been revoked")
+	ErrTokenExpired = errors.New("token has expired")
+	ErrUserDisabled = errors.New("token owner has been disabled")
+)
+
+// ErrRepoCheck wraps a failure to verify the repository on GitHub, as
+// opposed to GitHub reporting that the repository is unusable.
+var ErrRepoCheck = errors.New("checking repository on GitHub")
+
+// ValidationError reports which field of a CreateRequest was rejected.
+type ValidationError struct {
+	Field   string // "repository", "scopes", "duration", "max_requests" or "session_id".
+	Message string
+}
+
+func (e *ValidationError) Error() string { return e.Message }
+
 // CreateRequest contains the parameters for creating a new proxy token.
 type CreateRequest struct {
 	UserID        string
@@ -32,22 +55,51 @@ type CreateRequest struct {
 	Scopes        map[string]string
 	Duration      time.Duration
 	SessionID     string
+	// MaxRequests revokes the token once it has served this many requests.
+	// Zero is unlimited.
+	MaxRequests int64
+	// SingleUse is shorthand for MaxRequests = 1.
+	SingleUse bool
+	// Description is a free-text note on why the token exists. It is
+	// informational only.
+	Description string
 }
 
 // CreateResult contains the result of creating a new proxy token.
 type CreateResult struct {
-	Token      string    // The plaintext ghp_ token (shown once).
-	ID         string    // The database ID of the token.
-	Repository string    // The repository.
-	Scopes     map[string]string
-	ExpiresAt  time.Time
-	SessionID  string
+	Token       string // The plaintext ghp_ token (shown once).
+	ID          string // The database ID of the token.
+	Repository  string // The repository.
+	Scopes      map[string]string
+	ExpiresAt   time.Time
+	SessionID   string
+	MaxRequests int64
+	Description string
+	// Replaced lists the IDs of earlier tokens for the same session that
+	// were revoked under the "revoke" session ID policy.
+	Replaced []string
 }
 
+// RepoCheck confirms on GitHub, with the credentials of the given GitHub
+// token, that a repository can be used before a token is created for it. It
+// returns a *ValidationError to reject the repository.
+type RepoCheck func(ctx context.Context, gitHubTokenID, repository string) error
+
 // Service manages proxy token lifecycle.
 type Service struct {
-	store       database.Store
-	maxDuration time.Duration
+	store           database.Store
+	maxDuration     time.Duration
+	revocationGrace time.Duration
+	maxScopes       int
+	repoPolicies    []RepoPolicy
+	metadataOnly    bool
+	sessionPolicy   string
+	repoCheck       RepoCheck
+	expiryJitter    time.Duration
+
+	limiter    rateLimiter
+	rateLimit  int64
+	rateWindow time.Duration
 }
 
 // NewService creates a new token Service.
@@ -58,19 +110,146 @@ func NewService(store database.Store, maxDuration time.Duration) *Service {
 	}
 }
 
+// SetRevocationGrace sets how long a revoked token keeps resolving, flagged
+// as Revoking, so in-flight agent operations can finish. Zero (the default)
+// makes revocation immediate.
+func (s *Service) SetRevocationGrace(d time.Duration) {
+	s.revocationGrace = d
+}
+
+// SetMaxScopes caps how many distinct permissions a token may carry. Zero
+// (the default) is unlimited.
+func (s *Service) SetMaxScopes(n int) {
+	s.maxScopes = n
+}
+
+// SetAllowMetadataOnly makes Create treat a request without scopes as
+// metadata:read instead of rejecting it, for agents that only need
+// repository metadata.
+func (s *Service) SetAllowMetadataOnly(allow bool) {
+	s.metadataOnly = allow
+}
+
+// SetSessionIDPolicy sets how Create treats a session_id that already backs
+// one of the user's active tokens, for any repository: "reject" refuses the
+// new token, "revoke" revokes the earlier one, and "off" (the default) allows
+// both.
+func (s *Service) SetSessionIDPolicy(policy string) {
+	s.sessionPolicy = policy
+}
+
+// SetRepoCheck makes Create confirm the repository with check before
+// creating a token. Nil (the default) skips the check, which costs a GitHub
+// API call.
+func (s *Service) SetRepoCheck(check RepoCheck) {
+	s.repoCheck = check
+}
+
+// SetExpiryJitter makes Create move each token's expiry by a random offset
+// of up to ±d, so tokens minted together don't all expire together. Zero
+// (the default) gives every token exactly its requested duration.
+func (s *Service) SetExpiryJitter(d time.Duration) {
+	s.expiryJitter = d
+}
+
+// jitter applies the expiry jitter to d, keeping the result positive and
+// within the maximum duration.
+func (s *Service) jitter(d time.Duration) time.Duration {
+	if s.expiryJitter <= 0 {
+		return d
+	}
+	offset := time.Duration(mathrand.Int64N(2*int64(s.expiryJitter)+1)) - s.expiryJitter
+	jittered := min(d+offset, s.maxDuration)
+	if jittered <= 0 {
+		return d
+	}
+	return jittered
+}
+
+// RepoPolicy caps the level of every scope on tokens for repositories
+// matching Pattern (path.Match syntax over owner/repo, case-insensitive).
+type RepoPolicy struct {
+	Pattern  string
+	MaxLevel string // "read" or "write".
+	// Downgrade lowers scopes above MaxLevel to it instead of rejecting the
+	// token.
+	Downgrade bool
+}
+
+// SetRepoPolicies sets the per-repository level caps applied by Create. The
+// first policy matching a repository applies.
+func (s *Service) SetRepoPolicies(policies []RepoPolicy) {
+	s.repoPolicies = policies
+}
+
+// applyRepoPolicy returns scopes capped by the first policy matching repo,
+// or a ValidationError if that policy rejects them.
+func (s *Service) applyRepoPolicy(repo string, scopes map[string]string) (map[string]string, error) {
+	for _, p := range s.repoPolicies {
+		if ok, _ := path.Match(strings.ToLower(p.Pattern), strings.ToLower(repo)); !ok {
+			continue
+		}
+		if p.MaxLevel != "read" {
+			return scopes, nil
+		}
+		capped := make(map[string]string, len(scopes))
+		for perm, level := range scopes {
+			if level == "write" {
+				if !p.Downgrade {
+					return nil, &ValidationError{"scopes", fmt.Sprintf("%s is limited to read access by policy; %s:write is not allowed", repo, perm)}
+				}
+				level = "read"
+			}
+			capped[perm] = level
+		}
+		return capped, nil
+	}
+	return scopes, nil
+}
+
 // Create generates a new ghp_ token and stores its hash.
 func (s *Service) Create(ctx context.Context, req CreateRequest) (*CreateResult, error) {
 	if req.Repository == "" {
-		return nil, fmt.Errorf("repository is required")
+		return nil, &ValidationError{"repository", "repository is required"}
 	}
 	if len(req.Scopes) == 0 {
-		return nil, fmt.Errorf("at least one scope is required")
+		if !s.metadataOnly {
+			return nil, &ValidationError{"scopes", "at least one scope is required"}
+		}
+		req.Scopes = map[string]string{"metadata": "read"}
+	}
+	if s.maxScopes > 0 && len(req.Scopes) > s.maxScopes {
+		return nil, &ValidationError{"scopes", fmt.Sprintf("token requests %d permissions, more than the maximum of %d", len(req.Scopes), s.maxScopes)}
 	}
 	if req.Duration <= 0 {
-		return nil, fmt.Errorf("duration must be positive")
+		return nil, &ValidationError{"duration", "duration must be positive"}
+	}
+	if req.SingleUse {
+		if req.MaxRequests > 1 {
+			return nil, &ValidationError{"max_requests", "a single-use token cannot allow more than one request"}
+		}
+		req.MaxRequests = 1
+	}
+	if req.MaxRequests < 0 {
+		return nil, &ValidationError{"max_requests", "max_requests cannot be negative"}
 	}
 	if req.Duration > s.maxDuration {
-		return nil, fmt.Errorf("duration %s exceeds maximum %s", req.Duration, s.maxDuration)
+		return nil, &ValidationError{"duration", fmt.Sprintf("duration %s exceeds maximum %s", req.Duration, s.maxDuration)}
+	}
+	scopes, err := s.applyRepoPolicy(req.Repository, req.Scopes)
+	if err != nil {
+		return nil, err
+	}
+	req.Scopes = scopes
+
+	if s.repoCheck != nil {
+		if err := s.repoCheck(ctx, req.GitHubTokenID, req.Repository); err != nil {
+			var verr *ValidationError
+			if errors.As(err, &verr) {
+				return nil, verr
+			}
+			return nil, fmt.Errorf("%w: %w", ErrRepoCheck, err)
+		}
 	}
 
 	// Generate a cryptographically random token.
@@ -87,7 +266,7 @@ func (s *Service) Create(ctx context.Context, req CreateRequest) (*CreateResult,
 		return nil, fmt.Errorf("marshaling scopes: %w", err)
 	}
 
-	expiresAt := time.Now().UTC().Add(req.Duration)
+	expiresAt := time.Now().UTC().Add(s.jitter(req.Duration))
 
 	pt := &database.ProxyToken{
 		TokenHash:     hash,
@@ -98,27 +277,45 @@ func (s *Service) Create(ctx context.Context, req CreateRequest) (*CreateResult,
 		Scopes:        json.RawMessage(scopesJSON),
 		SessionID:     req.SessionID,
 		ExpiresAt:     expiresAt,
+		MaxRequests:   req.MaxRequests,
+		Description:   req.Description,
 	}
 
-	if err := s.store.CreateProxyToken(ctx, pt); err != nil {
+	// Under a session ID policy the store checks the session's other tokens
+	// in the same transaction as the insert, revoking them for "revoke".
+	var existing []string
+	if req.SessionID != "" && (s.sessionPolicy == "reject" || s.sessionPolicy == "revoke") {
+		existing, err = s.store.CreateSessionProxyToken(ctx, pt, s.sessionPolicy == "revoke")
+		if errors.Is(err, database.ErrSessionActive) {
+			return nil, &ValidationError{"session_id", fmt.Sprintf("session %q already has an active token; revoke it first", req.SessionID)}
+		}
+	} else {
+		err = s.store.CreateProxyToken(ctx, pt)
+	}
+	if err != nil {
 		return nil, fmt.Errorf("storing token: %w", err)
 	}
 
 	return &CreateResult{
-		Token:      plaintext,
-		ID:         pt.ID,
-		Repository: req.Repository,
-		Scopes:     req.Scopes,
-		ExpiresAt:  expiresAt,
-		SessionID:  req.SessionID,
+		Token:       plaintext,
+		ID:          pt.ID,
+		Repository:  req.Repository,
+		Scopes:      req.Scopes,
+		ExpiresAt:   expiresAt,
+		SessionID:   req.SessionID,
+		MaxRequests: req.MaxRequests,
+		Description: req.Description,
+		Replaced:    existing,
 	}, nil
 }
 
 // Resolve looks up a proxy token by its plaintext value.
-// Returns nil if the token is not found, expired, or revoked.
+// Returns nil if the token is not found, expired, or revoked, or if its owner
+// is disabled. A token revoked within the revocation grace still resolves,
+// with Revoking set.
 func (s *Service) Resolve(ctx context.Context, plaintext string) (*database.ProxyToken, error) {
 	if !strings.HasPrefix(plaintext, Prefix) {
-		return nil, fmt.Errorf("invalid token prefix")
+		return nil, fmt.Errorf("%w: bad prefix", ErrInvalidToken)
 	}
 
 	hash := Hash(plaintext)
@@ -131,10 +328,23 @@ func (s *Service) Resolve(ctx context.Context, plaintext string) (*database.Prox
 	}
 
 	if pt.RevokedAt != nil {
-		return nil, fmt.Errorf("token has been revoked")
+		if time.Since(*pt.RevokedAt) >= s.revocationGrace {
+			return nil, ErrTokenRevoked
+		}
+		pt.Revoking = true
 	}
 	if time.Now().After(pt.ExpiresAt) {
-		return nil, fmt.Errorf("token has expired")
+		return nil, ErrTokenExpired
+	}
+
+	// A disabled user's tokens stop working at once, grace or not, rather
+	// than when the reconciler gets round to revoking them.
+	owner, err := s.store.GetUserByID(ctx, pt.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("looking up token owner: %w", err)
+	}
+	if owner == nil || owner.DisabledAt != nil {
+		return nil, ErrUserDisabled
 	}
 
 	return pt, nil
@@ -145,11 +355,42 @@ func (s *Service) Revoke(ctx context.Context, id string) error {
 	return s.store.RevokeProxyToken(ctx, id)
 }
 
+// RevokeAll revokes every active token belonging to a user and returns
+// the number revoked.
+func (s *Service) RevokeAll(ctx context.Context, userID string) (int64, error) {
+	return s.store.RevokeAllProxyTokens(ctx, userID)
+}
+
 // RecordUsage updates the last_used_at and request_count fields.
 func (s *Service) RecordUsage(ctx context.Context, id string) error {
 	return s.store.UpdateProxyTokenUsage(ctx, id)
 }
 
+// Consume counts a request against a budgeted token before it is served,
+// reporting false once the token's MaxRequests are used up. The request that
+// spends the last of the budget revokes the token. Tokens without a budget
+// are always allowed; their usage is recorded with RecordUsage instead.
+func (s *Service) Consume(ctx context.Context, pt *database.ProxyToken) (bool, error) {
+	if pt.MaxRequests == 0 {
+		return true, nil
+	}
+	_, exceeded, err := s.store.IncrementAndCheckUsage(ctx, pt.ID, pt.MaxRequests)
+	if err != nil {
+		return false, err
+	}
+	return !exceeded, nil
+}
+
+// Refund gives back the request Consume counted when it wasn't served after
+// all, because the upstream call failed or GitHub answered with a server
+// error. A token its last request revoked becomes usable again.
+func (s *Service) Refund(ctx context.Context, pt *database.ProxyToken) error {
+	if pt.MaxRequests == 0 {
+		return nil
+	}
+	return s.store.RefundUsage(ctx, pt.ID)
+}
+
 // Hash returns the SHA-256 hex digest of a token string.
 func Hash(token string) string {
 	h := sha256.Sum256([]byte(token))
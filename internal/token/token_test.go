@@ -1,8 +1,16 @@
 package token
 
 import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/goodtune/ghp/internal/database"
 )
 
 func TestGenerateToken(t *testing.T) {
@@ -60,6 +68,10 @@ func TestParseScopeString(t *testing.T) {
 			input: "contents:read",
 			want:  map[string]string{"contents": "read"},
 		},
+		{
+			input: "administration:write,contents:read",
+			want:  map[string]string{"administration": "write", "contents": "read"},
+		},
 		{
 			input:   "invalid",
 			wantErr: true,
@@ -93,3 +105,456 @@ func TestParseScopeString(t *testing.T) {
 		}
 	}
 }
+
+// newTestStore returns a migrated SQLite store seeded with a user and their
+// GitHub token.
+func newTestStore(t *testing.T) (*database.SQLiteStore, *database.User, *database.GitHubToken) {
+	t.Helper()
+	ctx := context.Background()
+	store, err := database.NewSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if err := store.EnsureMigrationsTable(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.NewMigrator(store, "sqlite").Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	user := &database.User{GitHubID: 1, GitHubUsername: "alice", Role: "user"}
+	if err := store.UpsertUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	gt := &database.GitHubToken{UserID: user.ID, AccessToken: "a", RefreshToken: "r",
+		AccessTokenExpiresAt: time.Now().Add(time.Hour), RefreshTokenExpiresAt: time.Now().Add(time.Hour)}
+	if err := store.UpsertGitHubToken(ctx, gt); err != nil {
+		t.Fatal(err)
+	}
+	return store, user, gt
+}
+
+func TestResolveRevocationGrace(t *testing.T) {
+	ctx := context.Background()
+	store, user, gt := newTestStore(t)
+
+	tests := []struct {
+		name         string
+		grace        time.Duration
+		wantErr      error
+		wantRevoking bool
+	}{
+		{"immediate", 0, ErrTokenRevoked, false},
+		{"inside grace", time.Hour, nil, true},
+		{"grace elapsed", time.Nanosecond, ErrTokenRevoked, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := NewService(store, 24*time.Hour)
+			svc.SetRevocationGrace(tt.grace)
+			res, err := svc.Create(ctx, CreateRequest{
+				UserID:        user.ID,
+				GitHubTokenID: gt.ID,
+				Repository:    "org/repo",
+				Scopes:        map[string]string{"contents": "read"},
+				Duration:      time.Hour,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Active tokens are never flagged.
+			pt, err := svc.Resolve(ctx, res.Token)
+			if err != nil || pt == nil || pt.Revoking {
+				t.Fatalf("before revocation: pt = %+v, err = %v", pt, err)
+			}
+
+			if err := svc.Revoke(ctx, res.ID); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(time.Millisecond)
+			pt, err = svc.Resolve(ctx, res.Token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && (pt == nil || pt.Revoking != tt.wantRevoking) {
+				t.Errorf("pt = %+v, want Revoking = %v", pt, tt.wantRevoking)
+			}
+		})
+	}
+}
+
+func TestResolveDisabledUser(t *testing.T) {
+	ctx := context.Background()
+	store, user, gt := newTestStore(t)
+	svc := NewService(store, 24*time.Hour)
+	res, err := svc.Create(ctx, CreateRequest{
+		UserID:        user.ID,
+		GitHubTokenID: gt.ID,
+		Repository:    "org/repo",
+		Scopes:        map[string]string{"contents": "read"},
+		Duration:      time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.SetUserDisabled(ctx, user.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if pt, err := svc.Resolve(ctx, res.Token); !errors.Is(err, ErrUserDisabled) || pt != nil {
+		t.Errorf("disabled: pt = %+v, err = %v; want ErrUserDisabled", pt, err)
+	}
+	if err := store.SetUserDisabled(ctx, user.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if pt, err := svc.Resolve(ctx, res.Token); err != nil || pt == nil {
+		t.Errorf("re-enabled: pt = %+v, err = %v", pt, err)
+	}
+}
+
+func TestCreateMaxScopes(t *testing.T) {
+	ctx := context.Background()
+	store, user, gt := newTestStore(t)
+	svc := NewService(store, 24*time.Hour)
+	svc.SetMaxScopes(2)
+
+	tests := []struct {
+		name    string
+		scopes  map[string]string
+		wantErr bool
+	}{
+		{"within limit", map[string]string{"contents": "read", "pull_requests": "write"}, false},
+		{"over limit", map[string]string{"contents": "read", "pull_requests": "write", "issues": "write"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := svc.Create(ctx, CreateRequest{
+				UserID:        user.ID,
+				GitHubTokenID: gt.ID,
+				Repository:    "org/repo",
+				Scopes:        tt.scopes,
+				Duration:      time.Hour,
+			})
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("Create: %v", err)
+				}
+				return
+			}
+			var verr *ValidationError
+			if !errors.As(err, &verr) || verr.Field != "scopes" {
+				t.Fatalf("err = %v, want scopes ValidationError", err)
+			}
+		})
+	}
+}
+
+func TestCreateEmptyScopes(t *testing.T) {
+	ctx := context.Background()
+	store, user, gt := newTestStore(t)
+	req := CreateRequest{
+		UserID:        user.ID,
+		GitHubTokenID: gt.ID,
+		Repository:    "org/repo",
+		Duration:      time.Hour,
+	}
+
+	svc := NewService(store, 24*time.Hour)
+	_, err := svc.Create(ctx, req)
+	var verr *ValidationError
+	if !errors.As(err, &verr) || verr.Field != "scopes" {
+		t.Fatalf("default: err = %v, want scopes ValidationError", err)
+	}
+
+	svc.SetAllowMetadataOnly(true)
+	result, err := svc.Create(ctx, req)
+	if err != nil {
+		t.Fatalf("metadata only: %v", err)
+	}
+	if want := map[string]string{"metadata": "read"}; !reflect.DeepEqual(result.Scopes, want) {
+		t.Errorf("scopes = %v, want %v", result.Scopes, want)
+	}
+}
+
+func TestCreateSessionIDPolicy(t *testing.T) {
+	ctx := context.Background()
+
+	for _, policy := range []string{"off", "reject", "revoke"} {
+		t.Run(policy, func(t *testing.T) {
+			store, user, gt := newTestStore(t)
+			svc := NewService(store, 24*time.Hour)
+			svc.SetSessionIDPolicy(policy)
+			create := func(session string) (*CreateResult, error) {
+				return svc.Create(ctx, CreateRequest{
+					UserID:        user.ID,
+					GitHubTokenID: gt.ID,
+					Repository:    "org/repo",
+					Scopes:        map[string]string{"contents": "read"},
+					Duration:      time.Hour,
+					SessionID:     session,
+				})
+			}
+
+			first, err := create("agent-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Other sessions and unlabelled tokens are never affected.
+			if _, err := create("agent-2"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := create(""); err != nil {
+				t.Fatal(err)
+			}
+
+			second, err := create("agent-1")
+			switch policy {
+			case "reject":
+				var verr *ValidationError
+				if !errors.As(err, &verr) || verr.Field != "session_id" {
+					t.Fatalf("err = %v, want session_id ValidationError", err)
+				}
+			case "revoke":
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(second.Replaced, []string{first.ID}) {
+					t.Errorf("Replaced = %v, want [%s]", second.Replaced, first.ID)
+				}
+			default:
+				if err != nil || len(second.Replaced) != 0 {
+					t.Fatalf("second = %+v, err = %v", second, err)
+				}
+			}
+
+			_, err = svc.Resolve(ctx, first.Token)
+			if revoked := errors.Is(err, ErrTokenRevoked); revoked != (policy == "revoke") {
+				t.Errorf("first token revoked = %v (err %v)", revoked, err)
+			}
+		})
+	}
+}
+
+func TestCreateSessionIDPolicyConcurrent(t *testing.T) {
+	ctx := context.Background()
+	store, user, gt := newTestStore(t)
+	svc := NewService(store, 24*time.Hour)
+	svc.SetSessionIDPolicy("reject")
+
+	const n = 10
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := svc.Create(ctx, CreateRequest{
+				UserID:        user.ID,
+				GitHubTokenID: gt.ID,
+				Repository:    "org/repo",
+				Scopes:        map[string]string{"contents": "read"},
+				Duration:      time.Hour,
+				SessionID:     "agent-1",
+			})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	var created int
+	for err := range errs {
+		var verr *ValidationError
+		switch {
+		case err == nil:
+			created++
+		case !errors.As(err, &verr):
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d concurrent tokens created for one session, want 1", created)
+	}
+}
+
+func TestCreateRepoPolicies(t *testing.T) {
+	ctx := context.Background()
+	store, user, gt := newTestStore(t)
+	svc := NewService(store, 24*time.Hour)
+	svc.SetRepoPolicies([]RepoPolicy{
+		{Pattern: "org/locked", MaxLevel: "read"},
+		{Pattern: "archive/*", MaxLevel: "read", Downgrade: true},
+	})
+
+	tests := []struct {
+		name       string
+		repo       string
+		scopes     map[string]string
+		wantErr    bool
+		wantScopes map[string]string
+	}{
+		{"read-only repo rejects write", "Org/Locked", map[string]string{"contents": "write"}, true, nil},
+		{"read-only repo allows read", "org/locked", map[string]string{"contents": "read"}, false, map[string]string{"contents": "read"}},
+		{"downgraded", "archive/old", map[string]string{"contents": "write", "issues": "read"}, false, map[string]string{"contents": "read", "issues": "read"}},
+		{"unmatched repo", "org/open", map[string]string{"contents": "write"}, false, map[string]string{"contents": "write"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := svc.Create(ctx, CreateRequest{
+				UserID:        user.ID,
+				GitHubTokenID: gt.ID,
+				Repository:    tt.repo,
+				Scopes:        tt.scopes,
+				Duration:      time.Hour,
+			})
+			if tt.wantErr {
+				var verr *ValidationError
+				if !errors.As(err, &verr) || verr.Field != "scopes" {
+					t.Fatalf("err = %v, want scopes ValidationError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+			if !reflect.DeepEqual(result.Scopes, tt.wantScopes) {
+				t.Errorf("scopes = %v, want %v", result.Scopes, tt.wantScopes)
+			}
+		})
+	}
+}
+
+func TestCreateDescription(t *testing.T) {
+	ctx := context.Background()
+	store, user, gt := newTestStore(t)
+	svc := NewService(store, 24*time.Hour)
+
+	const note = "release bot for the v2 branch"
+	res, err := svc.Create(ctx, CreateRequest{
+		UserID:        user.ID,
+		GitHubTokenID: gt.ID,
+		Repository:    "org/repo",
+		Scopes:        map[string]string{"contents": "read"},
+		Duration:      time.Hour,
+		Description:   note,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Description != note {
+		t.Errorf("result Description = %q, want %q", res.Description, note)
+	}
+
+	tokens, err := store.ListProxyTokens(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].Description != note {
+		t.Fatalf("listed tokens = %+v, want one with the note", tokens)
+	}
+	pt, err := svc.Resolve(ctx, res.Token)
+	if err != nil || pt.Description != note {
+		t.Errorf("resolved Description = %q, %v; want %q", pt.Description, err, note)
+	}
+}
+
+func TestCreateExpiryJitter(t *testing.T) {
+	ctx := context.Background()
+	store, user, gt := newTestStore(t)
+	svc := NewService(store, 24*time.Hour)
+	svc.SetExpiryJitter(10 * time.Minute)
+
+	seen := make(map[time.Time]bool)
+	for i := 0; i < 2; i++ {
+		before := time.Now()
+		res, err := svc.Create(ctx, CreateRequest{
+			UserID:        user.ID,
+			GitHubTokenID: gt.ID,
+			Repository:    "org/repo",
+			Scopes:        map[string]string{"contents": "read"},
+			Duration:      time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lo, hi := before.Add(50*time.Minute), time.Now().Add(70*time.Minute); res.ExpiresAt.Before(lo) || res.ExpiresAt.After(hi) {
+			t.Errorf("ExpiresAt = %v, want between %v and %v", res.ExpiresAt, lo, hi)
+		}
+		seen[res.ExpiresAt] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("tokens created together share an expiry: %v", seen)
+	}
+
+	// Jitter never takes a token past the maximum duration.
+	res, err := svc.Create(ctx, CreateRequest{
+		UserID:        user.ID,
+		GitHubTokenID: gt.ID,
+		Repository:    "org/repo",
+		Scopes:        map[string]string{"contents": "read"},
+		Duration:      24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit := time.Now().Add(24 * time.Hour); res.ExpiresAt.After(limit) {
+		t.Errorf("ExpiresAt = %v, beyond the maximum duration (%v)", res.ExpiresAt, limit)
+	}
+}
+
+func TestSingleUseToken(t *testing.T) {
+	ctx := context.Background()
+	store, user, gt := newTestStore(t)
+	svc := NewService(store, 24*time.Hour)
+
+	res, err := svc.Create(ctx, CreateRequest{
+		UserID:        user.ID,
+		GitHubTokenID: gt.ID,
+		Repository:    "org/repo",
+		Scopes:        map[string]string{"contents": "read"},
+		Duration:      time.Hour,
+		SingleUse:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.MaxRequests != 1 {
+		t.Fatalf("MaxRequests = %d, want 1", res.MaxRequests)
+	}
+
+	pt, err := svc.Resolve(ctx, res.Token)
+	if err != nil || pt == nil {
+		t.Fatalf("Resolve: pt = %v, err = %v", pt, err)
+	}
+	// Two requests race with the same resolved token; only one is served.
+	first, err := svc.Consume(ctx, pt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := svc.Consume(ctx, pt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first || second {
+		t.Errorf("Consume = %v, %v; want true, false", first, second)
+	}
+
+	if _, err := svc.Resolve(ctx, res.Token); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("after use: err = %v, want ErrTokenRevoked", err)
+	}
+
+	_, err = svc.Create(ctx, CreateRequest{
+		UserID:        user.ID,
+		GitHubTokenID: gt.ID,
+		Repository:    "org/repo",
+		Scopes:        map[string]string{"contents": "read"},
+		Duration:      time.Hour,
+		SingleUse:     true,
+		MaxRequests:   5,
+	})
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Errorf("single_use with max_requests 5: err = %v, want ValidationError", err)
+	}
+}
@@ -3,11 +3,14 @@ package web
 
 import (
 	"embed"
+	"encoding/json"
 	"html/template"
 	"log/slog"
 	"net/http"
+	"path/filepath"
 
 	"github.com/goodtune/ghp/internal/auth"
+	"github.com/goodtune/ghp/internal/config"
 )
 
 //go:embed templates/*.html
@@ -22,17 +25,75 @@ type Handler struct {
 	devMode   bool
 	logger    *slog.Logger
 	templates *template.Template
+
+	rootBehavior string
+	rootRedirect string
 }
 
 // NewHandler creates a new web UI handler.
-func NewHandler(ah *auth.Handler, devMode bool, logger *slog.Logger) *Handler {
-	tmpl := template.Must(template.ParseFS(templateFS, "templates/*.html"))
-	return &Handler{
-		auth:      ah,
-		devMode:   devMode,
-		logger:    logger,
-		templates: tmpl,
+func NewHandler(cfg *config.Config, ah *auth.Handler, logger *slog.Logger) *Handler {
+	h := &Handler{
+		auth:         ah,
+		devMode:      cfg.DevMode,
+		logger:       logger,
+		templates:    loadTemplates(cfg.Web.TemplateDir, logger),
+		rootBehavior: cfg.Web.RootBehavior,
+		rootRedirect: cfg.Web.RootRedirect,
+	}
+	switch h.rootBehavior {
+	case rootLoginRedirect, rootJSONStatus:
+	case rootCustomRedirect:
+		if h.rootRedirect == "" {
+			logger.Warn("web.root_behavior is custom_redirect but web.root_redirect is empty; redirecting to /login")
+			h.rootBehavior = rootLoginRedirect
+		}
+	default:
+		if h.rootBehavior != "" {
+			logger.Warn("unknown web.root_behavior; redirecting to /login", "root_behavior", h.rootBehavior)
+		}
+		h.rootBehavior = rootLoginRedirect
 	}
+	return h
+}
+
+// Values for web.root_behavior.
+const (
+	rootLoginRedirect  = "login_redirect"
+	rootJSONStatus     = "json_status"
+	rootCustomRedirect = "custom_redirect"
+)
+
+// loadTemplates parses the embedded templates and, if dir is set, overlays
+// any *.html files found there. Templates missing from dir keep their
+// embedded version. If the overrides fail to parse, the error is logged and
+// the embedded templates are used unchanged.
+func loadTemplates(dir string, logger *slog.Logger) *template.Template {
+	embedded := template.Must(template.ParseFS(templateFS, "templates/*.html"))
+	if dir == "" {
+		return embedded
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil || len(files) == 0 {
+		logger.Warn("no template overrides found, using embedded templates", "template_dir", dir)
+		return embedded
+	}
+
+	tmpl, err := embedded.Clone()
+	if err != nil {
+		logger.Error("cloning embedded templates failed, using embedded templates", "error", err)
+		return embedded
+	}
+	if _, err := tmpl.ParseFiles(files...); err != nil {
+		logger.Error("parsing template overrides failed, using embedded templates",
+			"template_dir", dir, "error", err)
+		return embedded
+	}
+
+	for _, f := range files {
+		logger.Info("template override loaded", "template", filepath.Base(f), "path", f)
+	}
+	return tmpl
 }
 
 // RegisterRoutes adds web UI routes to the given mux.
@@ -46,7 +107,7 @@ func (h *Handler) RegisterRoutes(mux *http.ServeMux) {
 func (h *Handler) handleIndex(w http.ResponseWriter, r *http.Request) {
 	session := h.auth.GetSession(r)
 	if session == nil {
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		h.handleUnauthenticatedIndex(w, r)
 		return
 	}
 
@@ -61,6 +122,24 @@ func (h *Handler) handleIndex(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleUnauthenticatedIndex serves GET / without a session according to
+// web.root_behavior.
+func (h *Handler) handleUnauthenticatedIndex(w http.ResponseWriter, r *http.Request) {
+	switch h.rootBehavior {
+	case rootJSONStatus:
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":        "ok",
+			"authenticated": false,
+			"login_url":     "/login",
+		})
+	case rootCustomRedirect:
+		http.Redirect(w, r, h.rootRedirect, http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	}
+}
+
 func (h *Handler) handleAdmin(w http.ResponseWriter, r *http.Request) {
 	session := h.auth.GetSession(r)
 	if session == nil {
@@ -102,3 +181,17 @@ func (h *Handler) handleLogin(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Internal error", http.StatusInternalServerError)
 	}
 }
+
+// LoginErrorPage renders a failed GitHub login; see
+// auth.Handler.SetLoginErrorPage.
+func (h *Handler) LoginErrorPage(w http.ResponseWriter, r *http.Request, e auth.LoginError) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(e.Status)
+	data := map[string]interface{}{
+		"Reason":  e.Reason,
+		"Message": e.Message,
+	}
+	if err := h.templates.ExecuteTemplate(w, "login-error.html", data); err != nil {
+		h.logger.Error("template execution failed", "error", err)
+	}
+}
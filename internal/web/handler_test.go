@@ -0,0 +1,141 @@
+package web
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/goodtune/ghp/internal/auth"
+	"github.com/goodtune/ghp/internal/config"
+)
+
+func newTestHandler(t *testing.T, cfg *config.Config) *Handler {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return NewHandler(cfg, auth.NewHandler(cfg, nil, nil, logger), logger)
+}
+
+func render(t *testing.T, h *Handler, path string) string {
+	t.Helper()
+	mux := http.NewServeMux()
+	h.RegisterRoutes(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s: status = %d", path, rec.Code)
+	}
+	return rec.Body.String()
+}
+
+func TestTemplateDirOverride(t *testing.T) {
+	dir := t.TempDir()
+	override := `<html><body>Welcome to Example Corp ghp</body></html>`
+	if err := os.WriteFile(filepath.Join(dir, "login.html"), []byte(override), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Defaults()
+	cfg.Web.TemplateDir = dir
+	h := newTestHandler(t, cfg)
+
+	if body := render(t, h, "/login"); !strings.Contains(body, "Example Corp") {
+		t.Errorf("override template not rendered: %s", body)
+	}
+
+	// Templates not present in the directory fall back to the embedded ones.
+	if h.templates.Lookup("dashboard.html") == nil {
+		t.Error("embedded dashboard.html missing after override")
+	}
+}
+
+func TestTemplateDirParseError(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "login.html"), []byte(`{{ .Broken `), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Defaults()
+	cfg.Web.TemplateDir = dir
+	h := newTestHandler(t, cfg)
+
+	if body := render(t, h, "/login"); !strings.Contains(body, "Sign in with GitHub") {
+		t.Errorf("expected embedded login template after parse error: %s", body)
+	}
+}
+
+func TestRootBehavior(t *testing.T) {
+	tests := []struct {
+		behavior     string
+		redirect     string
+		wantStatus   int
+		wantLocation string
+	}{
+		{"login_redirect", "", http.StatusSeeOther, "/login"},
+		{"json_status", "", http.StatusOK, ""},
+		{"custom_redirect", "https://docs.example.com/ghp", http.StatusSeeOther, "https://docs.example.com/ghp"},
+		{"custom_redirect", "", http.StatusSeeOther, "/login"},
+		{"bogus", "", http.StatusSeeOther, "/login"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.behavior, func(t *testing.T) {
+			cfg := config.Defaults()
+			cfg.Web.RootBehavior = tt.behavior
+			cfg.Web.RootRedirect = tt.redirect
+			mux := http.NewServeMux()
+			newTestHandler(t, cfg).RegisterRoutes(mux)
+
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", got, tt.wantLocation)
+			}
+			if tt.wantStatus == http.StatusOK {
+				var body map[string]interface{}
+				if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+					t.Fatal(err)
+				}
+				if body["status"] != "ok" || body["authenticated"] != false {
+					t.Errorf("body = %v", body)
+				}
+			}
+		})
+	}
+}
+
+func TestLoginErrorPage(t *testing.T) {
+	h := newTestHandler(t, config.Defaults())
+	tests := []struct {
+		reason string
+		status int
+		want   string
+	}{
+		{"invalid_state", http.StatusBadRequest, "expired or was already used"},
+		{"exchange_failed", http.StatusBadGateway, "GitHub did not complete the sign-in"},
+		{"user_fetch_failed", http.StatusBadGateway, "GitHub profile could not be read"},
+		{"internal_error", http.StatusInternalServerError, "Something went wrong"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.LoginErrorPage(rec, httptest.NewRequest(http.MethodGet, "/auth/github/callback", nil),
+			auth.LoginError{Status: tt.status, Reason: tt.reason, Message: "detail"})
+		if rec.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.reason, rec.Code, tt.status)
+		}
+		if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+			t.Errorf("%s: Content-Type = %q", tt.reason, ct)
+		}
+		body := rec.Body.String()
+		if !strings.Contains(body, tt.want) || !strings.Contains(body, `href="/login"`) {
+			t.Errorf("%s: page lacks %q or a retry link:\n%s", tt.reason, tt.want, body)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// Package webhook receives GitHub webhooks, verifies their signatures and
+// forwards validated events to an internal endpoint.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/goodtune/ghp/internal/apierr"
+	"github.com/goodtune/ghp/internal/config"
+	"github.com/goodtune/ghp/internal/database"
+)
+
+// maxPayloadBytes matches GitHub's cap on webhook payload size.
+const maxPayloadBytes = 25 << 20
+
+// forwardHeaders are the GitHub delivery headers passed on to the target.
+var forwardHeaders = []string{
+	"Content-Type",
+	"User-Agent",
+	"X-GitHub-Event",
+	"X-GitHub-Delivery",
+	"X-GitHub-Hook-ID",
+	"X-GitHub-Hook-Installation-Target-ID",
+	"X-GitHub-Hook-Installation-Target-Type",
+	"X-Hub-Signature-256",
+}
+
+// Handler verifies and forwards inbound GitHub webhooks.
+type Handler struct {
+	cfg    *config.Config
+	store  database.Store
+	logger *slog.Logger
+	client *http.Client
+}
+
+// NewHandler creates a new webhook handler.
+func NewHandler(cfg *config.Config, store database.Store, logger *slog.Logger) *Handler {
+	return &Handler{
+		cfg:    cfg,
+		store:  store,
+		logger: logger,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}
+}
+
+// RegisterRoutes adds the webhook route to the given mux.
+func (h *Handler) RegisterRoutes(mux *http.ServeMux) {
+	mux.Handle("POST /webhooks", h)
+}
+
+// ServeHTTP handles an inbound webhook delivery.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPayloadBytes))
+	if err != nil {
+		apierr.Write(w, http.StatusRequestEntityTooLarge, apierr.PayloadTooLarge, "Payload too large")
+		return
+	}
+
+	event := r.Header.Get("X-GitHub-Event")
+	delivery := r.Header.Get("X-GitHub-Delivery")
+
+	// Unverified payloads are attacker-controlled: reject them before
+	// parsing and keep them out of the audit log.
+	if !VerifySignature(h.cfg.Webhooks.Secret, body, r.Header.Get("X-Hub-Signature-256")) {
+		h.logger.Warn("webhook_rejected", "event", event, "delivery", delivery, "remote_addr", r.RemoteAddr)
+		apierr.Write(w, http.StatusUnauthorized, apierr.InvalidSignature, "Invalid signature")
+		return
+	}
+
+	repo := repositoryFromPayload(body)
+	status := h.forward(w, r, body)
+	h.logger.Info("webhook_received", "event", event, "delivery", delivery, "repo", repo, "status", status)
+	h.audit(r, "webhook_received", event, delivery, repo, status, time.Since(start))
+}
+
+// forward relays a verified payload to the configured target and copies the
+// target's response back to GitHub.
+func (h *Handler) forward(w http.ResponseWriter, r *http.Request, body []byte) int {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, h.cfg.Webhooks.ForwardURL, bytes.NewReader(body))
+	if err != nil {
+		apierr.Write(w, http.StatusInternalServerError, apierr.Internal, "Failed to create forward request")
+		return http.StatusInternalServerError
+	}
+	for _, key := range forwardHeaders {
+		if v := r.Header.Get(key); v != "" {
+			req.Header.Set(key, v)
+		}
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		h.logger.Error("webhook forward failed", "error", err)
+		apierr.Write(w, http.StatusBadGateway, apierr.UpstreamError, "Forward target unavailable")
+		return http.StatusBadGateway
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+	return resp.StatusCode
+}
+
+func (h *Handler) audit(r *http.Request, action, event, delivery, repo string, status int, dur time.Duration) {
+	metadata, _ := json.Marshal(map[string]string{
+		"event":    event,
+		"delivery": delivery,
+	})
+	entry := &database.AuditEntry{
+		Action:     action,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Repository: repo,
+		StatusCode: status,
+		DurationMS: int(dur.Milliseconds()),
+		Metadata:   metadata,
+	}
+	if err := h.store.CreateAuditEntry(r.Context(), entry); err != nil {
+		h.logger.Error("failed to create audit entry", "error", err)
+	}
+}
+
+// VerifySignature checks an X-Hub-Signature-256 header value against the
+// HMAC-SHA256 of the payload. An empty secret never verifies.
+func VerifySignature(secret string, payload []byte, header string) bool {
+	if secret == "" {
+		return false
+	}
+	sig, ok := strings.CutPrefix(header, "sha256=")
+	if !ok {
+		return false
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// Sign returns the X-Hub-Signature-256 header value for a payload.
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return fmt.Sprintf("sha256=%s", hex.EncodeToString(mac.Sum(nil)))
+}
+
+// repositoryFromPayload extracts repository.full_name, if present.
+func repositoryFromPayload(body []byte) string {
+	var payload struct {
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return ""
+	}
+	return payload.Repository.FullName
+}
@@ -0,0 +1,113 @@
+package webhook
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/goodtune/ghp/internal/config"
+	"github.com/goodtune/ghp/internal/database"
+)
+
+const testSecret = "It's a Secret to Everybody"
+
+func newTestHandler(t *testing.T, forwardURL string) (*Handler, *database.SQLiteStore) {
+	t.Helper()
+	ctx := context.Background()
+	store, err := database.NewSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if err := store.EnsureMigrationsTable(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.NewMigrator(store, "sqlite").Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Defaults()
+	cfg.Webhooks.Secret = testSecret
+	cfg.Webhooks.ForwardURL = forwardURL
+	return NewHandler(cfg, store, slog.New(slog.NewTextHandler(io.Discard, nil))), store
+}
+
+func TestVerifySignature(t *testing.T) {
+	// Example from GitHub's webhook validation documentation.
+	payload := []byte("Hello, World!")
+	header := "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17"
+
+	if !VerifySignature(testSecret, payload, header) {
+		t.Error("expected documented signature to verify")
+	}
+	if Sign(testSecret, payload) != header {
+		t.Errorf("Sign = %q, want %q", Sign(testSecret, payload), header)
+	}
+	if VerifySignature("wrong", payload, header) {
+		t.Error("signature verified with the wrong secret")
+	}
+	if VerifySignature("", payload, header) {
+		t.Error("signature verified with an empty secret")
+	}
+	if VerifySignature(testSecret, payload, strings.TrimPrefix(header, "sha256=")) {
+		t.Error("signature verified without sha256= prefix")
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	var forwarded []string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = append(forwarded, r.Header.Get("X-GitHub-Delivery"))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer target.Close()
+
+	h, store := newTestHandler(t, target.URL)
+	payload := `{"action":"opened","repository":{"full_name":"org/repo"}}`
+
+	tests := []struct {
+		delivery   string
+		signature  string
+		wantStatus int
+	}{
+		{"valid-1", Sign(testSecret, []byte(payload)), http.StatusAccepted},
+		{"invalid-1", Sign("not the secret", []byte(payload)), http.StatusUnauthorized},
+		{"missing-1", "", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/webhooks", strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-GitHub-Event", "pull_request")
+		req.Header.Set("X-GitHub-Delivery", tt.delivery)
+		if tt.signature != "" {
+			req.Header.Set("X-Hub-Signature-256", tt.signature)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.delivery, rec.Code, tt.wantStatus)
+		}
+	}
+
+	if len(forwarded) != 1 || forwarded[0] != "valid-1" {
+		t.Errorf("forwarded deliveries = %v, want [valid-1]", forwarded)
+	}
+
+	entries, err := store.ListAuditEntries(context.Background(), database.AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("audit entries = %d, want 1 (rejected deliveries are not audited)", len(entries))
+	}
+	if entries[0].Action != "webhook_received" || entries[0].Repository != "org/repo" {
+		t.Errorf("audit entry = %s %q, want webhook_received org/repo", entries[0].Action, entries[0].Repository)
+	}
+}